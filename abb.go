@@ -0,0 +1,106 @@
+package adb
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+/*
+RunAbb calls a system service with args, like `adb shell cmd <args>`, e.g.
+
+	output, err := device.RunAbb("package", "list", "packages")
+
+and returns its output. If the service exits with a non-zero status, returns an AdbError with the
+output in its message.
+
+On devices with the abb feature, the service is called over binder with the abb service, which
+is much faster than starting a shell. args are sent as-is, so they don't need to be quoted and
+can contain any character except NUL. On older devices, falls back to running cmd in a shell.
+*/
+func (c *Device) RunAbb(args ...string) (string, error) {
+	if err := validateAbbArgs(args); err != nil {
+		return "", wrapClientError(err, c, "RunAbb")
+	}
+
+	var output string
+	var exitCode int
+	var err error
+	if c.supports(FeatureAbb) {
+		output, exitCode, err = c.runAbb(args)
+	} else {
+		output, exitCode, err = c.runShellCheckingExit(abbCommandLine(args))
+	}
+	if err == nil && exitCode != 0 {
+		err = errors.Errorf(errors.AdbError, "cmd %s exited with status %d: %s", args[0], exitCode, strings.TrimSpace(output))
+	}
+	return output, wrapClientError(err, c, "RunAbb")
+}
+
+/*
+OpenAbbExec calls a system service with args, like RunAbb, and returns a reader for its output.
+The reader must be closed.
+
+On devices with the abb_exec feature, the service is called with the abb_exec service, and its
+output is passed through unmodified. On older devices, falls back to running cmd with the exec
+service. Neither reports the exit status.
+*/
+func (c *Device) OpenAbbExec(args ...string) (io.ReadCloser, error) {
+	if err := validateAbbArgs(args); err != nil {
+		return nil, wrapClientError(err, c, "OpenAbbExec")
+	}
+
+	if !c.supports(FeatureAbbExec) {
+		conn, err := c.openExec(abbCommandLine(args))
+		return conn, wrapClientError(err, c, "OpenAbbExec")
+	}
+
+	conn, err := c.openService("abb_exec:" + strings.Join(args, "\x00"))
+	if err != nil {
+		return nil, wrapClientError(err, c, "OpenAbbExec")
+	}
+	return conn, nil
+}
+
+// runAbb runs args with the abb service, which uses the shell protocol, and returns the
+// combined stdout and stderr, and the exit status.
+func (c *Device) runAbb(args []string) (string, int, error) {
+	conn, err := c.openService("abb:" + strings.Join(args, "\x00"))
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+
+	var output bytes.Buffer
+	exitCode, err := readShellProtocol(conn, &output, &output)
+	return output.String(), exitCode, err
+}
+
+/*
+supports returns true if the device has feature. If the features can't be read, e.g. because the
+server is too old to report them, assumes the device doesn't have it, so callers fall back to
+services all devices have.
+*/
+func (c *Device) supports(feature Feature) bool {
+	features, err := c.Features()
+	return err == nil && features.Has(feature)
+}
+
+func validateAbbArgs(args []string) error {
+	if len(args) == 0 || isBlank(args[0]) {
+		return errors.AssertionErrorf("service cannot be empty")
+	}
+	for i, arg := range args {
+		if strings.ContainsRune(arg, 0) {
+			return errors.Errorf(errors.ParseError, "arg at index %d contains a NUL: %q", i, arg)
+		}
+	}
+	return nil
+}
+
+// abbCommandLine returns the shell command line that runs cmd with args.
+func abbCommandLine(args []string) string {
+	return NewCommand("cmd", args...).String()
+}
@@ -0,0 +1,120 @@
+package adb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/adbtest"
+)
+
+func newAbbTestDevice(t *testing.T, features ...string) (*Device, *adbtest.Server, *[]string) {
+	server := adbtest.NewServer()
+	device := server.AddDevice("serial")
+	device.SetFeatures(features...)
+	var cmds []string
+	device.HandleShell(func(cmd string) string {
+		cmds = append(cmds, cmd)
+		if strings.HasPrefix(cmd, "{ ") {
+			return "package:a b\n:0\n"
+		}
+		return "package:a b\n"
+	})
+
+	client, err := NewWithConfig(ServerConfig{Dialer: server, NoStartServer: true})
+	require.NoError(t, err)
+	return client.Device(DeviceWithSerial("serial")), server, &cmds
+}
+
+func TestRunAbb(t *testing.T) {
+	d, server, cmds := newAbbTestDevice(t, "abb", "abb_exec")
+	defer server.Close()
+
+	output, err := d.RunAbb("package", "list", "packages", "a b")
+	assert.NoError(t, err)
+	assert.Equal(t, "package:a b\n", output)
+
+	reader, err := d.OpenAbbExec("package", "list", "packages", `"quoted"`)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "package:a b\n", string(data))
+	reader.Close()
+
+	assert.Equal(t, []string{
+		"abb:package\x00list\x00packages\x00a b",
+		"abb_exec:package\x00list\x00packages\x00\"quoted\"",
+	}, *cmds)
+}
+
+func TestRunAbbFallsBackToCmd(t *testing.T) {
+	d, server, cmds := newAbbTestDevice(t)
+	defer server.Close()
+
+	output, err := d.RunAbb("package", "list", "packages", "a b")
+	assert.NoError(t, err)
+	assert.Equal(t, "package:a b\n", output)
+
+	reader, err := d.OpenAbbExec("package", "list", "packages", `"quoted"`)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "package:a b\n", string(data))
+	reader.Close()
+
+	assert.Equal(t, []string{
+		`{ cmd package list packages 'a b'; } 2>&1; echo ":$?"`,
+		`cmd package list packages '"quoted"'`,
+	}, *cmds)
+}
+
+func TestRunAbbInvalidArgs(t *testing.T) {
+	d, server, _ := newAbbTestDevice(t, "abb")
+	defer server.Close()
+
+	_, err := d.RunAbb()
+	assert.True(t, HasErrCode(err, AssertionError))
+	_, err = d.OpenAbbExec("package", "a\x00b")
+	assert.True(t, HasErrCode(err, ParseError))
+}
+
+func TestReadShellProtocol(t *testing.T) {
+	var buf bytes.Buffer
+	writePacket := func(id byte, data string) {
+		binary.Write(&buf, binary.LittleEndian, id)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+		buf.WriteString(data)
+	}
+	writePacket(shellPacketStdout, "out1 ")
+	writePacket(shellPacketStderr, "err")
+	writePacket(shellPacketWindowSize, "ignored")
+	writePacket(shellPacketStdout, "out2")
+	writePacket(shellPacketExit, "\x02")
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := readShellProtocol(&buf, &stdout, &stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, exitCode)
+	assert.Equal(t, "out1 out2", stdout.String())
+	assert.Equal(t, "err", stderr.String())
+
+	// The stream ends before the exit packet.
+	writePacket(shellPacketStdout, "out")
+	_, err = readShellProtocol(&buf, &stdout, &stderr)
+	assert.True(t, HasErrCode(err, ConnectionResetError))
+}
+
+func TestReadShellProtocolExitPacketTooLong(t *testing.T) {
+	// Only the header is sent: the exit packet must be rejected without reading, or allocating, its
+	// data.
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, byte(shellPacketExit))
+	binary.Write(&buf, binary.LittleEndian, uint32(0xffffffff))
+
+	_, err := readShellProtocol(&buf, ioutil.Discard, ioutil.Discard)
+	assert.True(t, HasErrCode(err, ParseError))
+}
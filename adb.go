@@ -1,6 +1,7 @@
 package adb
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 
@@ -19,7 +20,16 @@ See list of services at https://android.googlesource.com/platform/system/core/+/
 */
 // TODO(z): Finish implementing host services.
 type Adb struct {
-	server server
+	server   server
+	limiter  *deviceLimiter
+	retry    *RetryPolicy
+	features *featureCache
+
+	// Set if connections are pooled. See ServerConfig.Pool.
+	pool pooledServer
+
+	// Labels of devices keyed by serial, from ServerConfig.DeviceLabels.
+	labels map[string]map[string]string
 }
 
 // New creates a new Adb client that uses the default ServerConfig.
@@ -32,7 +42,50 @@ func NewWithConfig(config ServerConfig) (*Adb, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Adb{server}, nil
+	client := &Adb{server: server, retry: config.Retry, features: newFeatureCache()}
+	if config.Pool != nil {
+		client.pool = newConnPool(server, *config.Pool)
+		client.server = client.pool
+	}
+	client.labels = make(map[string]map[string]string)
+	for serial, labels := range config.DeviceLabels {
+		client.labels[serial] = make(map[string]string)
+		for name, value := range labels {
+			client.labels[serial][name] = value
+		}
+	}
+	if config.MaxConcurrentPerDevice > 0 {
+		client.limiter = newDeviceLimiter(config.MaxConcurrentPerDevice)
+	}
+	return client, nil
+}
+
+// PoolStats returns the activity of the client's connection pool. If ServerConfig.Pool isn't
+// set, returns the zero value.
+func (c *Adb) PoolStats() PoolStats {
+	if c.pool == nil {
+		return PoolStats{}
+	}
+	return c.pool.Stats()
+}
+
+// QueueStats returns how operations have waited to use devices. If
+// ServerConfig.MaxConcurrentPerDevice isn't set, returns the zero value.
+func (c *Adb) QueueStats() QueueStats {
+	if c.limiter == nil {
+		return QueueStats{}
+	}
+	return c.limiter.Stats()
+}
+
+// Close closes the client's idle pooled connections. Connections are only pooled if
+// ServerConfig.Pool is set, otherwise Close does nothing. Connections still in use are closed
+// when they're released, so the client can still be used after Close, but without pooling.
+func (c *Adb) Close() error {
+	if c.pool == nil {
+		return nil
+	}
+	return c.pool.Close()
 }
 
 // Dial establishes a connection with the adb server.
@@ -48,7 +101,11 @@ func (c *Adb) StartServer() error {
 func (c *Adb) Device(descriptor DeviceDescriptor) *Device {
 	return &Device{
 		server:         c.server,
+		pool:           c.pool,
 		descriptor:     descriptor,
+		limiter:        c.limiter,
+		retry:          c.retry,
+		features:       c.features,
 		deviceListFunc: c.ListDevices,
 	}
 }
@@ -59,7 +116,7 @@ func (c *Adb) NewDeviceWatcher() *DeviceWatcher {
 
 // ServerVersion asks the ADB server for its internal version number.
 func (c *Adb) ServerVersion() (int, error) {
-	resp, err := roundTripSingleResponse(c.server, "host:version")
+	resp, err := c.roundTripRetrying("host:version")
 	if err != nil {
 		return 0, wrapClientError(err, c, "GetServerVersion")
 	}
@@ -71,6 +128,20 @@ func (c *Adb) ServerVersion() (int, error) {
 	return version, nil
 }
 
+/*
+HostFeatures returns the features supported by the adb server.
+
+Corresponds to the command:
+	adb host-features
+*/
+func (c *Adb) HostFeatures() (FeatureSet, error) {
+	resp, err := c.roundTripRetrying("host:host-features")
+	if err != nil {
+		return nil, wrapClientError(err, c, "HostFeatures")
+	}
+	return parseFeatures(string(resp)), nil
+}
+
 /*
 KillServer tells the server to quit immediately.
 
@@ -98,7 +169,7 @@ Corresponds to the command:
 	adb devices
 */
 func (c *Adb) ListDeviceSerials() ([]string, error) {
-	resp, err := roundTripSingleResponse(c.server, "host:devices")
+	resp, err := c.roundTripRetrying("host:devices")
 	if err != nil {
 		return nil, wrapClientError(err, c, "ListDeviceSerials")
 	}
@@ -122,7 +193,7 @@ Corresponds to the command:
 	adb devices -l
 */
 func (c *Adb) ListDevices() ([]*DeviceInfo, error) {
-	resp, err := roundTripSingleResponse(c.server, "host:devices-l")
+	resp, err := c.roundTripRetrying("host:devices-l")
 	if err != nil {
 		return nil, wrapClientError(err, c, "ListDevices")
 	}
@@ -148,6 +219,15 @@ func (c *Adb) Connect(host string, port int) error {
 	return nil
 }
 
+// roundTripRetrying is like roundTripSingleResponse, for requests that are safe to retry.
+func (c *Adb) roundTripRetrying(req string) (resp []byte, err error) {
+	err = c.retry.do(context.Background(), true, func() error {
+		resp, err = roundTripSingleResponse(c.server, req)
+		return err
+	})
+	return resp, err
+}
+
 func (c *Adb) parseServerVersion(versionRaw []byte) (int, error) {
 	versionStr := string(versionRaw)
 	version, err := strconv.ParseInt(versionStr, 16, 32)
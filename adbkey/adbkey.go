@@ -0,0 +1,220 @@
+/*
+package adbkey handles the RSA keys adb uses to authenticate with devices.
+
+The adb server keeps its private key in PEM format in ~/.android/adbkey, and the matching public
+key, in Android's own encoding, in ~/.android/adbkey.pub. Devices only accept connections from
+hosts whose public key is in their list of authorized keys, /data/misc/adb/adb_keys, which has
+one public key per line in the same format as adbkey.pub.
+
+To create a key and authorize it on a device image:
+
+	key, err := adbkey.Generate()
+	if err != nil { … }
+	if err := key.Save("adbkey"); err != nil { … }
+	// Append key.PublicKey() and a newline to the image's /data/misc/adb/adb_keys.
+*/
+package adbkey
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+// Name of the private key file in the user's .android directory.
+const KeyFileName = "adbkey"
+
+// Suffix appended to the private key's path to get the path of its public key.
+const PublicKeySuffix = ".pub"
+
+// TokenSize is the size of the tokens devices ask hosts to sign.
+const TokenSize = sha1.Size
+
+// KeyBits is the size of keys created by Generate. Devices only accept keys of this size.
+const KeyBits = 2048
+
+// Key is an RSA key used to authenticate with devices.
+type Key struct {
+	priv *rsa.PrivateKey
+	// The public key in the format of adbkey.pub, without the trailing newline.
+	pub []byte
+}
+
+// Generate creates a new key, whose public key has DefaultComment as its comment.
+func Generate() (*Key, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, KeyBits)
+	if err != nil {
+		return nil, errors.WrapErrorf(err, errors.AssertionError, "error generating key")
+	}
+	return New(priv, DefaultComment())
+}
+
+// New returns a Key for priv, whose public key has comment appended, e.g. "user@host".
+func New(priv *rsa.PrivateKey, comment string) (*Key, error) {
+	pub, err := MarshalPublicKey(&priv.PublicKey, comment)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{priv: priv, pub: pub}, nil
+}
+
+// DefaultPath returns the path of the key used by the adb server, which is in
+// $ANDROID_USER_HOME if it's set, and ~/.android otherwise.
+func DefaultPath() (string, error) {
+	if dir := os.Getenv("ANDROID_USER_HOME"); dir != "" {
+		return filepath.Join(dir, KeyFileName), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.WrapErrorf(err, errors.FileNoExistError, "error finding home directory")
+	}
+	return filepath.Join(home, ".android", KeyFileName), nil
+}
+
+// LoadDefault loads the key at DefaultPath.
+func LoadDefault() (*Key, error) {
+	path, err := DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	return Load(path)
+}
+
+// LoadOrGenerate loads the key at path, or, like the adb server, generates and saves a new key
+// if there isn't one.
+func LoadOrGenerate(path string) (*Key, error) {
+	key, err := Load(path)
+	if !errors.HasErrCode(err, errors.FileNoExistError) {
+		return key, err
+	}
+
+	if key, err = Generate(); err != nil {
+		return nil, err
+	}
+	if err := key.Save(path); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+/*
+Load reads a PEM-encoded private key from path, and its public key from path+".pub". If the
+public key file doesn't exist, the public key is encoded with DefaultComment.
+*/
+func Load(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, wrapFileError(err, path)
+	}
+	priv, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, errors.WrapErrf(err, "error reading key from %s", path)
+	}
+
+	pub, err := ioutil.ReadFile(path + PublicKeySuffix)
+	if os.IsNotExist(err) {
+		return New(priv, DefaultComment())
+	} else if err != nil {
+		return nil, wrapFileError(err, path+PublicKeySuffix)
+	}
+	return &Key{priv: priv, pub: trimNewline(pub)}, nil
+}
+
+// Save writes the private key to path, readable only by the current user, and the public key to
+// path+".pub". The directory is created if it doesn't exist.
+func (k *Key) Save(path string) error {
+	privPEM, err := k.MarshalPEM()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return wrapFileError(err, filepath.Dir(path))
+	}
+	if err := ioutil.WriteFile(path, privPEM, 0600); err != nil {
+		return wrapFileError(err, path)
+	}
+	if err := ioutil.WriteFile(path+PublicKeySuffix, append(k.PublicKey(), '\n'), 0644); err != nil {
+		return wrapFileError(err, path+PublicKeySuffix)
+	}
+	return nil
+}
+
+// MarshalPEM encodes the private key in PKCS#8 PEM format, like adbkey.
+func (k *Key) MarshalPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.priv)
+	if err != nil {
+		return nil, errors.WrapErrorf(err, errors.AssertionError, "error encoding private key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.Errorf(errors.ParseError, "no PEM data found")
+	}
+
+	// adb writes PKCS#8 keys, but older versions wrote PKCS#1.
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.WrapErrorf(err, errors.ParseError, "invalid private key")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf(errors.ParseError, "expected an RSA key, got %T", parsed)
+	}
+	return key, nil
+}
+
+// PrivateKey returns the key's RSA private key.
+func (k *Key) PrivateKey() *rsa.PrivateKey {
+	return k.priv
+}
+
+// PublicKey returns the public key in the format of adbkey.pub, which is what's sent to devices
+// so the user can authorize it, and what's stored in their adb_keys files.
+func (k *Key) PublicKey() []byte {
+	return k.pub
+}
+
+// Sign signs an authentication token sent by a device.
+func (k *Key) Sign(token []byte) ([]byte, error) {
+	if len(token) != TokenSize {
+		return nil, errors.Errorf(errors.AssertionError, "token must be %d bytes, got %d", TokenSize, len(token))
+	}
+	// Devices treat the token as a SHA-1 digest, so it's signed as-is.
+	sig, err := rsa.SignPKCS1v15(nil, k.priv, crypto.SHA1, token)
+	if err != nil {
+		return nil, errors.WrapErrorf(err, errors.AssertionError, "error signing token")
+	}
+	return sig, nil
+}
+
+func wrapFileError(err error, path string) error {
+	switch {
+	case os.IsNotExist(err):
+		return errors.WrapErrorf(err, errors.FileNoExistError, "no key at %s", path)
+	case os.IsPermission(err):
+		return errors.WrapErrorf(err, errors.FilePermissionDeniedError, "error accessing %s", path)
+	default:
+		return errors.WrapErrorf(err, errors.NetworkError, "error accessing %s", path)
+	}
+}
+
+func trimNewline(data []byte) []byte {
+	for len(data) > 0 && (data[len(data)-1] == '\n' || data[len(data)-1] == '\r') {
+		data = data[:len(data)-1]
+	}
+	return data
+}
@@ -0,0 +1,175 @@
+package adbkey
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *Key
+)
+
+// getTestKey returns a key shared by all tests, since generating keys is slow.
+func getTestKey(t *testing.T) *Key {
+	testKeyOnce.Do(func() {
+		priv, err := rsa.GenerateKey(rand.Reader, KeyBits)
+		require.NoError(t, err)
+		testKey, err = New(priv, "user@host")
+		require.NoError(t, err)
+	})
+	return testKey
+}
+
+func newTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "adbkey")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestEncodePublicKey(t *testing.T) {
+	pub := &getTestKey(t).PrivateKey().PublicKey
+	encoded, err := EncodePublicKey(pub)
+	require.NoError(t, err)
+	require.Len(t, encoded, 524)
+
+	assert.Equal(t, uint32(64), binary.LittleEndian.Uint32(encoded[0:]))
+	assert.Equal(t, uint32(65537), binary.LittleEndian.Uint32(encoded[520:]))
+
+	// n * n0inv = -1 mod 2^32.
+	n0 := binary.LittleEndian.Uint32(encoded[8:])
+	n0inv := binary.LittleEndian.Uint32(encoded[4:])
+	assert.Equal(t, uint32(0xffffffff), n0*n0inv)
+
+	// rr * 2^-2048 * 2^-2048 = 1 mod n, i.e. rr = 2^4096 mod n.
+	rr := readLittleEndian(encoded[264:520])
+	expected := new(big.Int).Exp(big.NewInt(2), big.NewInt(4096), pub.N)
+	assert.Equal(t, 0, expected.Cmp(rr))
+
+	decoded, err := DecodePublicKey(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, pub, decoded)
+}
+
+func TestEncodePublicKeyWrongSize(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	_, err = EncodePublicKey(&priv.PublicKey)
+	assert.EqualError(t, err, "AssertionError: key must be 2048 bits, got 1024")
+}
+
+func TestDecodePublicKeyCorrupt(t *testing.T) {
+	encoded, err := EncodePublicKey(&getTestKey(t).PrivateKey().PublicKey)
+	require.NoError(t, err)
+	encoded[4]++
+	_, err = DecodePublicKey(encoded)
+	assert.EqualError(t, err, "ParseError: public key has invalid n0inv or rr")
+
+	_, err = DecodePublicKey(encoded[:10])
+	assert.EqualError(t, err, "ParseError: public key must be 524 bytes, got 10")
+}
+
+func TestMarshalAndParsePublicKey(t *testing.T) {
+	key := getTestKey(t)
+	line := string(key.PublicKey())
+	assert.True(t, strings.HasSuffix(line, " user@host"))
+	assert.Len(t, strings.TrimSuffix(line, " user@host"), base64.StdEncoding.EncodedLen(524))
+
+	pub, comment, err := ParsePublicKey([]byte(line + "\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "user@host", comment)
+	assert.Equal(t, &key.PrivateKey().PublicKey, pub)
+
+	_, _, err = ParsePublicKey([]byte("!!! user@host"))
+	assert.True(t, errors.HasErrCode(err, errors.ParseError))
+}
+
+func TestSign(t *testing.T) {
+	key := getTestKey(t)
+	token := []byte(strings.Repeat("t", TokenSize))
+
+	sig, err := key.Sign(token)
+	require.NoError(t, err)
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PrivateKey().PublicKey, crypto.SHA1, token, sig))
+
+	_, err = key.Sign([]byte("short"))
+	assert.EqualError(t, err, "AssertionError: token must be 20 bytes, got 5")
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".android", "adbkey")
+	key := getTestKey(t)
+
+	require.NoError(t, key.Save(path))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	pub, err := ioutil.ReadFile(path + PublicKeySuffix)
+	assert.NoError(t, err)
+	assert.Equal(t, string(key.PublicKey())+"\n", string(pub))
+
+	loaded, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, key.PrivateKey().D, loaded.PrivateKey().D)
+	assert.Equal(t, key.PublicKey(), loaded.PublicKey())
+}
+
+func TestLoadPKCS1WithoutPublicKey(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "adbkey")
+	key := getTestKey(t)
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key.PrivateKey())})
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	loaded, err := Load(path)
+	require.NoError(t, err)
+	pub, comment, err := ParsePublicKey(loaded.PublicKey())
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultComment(), comment)
+	assert.Equal(t, &key.PrivateKey().PublicKey, pub)
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := Load(filepath.Join(dir, "nope"))
+	assert.True(t, errors.HasErrCode(err, errors.FileNoExistError))
+
+	path := filepath.Join(dir, "adbkey")
+	require.NoError(t, ioutil.WriteFile(path, []byte("not a key"), 0600))
+	_, err = Load(path)
+	assert.True(t, errors.HasErrCode(err, errors.ParseError))
+}
+
+func TestLoadOrGenerate(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "adbkey")
+
+	generated, err := LoadOrGenerate(path)
+	require.NoError(t, err)
+	loaded, err := LoadOrGenerate(path)
+	require.NoError(t, err)
+	assert.Equal(t, generated.PublicKey(), loaded.PublicKey())
+	assert.Equal(t, KeyBits, loaded.PrivateKey().N.BitLen())
+}
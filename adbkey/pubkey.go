@@ -0,0 +1,145 @@
+package adbkey
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"os"
+	"os/user"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+/*
+Public keys are encoded as Android's RSAPublicKey struct, which has precomputed values used to
+verify signatures with Montgomery multiplication. All fields are little-endian:
+
+	uint32 modulus size in words (always 64)
+	uint32 n0inv, -1 / n[0] mod 2^32
+	[256]byte modulus
+	[256]byte rr, (2^2048)^2 mod n
+	uint32 exponent
+
+The struct is base64-encoded, and followed by a space and a comment, usually user@host.
+*/
+const (
+	modulusSize = KeyBits / 8
+	// Size of the encoded struct.
+	publicKeySize = 4 + 4 + modulusSize + modulusSize + 4
+)
+
+// DefaultComment returns the comment adb appends to public keys, user@host.
+func DefaultComment() string {
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return username + "@" + hostname
+}
+
+// EncodePublicKey encodes pub as an RSAPublicKey struct. The key's modulus must be KeyBits long.
+func EncodePublicKey(pub *rsa.PublicKey) ([]byte, error) {
+	if pub.N.BitLen() != KeyBits {
+		return nil, errors.Errorf(errors.AssertionError, "key must be %d bits, got %d", KeyBits, pub.N.BitLen())
+	}
+
+	// n0inv = -1 / n mod 2^32.
+	r32 := new(big.Int).Lsh(big.NewInt(1), 32)
+	n0inv := new(big.Int).ModInverse(new(big.Int).Mod(pub.N, r32), r32)
+	n0inv.Sub(r32, n0inv)
+
+	// rr = (2^KeyBits)^2 mod n.
+	rr := new(big.Int).Lsh(big.NewInt(1), 2*KeyBits)
+	rr.Mod(rr, pub.N)
+
+	buf := make([]byte, publicKeySize)
+	binary.LittleEndian.PutUint32(buf[0:], modulusSize/4)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(n0inv.Uint64()))
+	putLittleEndian(buf[8:8+modulusSize], pub.N)
+	putLittleEndian(buf[8+modulusSize:8+2*modulusSize], rr)
+	binary.LittleEndian.PutUint32(buf[8+2*modulusSize:], uint32(pub.E))
+	return buf, nil
+}
+
+// DecodePublicKey decodes an RSAPublicKey struct.
+func DecodePublicKey(data []byte) (*rsa.PublicKey, error) {
+	if len(data) != publicKeySize {
+		return nil, errors.Errorf(errors.ParseError, "public key must be %d bytes, got %d", publicKeySize, len(data))
+	}
+	if words := binary.LittleEndian.Uint32(data[0:]); words != modulusSize/4 {
+		return nil, errors.Errorf(errors.ParseError, "invalid modulus size: %d words", words)
+	}
+
+	pub := &rsa.PublicKey{
+		N: readLittleEndian(data[8 : 8+modulusSize]),
+		E: int(binary.LittleEndian.Uint32(data[8+2*modulusSize:])),
+	}
+	// Check the precomputed values, since that's what devices actually use.
+	encoded, err := EncodePublicKey(pub)
+	if err != nil {
+		return nil, errors.WrapErrorf(err, errors.ParseError, "invalid public key")
+	}
+	if !bytes.Equal(encoded, data) {
+		return nil, errors.Errorf(errors.ParseError, "public key has invalid n0inv or rr")
+	}
+	return pub, nil
+}
+
+// MarshalPublicKey encodes pub in the format of adbkey.pub and adb_keys, without a trailing
+// newline.
+func MarshalPublicKey(pub *rsa.PublicKey, comment string) ([]byte, error) {
+	encoded, err := EncodePublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(encoded)))
+	base64.StdEncoding.Encode(line, encoded)
+	if comment != "" {
+		line = append(line, ' ')
+		line = append(line, comment...)
+	}
+	return line, nil
+}
+
+// ParsePublicKey parses a public key line from adbkey.pub or adb_keys, and returns the key and
+// its comment.
+func ParsePublicKey(line []byte) (*rsa.PublicKey, string, error) {
+	line = bytes.TrimSpace(line)
+	encoded, comment := line, ""
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		encoded, comment = line[:i], string(bytes.TrimSpace(line[i+1:]))
+	}
+
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(data, encoded)
+	if err != nil {
+		return nil, "", errors.WrapErrorf(err, errors.ParseError, "invalid base64 in public key")
+	}
+	pub, err := DecodePublicKey(data[:n])
+	if err != nil {
+		return nil, "", err
+	}
+	return pub, comment, nil
+}
+
+// putLittleEndian writes x to buf as a little-endian integer. buf must be large enough.
+func putLittleEndian(buf []byte, x *big.Int) {
+	bigEndian := x.Bytes()
+	for i, b := range bigEndian {
+		buf[len(bigEndian)-1-i] = b
+	}
+}
+
+func readLittleEndian(buf []byte) *big.Int {
+	bigEndian := make([]byte, len(buf))
+	for i, b := range buf {
+		bigEndian[len(buf)-1-i] = b
+	}
+	return new(big.Int).SetBytes(bigEndian)
+}
@@ -0,0 +1,453 @@
+package adbtest
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/internal/hostserver"
+	"github.com/zach-klippenstein/goadb/transport"
+)
+
+/*
+Adbd emulates the adb daemon on a device. Unlike Server, which fakes the adb server, Adbd speaks
+the transport protocol adb servers use to talk to devices, so it can be used with the transport
+package, or with a real adb server:
+
+	adbd := adbtest.NewAdbd(adbtest.NewDirFS(dir))
+	defer adbd.Close()
+	if err := adbd.Start(); err != nil { … }
+	// adb connect <adbd.Addr()>
+
+It serves the shell and exec services with a ShellHandler, the sync service from a Filesystem,
+forwards to local TCP ports ("tcp:<port>"), and reverse forwards. Its "device" ports are ports
+on the local machine.
+
+Shell_v2 isn't supported, so adb servers use the original shell protocol. Adbd is safe for
+concurrent use.
+*/
+type Adbd struct {
+	fs Filesystem
+
+	lock           sync.Mutex
+	props          map[string]string
+	shell          ShellHandler
+	requireAuth    bool
+	authorizedKeys []*rsa.PublicKey
+	confirmKey     func(*rsa.PublicKey) bool
+	listener       net.Listener
+	// Connections that are being served, including ones that haven't finished the handshake.
+	conns    map[io.ReadWriteCloser]struct{}
+	reverses map[string]*reverseForward
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// A reverse forward from a port on the device to a service on the host.
+type reverseForward struct {
+	conn     *transport.Conn
+	local    string
+	remote   string
+	listener net.Listener
+}
+
+// NewAdbd returns an Adbd that serves fs with the sync service.
+func NewAdbd(fs Filesystem) *Adbd {
+	return &Adbd{
+		fs: fs,
+		props: map[string]string{
+			transport.PropertyProduct: "adbtest",
+			transport.PropertyModel:   "Adbd",
+			transport.PropertyDevice:  "adbtest",
+		},
+		shell:    func(string) string { return "" },
+		conns:    make(map[io.ReadWriteCloser]struct{}),
+		reverses: make(map[string]*reverseForward),
+	}
+}
+
+// FS returns the filesystem served by the sync service.
+func (d *Adbd) FS() Filesystem {
+	return d.fs
+}
+
+// HandleShell sets the handler for the shell and exec services. By default, commands print
+// nothing.
+func (d *Adbd) HandleShell(handler ShellHandler) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.shell = handler
+}
+
+// SetProperty sets a property sent to hosts when they connect, e.g. transport.PropertyModel.
+func (d *Adbd) SetProperty(key, value string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.props[key] = value
+}
+
+/*
+AuthorizeKey makes hosts authenticate when connecting, and allows hosts to connect with pub.
+
+Hosts with other keys are rejected, unless a function set by ConfirmKeys accepts them.
+*/
+func (d *Adbd) AuthorizeKey(pub *rsa.PublicKey) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.requireAuth = true
+	d.authorizedKeys = append(d.authorizedKeys, pub)
+}
+
+// ConfirmKeys sets the function that plays the user when a host with an unknown key asks to
+// connect. Keys it accepts are authorized for future connections.
+func (d *Adbd) ConfirmKeys(confirm func(pub *rsa.PublicKey) bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.confirmKey = confirm
+}
+
+// Start listens for connections on a random port on the loopback interface.
+func (d *Adbd) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return errors.WrapErrorf(err, errors.NetworkError, "error listening")
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed || d.listener != nil {
+		listener.Close()
+		return errors.AssertionErrorf("adbd already started or closed")
+	}
+	d.listener = listener
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if err := d.ServeConn(conn); err != nil {
+				conn.Close()
+			}
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address adbd is listening on, or "" if it hasn't been started.
+func (d *Adbd) Addr() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.listener == nil {
+		return ""
+	}
+	return d.listener.Addr().String()
+}
+
+// Port returns the port adbd is listening on, or 0 if it hasn't been started.
+func (d *Adbd) Port() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.listener == nil {
+		return 0
+	}
+	return d.listener.Addr().(*net.TCPAddr).Port
+}
+
+/*
+DialRaw returns the host end of a new in-memory connection to adbd, which doesn't use the
+network. Pass it to transport.NewConn to connect. The address is ignored.
+
+Adbd implements RawDialer.
+*/
+func (d *Adbd) DialRaw(address string) (io.ReadWriteCloser, error) {
+	host, device := net.Pipe()
+	if err := d.ServeConn(device); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// ServeConn serves a connection from a host in a new goroutine. It's closed when the host
+// disconnects or adbd is closed.
+func (d *Adbd) ServeConn(rw io.ReadWriteCloser) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return errors.Errorf(errors.ServerNotAvailable, "adbd closed")
+	}
+	d.conns[rw] = struct{}{}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer func() {
+			d.lock.Lock()
+			delete(d.conns, rw)
+			d.lock.Unlock()
+			rw.Close()
+		}()
+
+		conn, err := transport.NewDeviceConn(rw, d.deviceConfig())
+		if err != nil {
+			return
+		}
+		<-conn.Done()
+		d.removeReverses(conn, "")
+	}()
+	return nil
+}
+
+func (d *Adbd) deviceConfig() transport.DeviceConfig {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	props := make(map[string]string, len(d.props))
+	for key, val := range d.props {
+		props[key] = val
+	}
+	return transport.DeviceConfig{
+		Banner:      transport.Banner{SystemType: StateOnline, Properties: props},
+		RequireAuth: d.requireAuth,
+		AuthorizedKeys: func() []*rsa.PublicKey {
+			d.lock.Lock()
+			defer d.lock.Unlock()
+			return append([]*rsa.PublicKey(nil), d.authorizedKeys...)
+		},
+		ConfirmKey: d.confirm,
+		Accept:     d.openService,
+	}
+}
+
+func (d *Adbd) confirm(pub *rsa.PublicKey) bool {
+	d.lock.Lock()
+	confirm := d.confirmKey
+	d.lock.Unlock()
+	if confirm == nil || !confirm(pub) {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.authorizedKeys = append(d.authorizedKeys, pub)
+	return true
+}
+
+// Close stops listening, and closes all connections and reverse forwards.
+func (d *Adbd) Close() error {
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return nil
+	}
+	d.closed = true
+	if d.listener != nil {
+		d.listener.Close()
+	}
+	for rw := range d.conns {
+		rw.Close()
+	}
+	d.lock.Unlock()
+
+	d.removeReverses(nil, "")
+	d.wg.Wait()
+	return nil
+}
+
+// Reverses returns the reverse forwards from all connections. Local is the device port, and
+// Remote is the host service.
+func (d *Adbd) Reverses() []Forward {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var forwards []Forward
+	for _, r := range d.reverses {
+		forwards = append(forwards, Forward{Local: r.local, Remote: r.remote})
+	}
+	return forwards
+}
+
+// openService returns a connection to a service opened by the host.
+func (d *Adbd) openService(tconn *transport.Conn, service string) (io.ReadWriteCloser, error) {
+	switch {
+	case strings.HasPrefix(service, "shell:") || strings.HasPrefix(service, "exec:"):
+		cmd := service[strings.Index(service, ":")+1:]
+		if cmd == "" {
+			return nil, errors.Errorf(errors.AdbError, "interactive shells aren't supported")
+		}
+		d.lock.Lock()
+		shell := d.shell
+		d.lock.Unlock()
+		return d.serveService(func(rw io.ReadWriteCloser) {
+			io.WriteString(rw, shell(cmd))
+		}), nil
+
+	case service == "sync:":
+		return d.serveService(func(rw io.ReadWriteCloser) {
+			serveSync(rw, d.fs)
+		}), nil
+
+	case strings.HasPrefix(service, "tcp:"):
+		address := strings.TrimPrefix(service, "tcp:")
+		if !strings.Contains(address, ":") {
+			address = "127.0.0.1:" + address
+		}
+		netConn, err := net.Dial("tcp", address)
+		if err != nil {
+			return nil, errors.WrapErrorf(err, errors.NetworkError, "error connecting to %s", address)
+		}
+		return netConn, nil
+
+	case strings.HasPrefix(service, "reverse:"):
+		return d.serveService(func(rw io.ReadWriteCloser) {
+			d.handleReverse(hostserver.NewConn(rw), tconn, strings.TrimPrefix(service, "reverse:"))
+		}), nil
+
+	default:
+		return nil, errors.Errorf(errors.AdbError, "unknown service: %s", service)
+	}
+}
+
+// serveService runs serve in a new goroutine with one end of an in-memory connection, and
+// returns the other end. The connection is closed when serve returns.
+func (d *Adbd) serveService(serve func(rw io.ReadWriteCloser)) io.ReadWriteCloser {
+	stream, service := net.Pipe()
+	go func() {
+		defer service.Close()
+		serve(service)
+	}()
+	return stream
+}
+
+// handleReverse handles a request from `adb reverse`, which uses the same requests and responses
+// as host forwarding requests.
+func (d *Adbd) handleReverse(resp *hostserver.Conn, tconn *transport.Conn, req string) {
+	switch {
+	case req == "list-forward":
+		var lines []string
+		for _, r := range d.Reverses() {
+			lines = append(lines, fmt.Sprintf("host %s %s\n", r.Local, r.Remote))
+		}
+		resp.OkayMessage(strings.Join(lines, ""))
+
+	case req == "killforward-all":
+		d.removeReverses(tconn, "")
+		resp.Okay()
+
+	case strings.HasPrefix(req, "killforward:"):
+		local := strings.TrimPrefix(req, "killforward:")
+		d.lock.Lock()
+		_, ok := d.reverses[local]
+		d.lock.Unlock()
+		if !ok {
+			resp.Fail(fmt.Sprintf("listener '%s' not found", local))
+			return
+		}
+		d.removeReverses(nil, local)
+		resp.Okay()
+
+	case strings.HasPrefix(req, "forward:"):
+		spec := strings.TrimPrefix(req, "forward:")
+		noRebind := strings.HasPrefix(spec, "norebind:")
+		spec = strings.TrimPrefix(spec, "norebind:")
+		parts := strings.SplitN(spec, ";", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "tcp:") {
+			resp.Fail(fmt.Sprintf("unsupported reverse forward: %s", spec))
+			return
+		}
+		local, remote := parts[0], parts[1]
+
+		d.lock.Lock()
+		_, exists := d.reverses[local]
+		d.lock.Unlock()
+		if exists && noRebind {
+			resp.Fail("cannot rebind existing socket")
+			return
+		}
+		d.removeReverses(nil, local)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:"+strings.TrimPrefix(local, "tcp:"))
+		if err != nil {
+			resp.Fail(fmt.Sprintf("cannot bind listener: %s", err))
+			return
+		}
+		port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		if local == "tcp:0" {
+			local = "tcp:" + port
+		}
+		d.addReverse(&reverseForward{conn: tconn, local: local, remote: remote, listener: listener})
+
+		if err := resp.Okay(); err != nil {
+			return
+		}
+		if parts[0] == "tcp:0" {
+			// Like forward, the resolved port is only sent when the device chose it.
+			resp.Message(port)
+		}
+
+	default:
+		resp.Fail(fmt.Sprintf("unknown reverse request: %s", req))
+	}
+}
+
+func (d *Adbd) addReverse(r *reverseForward) {
+	d.lock.Lock()
+	d.reverses[r.local] = r
+	d.lock.Unlock()
+
+	go func() {
+		for {
+			netConn, err := r.listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := r.conn.Open(r.remote)
+				if err != nil {
+					netConn.Close()
+					return
+				}
+				hostserver.Splice(netConn, stream)
+			}()
+		}
+	}()
+}
+
+// removeReverses removes the reverse forwards from conn, or from all connections if conn is nil,
+// that listen on local, or on any port if local is empty.
+func (d *Adbd) removeReverses(conn *transport.Conn, local string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key, r := range d.reverses {
+		if (conn == nil || r.conn == conn) && (local == "" || r.local == local) {
+			r.listener.Close()
+			delete(d.reverses, key)
+		}
+	}
+}
+
+/*
+LocalShell returns a ShellHandler that runs commands with /bin/sh on the local machine, in dir,
+with only PATH set in the environment. Stdout and stderr are combined.
+
+This isn't a security sandbox: commands can access anything the test can.
+*/
+func LocalShell(dir string) ShellHandler {
+	return func(cmd string) string {
+		c := exec.Command("/bin/sh", "-c", cmd)
+		c.Dir = dir
+		c.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin"}
+		output, _ := c.CombinedOutput()
+		return string(output)
+	}
+}
+
+var _ RawDialer = &Adbd{}
@@ -0,0 +1,246 @@
+package adbtest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb"
+	"github.com/zach-klippenstein/goadb/adbkey"
+	"github.com/zach-klippenstein/goadb/transport"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+func newAdbdConn(t *testing.T, adbd *Adbd, config transport.Config) (*transport.Conn, error) {
+	rw, err := adbd.DialRaw("")
+	require.NoError(t, err)
+	if config.Keys == nil {
+		config.Keys = []*adbkey.Key{}
+	}
+	return transport.NewConn(rw, config)
+}
+
+func newAdbdClient(t *testing.T, adbd *Adbd) (*adb.Adb, *transport.Conn) {
+	conn, err := newAdbdConn(t, adbd, transport.Config{})
+	require.NoError(t, err)
+	client, err := adb.NewWithConfig(adb.ServerConfig{
+		Dialer:        transport.NewDialer(conn),
+		NoStartServer: true,
+	})
+	require.NoError(t, err)
+	return client, conn
+}
+
+func TestAdbdShell(t *testing.T) {
+	adbd := NewAdbd(NewFS())
+	defer adbd.Close()
+	adbd.HandleShell(func(cmd string) string {
+		return "ran " + cmd + "\n"
+	})
+	adbd.SetProperty(transport.PropertyModel, "Pixel")
+	client, conn := newAdbdClient(t, adbd)
+	defer conn.Close()
+
+	assert.Equal(t, "Pixel", conn.Banner().Properties[transport.PropertyModel])
+	output, err := client.Device(adb.AnyDevice()).RunCommand("ls", "/sdcard")
+	assert.NoError(t, err)
+	assert.Equal(t, "ran ls /sdcard\n", output)
+}
+
+func TestAdbdSyncWithDirFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adbd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	adbd := NewAdbd(NewDirFS(dir))
+	defer adbd.Close()
+	client, conn := newAdbdClient(t, adbd)
+	defer conn.Close()
+	device := client.Device(adb.AnyDevice())
+	mtime := time.Unix(1400000000, 0)
+
+	writer, err := device.OpenWrite("/sdcard/../sdcard/hello.txt", 0640, mtime)
+	require.NoError(t, err)
+	writer.Write([]byte("hello world"))
+	require.NoError(t, writer.Close())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "sdcard", "hello.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	entry, err := device.Stat("/sdcard/hello.txt")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), entry.Mode)
+	assert.True(t, mtime.Equal(entry.ModifiedAt))
+
+	reader, err := device.OpenRead("/sdcard/hello.txt")
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	reader.Close()
+	assert.Equal(t, "hello world", string(data))
+
+	_, err = device.OpenRead("/../../nope")
+	assert.True(t, adb.HasErrCode(err, adb.FileNoExistError))
+}
+
+func TestAdbdOverTCP(t *testing.T) {
+	adbd := NewAdbd(NewFS())
+	defer adbd.Close()
+	require.NoError(t, adbd.Start())
+	adbd.HandleShell(func(cmd string) string {
+		return cmd
+	})
+
+	conn, err := transport.Dial(adbd.Addr(), transport.Config{Keys: []*adbkey.Key{}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := conn.Open("shell:hi")
+	require.NoError(t, err)
+	output, err := ioutil.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(output))
+}
+
+func TestAdbdUnknownService(t *testing.T) {
+	adbd := NewAdbd(NewFS())
+	defer adbd.Close()
+	conn, err := newAdbdConn(t, adbd, transport.Config{})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Open("jdwp:1")
+	assert.EqualError(t, err, "AdbError: device refused to open service: jdwp:1")
+}
+
+func newAdbdKey(t *testing.T) *adbkey.Key {
+	priv, err := rsa.GenerateKey(rand.Reader, adbkey.KeyBits)
+	require.NoError(t, err)
+	key, err := adbkey.New(priv, "test@host")
+	require.NoError(t, err)
+	return key
+}
+
+func TestAdbdAuth(t *testing.T) {
+	authorized, unknown := newAdbdKey(t), newAdbdKey(t)
+	adbd := NewAdbd(NewFS())
+	defer adbd.Close()
+	adbd.AuthorizeKey(&authorized.PrivateKey().PublicKey)
+
+	conn, err := newAdbdConn(t, adbd, transport.Config{Keys: []*adbkey.Key{unknown, authorized}})
+	require.NoError(t, err)
+	conn.Close()
+
+	_, err = newAdbdConn(t, adbd, transport.Config{Keys: []*adbkey.Key{unknown}})
+	assert.Error(t, err)
+
+	var confirmed *rsa.PublicKey
+	adbd.ConfirmKeys(func(pub *rsa.PublicKey) bool {
+		confirmed = pub
+		return true
+	})
+	conn, err = newAdbdConn(t, adbd, transport.Config{Keys: []*adbkey.Key{unknown}})
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, &unknown.PrivateKey().PublicKey, confirmed)
+
+	// The confirmed key is remembered.
+	adbd.ConfirmKeys(nil)
+	conn, err = newAdbdConn(t, adbd, transport.Config{Keys: []*adbkey.Key{unknown}})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+// startEchoServer listens on a local port and echoes everything received on each connection.
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func assertEcho(t *testing.T, rw io.ReadWriter) {
+	_, err := rw.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(rw, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestAdbdForward(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	adbd := NewAdbd(NewFS())
+	defer adbd.Close()
+	conn, err := newAdbdConn(t, adbd, transport.Config{})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := conn.Open("tcp:" + portOf(echo))
+	require.NoError(t, err)
+	defer stream.Close()
+	assertEcho(t, stream)
+}
+
+func TestAdbdReverse(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	adbd := NewAdbd(NewFS())
+	defer adbd.Close()
+
+	var accepted []string
+	conn, err := newAdbdConn(t, adbd, transport.Config{
+		Accept: func(conn *transport.Conn, service string) (io.ReadWriteCloser, error) {
+			accepted = append(accepted, service)
+			return net.Dial("tcp", echo.Addr().String())
+		},
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := conn.Open("reverse:forward:tcp:0;tcp:7100")
+	require.NoError(t, err)
+	scanner := wire.NewScanner(stream)
+	_, err = scanner.ReadStatus("reverse")
+	require.NoError(t, err)
+	port, err := wire.ReadMessageString(scanner)
+	require.NoError(t, err)
+	stream.Close()
+	assert.Equal(t, []Forward{{Local: "tcp:" + port, Remote: "tcp:7100"}}, adbd.Reverses())
+
+	deviceConn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	require.NoError(t, err)
+	defer deviceConn.Close()
+	assertEcho(t, deviceConn)
+	assert.Equal(t, []string{"tcp:7100"}, accepted)
+
+	stream, err = conn.Open("reverse:killforward-all")
+	require.NoError(t, err)
+	ioutil.ReadAll(stream)
+	assert.Empty(t, adbd.Reverses())
+}
+
+func portOf(listener net.Listener) string {
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
@@ -0,0 +1,126 @@
+package adbtest
+
+// Device states, as reported by the server.
+const (
+	StateOnline       = "device"
+	StateOffline      = "offline"
+	StateUnauthorized = "unauthorized"
+	StateBootloader   = "bootloader"
+	StateRecovery     = "recovery"
+)
+
+// DeviceInfo holds the attributes of a device that are reported by host:devices-l.
+type DeviceInfo struct {
+	Product string
+	Model   string
+	Device  string
+
+	// Only set for devices connected via USB. Devices without it are selected by
+	// host:transport-local, and devices with it by host:transport-usb.
+	Usb string
+
+	// Returned by get-devpath.
+	DevPath string
+}
+
+/*
+ShellHandler handles a command sent to the shell, exec, abb or abb_exec services, and returns the command's
+output.
+
+Commands are passed exactly as sent by the client, so they include any quoting and wrappers the
+client added. Requests for the abb and abb_exec services are passed with the service name, e.g.
+"abb:package\x00list\x00packages", and always succeed.
+*/
+type ShellHandler func(cmd string) string
+
+// Device is a fake device attached to a Server. Its state and attributes may be changed at any
+// time.
+type Device struct {
+	server      *Server
+	serial      string
+	transportID int64
+	fs          *FS
+
+	// Guarded by server.lock.
+	state    string
+	info     DeviceInfo
+	features []string
+	shell    ShellHandler
+}
+
+func (d *Device) Serial() string {
+	return d.serial
+}
+
+// TransportID returns the ID the server assigned to the device when it was added, which is
+// reported by host:devices-l and used by host:transport-id:<id>.
+func (d *Device) TransportID() int64 {
+	return d.transportID
+}
+
+// FS returns the device's filesystem, which is served by the sync service.
+func (d *Device) FS() *FS {
+	return d.fs
+}
+
+func (d *Device) State() string {
+	d.server.lock.Lock()
+	defer d.server.lock.Unlock()
+	return d.state
+}
+
+// SetState changes the state of the device, and notifies any clients tracking devices.
+func (d *Device) SetState(state string) {
+	d.server.lock.Lock()
+	defer d.server.lock.Unlock()
+	if d.state != state {
+		d.state = state
+		d.server.host.Notify()
+	}
+}
+
+func (d *Device) Info() DeviceInfo {
+	d.server.lock.Lock()
+	defer d.server.lock.Unlock()
+	return d.info
+}
+
+func (d *Device) SetInfo(info DeviceInfo) {
+	d.server.lock.Lock()
+	defer d.server.lock.Unlock()
+	d.info = info
+}
+
+// Features returns the features reported by the device's features service.
+func (d *Device) Features() []string {
+	d.server.lock.Lock()
+	defer d.server.lock.Unlock()
+	return d.features
+}
+
+// SetFeatures sets the features reported by the device's features service. There are none by
+// default, like a very old device.
+func (d *Device) SetFeatures(features ...string) {
+	d.server.lock.Lock()
+	defer d.server.lock.Unlock()
+	d.features = features
+}
+
+// HandleShell sets the handler for commands sent to the device. If no handler is set, all
+// commands succeed with no output.
+func (d *Device) HandleShell(handler ShellHandler) {
+	d.server.lock.Lock()
+	defer d.server.lock.Unlock()
+	d.shell = handler
+}
+
+func (d *Device) runShell(cmd string) string {
+	d.server.lock.Lock()
+	handler := d.shell
+	d.server.lock.Unlock()
+
+	if handler == nil {
+		return ""
+	}
+	return handler(cmd)
+}
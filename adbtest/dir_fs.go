@@ -0,0 +1,90 @@
+package adbtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+DirFS is a Filesystem backed by a directory on the local filesystem. Device paths are resolved
+relative to the directory, e.g. /sdcard/foo is <dir>/sdcard/foo, and are cleaned so they can't
+refer to files outside it. Symlinks inside the directory are followed, so they can.
+*/
+type DirFS struct {
+	root string
+}
+
+var _ Filesystem = DirFS{}
+
+// NewDirFS returns a DirFS that serves the files in root.
+func NewDirFS(root string) DirFS {
+	return DirFS{root}
+}
+
+// Root returns the directory the filesystem is backed by.
+func (fs DirFS) Root() string {
+	return fs.root
+}
+
+// Path returns the local path of a device path.
+func (fs DirFS) Path(name string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(cleanPath(name)))
+}
+
+func (fs DirFS) Stat(name string) (FileInfo, error) {
+	info, err := os.Stat(fs.Path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return fileInfo(info), nil
+}
+
+func (fs DirFS) ReadDir(name string) ([]FileInfo, error) {
+	infos, err := ioutil.ReadDir(fs.Path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]FileInfo, len(infos))
+	for i, info := range infos {
+		files[i] = fileInfo(info)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+func (fs DirFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(fs.Path(name))
+}
+
+func (fs DirFS) WriteFile(name string, data []byte, perm os.FileMode, modTime time.Time) error {
+	path := fs.Path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, perm.Perm()); err != nil {
+		return err
+	}
+	// WriteFile doesn't change the mode of existing files.
+	if err := os.Chmod(path, perm.Perm()); err != nil {
+		return err
+	}
+	if modTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
+
+func fileInfo(info os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    info.Name(),
+		Mode:    info.Mode(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+}
@@ -0,0 +1,229 @@
+package adbtest
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileInfo describes a file in an FS.
+type FileInfo struct {
+	// Name is the base name of the file.
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+func (fi FileInfo) IsDir() bool {
+	return fi.Mode.IsDir()
+}
+
+/*
+Filesystem is the filesystem served by a device's sync service. Paths are absolute device paths.
+
+Errors should be *os.PathErrors wrapping syscall.Errnos, so devices can send the same messages as
+real devices.
+*/
+type Filesystem interface {
+	Stat(name string) (FileInfo, error)
+	// ReadDir returns the files in a directory, sorted by name.
+	ReadDir(name string) ([]FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	// WriteFile creates or replaces a file, creating any missing parent directories.
+	WriteFile(name string, data []byte, perm os.FileMode, modTime time.Time) error
+}
+
+var _ Filesystem = &FS{}
+
+/*
+FS is an in-memory filesystem for fake devices. It only contains regular files and directories.
+
+Paths are always treated as absolute and are cleaned before use, so "foo/../bar" and "/bar" refer
+to the same file. FS is safe for concurrent use.
+*/
+type FS struct {
+	lock  sync.Mutex
+	files map[string]*fsFile
+}
+
+type fsFile struct {
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+// NewFS returns an FS that contains only the root directory.
+func NewFS() *FS {
+	return &FS{
+		files: map[string]*fsFile{
+			"/": {mode: os.ModeDir | 0755},
+		},
+	}
+}
+
+// WriteFile creates or replaces the file at name, creating any missing parent directories.
+func (fs *FS) WriteFile(name string, data []byte, perm os.FileMode, modTime time.Time) error {
+	name = cleanPath(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if f, ok := fs.files[name]; ok && f.mode.IsDir() {
+		return &os.PathError{Op: "write", Path: name, Err: syscall.EISDIR}
+	}
+	if err := fs.mkdirAllLocked(path.Dir(name), 0755, modTime); err != nil {
+		return err
+	}
+
+	fs.files[name] = &fsFile{
+		mode:    perm.Perm(),
+		modTime: modTime,
+		data:    append([]byte(nil), data...),
+	}
+	return nil
+}
+
+// ReadFile returns the contents of the file at name.
+func (fs *FS) ReadFile(name string) ([]byte, error) {
+	name = cleanPath(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.ENOENT}
+	}
+	if f.mode.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+// MkdirAll creates the directory name, along with any missing parents.
+func (fs *FS) MkdirAll(name string, perm os.FileMode) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.mkdirAllLocked(cleanPath(name), perm, time.Now())
+}
+
+func (fs *FS) mkdirAllLocked(name string, perm os.FileMode, modTime time.Time) error {
+	if f, ok := fs.files[name]; ok {
+		if !f.mode.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if err := fs.mkdirAllLocked(path.Dir(name), perm, modTime); err != nil {
+		return err
+	}
+	fs.files[name] = &fsFile{
+		mode:    os.ModeDir | perm.Perm(),
+		modTime: modTime,
+	}
+	return nil
+}
+
+// Remove removes the file or empty directory at name.
+func (fs *FS) Remove(name string) error {
+	name = cleanPath(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	f, ok := fs.files[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOENT}
+	}
+	if name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	if f.mode.IsDir() && len(fs.readDirLocked(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+// Stat returns information about the file at name.
+func (fs *FS) Stat(name string) (FileInfo, error) {
+	name = cleanPath(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	f, ok := fs.files[name]
+	if !ok {
+		return FileInfo{}, &os.PathError{Op: "stat", Path: name, Err: syscall.ENOENT}
+	}
+	return f.info(name), nil
+}
+
+// ReadDir returns the files in the directory name, sorted by name.
+func (fs *FS) ReadDir(name string) ([]FileInfo, error) {
+	name = cleanPath(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOENT}
+	}
+	if !f.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return fs.readDirLocked(name), nil
+}
+
+func (fs *FS) readDirLocked(dir string) []FileInfo {
+	var infos []FileInfo
+	for name, f := range fs.files {
+		if name != "/" && path.Dir(name) == dir {
+			infos = append(infos, f.info(name))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func (f *fsFile) info(name string) FileInfo {
+	return FileInfo{
+		Name:    path.Base(name),
+		Mode:    f.mode,
+		Size:    int64(len(f.data)),
+		ModTime: f.modTime,
+	}
+}
+
+func cleanPath(name string) string {
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	return path.Clean(name)
+}
+
+// errnoMessages are the messages adbd sends for errors, as returned by strerror.
+var errnoMessages = map[syscall.Errno]string{
+	syscall.ENOENT:    "No such file or directory",
+	syscall.EISDIR:    "Is a directory",
+	syscall.ENOTDIR:   "Not a directory",
+	syscall.ENOTEMPTY: "Directory not empty",
+	syscall.EBUSY:     "Device or resource busy",
+	syscall.EACCES:    "Permission denied",
+	syscall.EEXIST:    "File exists",
+}
+
+// errorMessage returns the message a real device would send for err.
+func errorMessage(err error) string {
+	if pathErr, ok := err.(*os.PathError); ok {
+		if errno, ok := pathErr.Err.(syscall.Errno); ok {
+			if msg, ok := errnoMessages[errno]; ok {
+				return msg
+			}
+		}
+	}
+	return err.Error()
+}
@@ -0,0 +1,44 @@
+package adbtest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSWriteFileCreatesParents(t *testing.T) {
+	fs := NewFS()
+	require.NoError(t, fs.WriteFile("sdcard/a/b.txt", []byte("hi"), 0600, time.Unix(1, 0)))
+
+	info, err := fs.Stat("/sdcard/a")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	infos, err := fs.ReadDir("/sdcard/a/")
+	assert.NoError(t, err)
+	assert.Equal(t, []FileInfo{{Name: "b.txt", Mode: 0600, Size: 2, ModTime: time.Unix(1, 0)}}, infos)
+}
+
+func TestFSWriteFileParentIsFile(t *testing.T) {
+	fs := NewFS()
+	require.NoError(t, fs.WriteFile("/a", nil, 0644, time.Now()))
+
+	err := fs.WriteFile("/a/b", nil, 0644, time.Now())
+	assert.Equal(t, "Not a directory", errorMessage(err))
+}
+
+func TestFSRemove(t *testing.T) {
+	fs := NewFS()
+	require.NoError(t, fs.MkdirAll("/a/b", 0755))
+
+	assert.Equal(t, "Directory not empty", errorMessage(fs.Remove("/a")))
+	assert.NoError(t, fs.Remove("/a/b"))
+	assert.NoError(t, fs.Remove("/a"))
+
+	_, err := fs.Stat("/a")
+	assert.Equal(t, "No such file or directory", errorMessage(err))
+	assert.True(t, os.IsNotExist(err))
+}
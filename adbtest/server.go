@@ -0,0 +1,298 @@
+/*
+package adbtest provides a fake adb server for testing code that uses goadb, without a real adb
+server or devices.
+
+The server implements the host services used by goadb, and the shell, exec, abb, abb_exec, and
+sync services of its fake devices. Files on fake devices are kept in memory, and shell commands are handled by
+functions set with Device.HandleShell.
+
+A Server can be used by an adb client either by listening on a local TCP port:
+
+	server := adbtest.NewServer()
+	defer server.Close()
+	if err := server.Start(); err != nil { … }
+	client, err := adb.NewWithConfig(adb.ServerConfig{
+		Host:          "127.0.0.1",
+		Port:          server.Port(),
+		NoStartServer: true,
+	})
+
+or by using it as the client's Dialer, which doesn't use the network at all:
+
+	client, err := adb.NewWithConfig(adb.ServerConfig{
+		Dialer:        server,
+		NoStartServer: true,
+	})
+
+Sessions with real servers can be recorded with a Recorder and replayed in tests with a Replayer.
+
+For end-to-end tests of the transport package, or of a real adb server, Adbd emulates the daemon
+on a device instead, and can serve files from a local directory with DirFS.
+*/
+package adbtest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/internal/hostserver"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// DefaultVersion is the version reported by host:version unless changed with SetVersion.
+const DefaultVersion = 39
+
+// Forward is a port forward created with the forward service.
+type Forward = hostserver.Forward
+
+// Server is a fake adb server. It's safe for concurrent use.
+type Server struct {
+	host *hostserver.Server
+
+	lock         sync.Mutex
+	version      int
+	hostFeatures []string
+	devices      []*Device
+
+	// The transport ID of the last device added.
+	lastTransportID int64
+}
+
+// NewServer returns a Server with no devices. It can be used with Dial immediately, but won't
+// accept network connections until Start is called.
+func NewServer() *Server {
+	s := &Server{version: DefaultVersion}
+	s.host = hostserver.NewServer(serverBackend{s})
+	return s
+}
+
+// Start listens on a random TCP port on the loopback interface. Use Port to get the port.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return errors.WrapErrorf(err, errors.NetworkError, "error listening")
+	}
+	return s.host.Serve(listener)
+}
+
+// Addr returns the address the server is listening on, or "" if it hasn't been started.
+func (s *Server) Addr() string {
+	addr := s.host.Addr()
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// Port returns the port the server is listening on, or 0 if it hasn't been started.
+func (s *Server) Port() int {
+	addr := s.host.Addr()
+	if addr == nil {
+		return 0
+	}
+	return addr.(*net.TCPAddr).Port
+}
+
+/*
+Dial returns a connection to the server over an in-memory pipe, so Server can be used as an
+adb.Dialer. address is ignored.
+*/
+func (s *Server) Dial(address string) (*wire.Conn, error) {
+	conn, err := s.DialRaw(address)
+	if err != nil {
+		return nil, err
+	}
+	return newWireConn(conn), nil
+}
+
+// DialRaw is like Dial, but returns the raw connection. address is ignored.
+func (s *Server) DialRaw(address string) (io.ReadWriteCloser, error) {
+	return s.host.Dial()
+}
+
+// Close stops listening, closes all connections, and waits for them to finish.
+func (s *Server) Close() error {
+	err := s.host.Close()
+	return errors.WrapErrorf(err, errors.NetworkError, "error closing listener")
+}
+
+// SetVersion changes the version reported by host:version.
+func (s *Server) SetVersion(version int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.version = version
+}
+
+// SetHostFeatures sets the features reported by host:host-features. There are none by default.
+func (s *Server) SetHostFeatures(features ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hostFeatures = features
+}
+
+// AddDevice attaches a new online device with serial, and notifies any clients tracking
+// devices. If a device with serial is already attached, it's returned instead.
+func (s *Server) AddDevice(serial string) *Device {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if d := s.deviceLocked(serial); d != nil {
+		return d
+	}
+
+	s.lastTransportID++
+	d := &Device{
+		server:      s,
+		serial:      serial,
+		transportID: s.lastTransportID,
+		fs:          NewFS(),
+		state:       StateOnline,
+	}
+	s.devices = append(s.devices, d)
+	s.host.Notify()
+	return d
+}
+
+// RemoveDevice detaches the device with serial, if any, and notifies any clients tracking
+// devices.
+func (s *Server) RemoveDevice(serial string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, d := range s.devices {
+		if d.serial == serial {
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			s.host.Notify()
+			return
+		}
+	}
+}
+
+// Device returns the device with serial, or nil if there isn't one.
+func (s *Server) Device(serial string) *Device {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.deviceLocked(serial)
+}
+
+func (s *Server) deviceLocked(serial string) *Device {
+	for _, d := range s.devices {
+		if d.serial == serial {
+			return d
+		}
+	}
+	return nil
+}
+
+// Forwards returns the port forwards that have been created by clients.
+func (s *Server) Forwards() []Forward {
+	return s.host.Forwards()
+}
+
+// Shell protocol packet IDs, used by the abb service.
+const (
+	shellPacketStdout = 1
+	shellPacketExit   = 3
+)
+
+// writeShellPacket writes a shell protocol packet with id and data.
+func writeShellPacket(w io.Writer, id byte, data []byte) error {
+	header := make([]byte, 5)
+	header[0] = id
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(data)))
+	_, err := w.Write(append(header, data...))
+	return err
+}
+
+// serverBackend provides the devices of a Server to its hostserver.Server.
+type serverBackend struct {
+	s *Server
+}
+
+func (b serverBackend) Version() int {
+	b.s.lock.Lock()
+	defer b.s.lock.Unlock()
+	return b.s.version
+}
+
+func (b serverBackend) HostFeatures() []string {
+	b.s.lock.Lock()
+	defer b.s.lock.Unlock()
+	return b.s.hostFeatures
+}
+
+func (b serverBackend) Devices() []hostserver.Device {
+	b.s.lock.Lock()
+	defer b.s.lock.Unlock()
+	devices := make([]hostserver.Device, len(b.s.devices))
+	for i, d := range b.s.devices {
+		devices[i] = serverDevice{d}
+	}
+	return devices
+}
+
+// HandleHostRequest returns false, since all the host requests are handled by the
+// hostserver.Server.
+func (b serverBackend) HandleHostRequest(c *hostserver.Conn, req string) bool {
+	return false
+}
+
+// ServeTransport serves the request sent next for the device.
+func (b serverBackend) ServeTransport(c *hostserver.Conn, d hostserver.Device) {
+	if err := c.Okay(); err != nil {
+		return
+	}
+	req, err := c.Scanner.ReadMessage()
+	if err != nil {
+		return
+	}
+	b.s.handleDeviceRequest(c, d.(serverDevice).Device, string(req))
+}
+
+// Forward only records the forward: connections to local aren't accepted.
+func (b serverBackend) Forward(d hostserver.Device, local, remote string) (string, io.Closer, error) {
+	return local, nil, nil
+}
+
+// serverDevice is a device attached to a Server, as seen by its hostserver.Server.
+type serverDevice struct {
+	*Device
+}
+
+func (d serverDevice) Info() hostserver.DeviceInfo {
+	return hostserver.DeviceInfo(d.Device.Info())
+}
+
+// handleDeviceRequest serves a request sent after switching to a device's transport.
+func (s *Server) handleDeviceRequest(c *hostserver.Conn, d *Device, req string) {
+	switch {
+	case strings.HasPrefix(req, "shell:"):
+		if err := c.Okay(); err == nil {
+			io.WriteString(c, d.runShell(strings.TrimPrefix(req, "shell:")))
+		}
+	case strings.HasPrefix(req, "exec:"):
+		if err := c.Okay(); err == nil {
+			io.WriteString(c, d.runShell(strings.TrimPrefix(req, "exec:")))
+		}
+	case strings.HasPrefix(req, "abb_exec:"):
+		if err := c.Okay(); err == nil {
+			io.WriteString(c, d.runShell(req))
+		}
+	case strings.HasPrefix(req, "abb:"):
+		if err := c.Okay(); err == nil {
+			writeShellPacket(c, shellPacketStdout, []byte(d.runShell(req)))
+			writeShellPacket(c, shellPacketExit, []byte{0})
+		}
+	case req == "sync:":
+		if err := c.Okay(); err == nil {
+			serveSync(c, d.fs)
+		}
+	default:
+		c.Fail(fmt.Sprintf("unknown device service: %s", req))
+	}
+}
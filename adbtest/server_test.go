@@ -0,0 +1,290 @@
+package adbtest
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+func newTestClient(t *testing.T) (*adb.Adb, *Server) {
+	s := NewServer()
+	client, err := adb.NewWithConfig(adb.ServerConfig{
+		Dialer:        s,
+		NoStartServer: true,
+	})
+	require.NoError(t, err)
+	return client, s
+}
+
+func TestServerVersion(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+	s.SetVersion(31)
+
+	version, err := client.ServerVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, 31, version)
+}
+
+func TestListDevices(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+	s.AddDevice("emulator-5554").SetInfo(DeviceInfo{Product: "sdk", Model: "Android_SDK", Device: "generic"})
+	s.AddDevice("abc123").SetInfo(DeviceInfo{Usb: "1-1", Product: "hammerhead"})
+
+	devices, err := client.ListDevices()
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	assert.Equal(t, &adb.DeviceInfo{
+		Serial:      "emulator-5554",
+		State:       adb.StateOnline,
+		Product:     "sdk",
+		Model:       "Android_SDK",
+		DeviceInfo:  "generic",
+		TransportID: 1,
+		Connection:  adb.ConnectionEmulator,
+	}, devices[0])
+	assert.Equal(t, "abc123", devices[1].Serial)
+	assert.Equal(t, "1-1", devices[1].Usb)
+	assert.Equal(t, adb.ConnectionUsb, devices[1].Connection)
+
+	serials, err := client.ListDeviceSerials()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"emulator-5554", "abc123"}, serials)
+}
+
+func TestDeviceHostServices(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+	s.AddDevice("192.168.1.2:5555").SetState(StateOffline)
+
+	device := client.Device(adb.DeviceWithSerial("192.168.1.2:5555"))
+	serial, err := device.Serial()
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.2:5555", serial)
+
+	state, err := device.State()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.StateOffline, state)
+
+	_, err = client.Device(adb.DeviceWithSerial("nope")).Serial()
+	assert.True(t, adb.HasErrCode(err, adb.DeviceNotFound))
+}
+
+func TestTransportSelection(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+
+	_, err := client.Device(adb.AnyDevice()).RunCommand("true")
+	assert.Contains(t, adb.ErrorWithCauseChain(err), "no devices/emulators found")
+
+	s.AddDevice("usb").SetInfo(DeviceInfo{Usb: "1-1"})
+	s.AddDevice("emulator-5554").HandleShell(func(cmd string) string {
+		return "emulator\n"
+	})
+
+	_, err = client.Device(adb.AnyDevice()).RunCommand("true")
+	assert.Contains(t, adb.ErrorWithCauseChain(err), "more than one device/emulator")
+	assert.True(t, adb.HasErrCode(err, adb.MoreThanOneDevice))
+
+	output, err := client.Device(adb.AnyLocalDevice()).RunCommand("true")
+	assert.NoError(t, err)
+	assert.Equal(t, "emulator\n", output)
+
+	s.Device("usb").SetState(StateUnauthorized)
+	state, err := client.Device(adb.AnyUsbDevice()).State()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.StateUnauthorized, state)
+	_, err = client.Device(adb.AnyUsbDevice()).RunCommand("true")
+	assert.Contains(t, adb.ErrorWithCauseChain(err), "device unauthorized")
+	assert.True(t, adb.HasErrCode(err, adb.DeviceUnauthorized))
+}
+
+func TestShell(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+	var cmds []string
+	s.AddDevice("abc").HandleShell(func(cmd string) string {
+		cmds = append(cmds, cmd)
+		return "hello world\n"
+	})
+
+	output, err := client.Device(adb.DeviceWithSerial("abc")).RunCommand("echo", "hello world")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world\n", output)
+	assert.Equal(t, []string{`echo 'hello world'`}, cmds)
+}
+
+func TestSyncRoundTrip(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+	d := s.AddDevice("abc")
+	device := client.Device(adb.DeviceWithSerial("abc"))
+	mtime := time.Unix(1400000000, 0)
+
+	writer, err := device.OpenWrite("/sdcard/dir/hello.txt", 0640, mtime)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("hello world"))
+	assert.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	data, err := d.FS().ReadFile("/sdcard/dir/hello.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	entry, err := device.Stat("/sdcard/dir/hello.txt")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), entry.Mode)
+	assert.Equal(t, int32(11), entry.Size)
+	assert.True(t, mtime.Equal(entry.ModifiedAt))
+
+	reader, err := device.OpenRead("/sdcard/dir/hello.txt")
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, "hello world", string(data))
+
+	entries, err := device.ListDirEntries("/sdcard")
+	require.NoError(t, err)
+	all, err := entries.ReadAll()
+	assert.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, "dir", all[0].Name)
+	assert.True(t, all[0].Mode.IsDir())
+}
+
+func TestSyncLargeFile(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+	data := []byte(strings.Repeat("0123456789", wire.SyncMaxChunkSize/5))
+	s.AddDevice("abc").FS().WriteFile("/big", data, 0644, time.Now())
+
+	reader, err := client.Device(adb.AnyDevice()).OpenRead("/big")
+	require.NoError(t, err)
+	defer reader.Close()
+	read, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+}
+
+func TestSyncErrors(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+	s.AddDevice("abc")
+	device := client.Device(adb.AnyDevice())
+
+	_, err := device.Stat("/nope")
+	assert.True(t, adb.HasErrCode(err, adb.FileNoExistError))
+
+	_, err = device.OpenRead("/nope")
+	assert.True(t, adb.HasErrCode(err, adb.FileNoExistError))
+}
+
+func TestDeviceWatcher(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+
+	watcher := client.NewDeviceWatcher()
+	defer watcher.Shutdown()
+
+	d := s.AddDevice("abc")
+	assert.Equal(t, adb.DeviceStateChangedEvent{
+		Serial:      "abc",
+		OldState:    adb.StateDisconnected,
+		NewState:    adb.StateOnline,
+		TransportID: d.TransportID(),
+	}, <-watcher.C())
+
+	d.SetState(StateOffline)
+	assert.Equal(t, adb.DeviceStateChangedEvent{
+		Serial:      "abc",
+		OldState:    adb.StateOnline,
+		NewState:    adb.StateOffline,
+		TransportID: d.TransportID(),
+	}, <-watcher.C())
+
+	s.RemoveDevice("abc")
+	assert.Equal(t, adb.DeviceStateChangedEvent{
+		Serial:      "abc",
+		OldState:    adb.StateOffline,
+		NewState:    adb.StateDisconnected,
+		TransportID: d.TransportID(),
+	}, <-watcher.C())
+}
+
+func TestDeviceWithTransportID(t *testing.T) {
+	client, s := newTestClient(t)
+	defer s.Close()
+	s.AddDevice("abc").HandleShell(func(cmd string) string { return "abc\n" })
+	d := s.AddDevice("def")
+	d.HandleShell(func(cmd string) string { return "def\n" })
+
+	device := client.Device(adb.DeviceWithTransportID(d.TransportID()))
+	output, err := device.RunCommand("echo")
+	assert.NoError(t, err)
+	assert.Equal(t, "def\n", output)
+
+	serial, err := device.Serial()
+	assert.NoError(t, err)
+	assert.Equal(t, "def", serial)
+
+	info, err := device.DeviceInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, d.TransportID(), info.TransportID)
+
+	_, err = client.Device(adb.DeviceWithTransportID(100)).RunCommand("echo")
+	assert.True(t, adb.HasErrCode(err, adb.DeviceNotFound))
+}
+
+func TestForward(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddDevice("abc")
+
+	conn, err := s.Dial("")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, wire.SendMessageString(conn, "host-serial:abc:forward:tcp:6100;tcp:7100"))
+	_, err = conn.ReadStatus("forward")
+	assert.NoError(t, err)
+	_, err = conn.ReadStatus("forward")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Forward{{Serial: "abc", Local: "tcp:6100", Remote: "tcp:7100"}}, s.Forwards())
+
+	conn, err = s.Dial("")
+	require.NoError(t, err)
+	defer conn.Close()
+	list, err := conn.RoundTripSingleResponse([]byte("host:list-forward"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abc tcp:6100 tcp:7100\n", string(list))
+}
+
+func TestListen(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	require.NoError(t, s.Start())
+
+	client, err := adb.NewWithConfig(adb.ServerConfig{
+		Host:          "127.0.0.1",
+		Port:          s.Port(),
+		NoStartServer: true,
+	})
+	require.NoError(t, err)
+
+	version, err := client.ServerVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultVersion, version)
+
+	require.NoError(t, s.Close())
+	_, err = client.ServerVersion()
+	assert.True(t, adb.HasErrCode(err, adb.ServerNotAvailable))
+}
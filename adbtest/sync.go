@@ -0,0 +1,245 @@
+package adbtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// The file type bit for regular files, which wire doesn't define since clients never need it.
+const modeRegular uint32 = 0100000
+
+// errSyncFailed is returned by sync request handlers after sending a FAIL response. Devices drop
+// the connection after a failure.
+var errSyncFailed = errors.Errorf(errors.AdbError, "sync request failed")
+
+/*
+serveSync serves sync requests for the files in fs, until the client sends QUIT or a request
+fails.
+
+See https://android.googlesource.com/platform/system/core/+/master/adb/SYNC.TXT.
+*/
+func serveSync(rw io.ReadWriter, fs Filesystem) error {
+	scanner := wire.NewSyncScanner(rw)
+	sender := wire.NewSyncSender(rw)
+
+	for {
+		id, err := scanner.ReadStatus("sync-request")
+		if err != nil {
+			return err
+		}
+		arg, err := scanner.ReadString()
+		if err != nil {
+			return err
+		}
+
+		switch id {
+		case "STAT":
+			err = syncStat(sender, fs, arg)
+		case "STA2", "LST2":
+			// There are no symlinks, so LST2 is the same as STA2.
+			err = syncStat2(sender, fs, id, arg)
+		case "LIST":
+			err = syncList(sender, fs, arg)
+		case "RECV":
+			err = syncRecv(sender, fs, arg)
+		case "SEND":
+			err = syncSend(scanner, sender, fs, arg)
+		case "QUIT":
+			return nil
+		default:
+			err = syncFail(sender, fmt.Sprintf("unknown sync request: %q", id))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func syncStat(s wire.SyncSender, fs Filesystem, path string) error {
+	info, statErr := fs.Stat(path)
+	if err := s.SendOctetString("STAT"); err != nil {
+		return err
+	}
+	if statErr != nil {
+		// Missing files are reported as a zero mode, size, and time.
+		return sendZeroes(s, 3)
+	}
+	return sendFileInfo(s, info)
+}
+
+// syncStat2 responds to a STA2 or LST2 request, see readStat2SizeResponse in the adb package for
+// the layout. Only the error, mode, size, and mtime fields are set.
+func syncStat2(s wire.SyncSender, fs Filesystem, id, path string) error {
+	var fields [17]int32
+	if info, err := fs.Stat(path); err != nil {
+		fields[0] = errnoNoEnt
+	} else {
+		fields[5] = int32(syncMode(info.Mode))
+		fields[9] = int32(info.Size)
+		fields[10] = int32(info.Size >> 32)
+		if !info.ModTime.IsZero() {
+			fields[13] = int32(info.ModTime.Unix())
+			fields[14] = int32(info.ModTime.Unix() >> 32)
+		}
+	}
+
+	if err := s.SendOctetString(id); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if err := s.SendInt32(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The errno for missing files, reported in STA2 responses.
+const errnoNoEnt = 2
+
+func syncList(s wire.SyncSender, fs Filesystem, path string) error {
+	// Errors are reported as an empty directory.
+	infos, _ := fs.ReadDir(path)
+	for _, info := range infos {
+		if err := s.SendOctetString("DENT"); err != nil {
+			return err
+		}
+		if err := sendFileInfo(s, info); err != nil {
+			return err
+		}
+		if err := s.SendBytes([]byte(info.Name)); err != nil {
+			return err
+		}
+	}
+
+	// The DONE entry has the same layout as a DENT, zeroed.
+	if err := s.SendOctetString(wire.StatusSyncDone); err != nil {
+		return err
+	}
+	return sendZeroes(s, 4)
+}
+
+func syncRecv(s wire.SyncSender, fs Filesystem, path string) error {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return syncFail(s, errorMessage(err))
+	}
+
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > wire.SyncMaxChunkSize {
+			chunk = chunk[:wire.SyncMaxChunkSize]
+		}
+		data = data[len(chunk):]
+
+		if err := s.SendOctetString(wire.StatusSyncData); err != nil {
+			return err
+		}
+		if err := s.SendBytes(chunk); err != nil {
+			return err
+		}
+	}
+
+	if err := s.SendOctetString(wire.StatusSyncDone); err != nil {
+		return err
+	}
+	return s.SendInt32(0)
+}
+
+func syncSend(scanner wire.SyncScanner, s wire.SyncSender, fs Filesystem, pathAndMode string) error {
+	i := strings.LastIndex(pathAndMode, ",")
+	if i < 0 {
+		return syncFail(s, fmt.Sprintf("missing mode in send request: %q", pathAndMode))
+	}
+	mode, err := strconv.ParseUint(pathAndMode[i+1:], 10, 32)
+	if err != nil {
+		return syncFail(s, fmt.Sprintf("invalid mode in send request: %q", pathAndMode))
+	}
+	path := pathAndMode[:i]
+
+	var data bytes.Buffer
+	for {
+		id, err := scanner.ReadStatus("send-chunk")
+		if err != nil {
+			return err
+		}
+
+		switch id {
+		case wire.StatusSyncData:
+			chunk, err := scanner.ReadBytes()
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(&data, chunk); err != nil {
+				return errors.WrapErrorf(err, errors.NetworkError, "error reading data chunk")
+			}
+
+		case wire.StatusSyncDone:
+			mtime, err := scanner.ReadInt32()
+			if err != nil {
+				return err
+			}
+			err = fs.WriteFile(path, data.Bytes(), os.FileMode(mode), time.Unix(int64(mtime), 0))
+			if err != nil {
+				return syncFail(s, errorMessage(err))
+			}
+			if err := s.SendOctetString(wire.StatusSuccess); err != nil {
+				return err
+			}
+			return s.SendInt32(0)
+
+		default:
+			return syncFail(s, fmt.Sprintf("invalid send chunk ID: %q", id))
+		}
+	}
+}
+
+func syncFail(s wire.SyncSender, msg string) error {
+	if err := s.SendOctetString(wire.StatusFailure); err != nil {
+		return err
+	}
+	if err := s.SendBytes([]byte(msg)); err != nil {
+		return err
+	}
+	return errSyncFailed
+}
+
+// sendFileInfo sends the mode, size, and modification time of a file.
+func sendFileInfo(s wire.SyncSender, info FileInfo) error {
+	if err := s.SendInt32(int32(syncMode(info.Mode))); err != nil {
+		return err
+	}
+	if err := s.SendInt32(int32(info.Size)); err != nil {
+		return err
+	}
+	var mtime int32
+	if !info.ModTime.IsZero() {
+		mtime = int32(info.ModTime.Unix())
+	}
+	return s.SendInt32(mtime)
+}
+
+func sendZeroes(s wire.SyncSender, n int) error {
+	for i := 0; i < n; i++ {
+		if err := s.SendInt32(0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncMode converts mode to a POSIX file mode, as sent by the sync protocol.
+func syncMode(mode os.FileMode) uint32 {
+	if mode.IsDir() {
+		return wire.ModeDir | uint32(mode.Perm())
+	}
+	return modeRegular | uint32(mode.Perm())
+}
@@ -0,0 +1,382 @@
+package adbtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+/*
+Transcripts record every byte sent and received on connections to an adb server, so sessions
+with real servers and devices can be replayed in tests.
+
+A transcript is a stream of JSON objects, one per line, each describing an event on a
+connection:
+	{"conn":1,"type":"dial","address":"localhost:5037"}
+	{"conn":1,"type":"send","data":"MDAwY2hvc3Q6dmVyc2lvbg=="}
+	{"conn":1,"type":"recv","data":"T0tBWTAwMDQwMDI3"}
+	{"conn":1,"type":"eof"}
+	{"conn":1,"type":"close"}
+
+Data is base64-encoded, and is recorded exactly as it was read or written, so it includes the
+binary sync protocol. Events from different connections may be interleaved.
+*/
+
+// Transcript event types.
+const (
+	eventDial  = "dial"
+	eventSend  = "send"
+	eventRecv  = "recv"
+	eventEOF   = "eof"
+	eventClose = "close"
+)
+
+type transcriptEvent struct {
+	Conn    int    `json:"conn"`
+	Type    string `json:"type"`
+	Address string `json:"address,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+// RawDialer opens raw connections to an adb server. Server implements RawDialer.
+type RawDialer interface {
+	DialRaw(address string) (io.ReadWriteCloser, error)
+}
+
+// TCPDialer is a RawDialer that connects to a real adb server over TCP.
+type TCPDialer struct{}
+
+func (TCPDialer) DialRaw(address string) (io.ReadWriteCloser, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, errors.WrapErrorf(err, errors.ServerNotAvailable, "error dialing %s", address)
+	}
+	return conn, nil
+}
+
+func newWireConn(conn io.ReadWriteCloser) *wire.Conn {
+	safeConn := wire.MultiCloseable(conn)
+	return &wire.Conn{
+		Scanner: wire.NewScanner(safeConn),
+		Sender:  wire.NewSender(safeConn),
+	}
+}
+
+/*
+Recorder is an adb.Dialer that connects with another dialer, and writes a transcript of
+everything sent and received on its connections.
+
+To record a session with a real server:
+
+	recorder := adbtest.NewRecorder(adbtest.TCPDialer{}, transcriptFile)
+	client, err := adb.NewWithConfig(adb.ServerConfig{Dialer: recorder})
+*/
+type Recorder struct {
+	dialer RawDialer
+
+	lock     sync.Mutex
+	encoder  *json.Encoder
+	lastConn int
+	err      error
+}
+
+// NewRecorder returns a Recorder that dials with dialer and writes the transcript to w.
+func NewRecorder(dialer RawDialer, w io.Writer) *Recorder {
+	return &Recorder{
+		dialer:  dialer,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (r *Recorder) Dial(address string) (*wire.Conn, error) {
+	conn, err := r.dialer.DialRaw(address)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	r.lastConn++
+	id := r.lastConn
+	r.lock.Unlock()
+
+	r.record(transcriptEvent{Conn: id, Type: eventDial, Address: address})
+	return newWireConn(&recordingConn{
+		ReadWriteCloser: conn,
+		recorder:        r,
+		id:              id,
+	}), nil
+}
+
+// Err returns the first error that occurred writing the transcript, if any.
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(event transcriptEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.encoder.Encode(event); err != nil && r.err == nil {
+		r.err = errors.WrapErrorf(err, errors.AssertionError, "error writing transcript")
+	}
+}
+
+// recordingConn records everything read from and written to a connection.
+type recordingConn struct {
+	io.ReadWriteCloser
+	recorder *Recorder
+	id       int
+}
+
+func (c *recordingConn) Read(buf []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(buf)
+	if n > 0 {
+		c.recorder.record(transcriptEvent{Conn: c.id, Type: eventRecv, Data: buf[:n]})
+	}
+	if err == io.EOF {
+		c.recorder.record(transcriptEvent{Conn: c.id, Type: eventEOF})
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(buf []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(buf)
+	if n > 0 {
+		c.recorder.record(transcriptEvent{Conn: c.id, Type: eventSend, Data: buf[:n]})
+	}
+	return n, err
+}
+
+func (c *recordingConn) Close() error {
+	c.recorder.record(transcriptEvent{Conn: c.id, Type: eventClose})
+	return c.ReadWriteCloser.Close()
+}
+
+// How long a read waits for the client to send the data the transcript expects before the
+// recorded response.
+const replayReadTimeout = 5 * time.Second
+
+/*
+Replayer is an adb.Dialer that serves the connections recorded in a transcript, without
+connecting to a server.
+
+Connections are replayed in the order they were dialed in the transcript, regardless of the
+address. Data written by the client must match the data recorded for the connection, and reads
+return the recorded responses once the client has sent everything recorded before them. If the
+client diverges from the transcript, the read or write fails, and the error is returned by Err.
+*/
+type Replayer struct {
+	lock  sync.Mutex
+	conns []*replayConn
+	next  int
+	err   error
+}
+
+// NewReplayer reads a transcript written by a Recorder from r.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	replayer := &Replayer{}
+	connsByID := make(map[int]*replayConn)
+
+	decoder := json.NewDecoder(r)
+	for {
+		var event transcriptEvent
+		if err := decoder.Decode(&event); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.WrapErrorf(err, errors.ParseError, "error reading transcript")
+		}
+
+		if event.Type == eventDial {
+			conn := &replayConn{replayer: replayer, id: event.Conn, changed: make(chan struct{})}
+			connsByID[event.Conn] = conn
+			replayer.conns = append(replayer.conns, conn)
+			continue
+		}
+
+		conn, ok := connsByID[event.Conn]
+		if !ok {
+			return nil, errors.Errorf(errors.ParseError, "transcript has %s event for conn %d before dial",
+				event.Type, event.Conn)
+		}
+		switch event.Type {
+		case eventSend, eventRecv:
+			// Merge consecutive reads or writes, since clients may not read and write with the same
+			// buffer sizes as the recorded client.
+			if last := len(conn.events) - 1; last >= 0 && conn.events[last].Type == event.Type {
+				conn.events[last].Data = append(conn.events[last].Data, event.Data...)
+				continue
+			}
+		case eventEOF, eventClose:
+		default:
+			return nil, errors.Errorf(errors.ParseError, "invalid transcript event type: %s", event.Type)
+		}
+		conn.events = append(conn.events, event)
+	}
+
+	return replayer, nil
+}
+
+func (r *Replayer) Dial(address string) (*wire.Conn, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.next >= len(r.conns) {
+		return nil, errors.Errorf(errors.ServerNotAvailable,
+			"transcript only has %d connections", len(r.conns))
+	}
+	conn := r.conns[r.next]
+	r.next++
+	return newWireConn(conn), nil
+}
+
+/*
+Err returns the first error caused by the client diverging from the transcript. It also returns
+an error if any recorded connections weren't dialed, or if any data recorded as sent by the
+client wasn't sent.
+*/
+func (r *Replayer) Err() error {
+	r.lock.Lock()
+	err, dialed, conns := r.err, r.next, r.conns
+	r.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if dialed < len(conns) {
+		return errors.Errorf(errors.AssertionError, "only %d of %d recorded connections were dialed",
+			dialed, len(conns))
+	}
+	for _, conn := range conns {
+		if err := conn.checkSent(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Replayer) fail(err error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+	return err
+}
+
+// replayConn serves the recorded events for a single connection.
+type replayConn struct {
+	replayer *Replayer
+	id       int
+
+	lock   sync.Mutex
+	events []transcriptEvent
+	// Number of bytes of the current event's data that have already been read or written.
+	offset int
+	// Closed and replaced every time data is written.
+	changed chan struct{}
+}
+
+func (c *replayConn) Read(buf []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.events) > 0 {
+		event := &c.events[0]
+		switch event.Type {
+		case eventRecv:
+			n := copy(buf, event.Data[c.offset:])
+			c.advance(n)
+			return n, nil
+		case eventSend:
+			// The client may be sending on another goroutine, so wait for it like a real server.
+			changed := c.changed
+			c.lock.Unlock()
+			select {
+			case <-changed:
+				c.lock.Lock()
+			case <-time.After(replayReadTimeout):
+				c.lock.Lock()
+				if c.changed == changed {
+					return 0, c.replayer.fail(errors.Errorf(errors.AssertionError,
+						"conn %d: client read, but transcript expects it to send %q",
+						c.id, event.Data[c.offset:]))
+				}
+			}
+		case eventEOF:
+			c.advance(0)
+			return 0, io.EOF
+		default:
+			// The recorded client closed the connection here, so it never read anything else.
+			c.advance(0)
+		}
+	}
+	return 0, io.EOF
+}
+
+func (c *replayConn) Write(buf []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	written := 0
+	for written < len(buf) {
+		if len(c.events) == 0 || c.events[0].Type != eventSend {
+			return written, c.replayer.fail(errors.Errorf(errors.AssertionError,
+				"conn %d: client sent %q, but transcript doesn't expect it to send anything",
+				c.id, buf[written:]))
+		}
+
+		expected := c.events[0].Data[c.offset:]
+		actual := buf[written:]
+		if len(actual) > len(expected) {
+			actual = actual[:len(expected)]
+		}
+		if !bytes.Equal(actual, expected[:len(actual)]) {
+			return written, c.replayer.fail(errors.Errorf(errors.AssertionError,
+				"conn %d: client sent %q, but transcript expects %q", c.id, buf[written:], expected))
+		}
+		c.advance(len(actual))
+		written += len(actual)
+	}
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return written, nil
+}
+
+func (c *replayConn) Close() error {
+	return nil
+}
+
+// advance consumes n bytes of the current event's data, and moves to the next event if they've
+// all been consumed.
+func (c *replayConn) advance(n int) {
+	c.offset += n
+	if c.offset >= len(c.events[0].Data) {
+		c.events = c.events[1:]
+		c.offset = 0
+	}
+}
+
+// checkSent returns an error if the client didn't send everything it was recorded sending.
+func (c *replayConn) checkSent() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, event := range c.events {
+		if event.Type == eventSend {
+			data := event.Data
+			if i == 0 {
+				data = data[c.offset:]
+			}
+			return errors.Errorf(errors.AssertionError, "conn %d: client never sent %q", c.id, data)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package adbtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb"
+)
+
+// session runs some requests that use both normal and sync connections, and returns their results.
+func session(t *testing.T, client *adb.Adb) []string {
+	version, err := client.ServerVersion()
+	require.NoError(t, err)
+
+	device := client.Device(adb.DeviceWithSerial("abc"))
+	output, err := device.RunCommand("echo", "hi")
+	require.NoError(t, err)
+
+	writer, err := device.OpenWrite("/sdcard/file", 0644, time.Unix(1, 0))
+	require.NoError(t, err)
+	writer.Write([]byte("data"))
+	require.NoError(t, writer.Close())
+
+	reader, err := device.OpenRead("/sdcard/file")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	reader.Close()
+
+	return []string{strconv.Itoa(version), output, string(data)}
+}
+
+func recordSession(t *testing.T) (transcript []byte, results []string) {
+	s := NewServer()
+	defer s.Close()
+	s.AddDevice("abc").HandleShell(func(cmd string) string {
+		return cmd + "\n"
+	})
+
+	var buf bytes.Buffer
+	recorder := NewRecorder(s, &buf)
+	client, err := adb.NewWithConfig(adb.ServerConfig{Dialer: recorder, NoStartServer: true})
+	require.NoError(t, err)
+
+	results = session(t, client)
+	require.NoError(t, recorder.Err())
+	return buf.Bytes(), results
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	transcript, recorded := recordSession(t)
+	assert.Equal(t, []string{"39", "echo hi\n", "data"}, recorded)
+	assert.Contains(t, string(transcript), `{"conn":1,"type":"dial","address":"localhost:5037"}`)
+
+	replayer, err := NewReplayer(bytes.NewReader(transcript))
+	require.NoError(t, err)
+	client, err := adb.NewWithConfig(adb.ServerConfig{Dialer: replayer, NoStartServer: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, recorded, session(t, client))
+	assert.NoError(t, replayer.Err())
+}
+
+func TestReplayMismatch(t *testing.T) {
+	transcript, _ := recordSession(t)
+	replayer, err := NewReplayer(bytes.NewReader(transcript))
+	require.NoError(t, err)
+	client, err := adb.NewWithConfig(adb.ServerConfig{Dialer: replayer, NoStartServer: true})
+	require.NoError(t, err)
+
+	_, err = client.ListDevices()
+	assert.Error(t, err)
+	assert.Contains(t, adb.ErrorWithCauseChain(replayer.Err()), `client sent "000ehost:devices-l", but transcript expects "000chost:version"`)
+}
+
+func TestReplayUnusedConns(t *testing.T) {
+	transcript, _ := recordSession(t)
+	replayer, err := NewReplayer(bytes.NewReader(transcript))
+	require.NoError(t, err)
+	client, err := adb.NewWithConfig(adb.ServerConfig{Dialer: replayer, NoStartServer: true})
+	require.NoError(t, err)
+
+	_, err = client.ServerVersion()
+	assert.NoError(t, err)
+	assert.EqualError(t, replayer.Err(), "AssertionError: only 1 of 4 recorded connections were dialed")
+}
+
+func TestNewReplayerInvalid(t *testing.T) {
+	_, err := NewReplayer(strings.NewReader(`{"conn":1,"type":"send","data":""}`))
+	assert.EqualError(t, err, "ParseError: transcript has send event for conn 1 before dial")
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/cheggaaa/pb"
 	"github.com/zach-klippenstein/goadb"
+	"github.com/zach-klippenstein/goadb/adbkey"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -17,7 +18,7 @@ const StdIoFilename = "-"
 
 var (
 	serial = kingpin.Flag("serial",
-		"Connect to device by serial number.").
+		"Connect to device by serial number, or the only device matching a query, e.g. usb or model=Pixel_7,sdk>=33.").
 		Short('s').
 		String()
 
@@ -54,6 +55,9 @@ var (
 		"Show progress.").
 		Short('p').
 		Bool()
+	pushRateLimitFlag = pushCommand.Flag("rate-limit",
+		"Limit the transfer rate, in bytes per second. 0 means no limit.").
+		Int64()
 	pushLocalArg = pushCommand.Arg("local",
 		"Path of source file. If -, will read from stdin.").
 		Required().
@@ -62,6 +66,13 @@ var (
 		"Path of destination file on device.").
 		Required().
 		String()
+
+	keygenCommand = kingpin.Command("keygen",
+		"Generate an adb key, and write the private key to FILE and the public key to FILE.pub.")
+	keygenFileArg = keygenCommand.Arg("file",
+		"Path of the private key file.").
+		Required().
+		String()
 )
 
 var client *adb.Adb
@@ -69,6 +80,12 @@ var client *adb.Adb
 func main() {
 	var exitCode int
 
+	command := kingpin.Parse()
+	if command == "keygen" {
+		// Doesn't need a server.
+		os.Exit(keygen(*keygenFileArg))
+	}
+
 	var err error
 	client, err = adb.NewWithConfig(adb.ServerConfig{})
 	if err != nil {
@@ -76,7 +93,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	switch kingpin.Parse() {
+	switch command {
 	case "devices":
 		exitCode = listDevices(*devicesLongFlag)
 	case "shell":
@@ -84,18 +101,48 @@ func main() {
 	case "pull":
 		exitCode = pull(*pullProgressFlag, *pullRemoteArg, *pullLocalArg, parseDevice())
 	case "push":
-		exitCode = push(*pushProgressFlag, *pushLocalArg, *pushRemoteArg, parseDevice())
+		exitCode = push(*pushProgressFlag, *pushRateLimitFlag, *pushLocalArg, *pushRemoteArg, parseDevice())
 	}
 
 	os.Exit(exitCode)
 }
 
-func parseDevice() adb.DeviceDescriptor {
-	if *serial != "" {
-		return adb.DeviceWithSerial(*serial)
+func keygen(path string) int {
+	key, err := adbkey.Generate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	if err := key.Save(path); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// parseDevice returns the device selected by the serial flag. Exits if it doesn't select exactly
+// one device.
+func parseDevice() *adb.Device {
+	if *serial == "" {
+		return client.Device(adb.AnyDevice())
+	}
+
+	query, err := adb.ParseDeviceQuery(*serial)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", adb.ErrorWithCauseChain(err))
+		os.Exit(1)
+	}
+	if descriptor, ok := query.Descriptor(); ok {
+		// Let the server select the device, so its error messages are the usual ones.
+		return client.Device(descriptor)
 	}
 
-	return adb.AnyDevice()
+	device, err := client.SelectDevice(query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", adb.ErrorWithCauseChain(err))
+		os.Exit(1)
+	}
+	return device
 }
 
 func listDevices(long bool) int {
@@ -122,7 +169,7 @@ func listDevices(long bool) int {
 	return 0
 }
 
-func runShellCommand(commandAndArgs []string, device adb.DeviceDescriptor) int {
+func runShellCommand(commandAndArgs []string, client *adb.Device) int {
 	if len(commandAndArgs) == 0 {
 		fmt.Fprintln(os.Stderr, "error: no command")
 		kingpin.Usage()
@@ -136,7 +183,6 @@ func runShellCommand(commandAndArgs []string, device adb.DeviceDescriptor) int {
 		args = commandAndArgs[1:]
 	}
 
-	client := client.Device(device)
 	output, err := client.RunCommand(command, args...)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err)
@@ -147,7 +193,7 @@ func runShellCommand(commandAndArgs []string, device adb.DeviceDescriptor) int {
 	return 0
 }
 
-func pull(showProgress bool, remotePath, localPath string, device adb.DeviceDescriptor) int {
+func pull(showProgress bool, remotePath, localPath string, client *adb.Device) int {
 	if remotePath == "" {
 		fmt.Fprintln(os.Stderr, "error: must specify remote file")
 		kingpin.Usage()
@@ -158,8 +204,6 @@ func pull(showProgress bool, remotePath, localPath string, device adb.DeviceDesc
 		localPath = filepath.Base(remotePath)
 	}
 
-	client := client.Device(device)
-
 	info, err := client.Stat(remotePath)
 	if adb.HasErrCode(err, adb.ErrCode(adb.FileNoExistError)) {
 		fmt.Fprintln(os.Stderr, "remote file does not exist:", remotePath)
@@ -169,7 +213,8 @@ func pull(showProgress bool, remotePath, localPath string, device adb.DeviceDesc
 		return 1
 	}
 
-	remoteFile, err := client.OpenRead(remotePath)
+	progress := newProgressBar(int(info.Size), showProgress)
+	remoteFile, err := client.OpenRead(remotePath, progressOptions(progress)...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error opening remote file %s: %s\n", remotePath, adb.ErrorWithCauseChain(err))
 		return 1
@@ -188,14 +233,15 @@ func pull(showProgress bool, remotePath, localPath string, device adb.DeviceDesc
 	}
 	defer localFile.Close()
 
-	if err := copyWithProgressAndStats(localFile, remoteFile, int(info.Size), showProgress); err != nil {
+	if err := copyWithProgress(localFile, remoteFile, progress); err != nil {
 		fmt.Fprintln(os.Stderr, "error pulling file:", err)
 		return 1
 	}
+	printStats(remoteFile.Stats())
 	return 0
 }
 
-func push(showProgress bool, localPath, remotePath string, device adb.DeviceDescriptor) int {
+func push(showProgress bool, rateLimit int64, localPath, remotePath string, client *adb.Device) int {
 	if remotePath == "" {
 		fmt.Fprintln(os.Stderr, "error: must specify remote file")
 		kingpin.Usage()
@@ -231,41 +277,67 @@ func push(showProgress bool, localPath, remotePath string, device adb.DeviceDesc
 	}
 	defer localFile.Close()
 
-	client := client.Device(device)
-	writer, err := client.OpenWrite(remotePath, perms, mtime)
+	progress := newProgressBar(size, showProgress)
+	opts := progressOptions(progress)
+	if rateLimit > 0 {
+		opts = append(opts, adb.WithRateLimit(rateLimit))
+	}
+
+	writer, err := client.OpenWrite(remotePath, perms, mtime, opts...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error opening remote file %s: %s\n", remotePath, err)
 		return 1
 	}
-	defer writer.Close()
 
-	if err := copyWithProgressAndStats(writer, localFile, size, showProgress); err != nil {
+	if err := copyWithProgress(writer, localFile, progress); err != nil {
+		writer.Close()
 		fmt.Fprintln(os.Stderr, "error pushing file:", err)
 		return 1
 	}
+	// The last chunk isn't sent until the writer is closed.
+	if err := writer.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "error pushing file:", err)
+		return 1
+	}
+	printStats(writer.Stats())
 	return 0
 }
 
-// copyWithProgressAndStats copies src to dst.
-// If showProgress is true and size is positive, a progress bar is shown.
-// After copying, final stats about the transfer speed and size are shown.
-// Progress and stats are printed to stderr.
-func copyWithProgressAndStats(dst io.Writer, src io.Reader, size int, showProgress bool) error {
-	var progress *pb.ProgressBar
-	if showProgress && size > 0 {
-		progress = pb.New(size)
-		// Write to stderr in case dst is stdout.
-		progress.Output = os.Stderr
-		progress.ShowSpeed = true
-		progress.ShowPercent = true
-		progress.ShowTimeLeft = true
-		progress.SetUnits(pb.U_BYTES)
+// newProgressBar returns a progress bar for a transfer of size bytes, printed to stderr.
+// Returns nil if show is false or size isn't positive.
+func newProgressBar(size int, show bool) *pb.ProgressBar {
+	if !show || size <= 0 {
+		return nil
+	}
+	progress := pb.New(size)
+	// Write to stderr in case the destination is stdout.
+	progress.Output = os.Stderr
+	progress.ShowSpeed = true
+	progress.ShowPercent = true
+	progress.ShowTimeLeft = true
+	progress.SetUnits(pb.U_BYTES)
+	return progress
+}
+
+// progressOptions returns the transfer options that update progress, which may be nil.
+func progressOptions(progress *pb.ProgressBar) []adb.TransferOption {
+	if progress == nil {
+		return nil
+	}
+	return []adb.TransferOption{
+		adb.WithProgress(func(stats adb.TransferStats) {
+			progress.Set64(stats.Bytes)
+		}),
+	}
+}
+
+// copyWithProgress copies src to dst, showing progress if it's not nil.
+func copyWithProgress(dst io.Writer, src io.Reader, progress *pb.ProgressBar) error {
+	if progress != nil {
 		progress.Start()
-		dst = io.MultiWriter(dst, progress)
 	}
 
-	startTime := time.Now()
-	copied, err := io.Copy(dst, src)
+	_, err := io.Copy(dst, src)
 
 	if progress != nil {
 		progress.Finish()
@@ -277,13 +349,10 @@ func copyWithProgressAndStats(dst io.Writer, src io.Reader, size int, showProgre
 			err = nil
 		}
 	}
-	if err != nil {
-		return err
-	}
-
-	duration := time.Now().Sub(startTime)
-	rate := int64(float64(copied) / duration.Seconds())
-	fmt.Fprintf(os.Stderr, "%d B/s (%d bytes in %s)\n", rate, copied, duration)
+	return err
+}
 
-	return nil
+// printStats prints the transfer speed and size to stderr.
+func printStats(stats adb.TransferStats) {
+	fmt.Fprintf(os.Stderr, "%d B/s (%d bytes in %s)\n", int64(stats.Throughput()), stats.Bytes, stats.Duration)
 }
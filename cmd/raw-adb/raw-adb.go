@@ -14,7 +14,10 @@ import (
 	"github.com/zach-klippenstein/goadb/wire"
 )
 
-var port = flag.Int("p", adb.AdbPort, "`port` the adb server is listening on")
+var (
+	port  = flag.Int("p", adb.AdbPort, "`port` the adb server is listening on")
+	trace = flag.Bool("trace", false, "print all protocol traffic to stderr")
+)
 
 func main() {
 	flag.Parse()
@@ -49,9 +52,14 @@ func readLine() string {
 }
 
 func doCommand(cmd string) error {
-	server, err := adb.NewWithConfig(adb.ServerConfig{
+	config := adb.ServerConfig{
 		Port: *port,
-	})
+	}
+	if *trace {
+		config.Tracer = wire.NewWriterTracer(os.Stderr)
+	}
+
+	server, err := adb.NewWithConfig(config)
 	if err != nil {
 		log.Fatal(err)
 	}
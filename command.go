@@ -0,0 +1,245 @@
+package adb
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+/*
+Command is a command line for the device's shell, built from a command name and arguments. Each
+argument is quoted so the command receives it exactly as given, whatever characters it contains,
+e.g.
+
+	adb.NewCommand("ls", "-l", "/sdcard/My Photos")
+
+runs `ls -l '/sdcard/My Photos'`.
+
+Pipelines and redirections are only added when explicitly requested with Pipe and the redirection
+methods, e.g.
+
+	adb.NewCommand("logcat", "-d").Pipe(adb.NewCommand("grep", "ActivityManager")).StdoutTo("/sdcard/log")
+
+runs `{ logcat -d | grep ActivityManager; } > /sdcard/log`.
+
+The methods that build a command modify it and return it, so calls can be chained. Commands
+passed to Pipe are copied, so changing them afterwards doesn't change the pipeline, and changing
+the pipeline doesn't change them.
+*/
+type Command struct {
+	// Either args or pipeline is set.
+	args     []string
+	pipeline []*Command
+
+	// Redirections, already quoted.
+	redirects []string
+}
+
+// NewCommand returns a Command that runs name with args.
+func NewCommand(name string, args ...string) *Command {
+	return &Command{args: append([]string{name}, args...)}
+}
+
+// Arg adds args to the command's arguments, or to the last command's if it's a pipeline, and
+// returns the command.
+func (c *Command) Arg(args ...string) *Command {
+	last := c
+	for len(last.pipeline) > 0 {
+		last = last.pipeline[len(last.pipeline)-1]
+	}
+	last.args = append(last.args, args...)
+	return c
+}
+
+// Args returns the command name, followed by its arguments. Returns nil if the command is a
+// pipeline.
+func (c *Command) Args() []string {
+	if len(c.pipeline) > 0 {
+		return nil
+	}
+	return append([]string(nil), c.args...)
+}
+
+// Pipe connects the command's stdout to a copy of next's stdin, and returns the command.
+func (c *Command) Pipe(next *Command) *Command {
+	if len(c.pipeline) == 0 || len(c.redirects) > 0 {
+		// The command becomes the first stage, keeping its redirections.
+		first := *c
+		*c = Command{pipeline: []*Command{&first}}
+	}
+	c.pipeline = append(c.pipeline, next.clone())
+	return c
+}
+
+// clone returns a copy of c that doesn't share anything with it.
+func (c *Command) clone() *Command {
+	if c == nil {
+		return nil
+	}
+	clone := &Command{
+		args:      append([]string(nil), c.args...),
+		redirects: append([]string(nil), c.redirects...),
+	}
+	for _, stage := range c.pipeline {
+		clone.pipeline = append(clone.pipeline, stage.clone())
+	}
+	return clone
+}
+
+// StdinFrom redirects the command's stdin from the file at path on the device, and returns the
+// command.
+func (c *Command) StdinFrom(path string) *Command {
+	return c.redirect("<", path)
+}
+
+// StdoutTo redirects the command's stdout to the file at path on the device, replacing its
+// contents, and returns the command.
+func (c *Command) StdoutTo(path string) *Command {
+	return c.redirect(">", path)
+}
+
+// AppendStdoutTo redirects the command's stdout to the end of the file at path on the device, and
+// returns the command.
+func (c *Command) AppendStdoutTo(path string) *Command {
+	return c.redirect(">>", path)
+}
+
+// StderrTo redirects the command's stderr to the file at path on the device, e.g. /dev/null, and
+// returns the command.
+func (c *Command) StderrTo(path string) *Command {
+	return c.redirect("2>", path)
+}
+
+// StderrToStdout redirects the command's stderr to wherever its stdout goes, and returns the
+// command. Redirections are applied in order, so to send both to a file, call StdoutTo first.
+func (c *Command) StderrToStdout() *Command {
+	c.redirects = append(c.redirects, "2>&1")
+	return c
+}
+
+func (c *Command) redirect(op string, path string) *Command {
+	c.redirects = append(c.redirects, op+" "+shellQuote(path))
+	return c
+}
+
+// String returns the command line. It may not be valid, see commandLine.
+func (c *Command) String() string {
+	var line string
+	if len(c.pipeline) > 0 {
+		stages := make([]string, len(c.pipeline))
+		for i, stage := range c.pipeline {
+			stages[i] = stage.String()
+		}
+		line = strings.Join(stages, " | ")
+		if len(c.redirects) > 0 {
+			// Group the pipeline so the redirections apply to all of it.
+			line = "{ " + line + "; }"
+		}
+	} else {
+		quoted := make([]string, len(c.args))
+		for i, arg := range c.args {
+			quoted[i] = shellQuote(arg)
+		}
+		if len(quoted) > 0 {
+			quoted[0] = shellQuoteCommandName(c.args[0])
+		}
+		line = strings.Join(quoted, " ")
+	}
+
+	if len(c.redirects) > 0 {
+		line += " " + strings.Join(c.redirects, " ")
+	}
+	return line
+}
+
+// commandLine returns the command line, or an error if any command is empty or an argument can't
+// be passed to the shell.
+func (c *Command) commandLine() (string, error) {
+	if err := c.validate(); err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+func (c *Command) validate() error {
+	if c == nil {
+		return errors.AssertionErrorf("command cannot be empty")
+	}
+	if len(c.pipeline) > 0 {
+		for _, stage := range c.pipeline {
+			if err := stage.validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(c.args) == 0 || isBlank(c.args[0]) {
+		return errors.AssertionErrorf("command cannot be empty")
+	}
+	return validateShellArgs(c.args)
+}
+
+// validateShellArgs returns an error if any of args can't be passed to a command.
+func validateShellArgs(args []string) error {
+	for i, arg := range args {
+		// Arguments are passed to programs as C strings, so they can't contain NUL.
+		if strings.ContainsRune(arg, 0) {
+			return errors.Errorf(errors.ParseError, "arg at index %d contains a NUL: %q", i, arg)
+		}
+	}
+	return nil
+}
+
+// shellSafeWordPattern matches words that no POSIX shell treats specially, so don't need quoting.
+var shellSafeWordPattern = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+/*
+shellQuote returns str as a single shell word that the shell passes to the command unchanged.
+Words that don't contain any characters the shell would interpret are returned as-is, and others
+are wrapped in single quotes, inside which the shell doesn't interpret anything. Each single
+quote in str ends the quoted string, is escaped with a backslash, and starts a new one. str must
+not contain NUL.
+*/
+func shellQuote(str string) string {
+	if shellSafeWordPattern.MatchString(str) {
+		return str
+	}
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
+
+// shellReservedWords are only special as the first word of a command.
+var shellReservedWords = map[string]bool{
+	"case": true, "do": true, "done": true, "elif": true, "else": true, "esac": true, "fi": true,
+	"for": true, "function": true, "if": true, "in": true, "select": true, "then": true,
+	"time": true, "until": true, "while": true,
+}
+
+// shellQuoteCommandName is like shellQuote, but also quotes words that are only special as the
+// first word of a command: reserved words, and variable assignments like FOO=bar.
+func shellQuoteCommandName(name string) string {
+	quoted := shellQuote(name)
+	if quoted == name && (shellReservedWords[name] || strings.ContainsRune(name, '=')) {
+		// Safe words don't contain any quotes.
+		return "'" + name + "'"
+	}
+	return quoted
+}
+
+// shellCommandLine returns cmdLine followed by args, each quoted with shellQuote. cmdLine is passed
+// to the shell as-is, so it can contain multiple words, pipes, etc.
+func shellCommandLine(cmdLine string, args ...string) (string, error) {
+	if isBlank(cmdLine) {
+		return "", errors.AssertionErrorf("command cannot be empty")
+	}
+	if err := validateShellArgs(args); err != nil {
+		return "", err
+	}
+
+	words := []string{cmdLine}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " "), nil
+}
@@ -0,0 +1,114 @@
+package adb
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandString(t *testing.T) {
+	cmd := NewCommand("echo", "hello world", `"quoted"`, "it's", "$HOME;`id`", "", "-n", "/a/b.txt").Arg("*", "a\nb")
+	assert.Equal(t, `echo 'hello world' '"quoted"' 'it'\''s' '$HOME;`+"`id`"+`' '' -n /a/b.txt '*' 'a`+"\n"+`b'`, cmd.String())
+	assert.Equal(t, []string{"echo", "hello world", `"quoted"`, "it's", "$HOME;`id`", "", "-n", "/a/b.txt", "*", "a\nb"}, cmd.Args())
+
+	cmdLine, err := cmd.commandLine()
+	assert.NoError(t, err)
+	assert.Equal(t, cmd.String(), cmdLine)
+
+	// Words that are only special as command names are quoted there.
+	assert.Equal(t, `'if' if`, NewCommand("if", "if").String())
+	assert.Equal(t, `'FOO=bar' FOO=bar`, NewCommand("FOO=bar", "FOO=bar").String())
+}
+
+func TestCommandPipelinesAndRedirections(t *testing.T) {
+	cmd := NewCommand("logcat", "-d").Pipe(NewCommand("grep", "a b")).Pipe(NewCommand("head")).Arg("-n", "5")
+	assert.Equal(t, `logcat -d | grep 'a b' | head -n 5`, cmd.String())
+	assert.Nil(t, cmd.Args())
+
+	cmd.StdoutTo("/sdcard/my log").StderrToStdout()
+	assert.Equal(t, `{ logcat -d | grep 'a b' | head -n 5; } > '/sdcard/my log' 2>&1`, cmd.String())
+	assert.Equal(t, `{ logcat -d | grep 'a b' | head -n 5; } > '/sdcard/my log' 2>&1 | wc -l`, cmd.Pipe(NewCommand("wc", "-l")).String())
+
+	// Piped commands are copied, so changing the pipeline doesn't change them, and vice versa.
+	grep := NewCommand("grep", "a")
+	cmd = NewCommand("logcat").Pipe(grep)
+	cmd.Arg("b")
+	grep.Arg("c")
+	assert.Equal(t, `logcat | grep a b`, cmd.String())
+	assert.Equal(t, `grep a c`, grep.String())
+
+	cmd = NewCommand("sort").StdinFrom("/data/in").AppendStdoutTo("/data/out").StderrTo("/dev/null")
+	assert.Equal(t, `sort < /data/in >> /data/out 2> /dev/null`, cmd.String())
+}
+
+func TestCommandInvalid(t *testing.T) {
+	_, err := NewCommand(" ").commandLine()
+	assert.True(t, HasErrCode(err, AssertionError))
+	_, err = (*Command)(nil).commandLine()
+	assert.True(t, HasErrCode(err, AssertionError))
+	_, err = NewCommand("echo", "a\x00b").commandLine()
+	assert.True(t, HasErrCode(err, ParseError))
+	_, err = NewCommand("echo").Pipe(NewCommand("")).commandLine()
+	assert.True(t, HasErrCode(err, AssertionError))
+}
+
+// runLocalShell runs cmdLine with the local POSIX shell, and returns its output. Skips the test if
+// there isn't one.
+func runLocalShell(t *testing.T, cmdLine string) string {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	output, err := exec.Command(sh, "-c", cmdLine).Output()
+	require.NoError(t, err, cmdLine)
+	return string(output)
+}
+
+var shellQuoteSeeds = []string{
+	"", "hello", "hello world", "it's", `"quoted"`, "$HOME", "${HOME}", "`id`", "$(id)", "a;b",
+	"a|b", "a&b", "a>b", "a<b", "*", "?", "[a]", "~", "~root", "a\nb", "a\tb", "\\", "'", "''",
+	"!", "#comment", "-n", "--", "{a,b}", "a=b", "\r\n", "\xff\xfe", "日本語", "'\"'\"'",
+}
+
+// FuzzShellQuote checks that the shell passes quoted arguments to commands unchanged.
+func FuzzShellQuote(f *testing.F) {
+	for _, seed := range shellQuoteSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, arg string) {
+		if strings.ContainsRune(arg, 0) {
+			t.Skip("args can't contain NUL")
+		}
+		assert.Equal(t, arg, runLocalShell(t, "printf '%s' "+shellQuote(arg)))
+	})
+}
+
+// FuzzCommand checks that commands receive all their arguments unchanged, and that command names
+// aren't interpreted by the shell.
+func FuzzCommand(f *testing.F) {
+	for i, seed := range shellQuoteSeeds {
+		f.Add(seed, shellQuoteSeeds[(i+1)%len(shellQuoteSeeds)])
+	}
+	f.Fuzz(func(t *testing.T, arg1, arg2 string) {
+		if strings.ContainsRune(arg1+arg2, 0) {
+			t.Skip("args can't contain NUL")
+		}
+		cmdLine, err := NewCommand("printf", `%s\0`, arg1, arg2).commandLine()
+		require.NoError(t, err)
+		assert.Equal(t, arg1+"\x00"+arg2+"\x00", runLocalShell(t, cmdLine))
+
+		cmdLine, err = shellCommandLine("printf '%s\\0'", arg1, arg2)
+		require.NoError(t, err)
+		assert.Equal(t, arg1+"\x00"+arg2+"\x00", runLocalShell(t, cmdLine))
+
+		// A command name that doesn't exist is never run as anything else.
+		if arg1 != "" && !strings.ContainsRune(arg1, '/') {
+			cmdLine, err = NewCommand("no-such-command-" + arg1).Pipe(NewCommand("cat")).commandLine()
+			require.NoError(t, err)
+			assert.Equal(t, "", runLocalShell(t, cmdLine+" 2>/dev/null; true"))
+		}
+	})
+}
@@ -1,9 +1,11 @@
 package adb
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,10 +23,65 @@ type Device struct {
 	server     server
 	descriptor DeviceDescriptor
 
+	// Set if connections are pooled. See ServerConfig.Pool.
+	pool pooledServer
+
+	// If set, limits the operations using the device at once. See ServerConfig.MaxConcurrentPerDevice.
+	limiter *deviceLimiter
+	ctx     context.Context
+
+	// If set, operations that are safe to repeat are retried. If idempotent is true, all
+	// operations are assumed to be safe to repeat.
+	retry      *RetryPolicy
+	idempotent bool
+
+	features *featureCache
+
 	// Used to get device info.
 	deviceListFunc func() ([]*DeviceInfo, error)
 }
 
+/*
+WithContext returns a copy of the device whose operations stop waiting to use the device when ctx
+is done. Operations only wait if ServerConfig.MaxConcurrentPerDevice or
+ServerConfig.Pool.MaxConnsPerDevice is set, and ctx doesn't affect operations once they've started.
+*/
+func (c *Device) WithContext(ctx context.Context) *Device {
+	if ctx == nil {
+		panic("nil context")
+	}
+	device := *c
+	device.ctx = ctx
+	return &device
+}
+
+// WithRetry returns a copy of the device that retries operations according to policy, instead of
+// ServerConfig.Retry.
+func (c *Device) WithRetry(policy RetryPolicy) *Device {
+	device := *c
+	device.retry = &policy
+	return &device
+}
+
+/*
+Idempotent returns a copy of the device whose operations are all retried according to its
+RetryPolicy, including those that aren't always safe to repeat, e.g. read-only commands:
+
+	props, err := device.Idempotent().RunCommand("getprop")
+*/
+func (c *Device) Idempotent() *Device {
+	device := *c
+	device.idempotent = true
+	return &device
+}
+
+func (c *Device) context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
 func (c *Device) String() string {
 	return c.descriptor.String()
 }
@@ -46,10 +103,31 @@ func (c *Device) DevicePath() (string, error) {
 	return attr, wrapClientError(err, c, "DevicePath")
 }
 
+/*
+Features returns the features supported by the device. They're cached for devices selected by
+serial until the device disconnects.
+
+Corresponds to the command:
+	adb features
+*/
+func (c *Device) Features() (FeatureSet, error) {
+	if features, ok := c.features.get(c.descriptor); ok {
+		return features, nil
+	}
+
+	attr, err := c.getAttribute("features")
+	if err != nil {
+		return nil, wrapClientError(err, c, "Features")
+	}
+	features := parseFeatures(attr)
+	c.features.put(c.descriptor, features)
+	return features, nil
+}
+
 func (c *Device) State() (DeviceState, error) {
 	attr, err := c.getAttribute("get-state")
 	if err != nil {
-		if strings.Contains(err.Error(), "unauthorized") {
+		if HasErrCode(err, DeviceUnauthorized) {
 			return StateUnauthorized, nil
 		}
 		return StateInvalid, wrapClientError(err, c, "State")
@@ -73,6 +151,10 @@ func (c *Device) DeviceInfo() (*DeviceInfo, error) {
 	}
 
 	for _, deviceInfo := range devices {
+		// Serials aren't unique, so match the transport ID if the device was selected by one.
+		if c.descriptor.descriptorType == DeviceTransportID && deviceInfo.TransportID != c.descriptor.transportID {
+			continue
+		}
 		if deviceInfo.Serial == serial {
 			return deviceInfo, nil
 		}
@@ -95,35 +177,109 @@ From the Android docs:
 	Note that this is the non-interactive version of "adb shell"
 Source: https://android.googlesource.com/platform/system/core/+/master/adb/SERVICES.TXT
 
-This method quotes the arguments for you, and will return an error if any of them
-contain double quotes.
+This method quotes the arguments for you, so they're passed to the command exactly as given,
+whatever characters they contain. cmd is passed to the shell as-is, so it can be a whole command
+line, but mustn't include untrusted input. To build command lines from arbitrary strings, use
+NewCommand and Run.
 */
 func (c *Device) RunCommand(cmd string, args ...string) (string, error) {
-	cmd, err := prepareCommandLine(cmd, args...)
+	cmd, err := shellCommandLine(cmd, args...)
 	if err != nil {
 		return "", wrapClientError(err, c, "RunCommand")
 	}
 
-	conn, err := c.dialDevice()
+	var resp string
+	err = c.retry.do(c.context(), c.idempotent, func() (err error) {
+		resp, err = c.runShell(cmd)
+		return err
+	})
+	return resp, wrapClientError(err, c, "RunCommand")
+}
+
+// Run runs cmd on a shell on the device like RunCommand, and returns its output.
+func (c *Device) Run(cmd *Command) (string, error) {
+	cmdLine, err := cmd.commandLine()
 	if err != nil {
-		return "", wrapClientError(err, c, "RunCommand")
+		return "", wrapClientError(err, c, "Run")
 	}
-	defer conn.Close()
 
-	req := fmt.Sprintf("shell:%s", cmd)
+	var resp string
+	err = c.retry.do(c.context(), c.idempotent, func() (err error) {
+		resp, err = c.runShell(cmdLine)
+		return err
+	})
+	return resp, wrapClientError(err, c, "Run(%s)", cmdLine)
+}
+
+// runShell runs cmdLine, which must already be quoted, in a shell on the device and returns
+// its output.
+func (c *Device) runShell(cmdLine string) (string, error) {
+	return c.runShellContext(context.Background(), cmdLine)
+}
 
+// runShellContext runs cmdLine like runShell, but if ctx is done before the command finishes, the
+// connection is closed and an error wrapping ctx.Err() is returned.
+func (c *Device) runShellContext(ctx context.Context, cmdLine string) (string, error) {
 	// Shell responses are special, they don't include a length header.
 	// We read until the stream is closed.
 	// So, we can't use conn.RoundTripSingleResponse.
-	if err = conn.SendMessage([]byte(req)); err != nil {
-		return "", wrapClientError(err, c, "RunCommand")
+	conn, err := c.openService(fmt.Sprintf("shell:%s", cmdLine))
+	if err != nil {
+		return "", err
 	}
-	if _, err = conn.ReadStatus(req); err != nil {
-		return "", wrapClientError(err, c, "RunCommand")
+	defer conn.Close()
+
+	if ctx.Done() != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-finished:
+			}
+		}()
 	}
 
 	resp, err := conn.ReadUntilEof()
-	return string(resp), wrapClientError(err, c, "RunCommand")
+	if ctx.Err() != nil {
+		return "", errors.WrapErrorf(ctx.Err(), errors.Canceled, "error running %s", cmdLine)
+	}
+	return string(resp), err
+}
+
+// openExec runs cmdLine, which must already be quoted, with the exec service and returns a
+// reader for its output. Unlike the shell service, exec never allocates a PTY, so the output is
+// passed through unmodified.
+func (c *Device) openExec(cmdLine string) (io.ReadCloser, error) {
+	conn, err := c.openService(fmt.Sprintf("exec:%s", cmdLine))
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+/*
+runShellCheckingExit runs cmdLine like runShell, but also returns its exit status.
+The shell service doesn't report exit statuses, so the status is echoed after the command's
+output and parsed back out.
+*/
+func (c *Device) runShellCheckingExit(cmdLine string) (output string, exitCode int, err error) {
+	resp, err := c.runShell(fmt.Sprintf("{ %s; } 2>&1; echo \":$?\"", cmdLine))
+	if err != nil {
+		return "", 0, err
+	}
+
+	resp = strings.TrimRight(resp, "\r\n")
+	i := strings.LastIndex(resp, ":")
+	if i < 0 {
+		return "", 0, errors.Errorf(errors.ParseError, "exit status missing from command output: %q", resp)
+	}
+	exitCode, parseErr := strconv.Atoi(resp[i+1:])
+	if parseErr != nil {
+		return "", 0, errors.WrapErrorf(parseErr, errors.ParseError, "invalid exit status in command output: %q", resp)
+	}
+	return resp[:i], exitCode, nil
 }
 
 /*
@@ -136,131 +292,275 @@ Remount, from the official adb command’s docs:
 Source: https://android.googlesource.com/platform/system/core/+/master/adb/SERVICES.TXT
 */
 func (c *Device) Remount() (string, error) {
-	conn, err := c.dialDevice()
+	conn, err := c.openService("remount")
 	if err != nil {
 		return "", wrapClientError(err, c, "Remount")
 	}
 	defer conn.Close()
 
-	resp, err := conn.RoundTripSingleResponse([]byte("remount"))
+	resp, err := conn.ReadMessage()
 	return string(resp), wrapClientError(err, c, "Remount")
 }
 
 func (c *Device) ListDirEntries(path string) (*DirEntries, error) {
+	var entries *DirEntries
+	err := c.retry.do(c.context(), true, func() (err error) {
+		entries, err = c.listDirEntries(path)
+		return err
+	})
+	return entries, wrapClientError(err, c, "ListDirEntries(%s)", path)
+}
+
+func (c *Device) listDirEntries(path string) (*DirEntries, error) {
 	conn, err := c.getSyncConn()
 	if err != nil {
-		return nil, wrapClientError(err, c, "ListDirEntries(%s)", path)
+		return nil, err
 	}
 
-	entries, err := listDirEntries(conn, path)
-	return entries, wrapClientError(err, c, "ListDirEntries(%s)", path)
+	if c.pool != nil {
+		// Return the connection to the pool once the listing has been read.
+		if err := sendSyncRequest(conn, "LIST", path); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		scanner := &pooledListScanner{SyncConn: conn, pool: c.pool, descriptor: c.descriptor}
+		return &DirEntries{scanner: scanner}, nil
+	}
+	return listDirEntries(conn, path)
 }
 
 func (c *Device) Stat(path string) (*DirEntry, error) {
+	var entry *DirEntry
+	err := c.retry.do(c.context(), true, func() (err error) {
+		entry, err = c.stat(path)
+		return err
+	})
+	return entry, wrapClientError(err, c, "Stat(%s)", path)
+}
+
+func (c *Device) stat(path string) (*DirEntry, error) {
 	conn, err := c.getSyncConn()
 	if err != nil {
-		return nil, wrapClientError(err, c, "Stat(%s)", path)
+		return nil, err
 	}
-	defer conn.Close()
 
 	entry, err := stat(conn, path)
-	return entry, wrapClientError(err, c, "Stat(%s)", path)
+	c.finishSyncRequest(conn, err)
+	return entry, err
 }
 
-func (c *Device) OpenRead(path string) (io.ReadCloser, error) {
+/*
+fileSize returns the size of the file at path. STAT only reports the lower 32 bits of sizes, so
+if the device supports it the size is read with STA2 instead, and otherwise by running stat.
+*/
+func (c *Device) fileSize(path string) (int64, error) {
+	if !c.supports(FeatureStat2) {
+		return c.fileSizeFromShell(path)
+	}
+
+	var size int64
+	err := c.retry.do(c.context(), true, func() error {
+		conn, err := c.getSyncConn()
+		if err != nil {
+			return err
+		}
+		size, err = stat2Size(conn, path)
+		c.finishSyncRequest(conn, err)
+		return err
+	})
+	return size, err
+}
+
+func (c *Device) fileSizeFromShell(path string) (int64, error) {
+	cmdLine, err := NewCommand("stat", "-c", "%s", "--", path).commandLine()
+	if err != nil {
+		return 0, err
+	}
+	output, exitCode, err := c.runShellCheckingExit(cmdLine)
+	if err != nil {
+		return 0, err
+	}
+	if exitCode != 0 {
+		return 0, fileCommandError(path, exitCode, output)
+	}
+
+	size, parseErr := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if parseErr != nil {
+		return 0, errors.WrapErrorf(parseErr, errors.ParseError, "invalid size of %s from stat: %q", path, output)
+	}
+	return size, nil
+}
+
+// finishSyncRequest returns conn to the pool after a request that returned err, unless err may
+// have left the connection unusable, in which case it's closed.
+func (c *Device) finishSyncRequest(conn *wire.SyncConn, err error) {
+	if c.pool != nil && (err == nil || HasErrCode(err, FileNoExistError)) {
+		// Missing files don't affect the connection.
+		c.pool.putSyncConn(c.descriptor, releaseSlot(conn))
+	} else {
+		conn.Close()
+	}
+}
+
+// OpenRead opens the file at path on the device for reading.
+func (c *Device) OpenRead(path string, opts ...TransferOption) (FileReader, error) {
 	conn, err := c.getSyncConn()
 	if err != nil {
 		return nil, wrapClientError(err, c, "OpenRead(%s)", path)
 	}
 
-	reader, err := receiveFile(conn, path)
+	reader, err := receiveFile(conn, path, opts...)
 	return reader, wrapClientError(err, c, "OpenRead(%s)", path)
 }
 
 // OpenWrite opens the file at path on the device, creating it with the permissions specified
 // by perms if necessary, and returns a writer that writes to the file.
-// The files modification time will be set to mtime when the WriterCloser is closed. The zero value
+// The files modification time will be set to mtime when the FileWriter is closed. The zero value
 // is TimeOfClose, which will use the time the Close method is called as the modification time.
-func (c *Device) OpenWrite(path string, perms os.FileMode, mtime time.Time) (io.WriteCloser, error) {
+// Writes are buffered, see FileWriter.
+func (c *Device) OpenWrite(path string, perms os.FileMode, mtime time.Time, opts ...TransferOption) (FileWriter, error) {
 	conn, err := c.getSyncConn()
 	if err != nil {
 		return nil, wrapClientError(err, c, "OpenWrite(%s)", path)
 	}
 
-	writer, err := sendFile(conn, path, perms, mtime)
+	writer, err := sendFile(conn, path, perms, mtime, opts...)
 	return writer, wrapClientError(err, c, "OpenWrite(%s)", path)
 }
 
 // getAttribute returns the first message returned by the server by running
 // <host-prefix>:<attr>, where host-prefix is determined from the DeviceDescriptor.
 func (c *Device) getAttribute(attr string) (string, error) {
-	resp, err := roundTripSingleResponse(c.server,
-		fmt.Sprintf("%s:%s", c.descriptor.getHostPrefix(), attr))
+	var resp []byte
+	err := c.retry.do(c.context(), true, func() (err error) {
+		resp, err = roundTripSingleResponse(c.server,
+			fmt.Sprintf("%s:%s", c.descriptor.getHostPrefix(), attr))
+		return err
+	})
 	if err != nil {
+		c.checkDisconnected(err)
 		return "", err
 	}
 	return string(resp), nil
 }
 
 func (c *Device) getSyncConn() (*wire.SyncConn, error) {
-	conn, err := c.dialDevice()
+	release, err := c.acquire()
 	if err != nil {
 		return nil, err
 	}
 
+	if c.pool != nil {
+		if conn := c.pool.takeSyncConn(c.descriptor); conn != nil {
+			return c.syncWithRelease(conn, release), nil
+		}
+	}
+
 	// Switch the connection to sync mode.
-	if err := wire.SendMessageString(conn, "sync:"); err != nil {
+	conn, err := c.requestService("sync:")
+	if err != nil {
+		release()
 		return nil, err
 	}
-	if _, err := conn.ReadStatus("sync"); err != nil {
+	return c.syncWithRelease(conn.NewSyncConn(), release), nil
+}
+
+// openService waits to use the device, then dials it and requests service, and returns the
+// connection to the service.
+func (c *Device) openService(service string) (*wire.Conn, error) {
+	release, err := c.acquire()
+	if err != nil {
 		return nil, err
 	}
 
-	return conn.NewSyncConn(), nil
-}
-
-// dialDevice switches the connection to communicate directly with the device
-// by requesting the transport defined by the DeviceDescriptor.
-func (c *Device) dialDevice() (*wire.Conn, error) {
-	conn, err := c.server.Dial()
+	conn, err := c.requestService(service)
 	if err != nil {
+		release()
 		return nil, err
 	}
+	if c.limiter == nil {
+		return conn, nil
+	}
+	return withRelease(conn, release), nil
+}
 
-	req := fmt.Sprintf("host:%s", c.descriptor.getTransportDescriptor())
-	if err = wire.SendMessageString(conn, req); err != nil {
-		conn.Close()
-		return nil, errors.WrapErrf(err, "error connecting to device '%s'", c.descriptor)
+func (c *Device) syncWithRelease(conn *wire.SyncConn, release func()) *wire.SyncConn {
+	if c.limiter == nil {
+		return conn
 	}
+	return syncWithRelease(conn, release)
+}
 
-	if _, err = conn.ReadStatus(req); err != nil {
-		conn.Close()
+// acquire waits until the device can be used, if operations on it are limited, and returns a func
+// that must be called once the operation is done with the device.
+func (c *Device) acquire() (func(), error) {
+	if c.limiter == nil {
+		return func() {}, nil
+	}
+	return c.limiter.acquire(c.context(), c.descriptor)
+}
+
+/*
+requestService dials the device and requests service, and returns the connection to the service.
+
+If the connection was idle in the pool, it may have been closed by the server since it was
+dialed, so if the request fails with a network error, it's retried once on a newly-dialed
+connection.
+*/
+func (c *Device) requestService(service string) (*wire.Conn, error) {
+	conn, idle, err := c.dialDevice(true)
+	if err != nil {
+		return nil, err
+	}
+	err = sendServiceRequest(conn, service)
+	if err == nil {
+		return conn, nil
+	}
+	if !idle || !(HasErrCode(err, NetworkError) || HasErrCode(err, ConnectionResetError)) {
 		return nil, err
 	}
 
+	c.pool.discard()
+	conn, _, err = c.dialDevice(false)
+	if err != nil {
+		return nil, err
+	}
+	if err = sendServiceRequest(conn, service); err != nil {
+		return nil, err
+	}
 	return conn, nil
 }
 
-// prepareCommandLine validates the command and argument strings, quotes
-// arguments if required, and joins them into a valid adb command string.
-func prepareCommandLine(cmd string, args ...string) (string, error) {
-	if isBlank(cmd) {
-		return "", errors.AssertionErrorf("command cannot be empty")
+// sendServiceRequest requests service on conn, which must be switched to the device's transport.
+// If the request fails, conn is closed.
+func sendServiceRequest(conn *wire.Conn, service string) error {
+	err := wire.SendMessageString(conn, service)
+	if err == nil {
+		_, err = conn.ReadStatus(service)
 	}
-
-	for i, arg := range args {
-		if strings.ContainsRune(arg, '"') {
-			return "", errors.Errorf(errors.ParseError, "arg at index %d contains an invalid double quote: %s", i, arg)
-		}
-		if containsWhitespace(arg) {
-			args[i] = fmt.Sprintf("\"%s\"", arg)
-		}
+	if err != nil {
+		conn.Close()
 	}
+	return err
+}
 
-	// Prepend the command to the args array.
-	if len(args) > 0 {
-		cmd = fmt.Sprintf("%s %s", cmd, strings.Join(args, " "))
+// dialDevice switches the connection to communicate directly with the device
+// by requesting the transport defined by the DeviceDescriptor. If connections are pooled, also
+// returns true if the connection was idle, which it can only be if reuseIdle is true.
+func (c *Device) dialDevice(reuseIdle bool) (conn *wire.Conn, idle bool, err error) {
+	if c.pool != nil {
+		conn, idle, err = c.pool.dialDevice(c.context(), c.descriptor, reuseIdle)
+	} else {
+		conn, err = dialTransport(c.server, c.descriptor)
 	}
+	c.checkDisconnected(err)
+	return conn, idle, err
+}
 
-	return cmd, nil
+// checkDisconnected forgets the device's cached features if err shows that it disconnected,
+// since it may support different features when it reconnects.
+func (c *Device) checkDisconnected(err error) {
+	if HasErrCode(err, DeviceNotFound) || HasErrCode(err, DeviceOffline) {
+		c.features.forget(c.descriptor)
+	}
 }
@@ -14,6 +14,8 @@ const (
 	DeviceUsb
 	// host:transport-local and host-local:<request>
 	DeviceLocal
+	// host:transport-id:<id> and host-transport-id:<id>:<request>
+	DeviceTransportID
 )
 
 type DeviceDescriptor struct {
@@ -21,6 +23,9 @@ type DeviceDescriptor struct {
 
 	// Only used if Type is DeviceSerial.
 	serial string
+
+	// Only used if Type is DeviceTransportID.
+	transportID int64
 }
 
 func AnyDevice() DeviceDescriptor {
@@ -42,9 +47,25 @@ func DeviceWithSerial(serial string) DeviceDescriptor {
 	}
 }
 
+/*
+DeviceWithTransportID selects the device whose connection to the server has transport ID id, as
+reported in DeviceInfo and DeviceStateChangedEvent. Unlike serials, transport IDs are unique, so
+this can select one of several devices with the same serial, e.g. a device connected via both USB
+and TCP. The ID changes when the device reconnects. Requires server version 1.0.41 or later.
+*/
+func DeviceWithTransportID(id int64) DeviceDescriptor {
+	return DeviceDescriptor{
+		descriptorType: DeviceTransportID,
+		transportID:    id,
+	}
+}
+
 func (d DeviceDescriptor) String() string {
-	if d.descriptorType == DeviceSerial {
+	switch d.descriptorType {
+	case DeviceSerial:
 		return fmt.Sprintf("%s[%s]", d.descriptorType, d.serial)
+	case DeviceTransportID:
+		return fmt.Sprintf("%s[%d]", d.descriptorType, d.transportID)
 	}
 	return d.descriptorType.String()
 }
@@ -59,6 +80,8 @@ func (d DeviceDescriptor) getHostPrefix() string {
 		return "host-local"
 	case DeviceSerial:
 		return fmt.Sprintf("host-serial:%s", d.serial)
+	case DeviceTransportID:
+		return fmt.Sprintf("host-transport-id:%d", d.transportID)
 	default:
 		panic(fmt.Sprintf("invalid DeviceDescriptorType: %v", d.descriptorType))
 	}
@@ -74,6 +97,8 @@ func (d DeviceDescriptor) getTransportDescriptor() string {
 		return "transport-local"
 	case DeviceSerial:
 		return fmt.Sprintf("transport:%s", d.serial)
+	case DeviceTransportID:
+		return fmt.Sprintf("transport-id:%d", d.transportID)
 	default:
 		panic(fmt.Sprintf("invalid DeviceDescriptorType: %v", d.descriptorType))
 	}
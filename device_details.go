@@ -0,0 +1,219 @@
+package adb
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+DeviceDetails describes a device's software and hardware, as reported by the device itself.
+Fields that the device doesn't report, e.g. because it's in recovery, are left empty.
+*/
+type DeviceDetails struct {
+	// From system properties.
+	Fingerprint  string // ro.build.fingerprint
+	Release      string // ro.build.version.release, e.g. "11"
+	SdkLevel     int    // ro.build.version.sdk, e.g. 30
+	Manufacturer string // ro.product.manufacturer
+	Model        string // ro.product.model
+	// The ABIs the device supports, most preferred first, e.g. arm64-v8a.
+	Abis []string
+
+	// From wm. Overridden values are used if set, e.g. with `wm size`.
+	ScreenWidth   int
+	ScreenHeight  int
+	ScreenDensity int
+
+	// nil if the device doesn't have a battery.
+	Battery *BatteryInfo
+	// The size of the data partition, where apps and their data are stored.
+	Storage *StorageInfo
+}
+
+// BatteryInfo is the state of a device's battery, from dumpsys battery.
+type BatteryInfo struct {
+	// Charge level as a percentage.
+	Level    int
+	Charging bool
+	// True if the device is plugged in to AC, USB, or a wireless charger.
+	Powered bool
+	// In degrees Celsius.
+	Temperature float64
+}
+
+// StorageInfo is the size of a filesystem on a device, from df.
+type StorageInfo struct {
+	TotalBytes     int64
+	UsedBytes      int64
+	AvailableBytes int64
+}
+
+/*
+DeviceDetails reads the device's build, screen, battery, and storage details from its system
+properties and the wm, dumpsys, and df commands. Only returns an error if a command couldn't be
+run, not if its output couldn't be parsed.
+*/
+func (c *Device) DeviceDetails() (*DeviceDetails, error) {
+	props, err := c.properties()
+	if err != nil {
+		return nil, wrapClientError(err, c, "DeviceDetails(Properties)")
+	}
+	details := detailsFromProperties(props)
+
+	outputs := make(map[string]string)
+	for _, cmdLine := range []string{"wm size", "wm density", "dumpsys battery", "df -k /data"} {
+		outputs[cmdLine], err = c.runShellRetrying(cmdLine)
+		if err != nil {
+			return nil, wrapClientError(err, c, "DeviceDetails(%s)", cmdLine)
+		}
+	}
+
+	details.ScreenWidth, details.ScreenHeight = parseWmSize(outputs["wm size"])
+	details.ScreenDensity = parseWmDensity(outputs["wm density"])
+	details.Battery = parseBattery(outputs["dumpsys battery"])
+	details.Storage = parseDf(outputs["df -k /data"])
+	return details, nil
+}
+
+// runShellRetrying runs cmdLine like runShell, retrying it according to the device's
+// RetryPolicy. cmdLine must be safe to repeat.
+func (c *Device) runShellRetrying(cmdLine string) (string, error) {
+	var output string
+	err := c.retry.do(c.context(), true, func() (err error) {
+		output, err = c.runShell(cmdLine)
+		return err
+	})
+	return output, err
+}
+
+func detailsFromProperties(props map[string]string) *DeviceDetails {
+	details := &DeviceDetails{
+		Fingerprint:  props["ro.build.fingerprint"],
+		Release:      props["ro.build.version.release"],
+		Manufacturer: props["ro.product.manufacturer"],
+		Model:        props["ro.product.model"],
+	}
+	details.SdkLevel, _ = strconv.Atoi(props["ro.build.version.sdk"])
+
+	if abis := props["ro.product.cpu.abilist"]; abis != "" {
+		details.Abis = strings.Split(abis, ",")
+	} else {
+		// Devices older than Android 5.0 have at most two ABIs.
+		for _, prop := range []string{"ro.product.cpu.abi", "ro.product.cpu.abi2"} {
+			if abi := props[prop]; abi != "" {
+				details.Abis = append(details.Abis, abi)
+			}
+		}
+	}
+	return details
+}
+
+var (
+	wmSizePattern    = regexp.MustCompile(`(?m)^(Physical|Override) size: (\d+)x(\d+)`)
+	wmDensityPattern = regexp.MustCompile(`(?m)^(Physical|Override) density: (\d+)`)
+)
+
+// parseWmSize parses the output of `wm size`, e.g.
+//
+//	Physical size: 1080x1920
+//	Override size: 720x1280
+func parseWmSize(output string) (width, height int) {
+	for _, match := range wmSizePattern.FindAllStringSubmatch(output, -1) {
+		if match[1] == "Override" || width == 0 {
+			width, _ = strconv.Atoi(match[2])
+			height, _ = strconv.Atoi(match[3])
+		}
+	}
+	return
+}
+
+// parseWmDensity parses the output of `wm density`, which is like that of `wm size`.
+func parseWmDensity(output string) (density int) {
+	for _, match := range wmDensityPattern.FindAllStringSubmatch(output, -1) {
+		if match[1] == "Override" || density == 0 {
+			density, _ = strconv.Atoi(match[2])
+		}
+	}
+	return
+}
+
+/*
+parseBattery parses the output of `dumpsys battery`, e.g.
+
+	Current Battery Service state:
+	  AC powered: false
+	  USB powered: true
+	  Wireless powered: false
+	  status: 2
+	  present: true
+	  level: 85
+	  scale: 100
+	  temperature: 250
+
+Returns nil if the device doesn't have a battery, or the output can't be parsed.
+*/
+func parseBattery(output string) *BatteryInfo {
+	attrs := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if key, val, ok := parseKeyVal(strings.TrimSpace(line)); ok {
+			attrs[key] = strings.TrimSpace(val)
+		}
+	}
+
+	level, err := strconv.Atoi(attrs["level"])
+	if err != nil || attrs["present"] == "false" {
+		return nil
+	}
+	if scale, err := strconv.Atoi(attrs["scale"]); err == nil && scale > 0 {
+		level = level * 100 / scale
+	}
+
+	// Status values are defined by android.os.BatteryManager.
+	const batteryStatusCharging = "2"
+	battery := &BatteryInfo{
+		Level:    level,
+		Charging: attrs["status"] == batteryStatusCharging,
+		Powered:  attrs["AC powered"] == "true" || attrs["USB powered"] == "true" || attrs["Wireless powered"] == "true",
+	}
+	// Reported in tenths of a degree.
+	if temp, err := strconv.Atoi(attrs["temperature"]); err == nil {
+		battery.Temperature = float64(temp) / 10
+	}
+	return battery
+}
+
+/*
+parseDf parses the output of `df -k <path>`, e.g.
+
+	Filesystem     1K-blocks    Used Available Use% Mounted on
+	/dev/block/dm-5 115249236 8539836 106578616   8% /data
+
+Long filesystem names may be on a line by themselves. Returns nil if the output can't be parsed,
+e.g. because the device's df doesn't support -k.
+*/
+func parseDf(output string) *StorageInfo {
+	lines := strings.SplitN(strings.TrimSpace(output), "\n", 2)
+	if len(lines) != 2 {
+		return nil
+	}
+
+	// The last fields are 1K-blocks, Used, Available, Use%, and Mounted on.
+	fields := strings.Fields(lines[1])
+	if len(fields) < 5 {
+		return nil
+	}
+	var sizes [3]int64
+	for i := range sizes {
+		kb, err := strconv.ParseInt(fields[len(fields)-5+i], 10, 64)
+		if err != nil {
+			return nil
+		}
+		sizes[i] = kb * 1024
+	}
+	return &StorageInfo{
+		TotalBytes:     sizes[0],
+		UsedBytes:      sizes[1],
+		AvailableBytes: sizes[2],
+	}
+}
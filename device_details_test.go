@@ -0,0 +1,125 @@
+package adb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/adbtest"
+)
+
+const testDumpsysBattery = `Current Battery Service state:
+  AC powered: false
+  USB powered: true
+  Wireless powered: false
+  Max charging current: 500000
+  status: 2
+  health: 2
+  present: true
+  level: 85
+  scale: 100
+  voltage: 4200
+  temperature: 253
+  technology: Li-ion
+`
+
+const testDf = `Filesystem                                           1K-blocks    Used Available Use% Mounted on
+/dev/block/platform/soc/1d84000.ufshc/by-name/userdata
+                                                     115249236 8539836 106578616   8% /data
+`
+
+func TestDeviceDetails(t *testing.T) {
+	server := adbtest.NewServer()
+	defer server.Close()
+	server.AddDevice("serial").HandleShell(func(cmd string) string {
+		switch cmd {
+		case "getprop":
+			return "[ro.build.fingerprint]: [google/sdk_gphone_x86/generic_x86:11/RSR1.201013.001/6903271:user/release-keys]\n" +
+				"[ro.build.version.release]: [11]\n" +
+				"[ro.build.version.sdk]: [30]\n" +
+				"[ro.product.manufacturer]: [Google]\n" +
+				"[ro.product.model]: [sdk_gphone_x86]\n" +
+				"[ro.product.cpu.abilist]: [x86,armeabi-v7a,armeabi]\n"
+		case "wm size":
+			return "Physical size: 1080x1920\n"
+		case "wm density":
+			return "Physical density: 420\nOverride density: 320\n"
+		case "dumpsys battery":
+			return testDumpsysBattery
+		case "df -k /data":
+			return testDf
+		}
+		return "/system/bin/sh: " + cmd + ": not found\n"
+	})
+
+	client, err := NewWithConfig(ServerConfig{Dialer: server, NoStartServer: true})
+	require.NoError(t, err)
+
+	details, err := client.Device(DeviceWithSerial("serial")).DeviceDetails()
+	assert.NoError(t, err)
+	assert.Equal(t, &DeviceDetails{
+		Fingerprint:   "google/sdk_gphone_x86/generic_x86:11/RSR1.201013.001/6903271:user/release-keys",
+		Release:       "11",
+		SdkLevel:      30,
+		Manufacturer:  "Google",
+		Model:         "sdk_gphone_x86",
+		Abis:          []string{"x86", "armeabi-v7a", "armeabi"},
+		ScreenWidth:   1080,
+		ScreenHeight:  1920,
+		ScreenDensity: 320,
+		Battery: &BatteryInfo{
+			Level:       85,
+			Charging:    true,
+			Powered:     true,
+			Temperature: 25.3,
+		},
+		Storage: &StorageInfo{
+			TotalBytes:     115249236 * 1024,
+			UsedBytes:      8539836 * 1024,
+			AvailableBytes: 106578616 * 1024,
+		},
+	}, details)
+}
+
+func TestDeviceDetailsInRecovery(t *testing.T) {
+	server := adbtest.NewServer()
+	defer server.Close()
+	server.AddDevice("serial").HandleShell(func(cmd string) string {
+		if cmd == "getprop" {
+			return "[ro.build.version.sdk]: [19]\n[ro.product.cpu.abi]: [armeabi-v7a]\n[ro.product.cpu.abi2]: [armeabi]\n"
+		}
+		return "/system/bin/sh: " + cmd + ": not found\n"
+	})
+
+	client, err := NewWithConfig(ServerConfig{Dialer: server, NoStartServer: true})
+	require.NoError(t, err)
+
+	details, err := client.Device(DeviceWithSerial("serial")).DeviceDetails()
+	assert.NoError(t, err)
+	assert.Equal(t, &DeviceDetails{
+		SdkLevel: 19,
+		Abis:     []string{"armeabi-v7a", "armeabi"},
+	}, details)
+}
+
+func TestParseWmSize(t *testing.T) {
+	width, height := parseWmSize("Physical size: 1440x2960\r\nOverride size: 720x1480\r\n")
+	assert.Equal(t, 720, width)
+	assert.Equal(t, 1480, height)
+
+	width, height = parseWmSize("Error: Could not access the Window Manager\n")
+	assert.Equal(t, 0, width)
+	assert.Equal(t, 0, height)
+}
+
+func TestParseBatteryNotPresent(t *testing.T) {
+	assert.Nil(t, parseBattery("Current Battery Service state:\n  present: false\n  level: 0\n"))
+	assert.Equal(t, &BatteryInfo{Level: 50}, parseBattery("  level: 5\n  scale: 10\n"))
+}
+
+func TestParseDf(t *testing.T) {
+	assert.Equal(t, &StorageInfo{TotalBytes: 4096, UsedBytes: 1024, AvailableBytes: 3072},
+		parseDf("Filesystem 1K-blocks Used Available Use% Mounted on\r\n/dev/block/dm-5 4 1 3 25% /data\r\n"))
+	assert.Nil(t, parseDf("Filesystem Size Used Free Blksize\n/data 12G 3G 9G 4096\n"))
+	assert.Nil(t, parseDf(""))
+}
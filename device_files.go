@@ -0,0 +1,135 @@
+package adb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+/*
+The sync protocol can only read, write, stat, and list files, so the rest of the file
+operations are implemented by running commands in a shell on the device. All paths are quoted,
+so they may contain any characters.
+
+Errors reported by the commands are mapped to FileNoExistError, FilePermissionDeniedError,
+DirNotEmptyError, and FileExistsError where possible, and AdbError otherwise.
+*/
+
+// Mkdir creates a directory at path with the permissions perms. The parent directory must exist.
+func (c *Device) Mkdir(path string, perms os.FileMode) error {
+	err := c.runFileCommand(path, NewCommand("mkdir", "-m", formatPerms(perms), "--", path))
+	return wrapClientError(err, c, "Mkdir(%s)", path)
+}
+
+// MkdirAll creates a directory at path with the permissions perms, along with any missing
+// parents. Returns nil if path is already a directory.
+func (c *Device) MkdirAll(path string, perms os.FileMode) error {
+	err := c.runFileCommand(path, NewCommand("mkdir", "-p", "-m", formatPerms(perms), "--", path))
+	return wrapClientError(err, c, "MkdirAll(%s)", path)
+}
+
+// Remove removes the file or empty directory at path.
+func (c *Device) Remove(path string) error {
+	// rm can't remove directories without -r, which would also remove non-empty ones, so pick
+	// the command in a script that gets the path as its first argument.
+	err := c.runFileCommand(path, NewCommand("sh", "-c", removeScript, "sh", path))
+	return wrapClientError(err, c, "Remove(%s)", path)
+}
+
+// RemoveAll removes path and everything it contains. Returns nil if path doesn't exist.
+func (c *Device) RemoveAll(path string) error {
+	err := c.runFileCommand(path, NewCommand("rm", "-rf", "--", path))
+	return wrapClientError(err, c, "RemoveAll(%s)", path)
+}
+
+// Rename moves oldpath to newpath, replacing newpath if it's an existing file.
+func (c *Device) Rename(oldpath, newpath string) error {
+	err := c.runFileCommand(oldpath, NewCommand("mv", "--", oldpath, newpath))
+	return wrapClientError(err, c, "Rename(%s, %s)", oldpath, newpath)
+}
+
+// Chmod sets the permission bits of the file at path to those of mode.
+func (c *Device) Chmod(path string, mode os.FileMode) error {
+	err := c.runFileCommand(path, NewCommand("chmod", formatPerms(mode), "--", path))
+	return wrapClientError(err, c, "Chmod(%s)", path)
+}
+
+// Symlink creates newname as a symbolic link to oldname.
+func (c *Device) Symlink(oldname, newname string) error {
+	err := c.runFileCommand(newname, NewCommand("ln", "-s", "--", oldname, newname))
+	return wrapClientError(err, c, "Symlink(%s, %s)", oldname, newname)
+}
+
+// Readlink returns the destination of the symbolic link at path.
+func (c *Device) Readlink(path string) (string, error) {
+	cmdLine, err := NewCommand("readlink", "--", path).commandLine()
+	if err != nil {
+		return "", wrapClientError(err, c, "Readlink(%s)", path)
+	}
+	output, exitCode, err := c.runShellCheckingExit(cmdLine)
+	if err == nil && exitCode != 0 {
+		// readlink doesn't print anything if path isn't a link.
+		if output == "" {
+			output = "Invalid argument"
+		}
+		err = fileCommandError(path, exitCode, output)
+	}
+	if err != nil {
+		return "", wrapClientError(err, c, "Readlink(%s)", path)
+	}
+	return strings.TrimRight(output, "\r\n"), nil
+}
+
+// removeScript removes the file or empty directory $1, without following symlinks to directories.
+const removeScript = `if [ -d "$1" ] && [ ! -L "$1" ]; then rmdir -- "$1"; else rm -- "$1"; fi`
+
+// runFileCommand runs cmd, and returns an error if it exits with a non-zero status.
+// path is used to describe the error.
+func (c *Device) runFileCommand(path string, cmd *Command) error {
+	cmdLine, err := cmd.commandLine()
+	if err != nil {
+		return err
+	}
+	output, exitCode, err := c.runShellCheckingExit(cmdLine)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fileCommandError(path, exitCode, output)
+	}
+	return nil
+}
+
+// fileCommandErrors maps the messages printed by failing commands to error codes.
+var fileCommandErrors = []struct {
+	Message string
+	Code    errors.ErrCode
+}{
+	{"No such file or directory", errors.FileNoExistError},
+	{"Permission denied", errors.FilePermissionDeniedError},
+	{"Operation not permitted", errors.FilePermissionDeniedError},
+	{"Directory not empty", errors.DirNotEmptyError},
+	{"File exists", errors.FileExistsError},
+}
+
+// fileCommandError returns an error describing the failure of a command run on path.
+func fileCommandError(path string, exitCode int, output string) error {
+	output = strings.TrimSpace(output)
+
+	code := errors.AdbError
+	for _, e := range fileCommandErrors {
+		if strings.Contains(output, e.Message) {
+			code = e.Code
+			break
+		}
+	}
+
+	return errors.Errorf(code, "command on %s failed with exit status %d: %s", path, exitCode, output)
+}
+
+// formatPerms formats the permission bits of mode in octal, as accepted by chmod and mkdir -m.
+func formatPerms(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", uint32(mode.Perm()))
+}
@@ -0,0 +1,115 @@
+package adb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+func newFileOpsTestDevice(output string) (*Device, *MockServer) {
+	s := &MockServer{
+		Status:   wire.StatusSuccess,
+		Messages: []string{output},
+	}
+	return (&Adb{server: s}).Device(AnyDevice()), s
+}
+
+func TestMkdir(t *testing.T) {
+	d, s := newFileOpsTestDevice(":0\n")
+
+	assert.NoError(t, d.Mkdir("/sdcard/new dir", 0755))
+	assert.Equal(t, `shell:{ mkdir -m 0755 -- '/sdcard/new dir'; } 2>&1; echo ":$?"`, s.Requests[1])
+}
+
+func TestRemoveQuotesPath(t *testing.T) {
+	d, s := newFileOpsTestDevice(":0\n")
+
+	assert.NoError(t, d.Remove("/sdcard/it's $HOME"))
+	assert.Equal(t, `shell:{ sh -c 'if [ -d "$1" ] && [ ! -L "$1" ]; then rmdir -- "$1"; else rm -- "$1"; fi' `+
+		`sh '/sdcard/it'\''s $HOME'; } 2>&1; echo ":$?"`,
+		s.Requests[1])
+}
+
+func TestRemoveNoExist(t *testing.T) {
+	d, _ := newFileOpsTestDevice("rm: /sdcard/foo: No such file or directory\n:1\n")
+
+	err := d.Remove("/sdcard/foo")
+	assert.True(t, HasErrCode(err, FileNoExistError))
+}
+
+func TestRemoveNotEmpty(t *testing.T) {
+	d, _ := newFileOpsTestDevice("rmdir: '/sdcard/foo': Directory not empty\r\n:1\r\n")
+
+	err := d.Remove("/sdcard/foo")
+	assert.True(t, HasErrCode(err, DirNotEmptyError))
+}
+
+func TestChmodPermissionDenied(t *testing.T) {
+	d, s := newFileOpsTestDevice("chmod: /system/bin/sh: Operation not permitted\n:1\n")
+
+	err := d.Chmod("/system/bin/sh", 0777)
+	assert.Equal(t, `shell:{ chmod 0777 -- /system/bin/sh; } 2>&1; echo ":$?"`, s.Requests[1])
+	assert.True(t, HasErrCode(err, FilePermissionDeniedError))
+}
+
+func TestMkdirExists(t *testing.T) {
+	d, _ := newFileOpsTestDevice("mkdir: '/sdcard': File exists\n:1\n")
+
+	err := d.Mkdir("/sdcard", 0755)
+	assert.True(t, HasErrCode(err, FileExistsError))
+}
+
+func TestRenameUnknownError(t *testing.T) {
+	d, s := newFileOpsTestDevice("mv: bad things happened\n:2\n")
+
+	err := d.Rename("/a", "/b")
+	assert.Equal(t, `shell:{ mv -- /a /b; } 2>&1; echo ":$?"`, s.Requests[1])
+	assert.True(t, HasErrCode(err, AdbError))
+}
+
+func TestReadlink(t *testing.T) {
+	d, s := newFileOpsTestDevice("/storage/self/primary\n:0\n")
+
+	target, err := d.Readlink("/sdcard")
+	assert.NoError(t, err)
+	assert.Equal(t, "/storage/self/primary", target)
+	assert.Equal(t, `shell:{ readlink -- /sdcard; } 2>&1; echo ":$?"`, s.Requests[1])
+}
+
+func TestReadlinkNotLink(t *testing.T) {
+	d, _ := newFileOpsTestDevice(":1\n")
+
+	_, err := d.Readlink("/data")
+	assert.True(t, HasErrCode(err, AdbError))
+}
+
+func TestRunShellCheckingExitMissingStatus(t *testing.T) {
+	d, _ := newFileOpsTestDevice("no status here\n")
+
+	_, _, err := d.runShellCheckingExit("true")
+	assert.Equal(t, ParseError, ErrCode(code(err)))
+}
+
+func TestRemoveScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remove")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "it's a file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink(dir, link))
+
+	for _, path := range []string{file, link} {
+		runLocalShell(t, NewCommand("sh", "-c", removeScript, "sh", path).String())
+		_, err := os.Lstat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	runLocalShell(t, NewCommand("sh", "-c", removeScript, "sh", dir).String())
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -2,6 +2,9 @@ package adb
 
 import (
 	"bufio"
+	"net"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/zach-klippenstein/goadb/internal/errors"
@@ -10,6 +13,7 @@ import (
 type DeviceInfo struct {
 	// Always set.
 	Serial string
+	State  DeviceState
 
 	// Product, device, and model are not set in the short form.
 	Product    string
@@ -18,6 +22,13 @@ type DeviceInfo struct {
 
 	// Only set for devices connected via USB.
 	Usb string
+
+	// The ID the server assigned to the device's connection, which changes every time the device
+	// reconnects. Not set in the short form, or by servers older than 1.0.41.
+	TransportID int64
+
+	// How the device is connected, guessed from its serial and whether it has a USB port.
+	Connection ConnectionType
 }
 
 // IsUsb returns true if the device is connected via USB.
@@ -25,17 +36,64 @@ func (d *DeviceInfo) IsUsb() bool {
 	return d.Usb != ""
 }
 
-func newDevice(serial string, attrs map[string]string) (*DeviceInfo, error) {
+// ConnectionType is how a device is connected to the server.
+//
+//go:generate stringer -type=ConnectionType
+type ConnectionType int8
+
+const (
+	// The device may be connected via USB, but the short form of the device list doesn't say.
+	ConnectionUnknown ConnectionType = iota
+	ConnectionUsb
+	// Connected with adb connect, or discovered with mDNS.
+	ConnectionTcp
+	ConnectionEmulator
+)
+
+func connectionType(serial string, usb string) ConnectionType {
+	switch {
+	case usb != "":
+		return ConnectionUsb
+	case strings.HasPrefix(serial, "emulator-"):
+		return ConnectionEmulator
+	case strings.Contains(serial, "._adb-tls-connect._tcp"):
+		return ConnectionTcp
+	}
+	if _, port, err := net.SplitHostPort(serial); err == nil {
+		if _, err := strconv.Atoi(port); err == nil {
+			return ConnectionTcp
+		}
+	}
+	return ConnectionUnknown
+}
+
+func newDevice(serial string, state string, attrs map[string]string) (*DeviceInfo, error) {
 	if serial == "" {
 		return nil, errors.AssertionErrorf("device serial cannot be blank")
 	}
 
+	var transportID int64
+	if id, ok := attrs["transport_id"]; ok {
+		var err error
+		transportID, err = strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, errors.WrapErrorf(err, errors.ParseError, "invalid transport ID for device %s: %q", serial, id)
+		}
+	}
+
+	// Newer servers may report states we don't know about, which shouldn't stop the rest of the
+	// device list being read.
+	deviceState, _ := parseDeviceState(state)
+
 	return &DeviceInfo{
-		Serial:     serial,
-		Product:    attrs["product"],
-		Model:      attrs["model"],
-		DeviceInfo: attrs["device"],
-		Usb:        attrs["usb"],
+		Serial:      serial,
+		State:       deviceState,
+		Product:     attrs["product"],
+		Model:       attrs["model"],
+		DeviceInfo:  attrs["device"],
+		Usb:         attrs["usb"],
+		TransportID: transportID,
+		Connection:  connectionType(serial, attrs["usb"]),
 	}, nil
 }
 
@@ -55,33 +113,58 @@ func parseDeviceList(list string, lineParseFunc func(string) (*DeviceInfo, error
 }
 
 func parseDeviceShort(line string) (*DeviceInfo, error) {
-	fields := strings.Fields(line)
+	// The state can contain spaces, e.g. "no permissions (...)", so split on the tab.
+	fields := strings.SplitN(line, "\t", 2)
+	if len(fields) != 2 {
+		fields = strings.Fields(line)
+	}
 	if len(fields) != 2 {
 		return nil, errors.Errorf(errors.ParseError,
 			"malformed device line, expected 2 fields but found %d", len(fields))
 	}
 
-	return newDevice(fields[0], map[string]string{})
+	return newDevice(fields[0], strings.TrimSpace(fields[1]), map[string]string{})
 }
 
 func parseDeviceLong(line string) (*DeviceInfo, error) {
 	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, errors.Errorf(errors.ParseError,
+			"malformed device line, expected at least 2 fields but found %d", len(fields))
+	}
 
-	attrs := parseDeviceAttributes(fields[2:])
-	return newDevice(fields[0], attrs)
+	// The state is followed by the attributes, but can contain spaces itself.
+	stateFields := fields[1:]
+	for i, field := range stateFields {
+		if i > 0 && deviceAttributePattern.MatchString(field) {
+			stateFields = stateFields[:i]
+			break
+		}
+	}
+
+	attrs := parseDeviceAttributes(fields[1+len(stateFields):])
+	return newDevice(fields[0], strings.Join(stateFields, " "), attrs)
 }
 
+// deviceAttributePattern matches key:val pairs in the long form of the device list, e.g.
+// "transport_id:1".
+var deviceAttributePattern = regexp.MustCompile(`^[a-z_]+:`)
+
 func parseDeviceAttributes(fields []string) map[string]string {
 	attrs := map[string]string{}
 	for _, field := range fields {
-		key, val := parseKeyVal(field)
-		attrs[key] = val
+		if key, val, ok := parseKeyVal(field); ok {
+			attrs[key] = val
+		}
 	}
 	return attrs
 }
 
-// Parses a key:val pair and returns key, val.
-func parseKeyVal(pair string) (string, string) {
-	split := strings.Split(pair, ":")
-	return split[0], split[1]
+// Parses a key:val pair and returns key, val. Returns false if pair doesn't contain a colon.
+func parseKeyVal(pair string) (string, string, bool) {
+	split := strings.SplitN(pair, ":", 2)
+	if len(split) != 2 {
+		return "", "", false
+	}
+	return split[0], split[1], true
 }
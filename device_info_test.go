@@ -20,7 +20,17 @@ func TestParseDeviceShort(t *testing.T) {
 	dev, err := parseDeviceShort("192.168.56.101:5555	device\n")
 	assert.NoError(t, err)
 	assert.Equal(t, &DeviceInfo{
-		Serial: "192.168.56.101:5555"}, dev)
+		Serial:     "192.168.56.101:5555",
+		State:      StateOnline,
+		Connection: ConnectionTcp}, dev)
+}
+
+func TestParseDeviceShortNoPermissions(t *testing.T) {
+	dev, err := parseDeviceShort("SERIAL\tno permissions (missing udev rules? user is in the plugdev group); see [http://developer.android.com/tools/device.html]")
+	assert.NoError(t, err)
+	assert.Equal(t, &DeviceInfo{
+		Serial: "SERIAL",
+		State:  StateNoPermissions}, dev)
 }
 
 func TestParseDeviceLong(t *testing.T) {
@@ -28,6 +38,7 @@ func TestParseDeviceLong(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, &DeviceInfo{
 		Serial:     "SERIAL",
+		State:      StateOnline,
 		Product:    "PRODUCT",
 		Model:      "MODEL",
 		DeviceInfo: "DEVICE"}, dev)
@@ -37,8 +48,11 @@ func TestParseDeviceLongUnauthorized(t *testing.T) {
 	dev, err := parseDeviceLong("SERIAL    unauthorized usb:1234 transport_id:8")
 	assert.NoError(t, err)
 	assert.Equal(t, &DeviceInfo{
-		Serial: "SERIAL",
-		Usb: "1234"}, dev)
+		Serial:      "SERIAL",
+		State:       StateUnauthorized,
+		Usb:         "1234",
+		TransportID: 8,
+		Connection:  ConnectionUsb}, dev)
 }
 
 func TestParseDeviceLongUsb(t *testing.T) {
@@ -49,5 +63,56 @@ func TestParseDeviceLongUsb(t *testing.T) {
 		Product:    "PRODUCT",
 		Model:      "MODEL",
 		DeviceInfo: "DEVICE",
-		Usb:        "1234"}, dev)
+		Usb:        "1234",
+		State:      StateOnline,
+		Connection: ConnectionUsb}, dev)
+}
+
+func TestParseDeviceLongNoPermissions(t *testing.T) {
+	dev, err := parseDeviceLong("SERIAL    no permissions (user in plugdev group; are your udev rules wrong?); see [http://developer.android.com/tools/device.html] usb:1-4 transport_id:3")
+	assert.NoError(t, err)
+	assert.Equal(t, &DeviceInfo{
+		Serial:      "SERIAL",
+		State:       StateNoPermissions,
+		Usb:         "1-4",
+		TransportID: 3,
+		Connection:  ConnectionUsb}, dev)
+}
+
+func TestParseDeviceLongTcp(t *testing.T) {
+	dev, err := parseDeviceLong("192.168.1.5:5555       device product:PRODUCT model:MODEL device:DEVICE transport_id:12 unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, &DeviceInfo{
+		Serial:      "192.168.1.5:5555",
+		State:       StateOnline,
+		Product:     "PRODUCT",
+		Model:       "MODEL",
+		DeviceInfo:  "DEVICE",
+		TransportID: 12,
+		Connection:  ConnectionTcp}, dev)
+}
+
+func TestParseDeviceLongInvalid(t *testing.T) {
+	_, err := parseDeviceLong("SERIAL")
+	assert.True(t, HasErrCode(err, ParseError))
+
+	_, err = parseDeviceLong("SERIAL device transport_id:abc")
+	assert.True(t, HasErrCode(err, ParseError))
+}
+
+func TestConnectionType(t *testing.T) {
+	for _, test := range []struct {
+		Serial, Usb string
+		Want        ConnectionType
+	}{
+		{"0123456789ABCDEF", "1-1", ConnectionUsb},
+		{"0123456789ABCDEF", "", ConnectionUnknown},
+		{"emulator-5554", "", ConnectionEmulator},
+		{"192.168.1.5:5555", "", ConnectionTcp},
+		{"[::1]:5555", "", ConnectionTcp},
+		{"adb-0123456789ABCDEF-AbCdEf._adb-tls-connect._tcp", "", ConnectionTcp},
+	} {
+		assert.Equal(t, test.Want, connectionType(test.Serial, test.Usb), test.Serial)
+	}
+	assert.Equal(t, "ConnectionEmulator", ConnectionEmulator.String())
 }
@@ -0,0 +1,412 @@
+package adb
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+/*
+DeviceQuery selects devices by their attributes and system properties. Queries are parsed from
+strings with ParseDeviceQuery, so the same syntax can be used on command lines and in config
+files, and are matched with Adb.FindDevices and Adb.SelectDevice.
+*/
+type DeviceQuery struct {
+	// All terms must match.
+	terms []queryTerm
+}
+
+type queryTerm struct {
+	key   string
+	op    string
+	value string
+}
+
+// Keys that can be used in queries, besides prop.<name> and label.<name>.
+const (
+	queryKeySerial      = "serial"
+	queryKeyState       = "state"
+	queryKeyModel       = "model"
+	queryKeyProduct     = "product"
+	queryKeyDevice      = "device"
+	queryKeyConnection  = "connection"
+	queryKeyTransportID = "transport_id"
+	queryKeySdk         = "sdk"
+	queryKeyAbi         = "abi"
+
+	queryPropPrefix  = "prop."
+	queryLabelPrefix = "label."
+)
+
+var connectionTypeNames = map[string]ConnectionType{
+	"unknown":  ConnectionUnknown,
+	"usb":      ConnectionUsb,
+	"tcp":      ConnectionTcp,
+	"emulator": ConnectionEmulator,
+}
+
+// queryTermPattern matches comparisons like sdk>=33. Operators are ordered so the longest match
+// is found first.
+var queryTermPattern = regexp.MustCompile(`^([A-Za-z0-9_.-]+)\s*(>=|<=|!=|=|>|<)\s*(.*)$`)
+
+/*
+ParseDeviceQuery parses a query made of comma-separated terms, all of which must match, e.g.
+
+	model=Pixel_7,sdk>=33
+
+Terms compare a key with a value using one of =, !=, <, <=, > or >=. Keys are:
+
+	serial, model, product, device  As reported by `adb devices -l`.
+	state                           As reported by `adb devices`, e.g. device or unauthorized.
+	connection                      usb, tcp, emulator or unknown. See ConnectionType.
+	transport_id                    See DeviceWithTransportID.
+	sdk                             The SDK level, from ro.build.version.sdk.
+	abi                             Matches if the device supports the ABI, e.g. abi=arm64-v8a.
+	prop.<name>                     The system property <name>, e.g. prop.ro.debuggable=1.
+	label.<name>                    The label <name> set in ServerConfig.DeviceLabels.
+
+Only transport_id, sdk, and properties can be compared with <, <=, > or >=, and only as integers.
+Terms can also be one of these shorthands, so strings accepted by ParseDeviceDescriptor are also
+queries:
+
+	any                 Matches any device.
+	usb                 connection=usb
+	local               connection!=usb, i.e. devices selected by AnyLocalDevice.
+	serial:<serial>     serial=<serial>
+	transport-id:<id>   transport_id=<id>
+	<serial>            Any other term without an operator is a serial, like `adb -s`.
+
+Values can't contain commas.
+*/
+func ParseDeviceQuery(query string) (*DeviceQuery, error) {
+	if isBlank(query) {
+		return nil, errors.Errorf(errors.ParseError, "device query cannot be empty")
+	}
+
+	q := &DeviceQuery{}
+	for _, term := range strings.Split(query, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return nil, errors.Errorf(errors.ParseError, "empty term in device query: %q", query)
+		}
+		if term == "any" {
+			continue
+		}
+
+		t, err := parseQueryTerm(term)
+		if err != nil {
+			return nil, errors.WrapErrf(err, "invalid device query: %q", query)
+		}
+		q.terms = append(q.terms, t)
+	}
+	return q, nil
+}
+
+func parseQueryTerm(term string) (queryTerm, error) {
+	var t queryTerm
+	switch {
+	case term == "usb":
+		t = queryTerm{queryKeyConnection, "=", "usb"}
+	case term == "local":
+		t = queryTerm{queryKeyConnection, "!=", "usb"}
+	case strings.HasPrefix(term, "serial:"):
+		t = queryTerm{queryKeySerial, "=", strings.TrimPrefix(term, "serial:")}
+	case strings.HasPrefix(term, "transport-id:"):
+		t = queryTerm{queryKeyTransportID, "=", strings.TrimPrefix(term, "transport-id:")}
+	default:
+		match := queryTermPattern.FindStringSubmatch(term)
+		if match == nil {
+			// Serials of TCP devices contain colons, so anything else is a serial.
+			return queryTerm{queryKeySerial, "=", term}, nil
+		}
+		t = queryTerm{match[1], match[2], strings.TrimSpace(match[3])}
+	}
+	return t, t.validate()
+}
+
+func (t queryTerm) validate() error {
+	ordered := t.op != "=" && t.op != "!="
+	switch {
+	case t.key == queryPropPrefix || t.key == queryLabelPrefix:
+		return errors.Errorf(errors.ParseError, "missing name after %q", t.key)
+	case t.key == queryKeySerial && t.value == "":
+		return errors.Errorf(errors.ParseError, "serial cannot be empty")
+	case t.key == queryKeySerial || t.key == queryKeyModel || t.key == queryKeyProduct ||
+		t.key == queryKeyDevice || t.key == queryKeyAbi ||
+		strings.HasPrefix(t.key, queryLabelPrefix):
+		if ordered {
+			return errors.Errorf(errors.ParseError, "%s can't be compared with %s", t.key, t.op)
+		}
+	case t.key == queryKeyState:
+		if ordered {
+			return errors.Errorf(errors.ParseError, "%s can't be compared with %s", t.key, t.op)
+		}
+		if _, err := parseDeviceState(t.value); err != nil {
+			return err
+		}
+	case t.key == queryKeyConnection:
+		if ordered {
+			return errors.Errorf(errors.ParseError, "%s can't be compared with %s", t.key, t.op)
+		}
+		if _, ok := connectionTypeNames[t.value]; !ok {
+			return errors.Errorf(errors.ParseError, "invalid connection type: %q", t.value)
+		}
+	case t.key == queryKeyTransportID || t.key == queryKeySdk:
+		if _, err := strconv.ParseInt(t.value, 10, 64); err != nil {
+			return errors.WrapErrorf(err, errors.ParseError, "%s must be an integer: %q", t.key, t.value)
+		}
+	case strings.HasPrefix(t.key, queryPropPrefix):
+		if ordered {
+			if _, err := strconv.ParseInt(t.value, 10, 64); err != nil {
+				return errors.WrapErrorf(err, errors.ParseError, "%s must be an integer to compare with %s: %q", t.key, t.op, t.value)
+			}
+		}
+	default:
+		return errors.Errorf(errors.ParseError, "unknown key: %q", t.key)
+	}
+	return nil
+}
+
+/*
+ParseDeviceDescriptor parses a string that selects a device like a DeviceDescriptor: any, usb,
+local, serial:<serial>, transport-id:<id>, or a serial. Returns a ParseError for other queries,
+which must be matched with Adb.FindDevices or Adb.SelectDevice.
+*/
+func ParseDeviceDescriptor(str string) (DeviceDescriptor, error) {
+	query, err := ParseDeviceQuery(str)
+	if err != nil {
+		return DeviceDescriptor{}, err
+	}
+	descriptor, ok := query.Descriptor()
+	if !ok {
+		return DeviceDescriptor{}, errors.Errorf(errors.ParseError, "device query %q can't be used as a descriptor", str)
+	}
+	return descriptor, nil
+}
+
+/*
+Descriptor returns the DeviceDescriptor equivalent to the query, and true, if there is one, e.g.
+for queries like usb or serial:<serial>. The server can select the device itself, without listing
+devices first.
+*/
+func (q *DeviceQuery) Descriptor() (DeviceDescriptor, bool) {
+	if len(q.terms) == 0 {
+		return AnyDevice(), true
+	} else if len(q.terms) > 1 {
+		return DeviceDescriptor{}, false
+	}
+
+	switch t := q.terms[0]; {
+	case t.key == queryKeySerial && t.op == "=":
+		return DeviceWithSerial(t.value), true
+	case t.key == queryKeyTransportID && t.op == "=":
+		id, _ := strconv.ParseInt(t.value, 10, 64)
+		return DeviceWithTransportID(id), true
+	case t.key == queryKeyConnection && t.op == "=" && t.value == "usb":
+		return AnyUsbDevice(), true
+	case t.key == queryKeyConnection && t.op == "!=" && t.value == "usb":
+		return AnyLocalDevice(), true
+	}
+	return DeviceDescriptor{}, false
+}
+
+// String returns the query in the syntax accepted by ParseDeviceQuery.
+func (q *DeviceQuery) String() string {
+	if len(q.terms) == 0 {
+		return "any"
+	}
+	terms := make([]string, len(q.terms))
+	for i, t := range q.terms {
+		terms[i] = t.key + t.op + t.value
+	}
+	return strings.Join(terms, ",")
+}
+
+/*
+FindDevices returns the devices that match query, in the order the server lists them. Each device
+is selected by its transport ID if the server reports one, so it always refers to the same
+connection, even if another device has the same serial.
+
+Queries on system properties, e.g. sdk>=33, read the properties of each online device that matches
+the query's other terms. Devices that aren't online never match them, and neither do devices whose
+properties can't be read, e.g. because they disconnected. An error is only returned if the
+properties of every device that needed them couldn't be read.
+*/
+func (c *Adb) FindDevices(query *DeviceQuery) ([]*Device, error) {
+	infos, err := c.ListDevices()
+	if err != nil {
+		return nil, wrapClientError(err, c, "FindDevices(%s)", query)
+	}
+
+	var devices []*Device
+	var errs []error
+	// The number of devices whose properties were needed to match them.
+	queried := 0
+	for _, info := range infos {
+		device := c.Device(queryResultDescriptor(info))
+		ok, readProperties, err := c.matchDevice(query, device, info)
+		if readProperties {
+			queried++
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			devices = append(devices, device)
+		}
+	}
+	if len(errs) > 0 && len(errs) == queried {
+		err := errors.CombineErrs("error reading device properties", errors.AdbError, errs...)
+		return nil, wrapClientError(err, c, "FindDevices(%s)", query)
+	}
+	return devices, nil
+}
+
+/*
+SelectDevice returns the only device that matches query, e.g.
+
+	query, err := adb.ParseDeviceQuery("model=Pixel_7,sdk>=33")
+	…
+	device, err := client.SelectDevice(query)
+
+Returns a NoDevices error if no devices match, or a MoreThanOneDevice error if several do.
+*/
+func (c *Adb) SelectDevice(query *DeviceQuery) (*Device, error) {
+	devices, err := c.FindDevices(query)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(devices) {
+	case 0:
+		err = errors.Errorf(errors.NoDevices, "no devices match %s", query)
+	case 1:
+		return devices[0], nil
+	default:
+		descriptors := make([]string, len(devices))
+		for i, device := range devices {
+			descriptors[i] = device.descriptor.String()
+		}
+		err = errors.Errorf(errors.MoreThanOneDevice, "%d devices match %s: %s", len(devices), query, strings.Join(descriptors, ", "))
+	}
+	return nil, wrapClientError(err, c, "SelectDevice(%s)", query)
+}
+
+// queryResultDescriptor returns the most specific descriptor for the device described by info.
+func queryResultDescriptor(info *DeviceInfo) DeviceDescriptor {
+	if info.TransportID != 0 {
+		return DeviceWithTransportID(info.TransportID)
+	}
+	return DeviceWithSerial(info.Serial)
+}
+
+/*
+matchDevice returns true if device matches all of the query's terms. Properties are only read if
+the device matches all the terms that don't need them, in which case readProperties is true, and
+an error is only returned if reading them fails.
+*/
+func (c *Adb) matchDevice(query *DeviceQuery, device *Device, info *DeviceInfo) (ok, readProperties bool, err error) {
+	labels := c.labels[info.Serial]
+	needsProperties := false
+	for _, t := range query.terms {
+		if t.needsProperties() {
+			needsProperties = true
+		} else if !t.match(info, labels, nil) {
+			return false, false, nil
+		}
+	}
+	if !needsProperties {
+		return true, false, nil
+	}
+	if info.State != StateOnline {
+		return false, false, nil
+	}
+
+	props, err := device.properties()
+	if err != nil {
+		return false, true, err
+	}
+	for _, t := range query.terms {
+		if t.needsProperties() && !t.match(info, labels, props) {
+			return false, true, nil
+		}
+	}
+	return true, true, nil
+}
+
+// needsProperties returns true if the term can only be matched against the device's system
+// properties.
+func (t queryTerm) needsProperties() bool {
+	return t.key == queryKeySdk || t.key == queryKeyAbi || strings.HasPrefix(t.key, queryPropPrefix)
+}
+
+// match returns true if the term matches the device. Terms that need properties are matched
+// against props, which must be set.
+func (t queryTerm) match(info *DeviceInfo, labels map[string]string, props map[string]string) bool {
+	switch {
+	case t.key == queryKeySerial:
+		return t.compareString(info.Serial)
+	case t.key == queryKeyModel:
+		return t.compareString(info.Model)
+	case t.key == queryKeyProduct:
+		return t.compareString(info.Product)
+	case t.key == queryKeyDevice:
+		return t.compareString(info.DeviceInfo)
+	case t.key == queryKeyState:
+		state, _ := parseDeviceState(t.value)
+		return (info.State == state) == (t.op == "=")
+	case t.key == queryKeyConnection:
+		return (info.Connection == connectionTypeNames[t.value]) == (t.op == "=")
+	case t.key == queryKeyTransportID:
+		return t.compareInt(strconv.FormatInt(info.TransportID, 10))
+	case t.key == queryKeySdk:
+		return t.compareInt(props["ro.build.version.sdk"])
+	case t.key == queryKeyAbi:
+		hasAbi := false
+		for _, abi := range detailsFromProperties(props).Abis {
+			hasAbi = hasAbi || abi == t.value
+		}
+		return hasAbi == (t.op == "=")
+	case strings.HasPrefix(t.key, queryPropPrefix):
+		value := props[strings.TrimPrefix(t.key, queryPropPrefix)]
+		if t.op == "=" || t.op == "!=" {
+			return t.compareString(value)
+		}
+		return t.compareInt(value)
+	case strings.HasPrefix(t.key, queryLabelPrefix):
+		return t.compareString(labels[strings.TrimPrefix(t.key, queryLabelPrefix)])
+	}
+	return false
+}
+
+func (t queryTerm) compareString(actual string) bool {
+	return (actual == t.value) == (t.op == "=")
+}
+
+// compareInt compares actual and the term's value as integers. Returns false if actual isn't an
+// integer, e.g. because a property isn't set.
+func (t queryTerm) compareInt(actual string) bool {
+	a, err := strconv.ParseInt(actual, 10, 64)
+	if err != nil {
+		return false
+	}
+	want, _ := strconv.ParseInt(t.value, 10, 64)
+	switch t.op {
+	case "=":
+		return a == want
+	case "!=":
+		return a != want
+	case "<":
+		return a < want
+	case "<=":
+		return a <= want
+	case ">":
+		return a > want
+	case ">=":
+		return a >= want
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package adb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/adbtest"
+)
+
+func TestParseDeviceQuery(t *testing.T) {
+	for query, want := range map[string]string{
+		"model=Pixel_7,sdk>=33":          "model=Pixel_7,sdk>=33",
+		" model = Pixel_7 , sdk >= 33 ":  "model=Pixel_7,sdk>=33",
+		"any":                            "any",
+		"usb":                            "connection=usb",
+		"local,state=device":             "connection!=usb,state=device",
+		"serial:ABC":                     "serial=ABC",
+		"192.168.1.5:5555":               "serial=192.168.1.5:5555",
+		"transport-id:3":                 "transport_id=3",
+		"connection=tcp,abi=arm64-v8a":   "connection=tcp,abi=arm64-v8a",
+		"prop.ro.debuggable=1,label.a!=": "prop.ro.debuggable=1,label.a!=",
+		"prop.ro.build.version.sdk<30":   "prop.ro.build.version.sdk<30",
+	} {
+		q, err := ParseDeviceQuery(query)
+		if assert.NoError(t, err, query) {
+			assert.Equal(t, want, q.String(), query)
+		}
+	}
+}
+
+func TestParseDeviceQueryInvalid(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"usb,",
+		"serial:",
+		"model>Pixel",
+		"sdk>=thirty",
+		"transport-id:abc",
+		"state=broken",
+		"connection=bluetooth",
+		"color=red",
+		"prop.=1",
+		"label.=a",
+		"prop.ro.build.id>abc",
+	} {
+		_, err := ParseDeviceQuery(query)
+		assert.True(t, HasErrCode(err, ParseError), query)
+	}
+}
+
+func TestParseDeviceDescriptor(t *testing.T) {
+	for str, want := range map[string]DeviceDescriptor{
+		"any":              AnyDevice(),
+		"usb":              AnyUsbDevice(),
+		"local":            AnyLocalDevice(),
+		"serial:ABC":       DeviceWithSerial("ABC"),
+		"emulator-5554":    DeviceWithSerial("emulator-5554"),
+		"192.168.1.5:5555": DeviceWithSerial("192.168.1.5:5555"),
+		"transport-id:3":   DeviceWithTransportID(3),
+	} {
+		descriptor, err := ParseDeviceDescriptor(str)
+		assert.NoError(t, err, str)
+		assert.Equal(t, want, descriptor, str)
+	}
+
+	_, err := ParseDeviceDescriptor("model=Pixel_7")
+	assert.True(t, HasErrCode(err, ParseError))
+	_, err = ParseDeviceDescriptor("usb,serial:ABC")
+	assert.True(t, HasErrCode(err, ParseError))
+}
+
+func newQueryTestClient(t *testing.T) (*Adb, *adbtest.Server) {
+	server := adbtest.NewServer()
+
+	pixel := server.AddDevice("pixel")
+	pixel.SetInfo(adbtest.DeviceInfo{Usb: "1-1", Product: "panther", Model: "Pixel_7", Device: "panther"})
+	pixel.HandleShell(func(cmd string) string {
+		return "[ro.build.version.sdk]: [33]\n[ro.product.cpu.abilist]: [arm64-v8a]\n"
+	})
+
+	emulator := server.AddDevice("emulator-5554")
+	emulator.SetInfo(adbtest.DeviceInfo{Product: "sdk_gphone_x86", Model: "sdk_gphone_x86"})
+	emulator.HandleShell(func(cmd string) string {
+		return "[ro.build.version.sdk]: [30]\n[ro.product.cpu.abilist]: [x86,armeabi-v7a]\n"
+	})
+
+	server.AddDevice("old").SetState(adbtest.StateUnauthorized)
+
+	client, err := NewWithConfig(ServerConfig{
+		Dialer:        server,
+		NoStartServer: true,
+		DeviceLabels: map[string]map[string]string{
+			"pixel": {"rack": "a1"},
+		},
+	})
+	require.NoError(t, err)
+	return client, server
+}
+
+func findSerials(t *testing.T, client *Adb, query string) []string {
+	q, err := ParseDeviceQuery(query)
+	require.NoError(t, err)
+	devices, err := client.FindDevices(q)
+	require.NoError(t, err)
+
+	serials := []string{}
+	for _, device := range devices {
+		serial, err := device.Serial()
+		require.NoError(t, err)
+		serials = append(serials, serial)
+	}
+	return serials
+}
+
+func TestFindDevices(t *testing.T) {
+	client, server := newQueryTestClient(t)
+	defer server.Close()
+
+	for query, want := range map[string][]string{
+		"any":                          {"pixel", "emulator-5554", "old"},
+		"usb":                          {"pixel"},
+		"local":                        {"emulator-5554", "old"},
+		"connection=emulator":          {"emulator-5554"},
+		"state=device":                 {"pixel", "emulator-5554"},
+		"state!=device":                {"old"},
+		"model=Pixel_7":                {"pixel"},
+		"sdk>=30":                      {"pixel", "emulator-5554"},
+		"sdk>30":                       {"pixel"},
+		"sdk<33,abi=armeabi-v7a":       {"emulator-5554"},
+		"abi!=arm64-v8a":               {"emulator-5554"},
+		"prop.ro.build.version.sdk=33": {"pixel"},
+		"label.rack=a1":                {"pixel"},
+		"label.rack!=a1":               {"emulator-5554", "old"},
+		"serial:old":                   {"old"},
+		"model=Pixel_8":                {},
+	} {
+		assert.Equal(t, want, findSerials(t, client, query), query)
+	}
+}
+
+func TestFindDevicesSelectsByTransportID(t *testing.T) {
+	client, server := newQueryTestClient(t)
+	defer server.Close()
+
+	q, err := ParseDeviceQuery("model=Pixel_7")
+	require.NoError(t, err)
+	devices, err := client.FindDevices(q)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Equal(t, DeviceWithTransportID(server.Device("pixel").TransportID()), devices[0].descriptor)
+}
+
+func TestSelectDevice(t *testing.T) {
+	client, server := newQueryTestClient(t)
+	defer server.Close()
+
+	q, err := ParseDeviceQuery("sdk>=33")
+	require.NoError(t, err)
+	device, err := client.SelectDevice(q)
+	require.NoError(t, err)
+	serial, err := device.Serial()
+	assert.NoError(t, err)
+	assert.Equal(t, "pixel", serial)
+
+	q, err = ParseDeviceQuery("sdk>=34")
+	require.NoError(t, err)
+	_, err = client.SelectDevice(q)
+	assert.True(t, HasErrCode(err, NoDevices))
+
+	q, err = ParseDeviceQuery("state=device")
+	require.NoError(t, err)
+	_, err = client.SelectDevice(q)
+	assert.True(t, HasErrCode(err, MoreThanOneDevice))
+}
+
+func TestFindDevicesSkipsDevicesWithoutProperties(t *testing.T) {
+	server := adbtest.NewServer()
+	defer server.Close()
+	server.AddDevice("pixel").HandleShell(func(cmd string) string {
+		return "[ro.build.version.sdk]: [33]\n"
+	})
+	server.AddDevice("broken").HandleShell(func(cmd string) string {
+		return "[ro.build.version.sdk]: [33\n"
+	})
+	client, err := NewWithConfig(ServerConfig{Dialer: server, NoStartServer: true})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"pixel"}, findSerials(t, client, "sdk>=33"))
+	assert.Equal(t, []string{}, findSerials(t, client, "sdk>=34"))
+
+	// Nothing can be matched if the only candidate's properties can't be read.
+	q, err := ParseDeviceQuery("serial:broken,sdk>=33")
+	require.NoError(t, err)
+	_, err = client.FindDevices(q)
+	assert.True(t, HasErrCode(err, ParseError))
+}
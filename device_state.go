@@ -1,12 +1,19 @@
 package adb
 
-import "github.com/zach-klippenstein/goadb/internal/errors"
+import (
+	"strings"
 
-// DeviceState represents one of the 3 possible states adb will report devices.
-// A device can be communicated with when it's in StateOnline.
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+// DeviceState represents one of the states adb will report devices in.
+// A device can be communicated with when it's in StateOnline, and some services work in
+// StateRecovery.
 // A USB device will make the following state transitions:
-// 	Plugged in: StateDisconnected->StateOffline->StateOnline
-// 	Unplugged:  StateOnline->StateDisconnected
+//
+//	Plugged in: StateDisconnected->StateOffline->StateOnline
+//	Unplugged:  StateOnline->StateDisconnected
+//
 //go:generate stringer -type=DeviceState
 type DeviceState int8
 
@@ -16,6 +23,15 @@ const (
 	StateDisconnected
 	StateOffline
 	StateOnline
+	StateBootloader
+	StateRecovery
+	StateSideload
+	StateRescue
+	StateHost
+	// The server doesn't have permission to open the device, e.g. because of udev rules.
+	StateNoPermissions
+	StateAuthorizing
+	StateConnecting
 )
 
 var deviceStateStrings = map[string]DeviceState{
@@ -23,9 +39,22 @@ var deviceStateStrings = map[string]DeviceState{
 	"offline":      StateOffline,
 	"device":       StateOnline,
 	"unauthorized": StateUnauthorized,
+	"bootloader":   StateBootloader,
+	"recovery":     StateRecovery,
+	"sideload":     StateSideload,
+	"rescue":       StateRescue,
+	"host":         StateHost,
+	"authorizing":  StateAuthorizing,
+	"connecting":   StateConnecting,
 }
 
 func parseDeviceState(str string) (DeviceState, error) {
+	// The server explains why it doesn't have permission, e.g.
+	// "no permissions (user in plugdev group; are your udev rules wrong?); see [...]".
+	if strings.HasPrefix(str, "no permissions") {
+		return StateNoPermissions, nil
+	}
+
 	state, ok := deviceStateStrings[str]
 	if !ok {
 		return StateInvalid, errors.Errorf(errors.ParseError, "invalid device state: %q", state)
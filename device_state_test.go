@@ -18,6 +18,11 @@ func TestParseDeviceState(t *testing.T) {
 		{"offline", StateOffline, "StateOffline", nil},
 		{"device", StateOnline, "StateOnline", nil},
 		{"unauthorized", StateUnauthorized, "StateUnauthorized", nil},
+		{"bootloader", StateBootloader, "StateBootloader", nil},
+		{"recovery", StateRecovery, "StateRecovery", nil},
+		{"sideload", StateSideload, "StateSideload", nil},
+		{"authorizing", StateAuthorizing, "StateAuthorizing", nil},
+		{"no permissions (user in plugdev group; are your udev rules wrong?); see [http://developer.android.com/tools/device.html]", StateNoPermissions, "StateNoPermissions", nil},
 		{"bad", StateInvalid, "StateInvalid", errors.New(`ParseError: invalid device state: "StateInvalid"`)},
 	} {
 		state, err := parseDeviceState(test.String)
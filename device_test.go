@@ -13,7 +13,7 @@ func TestGetAttribute(t *testing.T) {
 		Status:   wire.StatusSuccess,
 		Messages: []string{"value"},
 	}
-	client := (&Adb{s}).Device(DeviceWithSerial("serial"))
+	client := (&Adb{server: s}).Device(DeviceWithSerial("serial"))
 
 	v, err := client.getAttribute("attr")
 	assert.Equal(t, "host-serial:serial:attr", s.Requests[0])
@@ -53,8 +53,27 @@ func TestGetDeviceInfo(t *testing.T) {
 	assert.Nil(t, device)
 }
 
+func TestGetDeviceInfoByTransportID(t *testing.T) {
+	s := &MockServer{
+		Status:   wire.StatusSuccess,
+		Messages: []string{"abc"},
+	}
+	client := (&Adb{server: s}).Device(DeviceWithTransportID(2))
+	client.deviceListFunc = func() ([]*DeviceInfo, error) {
+		return []*DeviceInfo{
+			&DeviceInfo{Serial: "abc", Usb: "1-1", TransportID: 1},
+			&DeviceInfo{Serial: "abc", TransportID: 2},
+		}, nil
+	}
+
+	device, err := client.DeviceInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), device.TransportID)
+	assert.Equal(t, []string{"host-transport-id:2:get-serialno"}, s.Requests)
+}
+
 func newDeviceClientWithDeviceLister(serial string, deviceLister func() ([]*DeviceInfo, error)) *Device {
-	client := (&Adb{&MockServer{
+	client := (&Adb{server: &MockServer{
 		Status:   wire.StatusSuccess,
 		Messages: []string{serial},
 	}}).Device(DeviceWithSerial(serial))
@@ -67,7 +86,7 @@ func TestRunCommandNoArgs(t *testing.T) {
 		Status:   wire.StatusSuccess,
 		Messages: []string{"output"},
 	}
-	client := (&Adb{s}).Device(AnyDevice())
+	client := (&Adb{server: s}).Device(AnyDevice())
 
 	v, err := client.RunCommand("cmd")
 	assert.Equal(t, "host:transport-any", s.Requests[0])
@@ -76,40 +95,74 @@ func TestRunCommandNoArgs(t *testing.T) {
 	assert.Equal(t, "output", v)
 }
 
-func TestPrepareCommandLineNoArgs(t *testing.T) {
-	result, err := prepareCommandLine("cmd")
+func TestRunPipeline(t *testing.T) {
+	s := &MockServer{
+		Status:   wire.StatusSuccess,
+		Messages: []string{"output"},
+	}
+	client := (&Adb{server: s}).Device(AnyDevice())
+
+	v, err := client.Run(NewCommand("ls", "My Photos").Pipe(NewCommand("grep", "$x")).StderrTo("/dev/null"))
+	assert.Equal(t, "shell:{ ls 'My Photos' | grep '$x'; } 2> /dev/null", s.Requests[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "output", v)
+}
+
+func TestRunEmptyCommandFails(t *testing.T) {
+	s := &MockServer{}
+	client := (&Adb{server: s}).Device(AnyDevice())
+
+	_, err := client.Run(NewCommand(""))
+	assert.True(t, HasErrCode(err, AssertionError))
+	assert.Empty(t, s.Requests)
+}
+
+func TestShellCommandLineNoArgs(t *testing.T) {
+	result, err := shellCommandLine("cmd")
 	assert.NoError(t, err)
 	assert.Equal(t, "cmd", result)
 }
 
-func TestPrepareCommandLineEmptyCommand(t *testing.T) {
-	_, err := prepareCommandLine("")
+func TestShellCommandLineEmptyCommand(t *testing.T) {
+	_, err := shellCommandLine("")
 	assert.Equal(t, errors.AssertionError, code(err))
 	assert.Equal(t, "command cannot be empty", message(err))
 }
 
-func TestPrepareCommandLineBlankCommand(t *testing.T) {
-	_, err := prepareCommandLine("  ")
+func TestShellCommandLineBlankCommand(t *testing.T) {
+	_, err := shellCommandLine("  ")
 	assert.Equal(t, errors.AssertionError, code(err))
 	assert.Equal(t, "command cannot be empty", message(err))
 }
 
-func TestPrepareCommandLineCleanArgs(t *testing.T) {
-	result, err := prepareCommandLine("cmd", "arg1", "arg2")
+func TestShellCommandLineCleanArgs(t *testing.T) {
+	result, err := shellCommandLine("cmd", "arg1", "arg2")
 	assert.NoError(t, err)
 	assert.Equal(t, "cmd arg1 arg2", result)
 }
 
-func TestPrepareCommandLineArgWithWhitespaceQuotes(t *testing.T) {
-	result, err := prepareCommandLine("cmd", "arg with spaces")
+func TestShellCommandLineArgWithWhitespaceQuotes(t *testing.T) {
+	result, err := shellCommandLine("cmd", "arg with spaces")
+	assert.NoError(t, err)
+	assert.Equal(t, "cmd 'arg with spaces'", result)
+}
+
+func TestShellCommandLineArgWithQuotes(t *testing.T) {
+	result, err := shellCommandLine("cmd", "quoted\"arg", "it's")
+	assert.NoError(t, err)
+	assert.Equal(t, `cmd 'quoted"arg' 'it'\''s'`, result)
+}
+
+func TestShellCommandLineArgWithShellCharacters(t *testing.T) {
+	result, err := shellCommandLine("cmd", "$HOME", "`id`", "a;b", "*", "a\nb", "")
 	assert.NoError(t, err)
-	assert.Equal(t, "cmd \"arg with spaces\"", result)
+	assert.Equal(t, "cmd '$HOME' '`id`' 'a;b' '*' 'a\nb' ''", result)
 }
 
-func TestPrepareCommandLineArgWithDoubleQuoteFails(t *testing.T) {
-	_, err := prepareCommandLine("cmd", "quoted\"arg")
+func TestShellCommandLineArgWithNulFails(t *testing.T) {
+	_, err := shellCommandLine("cmd", "a\x00b")
 	assert.Equal(t, errors.ParseError, code(err))
-	assert.Equal(t, "arg at index 0 contains an invalid double quote: quoted\"arg", message(err))
+	assert.Equal(t, `arg at index 0 contains a NUL: "a\x00b"`, message(err))
 }
 
 func code(err error) errors.ErrCode {
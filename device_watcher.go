@@ -20,13 +20,24 @@ type DeviceWatcher struct {
 	*deviceWatcherImpl
 }
 
-// DeviceStateChangedEvent represents a device state transition.
-// Contains the device’s old and new states, but also provides methods to query the
-// type of state transition.
+/*
+DeviceStateChangedEvent represents a device state transition.
+Contains the device’s old and new states, but also provides methods to query the
+type of state transition.
+
+If the server reports transport IDs, devices are told apart by both serial and transport ID, and
+a device gets a new transport ID every time it reconnects. So a device that reconnects between
+two updates from the server is reported as disconnecting with its old transport ID, followed by
+connecting with its new one, even if its state didn't change.
+*/
 type DeviceStateChangedEvent struct {
 	Serial   string
 	OldState DeviceState
 	NewState DeviceState
+
+	// Selects the device with DeviceWithTransportID, even if another device has the same serial.
+	// 0 if the server is too old to report transport IDs.
+	TransportID int64
 }
 
 // CameOnline returns true if this event represents a device coming online.
@@ -90,6 +101,13 @@ func (w *deviceWatcherImpl) reportErr(err error) {
 	w.err.Store(err)
 }
 
+// deviceKey identifies a device in the device list. Devices can have the same serial, e.g. if one
+// is connected via both USB and TCP, but their transport IDs are unique.
+type deviceKey struct {
+	serial      string
+	transportID int64
+}
+
 /*
 publishDevices reads device lists from scanner, calculates diffs, and publishes events on
 eventChan.
@@ -107,17 +125,17 @@ and abort. If true, report no error and stop.
 func publishDevices(watcher *deviceWatcherImpl) {
 	defer close(watcher.eventChan)
 
-	var lastKnownStates map[string]DeviceState
+	var lastKnownStates map[deviceKey]DeviceState
 	finished := false
 
 	for {
-		scanner, err := connectToTrackDevices(watcher.server)
+		scanner, long, err := connectToTrackDevices(watcher.server)
 		if err != nil {
 			watcher.reportErr(err)
 			return
 		}
 
-		finished, err = publishDevicesUntilError(scanner, watcher.eventChan, &lastKnownStates)
+		finished, err = publishDevicesUntilError(scanner, long, watcher.eventChan, &lastKnownStates)
 
 		if finished {
 			scanner.Close()
@@ -146,18 +164,31 @@ func publishDevices(watcher *deviceWatcherImpl) {
 	}
 }
 
-func connectToTrackDevices(server server) (wire.Scanner, error) {
+/*
+connectToTrackDevices requests the long form of the device list, which includes transport IDs,
+and returns true if the server supports it. Falls back to the short form for older servers.
+*/
+func connectToTrackDevices(server server) (scanner wire.Scanner, long bool, err error) {
+	scanner, err = requestTrackDevices(server, "host:track-devices-l")
+	if HasErrCode(err, UnknownService) {
+		scanner, err = requestTrackDevices(server, "host:track-devices")
+		return scanner, false, err
+	}
+	return scanner, true, err
+}
+
+func requestTrackDevices(server server, req string) (wire.Scanner, error) {
 	conn, err := server.Dial()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := wire.SendMessageString(conn, "host:track-devices"); err != nil {
+	if err := wire.SendMessageString(conn, req); err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	if _, err := conn.ReadStatus("host:track-devices"); err != nil {
+	if _, err := conn.ReadStatus(req); err != nil {
 		conn.Close()
 		return nil, err
 	}
@@ -165,14 +196,19 @@ func connectToTrackDevices(server server) (wire.Scanner, error) {
 	return conn, nil
 }
 
-func publishDevicesUntilError(scanner wire.Scanner, eventChan chan<- DeviceStateChangedEvent, lastKnownStates *map[string]DeviceState) (finished bool, err error) {
+func publishDevicesUntilError(scanner wire.Scanner, long bool, eventChan chan<- DeviceStateChangedEvent, lastKnownStates *map[deviceKey]DeviceState) (finished bool, err error) {
+	parse := parseDeviceStates
+	if long {
+		parse = parseDeviceStatesLong
+	}
+
 	for {
 		msg, err := scanner.ReadMessage()
 		if err != nil {
 			return false, err
 		}
 
-		deviceStates, err := parseDeviceStates(string(msg))
+		deviceStates, err := parse(string(msg))
 		if err != nil {
 			return false, err
 		}
@@ -184,8 +220,8 @@ func publishDevicesUntilError(scanner wire.Scanner, eventChan chan<- DeviceState
 	}
 }
 
-func parseDeviceStates(msg string) (states map[string]DeviceState, err error) {
-	states = make(map[string]DeviceState)
+func parseDeviceStates(msg string) (states map[deviceKey]DeviceState, err error) {
+	states = make(map[deviceKey]DeviceState)
 
 	for lineNum, line := range strings.Split(msg, "\n") {
 		if len(line) == 0 {
@@ -201,31 +237,61 @@ func parseDeviceStates(msg string) (states map[string]DeviceState, err error) {
 		serial, stateString := fields[0], fields[1]
 		var state DeviceState
 		state, err = parseDeviceState(stateString)
-		states[serial] = state
+		states[deviceKey{serial: serial}] = state
 	}
 
 	return
 }
 
-func calculateStateDiffs(oldStates, newStates map[string]DeviceState) (events []DeviceStateChangedEvent) {
-	for serial, oldState := range oldStates {
-		newState, ok := newStates[serial]
+// parseDeviceStatesLong parses the long form of the device list, as sent by
+// host:track-devices-l.
+func parseDeviceStatesLong(msg string) (map[deviceKey]DeviceState, error) {
+	devices, err := parseDeviceList(msg, parseDeviceLong)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[deviceKey]DeviceState)
+	for _, device := range devices {
+		states[deviceKey{device.Serial, device.TransportID}] = device.State
+	}
+	return states, nil
+}
+
+func calculateStateDiffs(oldStates, newStates map[deviceKey]DeviceState) (events []DeviceStateChangedEvent) {
+	for key, oldState := range oldStates {
+		newState, ok := newStates[key]
 
 		if oldState != newState {
 			if ok {
 				// Device present in both lists: state changed.
-				events = append(events, DeviceStateChangedEvent{serial, oldState, newState})
+				events = append(events, DeviceStateChangedEvent{
+					Serial:      key.serial,
+					OldState:    oldState,
+					NewState:    newState,
+					TransportID: key.transportID,
+				})
 			} else {
 				// Device only present in old list: device removed.
-				events = append(events, DeviceStateChangedEvent{serial, oldState, StateDisconnected})
+				events = append(events, DeviceStateChangedEvent{
+					Serial:      key.serial,
+					OldState:    oldState,
+					NewState:    StateDisconnected,
+					TransportID: key.transportID,
+				})
 			}
 		}
 	}
 
-	for serial, newState := range newStates {
-		if _, ok := oldStates[serial]; !ok {
+	for key, newState := range newStates {
+		if _, ok := oldStates[key]; !ok {
 			// Device only present in new list: device added.
-			events = append(events, DeviceStateChangedEvent{serial, StateDisconnected, newState})
+			events = append(events, DeviceStateChangedEvent{
+				Serial:      key.serial,
+				OldState:    StateDisconnected,
+				NewState:    newState,
+				TransportID: key.transportID,
+			})
 		}
 	}
 
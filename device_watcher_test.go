@@ -14,7 +14,7 @@ func TestParseDeviceStatesSingle(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Len(t, states, 1)
-	assert.Equal(t, StateOffline, states["192.168.56.101:5555"])
+	assert.Equal(t, StateOffline, states[deviceKey{serial: "192.168.56.101:5555"}])
 }
 
 func TestParseDeviceStatesMultiple(t *testing.T) {
@@ -24,8 +24,8 @@ func TestParseDeviceStatesMultiple(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Len(t, states, 2)
-	assert.Equal(t, StateOffline, states["192.168.56.101:5555"])
-	assert.Equal(t, StateOnline, states["0x0x0x0x"])
+	assert.Equal(t, StateOffline, states[deviceKey{serial: "192.168.56.101:5555"}])
+	assert.Equal(t, StateOnline, states[deviceKey{serial: "0x0x0x0x"}])
 }
 
 func TestParseDeviceStatesMalformed(t *testing.T) {
@@ -37,9 +37,53 @@ func TestParseDeviceStatesMalformed(t *testing.T) {
 	assert.Equal(t, "invalid device state line 1: 0x0x0x0x", err.(*errors.Err).Message)
 }
 
+func TestParseDeviceStatesLong(t *testing.T) {
+	states, err := parseDeviceStatesLong(`abc                    device usb:1-1 product:sdk model:Pixel transport_id:1
+abc                    offline transport_id:2
+`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[deviceKey]DeviceState{
+		{serial: "abc", transportID: 1}: StateOnline,
+		{serial: "abc", transportID: 2}: StateOffline,
+	}, states)
+}
+
+func TestCalculateStateDiffsSameSerial(t *testing.T) {
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "abc", transportID: 1}: StateOnline,
+	}
+	newStates := map[deviceKey]DeviceState{
+		{serial: "abc", transportID: 1}: StateOnline,
+		{serial: "abc", transportID: 2}: StateOffline,
+	}
+
+	diffs := calculateStateDiffs(oldStates, newStates)
+
+	assertContainsOnly(t, []DeviceStateChangedEvent{
+		DeviceStateChangedEvent{Serial: "abc", OldState: StateDisconnected, NewState: StateOffline, TransportID: 2},
+	}, diffs)
+}
+
+func TestCalculateStateDiffsReconnected(t *testing.T) {
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "abc", transportID: 1}: StateOnline,
+	}
+	newStates := map[deviceKey]DeviceState{
+		{serial: "abc", transportID: 2}: StateOnline,
+	}
+
+	diffs := calculateStateDiffs(oldStates, newStates)
+
+	assert.Equal(t, []DeviceStateChangedEvent{
+		DeviceStateChangedEvent{Serial: "abc", OldState: StateOnline, NewState: StateDisconnected, TransportID: 1},
+		DeviceStateChangedEvent{Serial: "abc", OldState: StateDisconnected, NewState: StateOnline, TransportID: 2},
+	}, diffs)
+}
+
 func TestCalculateStateDiffsUnchangedEmpty(t *testing.T) {
-	oldStates := map[string]DeviceState{}
-	newStates := map[string]DeviceState{}
+	oldStates := map[deviceKey]DeviceState{}
+	newStates := map[deviceKey]DeviceState{}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
 
@@ -47,13 +91,13 @@ func TestCalculateStateDiffsUnchangedEmpty(t *testing.T) {
 }
 
 func TestCalculateStateDiffsUnchangedNonEmpty(t *testing.T) {
-	oldStates := map[string]DeviceState{
-		"1": StateOnline,
-		"2": StateOnline,
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOnline,
+		{serial: "2"}: StateOnline,
 	}
-	newStates := map[string]DeviceState{
-		"1": StateOnline,
-		"2": StateOnline,
+	newStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOnline,
+		{serial: "2"}: StateOnline,
 	}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
@@ -62,147 +106,147 @@ func TestCalculateStateDiffsUnchangedNonEmpty(t *testing.T) {
 }
 
 func TestCalculateStateDiffsOneAdded(t *testing.T) {
-	oldStates := map[string]DeviceState{}
-	newStates := map[string]DeviceState{
-		"serial": StateOffline,
+	oldStates := map[deviceKey]DeviceState{}
+	newStates := map[deviceKey]DeviceState{
+		{serial: "serial"}: StateOffline,
 	}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
 
 	assertContainsOnly(t, []DeviceStateChangedEvent{
-		DeviceStateChangedEvent{"serial", StateDisconnected, StateOffline},
+		DeviceStateChangedEvent{Serial: "serial", OldState: StateDisconnected, NewState: StateOffline},
 	}, diffs)
 }
 
 func TestCalculateStateDiffsOneRemoved(t *testing.T) {
-	oldStates := map[string]DeviceState{
-		"serial": StateOffline,
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "serial"}: StateOffline,
 	}
-	newStates := map[string]DeviceState{}
+	newStates := map[deviceKey]DeviceState{}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
 
 	assertContainsOnly(t, []DeviceStateChangedEvent{
-		DeviceStateChangedEvent{"serial", StateOffline, StateDisconnected},
+		DeviceStateChangedEvent{Serial: "serial", OldState: StateOffline, NewState: StateDisconnected},
 	}, diffs)
 }
 
 func TestCalculateStateDiffsOneAddedOneUnchanged(t *testing.T) {
-	oldStates := map[string]DeviceState{
-		"1": StateOnline,
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOnline,
 	}
-	newStates := map[string]DeviceState{
-		"1": StateOnline,
-		"2": StateOffline,
+	newStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOnline,
+		{serial: "2"}: StateOffline,
 	}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
 
 	assertContainsOnly(t, []DeviceStateChangedEvent{
-		DeviceStateChangedEvent{"2", StateDisconnected, StateOffline},
+		DeviceStateChangedEvent{Serial: "2", OldState: StateDisconnected, NewState: StateOffline},
 	}, diffs)
 }
 
 func TestCalculateStateDiffsOneRemovedOneUnchanged(t *testing.T) {
-	oldStates := map[string]DeviceState{
-		"1": StateOffline,
-		"2": StateOnline,
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOffline,
+		{serial: "2"}: StateOnline,
 	}
-	newStates := map[string]DeviceState{
-		"2": StateOnline,
+	newStates := map[deviceKey]DeviceState{
+		{serial: "2"}: StateOnline,
 	}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
 
 	assertContainsOnly(t, []DeviceStateChangedEvent{
-		DeviceStateChangedEvent{"1", StateOffline, StateDisconnected},
+		DeviceStateChangedEvent{Serial: "1", OldState: StateOffline, NewState: StateDisconnected},
 	}, diffs)
 }
 
 func TestCalculateStateDiffsOneAddedOneRemoved(t *testing.T) {
-	oldStates := map[string]DeviceState{
-		"1": StateOffline,
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOffline,
 	}
-	newStates := map[string]DeviceState{
-		"2": StateOffline,
+	newStates := map[deviceKey]DeviceState{
+		{serial: "2"}: StateOffline,
 	}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
 
 	assertContainsOnly(t, []DeviceStateChangedEvent{
-		DeviceStateChangedEvent{"1", StateOffline, StateDisconnected},
-		DeviceStateChangedEvent{"2", StateDisconnected, StateOffline},
+		DeviceStateChangedEvent{Serial: "1", OldState: StateOffline, NewState: StateDisconnected},
+		DeviceStateChangedEvent{Serial: "2", OldState: StateDisconnected, NewState: StateOffline},
 	}, diffs)
 }
 
 func TestCalculateStateDiffsOneChangedOneUnchanged(t *testing.T) {
-	oldStates := map[string]DeviceState{
-		"1": StateOffline,
-		"2": StateOnline,
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOffline,
+		{serial: "2"}: StateOnline,
 	}
-	newStates := map[string]DeviceState{
-		"1": StateOnline,
-		"2": StateOnline,
+	newStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOnline,
+		{serial: "2"}: StateOnline,
 	}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
 
 	assertContainsOnly(t, []DeviceStateChangedEvent{
-		DeviceStateChangedEvent{"1", StateOffline, StateOnline},
+		DeviceStateChangedEvent{Serial: "1", OldState: StateOffline, NewState: StateOnline},
 	}, diffs)
 }
 
 func TestCalculateStateDiffsMultipleChanged(t *testing.T) {
-	oldStates := map[string]DeviceState{
-		"1": StateOffline,
-		"2": StateOnline,
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOffline,
+		{serial: "2"}: StateOnline,
 	}
-	newStates := map[string]DeviceState{
-		"1": StateOnline,
-		"2": StateOffline,
+	newStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOnline,
+		{serial: "2"}: StateOffline,
 	}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
 
 	assertContainsOnly(t, []DeviceStateChangedEvent{
-		DeviceStateChangedEvent{"1", StateOffline, StateOnline},
-		DeviceStateChangedEvent{"2", StateOnline, StateOffline},
+		DeviceStateChangedEvent{Serial: "1", OldState: StateOffline, NewState: StateOnline},
+		DeviceStateChangedEvent{Serial: "2", OldState: StateOnline, NewState: StateOffline},
 	}, diffs)
 }
 
 func TestCalculateStateDiffsOneAddedOneRemovedOneChanged(t *testing.T) {
-	oldStates := map[string]DeviceState{
-		"1": StateOffline,
-		"2": StateOffline,
+	oldStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOffline,
+		{serial: "2"}: StateOffline,
 	}
-	newStates := map[string]DeviceState{
-		"1": StateOnline,
-		"3": StateOffline,
+	newStates := map[deviceKey]DeviceState{
+		{serial: "1"}: StateOnline,
+		{serial: "3"}: StateOffline,
 	}
 
 	diffs := calculateStateDiffs(oldStates, newStates)
 
 	assertContainsOnly(t, []DeviceStateChangedEvent{
-		DeviceStateChangedEvent{"1", StateOffline, StateOnline},
-		DeviceStateChangedEvent{"2", StateOffline, StateDisconnected},
-		DeviceStateChangedEvent{"3", StateDisconnected, StateOffline},
+		DeviceStateChangedEvent{Serial: "1", OldState: StateOffline, NewState: StateOnline},
+		DeviceStateChangedEvent{Serial: "2", OldState: StateOffline, NewState: StateDisconnected},
+		DeviceStateChangedEvent{Serial: "3", OldState: StateDisconnected, NewState: StateOffline},
 	}, diffs)
 }
 
 func TestCameOnline(t *testing.T) {
-	assert.True(t, DeviceStateChangedEvent{"", StateDisconnected, StateOnline}.CameOnline())
-	assert.True(t, DeviceStateChangedEvent{"", StateOffline, StateOnline}.CameOnline())
-	assert.False(t, DeviceStateChangedEvent{"", StateOnline, StateOffline}.CameOnline())
-	assert.False(t, DeviceStateChangedEvent{"", StateOnline, StateDisconnected}.CameOnline())
-	assert.False(t, DeviceStateChangedEvent{"", StateOffline, StateDisconnected}.CameOnline())
+	assert.True(t, DeviceStateChangedEvent{OldState: StateDisconnected, NewState: StateOnline}.CameOnline())
+	assert.True(t, DeviceStateChangedEvent{OldState: StateOffline, NewState: StateOnline}.CameOnline())
+	assert.False(t, DeviceStateChangedEvent{OldState: StateOnline, NewState: StateOffline}.CameOnline())
+	assert.False(t, DeviceStateChangedEvent{OldState: StateOnline, NewState: StateDisconnected}.CameOnline())
+	assert.False(t, DeviceStateChangedEvent{OldState: StateOffline, NewState: StateDisconnected}.CameOnline())
 }
 
 func TestWentOffline(t *testing.T) {
-	assert.True(t, DeviceStateChangedEvent{"", StateOnline, StateDisconnected}.WentOffline())
-	assert.True(t, DeviceStateChangedEvent{"", StateOnline, StateOffline}.WentOffline())
-	assert.False(t, DeviceStateChangedEvent{"", StateOffline, StateOnline}.WentOffline())
-	assert.False(t, DeviceStateChangedEvent{"", StateDisconnected, StateOnline}.WentOffline())
-	assert.False(t, DeviceStateChangedEvent{"", StateOffline, StateDisconnected}.WentOffline())
+	assert.True(t, DeviceStateChangedEvent{OldState: StateOnline, NewState: StateDisconnected}.WentOffline())
+	assert.True(t, DeviceStateChangedEvent{OldState: StateOnline, NewState: StateOffline}.WentOffline())
+	assert.False(t, DeviceStateChangedEvent{OldState: StateOffline, NewState: StateOnline}.WentOffline())
+	assert.False(t, DeviceStateChangedEvent{OldState: StateDisconnected, NewState: StateOnline}.WentOffline())
+	assert.False(t, DeviceStateChangedEvent{OldState: StateOffline, NewState: StateDisconnected}.WentOffline())
 }
 
 func TestPublishDevicesRestartsServer(t *testing.T) {
@@ -222,12 +266,26 @@ func TestPublishDevicesRestartsServer(t *testing.T) {
 	publishDevices(&watcher)
 
 	assert.Empty(t, server.Errs)
-	assert.Equal(t, []string{"host:track-devices"}, server.Requests)
+	assert.Equal(t, []string{"host:track-devices-l"}, server.Requests)
 	assert.Equal(t, []string{"Dial", "SendMessage", "ReadStatus", "ReadMessage", "Start", "Dial"}, server.Trace)
 	err := watcher.err.Load().(*errors.Err)
 	assert.Equal(t, errors.ServerNotAvailable, err.Code)
 }
 
+func TestConnectToTrackDevicesFallsBackToShortForm(t *testing.T) {
+	server := &MockServer{
+		Status: wire.StatusSuccess,
+		Errs: []error{
+			nil, nil, errors.Errorf(errors.UnknownService, "unknown host service"),
+		},
+	}
+
+	_, long, err := connectToTrackDevices(server)
+	assert.NoError(t, err)
+	assert.False(t, long)
+	assert.Equal(t, []string{"host:track-devices-l", "host:track-devices"}, server.Requests)
+}
+
 func assertContainsOnly(t *testing.T, expected, actual []DeviceStateChangedEvent) {
 	assert.Len(t, actual, len(expected))
 	for _, expectedEntry := range expected {
@@ -4,9 +4,9 @@ package adb
 
 import "fmt"
 
-const _DeviceState_name = "StateInvalidStateUnauthorizedStateDisconnectedStateOfflineStateOnline"
+const _DeviceState_name = "StateInvalidStateUnauthorizedStateDisconnectedStateOfflineStateOnlineStateBootloaderStateRecoveryStateSideloadStateRescueStateHostStateNoPermissionsStateAuthorizingStateConnecting"
 
-var _DeviceState_index = [...]uint8{0, 12, 29, 46, 58, 69}
+var _DeviceState_index = [...]uint8{0, 12, 29, 46, 58, 69, 84, 97, 110, 121, 130, 148, 164, 179}
 
 func (i DeviceState) String() string {
 	if i < 0 || i >= DeviceState(len(_DeviceState_index)-1) {
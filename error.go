@@ -1,8 +1,10 @@
 package adb
 
-import "github.com/zach-klippenstein/goadb/internal/errors"
+import (
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
 
-type ErrCode errors.ErrCode
+type ErrCode = errors.ErrCode
 
 const (
 	AssertionError = ErrCode(errors.AssertionError)
@@ -19,8 +21,87 @@ const (
 	DeviceNotFound = ErrCode(errors.DeviceNotFound)
 	// Tried to perform an operation on a path that doesn't exist on the device.
 	FileNoExistError = ErrCode(errors.FileNoExistError)
+	// The device refused to perform an operation on a path because of its permissions.
+	FilePermissionDeniedError = ErrCode(errors.FilePermissionDeniedError)
+	// Tried to remove a directory that isn't empty.
+	DirNotEmptyError = ErrCode(errors.DirNotEmptyError)
+	// Tried to create a file or directory at a path that already exists.
+	FileExistsError = ErrCode(errors.FileExistsError)
+	// A file on the device doesn't match the data that was transferred.
+	FileMismatchError = ErrCode(errors.FileMismatchError)
+	// The device hasn't authorized this computer's key.
+	DeviceUnauthorized = ErrCode(errors.DeviceUnauthorized)
+	// The device is offline, e.g. because it's still connecting.
+	DeviceOffline = ErrCode(errors.DeviceOffline)
+	// The request didn't specify a device, and there is more than one.
+	MoreThanOneDevice = ErrCode(errors.MoreThanOneDevice)
+	// The request didn't specify a device, and there are none.
+	NoDevices = ErrCode(errors.NoDevices)
+	// The server doesn't have permission to use the device, e.g. because of udev rules.
+	DevicePermissionDenied = ErrCode(errors.DevicePermissionDenied)
+	// Tried to modify a read-only file system on the device.
+	ReadOnlyFileSystem = ErrCode(errors.ReadOnlyFileSystem)
+	// The server or device closed the connection, or didn't follow the protocol.
+	ProtocolFault = ErrCode(errors.ProtocolFault)
+	// The server doesn't support the requested service.
+	UnknownService = ErrCode(errors.UnknownService)
+	// A system property isn't set on the device.
+	PropertyNotFound = ErrCode(errors.PropertyNotFound)
+	// The device refused to set a system property, e.g. because it's read-only.
+	PropertyPermissionDenied = ErrCode(errors.PropertyPermissionDenied)
+	// The operation's context was canceled, or its deadline passed, before it finished.
+	Canceled = ErrCode(errors.Canceled)
+	// Reading or writing local data failed, e.g. the reader passed to Device.PushFile.
+	LocalIOError = ErrCode(errors.LocalIOError)
 )
 
+/*
+Sentinel errors for each ErrCode. Errors returned by this package match the sentinel for their
+code with errors.Is, e.g.
+
+	if errors.Is(err, adb.ErrDeviceNotFound) {
+
+FileNoExistError, FilePermissionDeniedError and FileExistsError errors also match os.ErrNotExist,
+os.ErrPermission and os.ErrExist respectively.
+*/
+var (
+	ErrAssertion                error = errors.AssertionError
+	ErrParse                    error = errors.ParseError
+	ErrServerNotAvailable       error = errors.ServerNotAvailable
+	ErrNetwork                  error = errors.NetworkError
+	ErrConnectionReset          error = errors.ConnectionResetError
+	ErrAdb                      error = errors.AdbError
+	ErrDeviceNotFound           error = errors.DeviceNotFound
+	ErrFileNoExist              error = errors.FileNoExistError
+	ErrFilePermissionDenied     error = errors.FilePermissionDeniedError
+	ErrDirNotEmpty              error = errors.DirNotEmptyError
+	ErrFileExists               error = errors.FileExistsError
+	ErrFileMismatch             error = errors.FileMismatchError
+	ErrDeviceUnauthorized       error = errors.DeviceUnauthorized
+	ErrDeviceOffline            error = errors.DeviceOffline
+	ErrMoreThanOneDevice        error = errors.MoreThanOneDevice
+	ErrNoDevices                error = errors.NoDevices
+	ErrDevicePermissionDenied   error = errors.DevicePermissionDenied
+	ErrReadOnlyFileSystem       error = errors.ReadOnlyFileSystem
+	ErrProtocolFault            error = errors.ProtocolFault
+	ErrUnknownService           error = errors.UnknownService
+	ErrPropertyNotFound         error = errors.PropertyNotFound
+	ErrPropertyPermissionDenied error = errors.PropertyPermissionDenied
+	ErrCanceled                 error = errors.Canceled
+	ErrLocalIO                  error = errors.LocalIOError
+)
+
+/*
+ServerError is an error message the server returned for a request. Errors returned by this
+package caused by one can be converted to it with errors.As:
+
+	var serverErr *adb.ServerError
+	if errors.As(err, &serverErr) {
+		log.Println(serverErr.ServerMsg)
+	}
+*/
+type ServerError = errors.ServerError
+
 // HasErrCode returns true if err is an *errors.Err and err.Code == code.
 func HasErrCode(err error, code ErrCode) bool {
 	return errors.HasErrCode(err, errors.ErrCode(code))
@@ -0,0 +1,43 @@
+package adb
+
+import (
+	stderrors "errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+func TestErrorsIs(t *testing.T) {
+	s := &MockServer{
+		Errs: []error{errors.Errorf(errors.DeviceNotFound, "not found")},
+	}
+	_, err := (&Adb{server: s}).Device(AnyDevice()).Serial()
+	assert.True(t, stderrors.Is(err, ErrDeviceNotFound))
+	assert.False(t, stderrors.Is(err, ErrAdb))
+
+	err = wrapClientError(errors.Errorf(errors.FileNoExistError, "no such file"), s, "Stat")
+	assert.True(t, stderrors.Is(err, ErrFileNoExist))
+	assert.True(t, stderrors.Is(err, os.ErrNotExist))
+	assert.False(t, stderrors.Is(err, os.ErrExist))
+}
+
+func TestErrorsAsServerError(t *testing.T) {
+	cause := &errors.Err{
+		Code:    errors.AdbError,
+		Message: "server error for host:version request: unknown host service",
+		Details: wire.ErrorResponseDetails{Request: "host:version", ServerMsg: "unknown host service"},
+	}
+	err := wrapClientError(cause, &MockServer{}, "ServerVersion")
+
+	var serverErr *ServerError
+	if assert.True(t, stderrors.As(err, &serverErr)) {
+		assert.Equal(t, &ServerError{Code: AdbError, Request: "host:version", ServerMsg: "unknown host service"}, serverErr)
+		assert.EqualError(t, serverErr, "server error for host:version request: unknown host service")
+	}
+
+	err = wrapClientError(errors.Errorf(errors.NetworkError, "broken"), &MockServer{}, "ServerVersion")
+	assert.False(t, stderrors.As(err, &serverErr))
+}
@@ -0,0 +1,49 @@
+package adb
+
+import (
+	"io"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+/*
+OpenExec runs cmd with the exec service, and returns a reader for its stdout. The reader must be
+closed.
+
+Unlike RunCommand, which uses the shell service, exec never allocates a PTY, so the output is
+passed through unmodified and is safe to use for binary data, e.g.
+
+	reader, err := device.OpenExec(adb.NewCommand("screencap", "-p"))
+
+The exec service doesn't report the command's exit status, and needs Android 5.0 or later.
+*/
+func (c *Device) OpenExec(cmd *Command) (io.ReadCloser, error) {
+	cmdLine, err := cmd.commandLine()
+	if err != nil {
+		return nil, wrapClientError(err, c, "OpenExec")
+	}
+
+	reader, err := c.openExec(cmdLine)
+	return reader, wrapClientError(err, c, "OpenExec(%s)", cmdLine)
+}
+
+// Exec runs cmd with the exec service like OpenExec, and copies its stdout to w until it exits.
+// Returns the number of bytes copied.
+func (c *Device) Exec(w io.Writer, cmd *Command) (int64, error) {
+	cmdLine, err := cmd.commandLine()
+	if err != nil {
+		return 0, wrapClientError(err, c, "Exec")
+	}
+
+	reader, err := c.openExec(cmdLine)
+	if err != nil {
+		return 0, wrapClientError(err, c, "Exec(%s)", cmdLine)
+	}
+	defer reader.Close()
+
+	n, err := io.Copy(w, reader)
+	if err != nil {
+		err = errors.WrapErrorf(err, errors.NetworkError, "error copying output")
+	}
+	return n, wrapClientError(err, c, "Exec(%s)", cmdLine)
+}
@@ -0,0 +1,42 @@
+package adb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/adbtest"
+)
+
+func TestExec(t *testing.T) {
+	server := adbtest.NewServer()
+	defer server.Close()
+	var cmds []string
+	server.AddDevice("serial").HandleShell(func(cmd string) string {
+		cmds = append(cmds, cmd)
+		return "\x89PNG\r\n\x1a\n\x00"
+	})
+	client, err := NewWithConfig(ServerConfig{Dialer: server, NoStartServer: true})
+	require.NoError(t, err)
+	d := client.Device(DeviceWithSerial("serial"))
+
+	var buf bytes.Buffer
+	n, err := d.Exec(&buf, NewCommand("screencap", "-p"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), n)
+	assert.Equal(t, "\x89PNG\r\n\x1a\n\x00", buf.String())
+
+	reader, err := d.OpenExec(NewCommand("cat", `"my file"`))
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "\x89PNG\r\n\x1a\n\x00", string(data))
+	reader.Close()
+
+	assert.Equal(t, []string{`screencap -p`, `cat '"my file"'`}, cmds)
+
+	_, err = d.Exec(&buf, NewCommand(""))
+	assert.True(t, HasErrCode(err, AssertionError))
+}
@@ -0,0 +1,127 @@
+package adb
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Feature is a protocol feature supported by the adb server or a device. Some services can only be
+// used, or behave differently, if both ends support a feature.
+type Feature string
+
+// Features reported by adb servers and devices.
+const (
+	// The shell service supports the v2 protocol, which separates stdout and stderr and reports
+	// exit statuses.
+	FeatureShell2 Feature = "shell_v2"
+	// The device has the cmd command, for calling system services.
+	FeatureCmd Feature = "cmd"
+	// The sync service supports STA2 and LST2, which return 64-bit sizes and more fields.
+	FeatureStat2 Feature = "stat_v2"
+	FeatureLs2   Feature = "ls_v2"
+	// Pushing a file creates its parent directories.
+	FeatureFixedPushMkdir Feature = "fixed_push_mkdir"
+	// Pushing a symlink preserves its timestamp.
+	FeatureFixedPushSymlinkTimestamp Feature = "fixed_push_symlink_timestamp"
+	// The device supports installing APEX packages.
+	FeatureApex Feature = "apex"
+	// The device supports the abb and abb_exec services, for calling system services without a
+	// shell.
+	FeatureAbb     Feature = "abb"
+	FeatureAbbExec Feature = "abb_exec"
+	// The sync service supports SND2 and RCV2, which can compress transfers.
+	FeatureSendRecv2 Feature = "sendrecv_v2"
+	// The remount service runs the remount command in a shell.
+	FeatureRemountShell Feature = "remount_shell"
+	// The device supports the track-app service.
+	FeatureTrackApp Feature = "track_app"
+)
+
+// FeatureSet is the set of features supported by the server or a device.
+type FeatureSet map[Feature]bool
+
+// parseFeatures parses a comma-separated list of features, as returned by the features and
+// host-features services.
+func parseFeatures(s string) FeatureSet {
+	features := make(FeatureSet)
+	for _, f := range strings.Split(strings.TrimSpace(s), ",") {
+		if f != "" {
+			features[Feature(f)] = true
+		}
+	}
+	return features
+}
+
+// Has returns true if feature is in the set.
+func (s FeatureSet) Has(feature Feature) bool {
+	return s[feature]
+}
+
+// List returns the features in the set, sorted.
+func (s FeatureSet) List() []Feature {
+	list := make([]Feature, 0, len(s))
+	for f := range s {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+func (s FeatureSet) String() string {
+	list := s.List()
+	strs := make([]string, len(list))
+	for i, f := range list {
+		strs[i] = string(f)
+	}
+	return strings.Join(strs, ",")
+}
+
+/*
+featureCache caches the features of devices, keyed by transport descriptor. Devices selected by
+serial or transport ID always refer to the same device, but others like AnyDevice can refer to a
+different device each time, so their features aren't cached.
+
+A device's features can change when it reconnects, e.g. into recovery, so they're forgotten when
+the device is found to be missing or offline.
+*/
+type featureCache struct {
+	lock     sync.Mutex
+	features map[string]FeatureSet
+}
+
+func newFeatureCache() *featureCache {
+	return &featureCache{features: make(map[string]FeatureSet)}
+}
+
+func (c *featureCache) get(descriptor DeviceDescriptor) (FeatureSet, bool) {
+	if c == nil || !isCacheableDescriptor(descriptor) {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	features, ok := c.features[descriptor.getTransportDescriptor()]
+	return features, ok
+}
+
+func (c *featureCache) put(descriptor DeviceDescriptor, features FeatureSet) {
+	if c == nil || !isCacheableDescriptor(descriptor) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.features[descriptor.getTransportDescriptor()] = features
+}
+
+func (c *featureCache) forget(descriptor DeviceDescriptor) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.features, descriptor.getTransportDescriptor())
+}
+
+func isCacheableDescriptor(descriptor DeviceDescriptor) bool {
+	return descriptor.descriptorType == DeviceSerial || descriptor.descriptorType == DeviceTransportID
+}
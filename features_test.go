@@ -0,0 +1,58 @@
+package adb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/adbtest"
+)
+
+func TestParseFeatures(t *testing.T) {
+	features := parseFeatures("shell_v2,cmd,stat_v2,ls_v2,fixed_push_mkdir,apex,abb,unknown\n")
+	assert.True(t, features.Has(FeatureShell2))
+	assert.True(t, features.Has(FeatureAbb))
+	assert.True(t, features.Has("unknown"))
+	assert.False(t, features.Has(FeatureAbbExec))
+	assert.Equal(t, "abb,apex,cmd,fixed_push_mkdir,ls_v2,shell_v2,stat_v2,unknown", features.String())
+
+	assert.Empty(t, parseFeatures(""))
+}
+
+func TestFeatures(t *testing.T) {
+	server := adbtest.NewServer()
+	defer server.Close()
+	server.SetHostFeatures("shell_v2", "cmd")
+	device := server.AddDevice("serial")
+	device.SetFeatures("shell_v2", "abb")
+
+	client, err := NewWithConfig(ServerConfig{Dialer: server, NoStartServer: true})
+	require.NoError(t, err)
+
+	hostFeatures, err := client.HostFeatures()
+	assert.NoError(t, err)
+	assert.Equal(t, FeatureSet{FeatureShell2: true, FeatureCmd: true}, hostFeatures)
+
+	d := client.Device(DeviceWithSerial("serial"))
+	features, err := d.Features()
+	assert.NoError(t, err)
+	assert.Equal(t, FeatureSet{FeatureShell2: true, FeatureAbb: true}, features)
+
+	// The features of devices selected by serial are cached.
+	device.SetFeatures("shell_v2")
+	features, err = d.Features()
+	assert.NoError(t, err)
+	assert.True(t, features.Has(FeatureAbb))
+	features, err = client.Device(AnyDevice()).Features()
+	assert.NoError(t, err)
+	assert.False(t, features.Has(FeatureAbb))
+
+	// Until the device disconnects.
+	server.RemoveDevice("serial")
+	_, err = d.Serial()
+	assert.True(t, HasErrCode(err, DeviceNotFound))
+	server.AddDevice("serial").SetFeatures("cmd")
+	features, err = d.Features()
+	assert.NoError(t, err)
+	assert.Equal(t, FeatureSet{FeatureCmd: true}, features)
+}
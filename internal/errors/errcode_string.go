@@ -4,9 +4,9 @@ package errors
 
 import "fmt"
 
-const _ErrCode_name = "AssertionErrorParseErrorServerNotAvailableNetworkErrorConnectionResetErrorAdbErrorDeviceNotFoundFileNoExistError"
+const _ErrCode_name = "AssertionErrorParseErrorServerNotAvailableNetworkErrorConnectionResetErrorAdbErrorDeviceNotFoundFileNoExistErrorFilePermissionDeniedErrorDirNotEmptyErrorFileExistsErrorFileMismatchErrorDeviceUnauthorizedDeviceOfflineMoreThanOneDeviceNoDevicesDevicePermissionDeniedReadOnlyFileSystemProtocolFaultUnknownServicePropertyNotFoundPropertyPermissionDeniedCanceledLocalIOError"
 
-var _ErrCode_index = [...]uint8{0, 14, 24, 42, 54, 74, 82, 96, 112}
+var _ErrCode_index = [...]uint16{0, 14, 24, 42, 54, 74, 82, 96, 112, 137, 153, 168, 185, 203, 216, 233, 242, 264, 282, 295, 309, 325, 349, 357, 369}
 
 func (i ErrCode) String() string {
 	if i >= ErrCode(len(_ErrCode_index)-1) {
@@ -3,6 +3,7 @@ package errors
 import (
 	"bytes"
 	"fmt"
+	"os"
 )
 
 /*
@@ -50,8 +51,81 @@ const (
 	DeviceNotFound
 	// Tried to perform an operation on a path that doesn't exist on the device.
 	FileNoExistError
+	// The device refused to perform an operation on a path because of its permissions.
+	FilePermissionDeniedError
+	// Tried to remove a directory that isn't empty.
+	DirNotEmptyError
+	// Tried to create a file or directory at a path that already exists.
+	FileExistsError
+	// A file on the device doesn't match the data that was transferred.
+	FileMismatchError
+	// The device hasn't authorized this computer's key.
+	DeviceUnauthorized
+	// The device is offline, e.g. because it's still connecting.
+	DeviceOffline
+	// The request didn't specify a device, and there is more than one.
+	MoreThanOneDevice
+	// The request didn't specify a device, and there are none.
+	NoDevices
+	// The server doesn't have permission to use the device, e.g. because of udev rules.
+	DevicePermissionDenied
+	// Tried to modify a read-only file system on the device.
+	ReadOnlyFileSystem
+	// The server or device closed the connection, or didn't follow the protocol.
+	ProtocolFault
+	// The server doesn't support the requested service.
+	UnknownService
+	// A system property isn't set on the device.
+	PropertyNotFound
+	// The device refused to set a system property, e.g. because it's read-only.
+	PropertyPermissionDenied
+	// The operation's context was canceled, or its deadline passed, before it finished.
+	Canceled
+	// Reading or writing local data failed, e.g. the reader passed to Device.PushFile.
+	LocalIOError
 )
 
+// Error makes ErrCode values usable as sentinel errors, e.g. errors.Is(err, DeviceNotFound).
+func (code ErrCode) Error() string {
+	return code.String()
+}
+
+// osErrors maps ErrCodes to the equivalent errors in the os package, so that e.g.
+// errors.Is(err, os.ErrNotExist) is true for FileNoExistErrors.
+var osErrors = map[ErrCode]error{
+	FileNoExistError:          os.ErrNotExist,
+	FilePermissionDeniedError: os.ErrPermission,
+	FileExistsError:           os.ErrExist,
+}
+
+// ErrorResponseDetails is an error message returned by the server for a particular request.
+type ErrorResponseDetails struct {
+	Request   string
+	ServerMsg string
+}
+
+/*
+ServerError is an error message the server returned for a request. Errors caused by one can be
+converted to it with errors.As:
+
+	var serverErr *adb.ServerError
+	if errors.As(err, &serverErr) {
+		log.Println(serverErr.ServerMsg)
+	}
+*/
+type ServerError struct {
+	Code      ErrCode
+	Request   string
+	ServerMsg string
+}
+
+func (err *ServerError) Error() string {
+	if err.Request == "" {
+		return fmt.Sprintf("server error: %s", err.ServerMsg)
+	}
+	return fmt.Sprintf("server error for %s request: %s", err.Request, err.ServerMsg)
+}
+
 func Errorf(code ErrCode, format string, args ...interface{}) error {
 	return &Err{
 		Code:    code,
@@ -116,6 +190,11 @@ func (errs multiError) Error() string {
 	return buf.String()
 }
 
+// Unwrap returns all the errors, so errors.Is and errors.As check each of them.
+func (errs multiError) Unwrap() []error {
+	return errs
+}
+
 /*
 WrapErrorf returns an *Err that wraps another arbitrary error with an ErrCode and a message.
 
@@ -151,6 +230,41 @@ func (err *Err) Error() string {
 	return msg
 }
 
+// Unwrap returns the cause of err, if any, for errors.Unwrap.
+func (err *Err) Unwrap() error {
+	return err.Cause
+}
+
+// Is returns true if target is err's ErrCode, or the os package's equivalent of it.
+func (err *Err) Is(target error) bool {
+	if code, ok := target.(ErrCode); ok {
+		return err.Code == code
+	}
+	if osErr, ok := osErrors[err.Code]; ok {
+		return target == osErr
+	}
+	return false
+}
+
+// As converts err to a *ServerError if target is a **ServerError and err has
+// ErrorResponseDetails, for errors.As.
+func (err *Err) As(target interface{}) bool {
+	serverErr, ok := target.(**ServerError)
+	if !ok {
+		return false
+	}
+	details, ok := err.Details.(ErrorResponseDetails)
+	if !ok {
+		return false
+	}
+	*serverErr = &ServerError{
+		Code:      err.Code,
+		Request:   details.Request,
+		ServerMsg: details.ServerMsg,
+	}
+	return true
+}
+
 // HasErrCode returns true if err is an *Err and err.Code == code.
 func HasErrCode(err error, code ErrCode) bool {
 	switch err := err.(type) {
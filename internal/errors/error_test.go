@@ -2,6 +2,7 @@ package errors
 
 import (
 	"errors"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -42,3 +43,53 @@ func TestCombineErrors(t *testing.T) {
 	assert.Equal(t, `AdbError: hello
 caused by 2 errors: [lulz ∪ fail]`, ErrorWithCauseChain(err))
 }
+
+func TestErrIsAndUnwrap(t *testing.T) {
+	cause := errors.New("cause")
+	err := WrapErrf(WrapErrorf(cause, FileNoExistError, "stat"), "error performing Stat")
+
+	assert.True(t, errors.Is(err, FileNoExistError))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.True(t, errors.Is(err, cause))
+	assert.False(t, errors.Is(err, DeviceNotFound))
+	assert.False(t, errors.Is(err, os.ErrPermission))
+	assert.Equal(t, cause, errors.Unwrap(errors.Unwrap(err)))
+
+	// ErrCodes are errors themselves, so they can be used as sentinels.
+	assert.EqualError(t, DeviceNotFound, "DeviceNotFound")
+	assert.EqualError(t, err, "FileNoExistError: error performing Stat")
+}
+
+func TestCombineErrorsIs(t *testing.T) {
+	err1 := errors.New("lulz")
+	err2 := WrapErrorf(os.ErrNotExist, FileNoExistError, "stat")
+
+	err := CombineErrs("hello", NetworkError, err1, err2)
+	assert.True(t, errors.Is(err, err1))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.True(t, errors.Is(err, FileNoExistError))
+	assert.False(t, errors.Is(err, os.ErrPermission))
+}
+
+func TestErrAsServerError(t *testing.T) {
+	cause := &Err{
+		Code:    DeviceNotFound,
+		Message: "server error",
+		Details: ErrorResponseDetails{Request: "host:transport:abc", ServerMsg: "device 'abc' not found"},
+	}
+	err := WrapErrf(cause, "error getting device state")
+
+	var serverErr *ServerError
+	if assert.True(t, errors.As(err, &serverErr)) {
+		assert.Equal(t, &ServerError{
+			Code:      DeviceNotFound,
+			Request:   "host:transport:abc",
+			ServerMsg: "device 'abc' not found",
+		}, serverErr)
+	}
+	assert.False(t, errors.As(Errorf(NetworkError, "broken"), &serverErr))
+
+	// Server errors are also found among combined errors.
+	err = CombineErrs("hello", NetworkError, errors.New("lulz"), cause)
+	assert.True(t, errors.As(err, &serverErr))
+}
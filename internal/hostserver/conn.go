@@ -0,0 +1,63 @@
+package hostserver
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// Conn is a connection from a client to an adb server.
+type Conn struct {
+	io.ReadWriteCloser
+	Scanner wire.Scanner
+}
+
+// NewConn returns a Conn that reads requests from rw and writes responses to it.
+func NewConn(rw io.ReadWriteCloser) *Conn {
+	return &Conn{rw, wire.NewScanner(rw)}
+}
+
+// Okay sends an OKAY status.
+func (c *Conn) Okay() error {
+	_, err := io.WriteString(c, wire.StatusSuccess)
+	return err
+}
+
+// Message sends msg with a hex length header.
+func (c *Conn) Message(msg string) error {
+	_, err := fmt.Fprintf(c, "%04x%s", len(msg), msg)
+	return err
+}
+
+// OkayMessage sends an OKAY status, followed by msg with a hex length header.
+func (c *Conn) OkayMessage(msg string) error {
+	if err := c.Okay(); err != nil {
+		return err
+	}
+	return c.Message(msg)
+}
+
+// Fail sends a FAIL status, followed by msg with a hex length header.
+func (c *Conn) Fail(msg string) error {
+	if _, err := io.WriteString(c, wire.StatusFailure); err != nil {
+		return err
+	}
+	return c.Message(msg)
+}
+
+// Splice copies data between a and b until either is closed, then closes both.
+func Splice(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,624 @@
+/*
+Package hostserver implements the host services of an adb server, i.e. the smart socket protocol
+spoken by adb clients, for the servers in the transport and adbtest packages. The devices, and the
+services opened on them, are provided by a Backend.
+*/
+package hostserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+// Message returned by real servers when trying to use an unauthorized device.
+const unauthorizedMessage = "device unauthorized.\n" +
+	"This adb server's $ADB_VENDOR_KEYS is not set\n" +
+	"Try 'adb kill-server' if that seems wrong.\n" +
+	"Otherwise check for a confirmation dialog on your device."
+
+// Device is a device attached to a server.
+type Device interface {
+	Serial() string
+	// State returns the state reported by host:devices and get-state, e.g. "device" or "offline".
+	State() string
+	// TransportID returns the device's transport ID, or 0 if it doesn't have one.
+	TransportID() int64
+	Features() []string
+	Info() DeviceInfo
+}
+
+// DeviceInfo holds the attributes of a device reported by host:devices-l and get-devpath.
+type DeviceInfo struct {
+	Product string
+	Model   string
+	Device  string
+
+	// Only set for devices connected via USB. Devices without it are selected by
+	// host:transport-local, and devices with it by host:transport-usb.
+	Usb string
+
+	// Returned by get-devpath. If empty, "unknown" is returned.
+	DevPath string
+}
+
+// Forward is a port forward created with the forward service.
+type Forward struct {
+	Serial string
+	// Local is the port on the host, e.g. "tcp:8080".
+	Local string
+	// Remote is the service opened on the device, e.g. "tcp:8080" or "localabstract:foo".
+	Remote string
+}
+
+// Backend provides the devices of a Server.
+type Backend interface {
+	// Version returns the version reported by host:version.
+	Version() int
+	// HostFeatures returns the features reported by host:host-features.
+	HostFeatures() []string
+
+	// Devices returns the attached devices, in the order they were attached. Server.Notify must
+	// be called every time the list, or the state of a device, changes.
+	Devices() []Device
+
+	// HandleHostRequest serves a host request that the Server doesn't handle itself, e.g.
+	// host:connect. It's called before the Server's own handling, and returns false if it didn't
+	// handle req.
+	HandleHostRequest(c *Conn, req string) bool
+
+	// ServeTransport serves c once it has been switched to d by a host:transport request. The
+	// request hasn't been acknowledged yet.
+	ServeTransport(c *Conn, d Device)
+
+	// Forward starts forwarding connections to local on the host, e.g. "tcp:8080", to the remote
+	// service on d. It returns the local address with the port that was picked if the port was 0,
+	// and a Closer that stops forwarding, which may be nil.
+	Forward(d Device, local, remote string) (string, io.Closer, error)
+}
+
+/*
+Server serves the host services of an adb server: version, host-features, the device list,
+selecting devices with the transport requests, and the attributes and port forwards of devices.
+Everything else is left to its Backend.
+
+Server is safe for concurrent use.
+*/
+type Server struct {
+	backend Backend
+
+	lock     sync.Mutex
+	forwards []*forward
+	listener net.Listener
+	conns    map[io.ReadWriteCloser]struct{}
+	// Closed and replaced every time the device list changes.
+	changed chan struct{}
+	done    chan struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// A forward and the Closer that stops it.
+type forward struct {
+	Forward
+	closer io.Closer
+}
+
+func (f *forward) close() {
+	if f.closer != nil {
+		f.closer.Close()
+	}
+}
+
+// NewServer returns a server for the devices of backend. It doesn't listen until Serve is
+// called.
+func NewServer(backend Backend) *Server {
+	return &Server{
+		backend: backend,
+		conns:   make(map[io.ReadWriteCloser]struct{}),
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Serve serves clients connecting to listener, until the server is closed. The server owns
+// listener, and closes it if it can't be used.
+func (s *Server) Serve(listener net.Listener) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		listener.Close()
+		return errors.Errorf(errors.ServerNotAvailable, "server closed")
+	}
+	if s.listener != nil {
+		listener.Close()
+		return errors.AssertionErrorf("server already started")
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.acceptConns(listener)
+	return nil
+}
+
+// Addr returns the address the server is listening on, or nil if Serve hasn't been called.
+func (s *Server) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Dial returns a connection to the server over an in-memory pipe.
+func (s *Server) Dial() (io.ReadWriteCloser, error) {
+	client, server := net.Pipe()
+	if err := s.ServeConn(server); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// ServeConn starts serving a connection from a client in a new goroutine.
+func (s *Server) ServeConn(rw io.ReadWriteCloser) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errors.Errorf(errors.ServerNotAvailable, "server closed")
+	}
+	s.conns[rw] = struct{}{}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.lock.Lock()
+			delete(s.conns, rw)
+			s.lock.Unlock()
+			rw.Close()
+		}()
+
+		c := NewConn(rw)
+		req, err := c.Scanner.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.handleHostRequest(c, string(req))
+	}()
+	return nil
+}
+
+// Notify wakes up any clients tracking devices, after the device list has changed.
+func (s *Server) Notify() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Done returns a channel that's closed when the server is closed.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Forwards returns the port forwards that have been created by clients.
+func (s *Server) Forwards() []Forward {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	forwards := make([]Forward, len(s.forwards))
+	for i, f := range s.forwards {
+		forwards[i] = f.Forward
+	}
+	return forwards
+}
+
+// RemoveForwards stops and removes the forwards to the device with serial.
+func (s *Server) RemoveForwards(serial string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var forwards []*forward
+	for _, f := range s.forwards {
+		if f.Serial == serial {
+			f.close()
+		} else {
+			forwards = append(forwards, f)
+		}
+	}
+	s.forwards = forwards
+}
+
+// Close stops listening, removes all forwards, closes all client connections, and waits for them
+// to finish. Returns the error from closing the listener, if any.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for rw := range s.conns {
+		rw.Close()
+	}
+	for _, f := range s.forwards {
+		f.close()
+	}
+	s.forwards = nil
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) acceptConns(listener net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if err := s.ServeConn(conn); err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// selector identifies the device a request is for, as in host-serial:<serial>:<request> or
+// host:transport-usb. The zero value selects any device.
+type selector struct {
+	serial      string
+	transportID int64
+	usb         bool
+	local       bool
+}
+
+// Host services that are sent to a specific device with a prefix like host-serial:<serial>:.
+// Serials of TCP devices contain colons, so these are used to find where the serial ends.
+var deviceHostServices = []string{
+	"get-state",
+	"get-serialno",
+	"get-devpath",
+	"features",
+	"forward:",
+	"killforward:",
+	"killforward-all",
+	"list-forward",
+}
+
+func (s *Server) handleHostRequest(c *Conn, req string) {
+	if s.backend.HandleHostRequest(c, req) {
+		return
+	}
+
+	switch {
+	case req == "host:version":
+		c.OkayMessage(fmt.Sprintf("%04x", s.backend.Version()))
+	case req == "host:host-features":
+		c.OkayMessage(strings.Join(s.backend.HostFeatures(), ","))
+
+	case req == "host:devices":
+		c.OkayMessage(formatDevices(s.backend.Devices(), false))
+	case req == "host:devices-l":
+		c.OkayMessage(formatDevices(s.backend.Devices(), true))
+	case req == "host:track-devices":
+		s.trackDevices(c, false)
+	case req == "host:track-devices-l":
+		s.trackDevices(c, true)
+
+	case req == "host:transport-any":
+		s.handleTransport(c, selector{})
+	case req == "host:transport-usb":
+		s.handleTransport(c, selector{usb: true})
+	case req == "host:transport-local":
+		s.handleTransport(c, selector{local: true})
+	case strings.HasPrefix(req, "host:transport:"):
+		s.handleTransport(c, selector{serial: strings.TrimPrefix(req, "host:transport:")})
+	case strings.HasPrefix(req, "host:transport-id:"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(req, "host:transport-id:"), 10, 64)
+		if err != nil {
+			c.Fail(fmt.Sprintf("invalid transport id: %s", req))
+			return
+		}
+		s.handleTransport(c, selector{transportID: id})
+
+	case strings.HasPrefix(req, "host-serial:"):
+		rest := strings.TrimPrefix(req, "host-serial:")
+		for _, service := range deviceHostServices {
+			if i := strings.Index(rest, ":"+service); i >= 0 {
+				s.handleDeviceHostRequest(c, selector{serial: rest[:i]}, rest[i+1:])
+				return
+			}
+		}
+		c.Fail(fmt.Sprintf("unknown host service: %s", req))
+	case strings.HasPrefix(req, "host-transport-id:"):
+		rest := strings.TrimPrefix(req, "host-transport-id:")
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			c.Fail(fmt.Sprintf("unknown host service: %s", req))
+			return
+		}
+		id, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			c.Fail(fmt.Sprintf("invalid transport id: %s", req))
+			return
+		}
+		s.handleDeviceHostRequest(c, selector{transportID: id}, rest[i+1:])
+	case strings.HasPrefix(req, "host-usb:"):
+		s.handleDeviceHostRequest(c, selector{usb: true}, strings.TrimPrefix(req, "host-usb:"))
+	case strings.HasPrefix(req, "host-local:"):
+		s.handleDeviceHostRequest(c, selector{local: true}, strings.TrimPrefix(req, "host-local:"))
+	case strings.HasPrefix(req, "host:"):
+		s.handleDeviceHostRequest(c, selector{}, strings.TrimPrefix(req, "host:"))
+
+	default:
+		c.Fail(fmt.Sprintf("unknown host service: %s", req))
+	}
+}
+
+// formatDevices formats devices as returned by host:devices, or host:devices-l if long is true.
+func formatDevices(devices []Device, long bool) string {
+	var buf bytes.Buffer
+	for _, d := range devices {
+		if !long {
+			fmt.Fprintf(&buf, "%s\t%s\n", d.Serial(), d.State())
+			continue
+		}
+
+		info := d.Info()
+		fmt.Fprintf(&buf, "%-22s %s", d.Serial(), d.State())
+		for _, attr := range []struct{ key, val string }{
+			{"usb", info.Usb},
+			{"product", info.Product},
+			{"model", info.Model},
+			{"device", info.Device},
+		} {
+			if attr.val != "" {
+				fmt.Fprintf(&buf, " %s:%s", attr.key, attr.val)
+			}
+		}
+		if id := d.TransportID(); id != 0 {
+			fmt.Fprintf(&buf, " transport_id:%d", id)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// trackDevices sends the device list every time it changes, until the connection or server is
+// closed. Sends the long form of the list if long is true, as for host:track-devices-l.
+func (s *Server) trackDevices(c *Conn, long bool) {
+	if err := c.Okay(); err != nil {
+		return
+	}
+
+	for {
+		s.lock.Lock()
+		changed := s.changed
+		s.lock.Unlock()
+
+		if err := c.Message(formatDevices(s.backend.Devices(), long)); err != nil {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// selectDevice returns the device matching sel. If there isn't exactly one, returns the message
+// a real server would fail with.
+func (s *Server) selectDevice(sel selector) (Device, string) {
+	devices := s.backend.Devices()
+
+	if sel.serial != "" {
+		for _, d := range devices {
+			if d.Serial() == sel.serial {
+				return d, ""
+			}
+		}
+		return nil, fmt.Sprintf("device '%s' not found", sel.serial)
+	}
+	if sel.transportID != 0 {
+		for _, d := range devices {
+			if d.TransportID() == sel.transportID {
+				return d, ""
+			}
+		}
+		return nil, fmt.Sprintf("no device with transport id '%d'", sel.transportID)
+	}
+
+	var matches []Device
+	for _, d := range devices {
+		usb := d.Info().Usb != ""
+		if (sel.usb && !usb) || (sel.local && usb) {
+			continue
+		}
+		matches = append(matches, d)
+	}
+
+	none, many := "no devices/emulators found", "more than one device/emulator"
+	if sel.usb {
+		none, many = "no devices found", "more than one device"
+	} else if sel.local {
+		none, many = "no emulators found", "more than one emulator"
+	}
+	switch len(matches) {
+	case 0:
+		return nil, none
+	case 1:
+		return matches[0], ""
+	default:
+		return nil, many
+	}
+}
+
+// handleTransport switches the connection to the device matching sel, and leaves the rest to the
+// backend.
+func (s *Server) handleTransport(c *Conn, sel selector) {
+	d, msg := s.selectDevice(sel)
+	if d != nil {
+		switch d.State() {
+		case "offline":
+			msg = "device offline"
+		case "unauthorized":
+			msg = unauthorizedMessage
+		}
+	}
+	if msg != "" {
+		c.Fail(msg)
+		return
+	}
+	s.backend.ServeTransport(c, d)
+}
+
+// handleDeviceHostRequest serves a host request for the device matching sel.
+func (s *Server) handleDeviceHostRequest(c *Conn, sel selector, req string) {
+	// list-forward lists the forwards for all devices, so it works without any devices.
+	if req == "list-forward" {
+		var buf bytes.Buffer
+		for _, f := range s.Forwards() {
+			fmt.Fprintf(&buf, "%s %s %s\n", f.Serial, f.Local, f.Remote)
+		}
+		c.OkayMessage(buf.String())
+		return
+	}
+
+	d, msg := s.selectDevice(sel)
+	if d == nil {
+		c.Fail(msg)
+		return
+	}
+
+	switch {
+	case req == "get-state":
+		c.OkayMessage(d.State())
+	case req == "get-serialno":
+		c.OkayMessage(d.Serial())
+	case req == "get-devpath":
+		devPath := d.Info().DevPath
+		if devPath == "" {
+			devPath = "unknown"
+		}
+		c.OkayMessage(devPath)
+	case req == "features":
+		c.OkayMessage(strings.Join(d.Features(), ","))
+	case strings.HasPrefix(req, "forward:"):
+		s.handleForward(c, d, strings.TrimPrefix(req, "forward:"))
+	case strings.HasPrefix(req, "killforward:"):
+		s.handleKillForward(c, strings.TrimPrefix(req, "killforward:"))
+	case req == "killforward-all":
+		s.RemoveForwards(d.Serial())
+		c.Okay()
+	default:
+		c.Fail(fmt.Sprintf("unknown host service: %s", req))
+	}
+}
+
+/*
+handleForward handles forward:[norebind:]<local>;<remote>. Like real servers, it sends one OKAY
+when the request is accepted and another once the forward is created. If the backend picked the
+local port, the port is sent after the second OKAY.
+*/
+func (s *Server) handleForward(c *Conn, d Device, spec string) {
+	noRebind := strings.HasPrefix(spec, "norebind:")
+	spec = strings.TrimPrefix(spec, "norebind:")
+
+	parts := strings.SplitN(spec, ";", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		c.Fail(fmt.Sprintf("malformed forward spec '%s'", spec))
+		return
+	}
+	local, remote := parts[0], parts[1]
+
+	if err := c.Okay(); err != nil {
+		return
+	}
+
+	// The old forward is removed first, so its port can be reused.
+	s.lock.Lock()
+	for i, f := range s.forwards {
+		if f.Local == local {
+			if noRebind {
+				s.lock.Unlock()
+				c.Fail("cannot rebind existing socket")
+				return
+			}
+			f.close()
+			s.forwards = append(s.forwards[:i], s.forwards[i+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	boundLocal, closer, err := s.backend.Forward(d, local, remote)
+	if err != nil {
+		c.Fail(errorMessage(err))
+		return
+	}
+	f := &forward{
+		Forward: Forward{Serial: d.Serial(), Local: boundLocal, Remote: remote},
+		closer:  closer,
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		f.close()
+		c.Fail("server closed")
+		return
+	}
+	s.forwards = append(s.forwards, f)
+	s.lock.Unlock()
+
+	if boundLocal != local {
+		c.OkayMessage(strings.TrimPrefix(boundLocal, "tcp:"))
+	} else {
+		c.Okay()
+	}
+}
+
+func (s *Server) handleKillForward(c *Conn, local string) {
+	s.lock.Lock()
+	found := false
+	for i, f := range s.forwards {
+		if f.Local == local {
+			f.close()
+			s.forwards = append(s.forwards[:i], s.forwards[i+1:]...)
+			found = true
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	if !found {
+		c.Fail(fmt.Sprintf("listener '%s' not found", local))
+		return
+	}
+	c.Okay()
+}
+
+// errorMessage returns the message a real server would fail a request with because of err, i.e.
+// without the error code added by *errors.Err.
+func errorMessage(err error) string {
+	if err, ok := err.(*errors.Err); ok {
+		return err.Message
+	}
+	return err.Error()
+}
@@ -0,0 +1,169 @@
+package hostserver
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+type testDevice struct {
+	serial      string
+	state       string
+	transportID int64
+	info        DeviceInfo
+}
+
+func (d *testDevice) Serial() string     { return d.serial }
+func (d *testDevice) State() string      { return d.state }
+func (d *testDevice) TransportID() int64 { return d.transportID }
+func (d *testDevice) Features() []string { return []string{"shell_v2"} }
+func (d *testDevice) Info() DeviceInfo   { return d.info }
+
+// testBackend answers transport requests with the serial of the selected device, and picks port
+// 1234 for tcp:0 forwards.
+type testBackend struct {
+	devices []Device
+}
+
+func (b *testBackend) Version() int                               { return 41 }
+func (b *testBackend) HostFeatures() []string                     { return nil }
+func (b *testBackend) Devices() []Device                          { return b.devices }
+func (b *testBackend) HandleHostRequest(c *Conn, req string) bool { return false }
+
+func (b *testBackend) ServeTransport(c *Conn, d Device) {
+	c.OkayMessage(d.Serial())
+}
+
+func (b *testBackend) Forward(d Device, local, remote string) (string, io.Closer, error) {
+	if local == "tcp:0" {
+		return "tcp:1234", nil, nil
+	}
+	return local, nil, nil
+}
+
+func newTestServer() *Server {
+	return NewServer(&testBackend{devices: []Device{
+		&testDevice{serial: "192.168.1.2:5555", state: "device", transportID: 1},
+		&testDevice{serial: "usb1", state: "device", transportID: 2, info: DeviceInfo{Usb: "1-1", Model: "Pixel"}},
+		&testDevice{serial: "usb2", state: "unauthorized", transportID: 3, info: DeviceInfo{Usb: "1-2"}},
+	}})
+}
+
+func roundTrip(t *testing.T, s *Server, req string) (string, error) {
+	rw, err := s.Dial()
+	require.NoError(t, err)
+	conn := &wire.Conn{Scanner: wire.NewScanner(rw), Sender: wire.NewSender(rw)}
+	defer conn.Close()
+	resp, err := conn.RoundTripSingleResponse([]byte(req))
+	return string(resp), err
+}
+
+func assertFails(t *testing.T, s *Server, req, msg string) {
+	_, err := roundTrip(t, s, req)
+	if assert.Error(t, err, req) {
+		assert.Contains(t, err.Error(), msg, req)
+	}
+}
+
+func TestSelectDevice(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	for req, want := range map[string]string{
+		"host-serial:192.168.1.2:5555:get-serialno": "192.168.1.2:5555",
+		"host-transport-id:2:get-serialno":          "usb1",
+		"host-local:get-serialno":                   "192.168.1.2:5555",
+		"host:transport-id:1":                       "192.168.1.2:5555",
+		"host-serial:usb1:get-devpath":              "unknown",
+		"host-serial:usb2:get-state":                "unauthorized",
+	} {
+		resp, err := roundTrip(t, s, req)
+		assert.NoError(t, err, req)
+		assert.Equal(t, want, resp, req)
+	}
+
+	assertFails(t, s, "host:get-state", "more than one device/emulator")
+	assertFails(t, s, "host-usb:get-state", "more than one device")
+	assertFails(t, s, "host-transport-id:4:get-state", "no device with transport id '4'")
+	assertFails(t, s, "host:transport:usb2", "device unauthorized")
+	assertFails(t, s, "host:transport:nope", "device 'nope' not found")
+}
+
+func TestDevices(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	resp, err := roundTrip(t, s, "host:devices-l")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.2:5555       device transport_id:1\n"+
+		"usb1                   device usb:1-1 model:Pixel transport_id:2\n"+
+		"usb2                   unauthorized usb:1-2 transport_id:3\n", resp)
+}
+
+func TestForward(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+	forward := func(spec string) (string, error) {
+		rw, err := s.Dial()
+		require.NoError(t, err)
+		conn := &wire.Conn{Scanner: wire.NewScanner(rw), Sender: wire.NewSender(rw)}
+		defer conn.Close()
+		req := "host-serial:usb1:forward:" + spec
+		require.NoError(t, conn.SendMessage([]byte(req)))
+		if _, err := conn.ReadStatus(req); err != nil {
+			return "", err
+		}
+		if _, err := conn.ReadStatus(req); err != nil {
+			return "", err
+		}
+		if spec != "tcp:0;tcp:80" {
+			return "", nil
+		}
+		port, err := conn.ReadMessage()
+		return string(port), err
+	}
+
+	_, err := forward("tcp:8080;tcp:80")
+	assert.NoError(t, err)
+	_, err = forward("norebind:tcp:8080;tcp:81")
+	assert.Error(t, err)
+	port, err := forward("tcp:0;tcp:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", port)
+	assert.Equal(t, []Forward{
+		{Serial: "usb1", Local: "tcp:8080", Remote: "tcp:80"},
+		{Serial: "usb1", Local: "tcp:1234", Remote: "tcp:80"},
+	}, s.Forwards())
+
+	resp, err := roundTrip(t, s, "host:list-forward")
+	assert.NoError(t, err)
+	assert.Equal(t, "usb1 tcp:8080 tcp:80\nusb1 tcp:1234 tcp:80\n", resp)
+
+	s.RemoveForwards("usb1")
+	assert.Empty(t, s.Forwards())
+}
+
+func TestSplice(t *testing.T) {
+	a, aPeer := net.Pipe()
+	b, bPeer := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		Splice(aPeer, bPeer)
+		close(done)
+	}()
+
+	go a.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(b, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	a.Close()
+	<-done
+	_, err = b.Read(buf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,211 @@
+package adb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// QueueStats reports how device operations waited for ServerConfig.MaxConcurrentPerDevice.
+// See Adb.QueueStats.
+type QueueStats struct {
+	// Acquired is the number of operations that were allowed to use a device.
+	Acquired int64
+	// Queued is the number of operations that had to wait before using a device.
+	Queued int64
+	// Canceled is the number of operations whose context was done while they were waiting.
+	Canceled int64
+	// TotalWait is the time operations have spent waiting, and MaxWait the longest any has
+	// waited.
+	TotalWait time.Duration
+	MaxWait   time.Duration
+
+	// Active is the number of operations currently using devices.
+	Active int
+	// Waiting is the number of operations currently waiting.
+	Waiting int
+}
+
+/*
+deviceLimiter limits the number of operations using each device at once. Operations that can't
+run immediately wait in a queue for each device, and are let through in the order they arrived.
+*/
+type deviceLimiter struct {
+	max int
+
+	lock   sync.Mutex
+	queues map[string]*deviceQueue
+	stats  QueueStats
+}
+
+type deviceQueue struct {
+	key     string
+	active  int
+	waiters []chan struct{}
+}
+
+func newDeviceLimiter(max int) *deviceLimiter {
+	return &deviceLimiter{
+		max:    max,
+		queues: make(map[string]*deviceQueue),
+	}
+}
+
+func (l *deviceLimiter) Stats() QueueStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	stats := l.stats
+	for _, q := range l.queues {
+		stats.Active += q.active
+		stats.Waiting += len(q.waiters)
+	}
+	return stats
+}
+
+/*
+acquire waits until the device has fewer than max operations using it, and no operations that
+arrived earlier are waiting, or ctx is done. Returns a func that must be called when the
+operation is done with the device. It can be called more than once.
+*/
+func (l *deviceLimiter) acquire(ctx context.Context, descriptor DeviceDescriptor) (func(), error) {
+	key := descriptor.getTransportDescriptor()
+
+	l.lock.Lock()
+	q, ok := l.queues[key]
+	if !ok {
+		q = &deviceQueue{key: key}
+		l.queues[key] = q
+	}
+	if q.active < l.max && len(q.waiters) == 0 {
+		q.active++
+		l.stats.Acquired++
+		l.lock.Unlock()
+		return l.releaseFunc(q), nil
+	}
+
+	ready := make(chan struct{})
+	q.waiters = append(q.waiters, ready)
+	l.stats.Queued++
+	l.lock.Unlock()
+
+	start := time.Now()
+	select {
+	case <-ready:
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		l.recordWaitLocked(time.Since(start))
+		l.stats.Acquired++
+		return l.releaseFunc(q), nil
+
+	case <-ctx.Done():
+		l.lock.Lock()
+		l.recordWaitLocked(time.Since(start))
+		l.stats.Canceled++
+		granted := true
+		for i, w := range q.waiters {
+			if w == ready {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				granted = false
+				break
+			}
+		}
+		l.lock.Unlock()
+
+		if granted {
+			// The slot was handed over after ctx was done, so pass it on.
+			l.release(q)
+		}
+		return nil, errors.WrapErrorf(ctx.Err(), errors.Canceled, "error waiting for device '%s'", descriptor)
+	}
+}
+
+func (l *deviceLimiter) releaseFunc(q *deviceQueue) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(q) })
+	}
+}
+
+// release hands the operation's slot to the next waiting operation, if there is one, and
+// forgets the device once nothing is using or waiting for it.
+func (l *deviceLimiter) release(q *deviceQueue) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(q.waiters) == 0 {
+		q.active--
+		if q.active == 0 {
+			delete(l.queues, q.key)
+		}
+		return
+	}
+	next := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	close(next)
+}
+
+func (l *deviceLimiter) recordWaitLocked(wait time.Duration) {
+	l.stats.TotalWait += wait
+	if wait > l.stats.MaxWait {
+		l.stats.MaxWait = wait
+	}
+}
+
+// limitedScanner releases its connection's slot in the device's queue when it's closed,
+// including when the connection has been switched to sync mode.
+type limitedScanner struct {
+	wire.Scanner
+	release func()
+}
+
+func (s *limitedScanner) Close() error {
+	s.release()
+	return s.Scanner.Close()
+}
+
+func (s *limitedScanner) Read(buf []byte) (int, error) {
+	return wire.ReadRaw(s.Scanner, buf)
+}
+
+func (s *limitedScanner) NewSyncScanner() wire.SyncScanner {
+	return &limitedSyncScanner{SyncScanner: s.Scanner.NewSyncScanner(), release: s.release}
+}
+
+type limitedSyncScanner struct {
+	wire.SyncScanner
+	release func()
+}
+
+func (s *limitedSyncScanner) Close() error {
+	s.release()
+	return s.SyncScanner.Close()
+}
+
+func withRelease(conn *wire.Conn, release func()) *wire.Conn {
+	return &wire.Conn{
+		Scanner: &limitedScanner{Scanner: conn.Scanner, release: release},
+		Sender:  conn.Sender,
+	}
+}
+
+func syncWithRelease(conn *wire.SyncConn, release func()) *wire.SyncConn {
+	return &wire.SyncConn{
+		SyncScanner: &limitedSyncScanner{SyncScanner: conn.SyncScanner, release: release},
+		SyncSender:  conn.SyncSender,
+	}
+}
+
+// releaseSlot releases conn's slot in the device's queue without closing it, e.g. to return it to
+// the pool, and returns the underlying connection.
+func releaseSlot(conn *wire.SyncConn) *wire.SyncConn {
+	s, ok := conn.SyncScanner.(*limitedSyncScanner)
+	if !ok {
+		return conn
+	}
+	s.release()
+	return &wire.SyncConn{SyncScanner: s.SyncScanner, SyncSender: conn.SyncSender}
+}
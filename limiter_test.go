@@ -0,0 +1,177 @@
+package adb
+
+import (
+	"context"
+	stderrors "errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/adbtest"
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+// waitForWaiting waits until n operations are waiting in the limiter.
+func waitForWaiting(t *testing.T, limiter *deviceLimiter, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for limiter.Stats().Waiting < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d waiting operations: %+v", n, limiter.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeviceLimiterIsFair(t *testing.T) {
+	limiter := newDeviceLimiter(1)
+	device := DeviceWithSerial("serial")
+
+	release, err := limiter.acquire(context.Background(), device)
+	require.NoError(t, err)
+
+	// Another device isn't affected.
+	releaseOther, err := limiter.acquire(context.Background(), DeviceWithSerial("other"))
+	require.NoError(t, err)
+	releaseOther()
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			release, err := limiter.acquire(context.Background(), device)
+			if assert.NoError(t, err) {
+				order <- i
+				release()
+			}
+		}(i)
+		waitForWaiting(t, limiter, i+1)
+	}
+
+	release()
+	// Releasing more than once has no effect.
+	release()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, i, <-order)
+	}
+
+	stats := limiter.Stats()
+	assert.Equal(t, int64(5), stats.Acquired)
+	assert.Equal(t, int64(3), stats.Queued)
+	assert.Equal(t, 0, stats.Active)
+	assert.Equal(t, 0, stats.Waiting)
+	assert.True(t, stats.MaxWait > 0)
+	assert.True(t, stats.TotalWait >= stats.MaxWait)
+}
+
+func TestDeviceLimiterCanceled(t *testing.T) {
+	limiter := newDeviceLimiter(1)
+	device := DeviceWithSerial("serial")
+
+	release, err := limiter.acquire(context.Background(), device)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = limiter.acquire(ctx, device)
+	assert.Equal(t, context.DeadlineExceeded, err.(*errors.Err).Cause)
+	assert.True(t, HasErrCode(err, Canceled))
+	assert.True(t, stderrors.Is(err, context.DeadlineExceeded))
+
+	stats := limiter.Stats()
+	assert.Equal(t, int64(1), stats.Canceled)
+	assert.Equal(t, 1, stats.Active)
+	assert.Equal(t, 0, stats.Waiting)
+
+	// The canceled operation doesn't hold up the device.
+	release()
+	release, err = limiter.acquire(context.Background(), device)
+	assert.NoError(t, err)
+	release()
+	assert.Equal(t, 0, limiter.Stats().Active)
+	// Devices that aren't in use are forgotten.
+	assert.Empty(t, limiter.queues)
+}
+
+func TestMaxConcurrentPerDevice(t *testing.T) {
+	server := adbtest.NewServer()
+	defer server.Close()
+	device := server.AddDevice("serial")
+	device.HandleShell(func(cmd string) string {
+		return cmd + "\n"
+	})
+	require.NoError(t, device.FS().WriteFile("/sdcard/file", []byte("hello"), 0644, time.Unix(0, 0)))
+
+	client, err := NewWithConfig(ServerConfig{
+		Dialer:                 server,
+		NoStartServer:          true,
+		MaxConcurrentPerDevice: 1,
+	})
+	require.NoError(t, err)
+	d := client.Device(DeviceWithSerial("serial"))
+
+	reader, err := d.OpenRead("/sdcard/file")
+	require.NoError(t, err)
+	assert.Equal(t, 1, client.QueueStats().Active)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = d.WithContext(ctx).RunCommand("true")
+	assert.True(t, HasErrCode(err, Canceled))
+	assert.True(t, stderrors.Is(err, context.DeadlineExceeded))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		output, err := d.RunCommand("echo", "hi")
+		assert.NoError(t, err)
+		assert.Equal(t, "echo hi\n", output)
+	}()
+	waitForWaiting(t, client.limiter, 1)
+
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	reader.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command didn't run after the file was closed")
+	}
+
+	stats := client.QueueStats()
+	assert.Equal(t, int64(2), stats.Acquired)
+	assert.Equal(t, int64(2), stats.Queued)
+	assert.Equal(t, int64(1), stats.Canceled)
+	assert.Equal(t, 0, stats.Active)
+}
+
+func TestMaxConcurrentPerDeviceWithPool(t *testing.T) {
+	server := adbtest.NewServer()
+	defer server.Close()
+	device := server.AddDevice("serial")
+	require.NoError(t, device.FS().WriteFile("/sdcard/file", []byte("hello"), 0644, time.Unix(0, 0)))
+
+	client, err := NewWithConfig(ServerConfig{
+		Dialer:                 server,
+		NoStartServer:          true,
+		Pool:                   &PoolConfig{},
+		MaxConcurrentPerDevice: 1,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	d := client.Device(DeviceWithSerial("serial"))
+
+	// Connections returned to the pool no longer use the device.
+	for i := 0; i < 3; i++ {
+		_, err := d.Stat("/sdcard/file")
+		require.NoError(t, err)
+		entries, err := d.ListDirEntries("/sdcard")
+		require.NoError(t, err)
+		_, err = entries.ReadAll()
+		assert.NoError(t, err)
+		entries.Close()
+	}
+	assert.Equal(t, 0, client.QueueStats().Active)
+	assert.Equal(t, int64(0), client.QueueStats().Queued)
+}
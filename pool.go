@@ -0,0 +1,529 @@
+package adb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// Defaults for zero fields of PoolConfig.
+const (
+	DefaultPoolMaxIdlePerDevice = 2
+	DefaultPoolIdleTimeout      = 30 * time.Second
+	DefaultPoolHealthCheckAfter = 5 * time.Second
+)
+
+/*
+PoolConfig configures pooling of connections to devices. See ServerConfig.Pool.
+
+A connection to the adb server can only be used for a single service, so the pool keeps two kinds
+of idle connections for each device:
+
+Connections that have already been switched to the device's transport, and are waiting for a
+service to be requested. Every time a device operation needs one, another is dialed in the
+background, so the next operation doesn't have to wait for the server to be dialed and the
+device to be selected. Nothing is dialed in the background until a connection to the device has
+been dialed successfully, or after dialing one fails.
+
+Connections in sync mode. These are returned to the pool when Stat and ListDirEntries finish, and
+are used by the other sync operations on Device, so consecutive file operations don't need a new
+connection.
+
+Idle connections can become unusable without the pool noticing, e.g. when the device is
+disconnected. Sync connections that have been idle for a while are checked with a STAT request
+before being used, and if requesting a service on an idle connection fails, the operation is
+retried on a new connection.
+*/
+type PoolConfig struct {
+	// MaxIdlePerDevice is the number of idle connections of each kind kept for each device. If
+	// 0, DefaultPoolMaxIdlePerDevice is used.
+	MaxIdlePerDevice int
+
+	// MaxConnsPerDevice limits the connections open to each device, including idle connections.
+	// When the limit is reached, operations wait until a connection is closed, or their context
+	// is done (see Device.WithContext). If 0, there's no limit.
+	MaxConnsPerDevice int
+
+	// Connections that have been idle for longer than IdleTimeout are closed. If 0,
+	// DefaultPoolIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	// Sync connections that have been idle for longer than HealthCheckAfter are checked before
+	// being used. If 0, DefaultPoolHealthCheckAfter is used.
+	HealthCheckAfter time.Duration
+}
+
+// PoolStats reports the activity of a connection pool. See Adb.PoolStats.
+type PoolStats struct {
+	// Hits is the number of connections that were served by idle connections.
+	Hits int64
+	// Misses is the number of connections that had to be dialed while an operation waited.
+	Misses int64
+	// Discarded is the number of idle connections that were closed because they timed out,
+	// failed a health check, or failed when they were used.
+	Discarded int64
+
+	// Open is the number of connections open to devices, including idle connections.
+	Open int
+	// Idle is the number of idle connections.
+	Idle int
+}
+
+// pooledServer is a server that pools connections to devices. See connPool.
+type pooledServer interface {
+	server
+	Stats() PoolStats
+	Close() error
+
+	dialDevice(ctx context.Context, descriptor DeviceDescriptor, reuseIdle bool) (*wire.Conn, bool, error)
+	takeSyncConn(descriptor DeviceDescriptor) *wire.SyncConn
+	putSyncConn(descriptor DeviceDescriptor, conn *wire.SyncConn) error
+	discard()
+}
+
+// connPool is a server that pools connections to devices.
+type connPool struct {
+	server
+	config PoolConfig
+
+	lock sync.Mutex
+	// Closed, and replaced, whenever a connection is closed or becomes idle.
+	changed chan struct{}
+	devices map[string]*devicePool
+	stats   PoolStats
+	// Set while a sweep of expired connections is scheduled.
+	sweep  *time.Timer
+	closed bool
+}
+
+// devicePool holds the connections to a single device, keyed by transport descriptor.
+type devicePool struct {
+	descriptor DeviceDescriptor
+	// Number of connections open, or being dialed, to the device.
+	open     int
+	idle     []idleConn
+	idleSync []idleSyncConn
+	// Number of connections being dialed in the background.
+	prewarming int
+	// Set when a connection to the device is dialed, and cleared when dialing one fails.
+	// Connections are only dialed in the background while it's set, so a device that can't be
+	// dialed isn't dialed over and over without anyone seeing the errors.
+	dialed bool
+}
+
+type idleConn struct {
+	conn  *wire.Conn
+	since time.Time
+}
+
+type idleSyncConn struct {
+	conn  *wire.SyncConn
+	since time.Time
+}
+
+func newConnPool(s server, config PoolConfig) *connPool {
+	if config.MaxIdlePerDevice == 0 {
+		config.MaxIdlePerDevice = DefaultPoolMaxIdlePerDevice
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = DefaultPoolIdleTimeout
+	}
+	if config.HealthCheckAfter == 0 {
+		config.HealthCheckAfter = DefaultPoolHealthCheckAfter
+	}
+
+	return &connPool{
+		server:  s,
+		config:  config,
+		changed: make(chan struct{}),
+		devices: make(map[string]*devicePool),
+	}
+}
+
+// Stats returns the pool's counters, and the current number of open and idle connections.
+func (p *connPool) Stats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stats := p.stats
+	for _, d := range p.devices {
+		stats.Open += d.open
+		stats.Idle += len(d.idle) + len(d.idleSync)
+	}
+	return stats
+}
+
+// Close closes all idle connections. Connections in use are closed when they're released.
+func (p *connPool) Close() error {
+	p.lock.Lock()
+	p.closed = true
+	if p.sweep != nil {
+		p.sweep.Stop()
+		p.sweep = nil
+	}
+	var conns []idleConn
+	var syncConns []idleSyncConn
+	for _, d := range p.devices {
+		conns = append(conns, d.idle...)
+		syncConns = append(syncConns, d.idleSync...)
+		d.idle, d.idleSync = nil, nil
+	}
+	p.lock.Unlock()
+
+	var errs []error
+	for _, c := range conns {
+		errs = append(errs, c.conn.Close())
+	}
+	for _, c := range syncConns {
+		errs = append(errs, c.conn.Close())
+	}
+	return errors.CombineErrs("error closing idle connections", errors.NetworkError, errs...)
+}
+
+func (p *connPool) deviceLocked(descriptor DeviceDescriptor) *devicePool {
+	key := descriptor.getTransportDescriptor()
+	d, ok := p.devices[key]
+	if !ok {
+		d = &devicePool{descriptor: descriptor}
+		p.devices[key] = d
+	}
+	return d
+}
+
+/*
+dialDevice returns a connection switched to the device's transport, and true if it was idle. If
+the device has no idle connections, or reuseIdle is false, one is dialed, waiting until the
+device is below MaxConnsPerDevice or ctx is done if necessary.
+*/
+func (p *connPool) dialDevice(ctx context.Context, descriptor DeviceDescriptor, reuseIdle bool) (*wire.Conn, bool, error) {
+	p.lock.Lock()
+	d := p.deviceLocked(descriptor)
+	for {
+		p.expireLocked(d)
+		if n := len(d.idle); reuseIdle && n > 0 {
+			conn := d.idle[n-1].conn
+			d.idle = d.idle[:n-1]
+			p.stats.Hits++
+			p.prewarmLocked(d)
+			p.lock.Unlock()
+			return conn, true, nil
+		}
+		if p.hasRoomLocked(d) {
+			break
+		}
+		// Idle sync connections take up slots, but aren't useful for anything but sync.
+		if n := len(d.idleSync); n > 0 {
+			conn := d.idleSync[0].conn
+			d.idleSync = d.idleSync[1:]
+			p.lock.Unlock()
+			conn.Close()
+			p.lock.Lock()
+			continue
+		}
+		// Neither are idle transport connections that mustn't be reused.
+		if n := len(d.idle); n > 0 {
+			conn := d.idle[0].conn
+			d.idle = d.idle[1:]
+			p.lock.Unlock()
+			conn.Close()
+			p.lock.Lock()
+			continue
+		}
+
+		changed := p.changed
+		p.lock.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false, errors.WrapErrorf(ctx.Err(), errors.Canceled, "error waiting for a connection to device '%s'", descriptor)
+		}
+		p.lock.Lock()
+	}
+
+	d.open++
+	p.stats.Misses++
+	p.lock.Unlock()
+
+	conn, err := p.dialTransport(d)
+	if err == nil {
+		// Only prewarm once the device is known to be reachable.
+		p.lock.Lock()
+		p.prewarmLocked(d)
+		p.lock.Unlock()
+	}
+	return conn, false, err
+}
+
+// takeSyncConn returns an idle sync connection to the device, or nil if there aren't any.
+func (p *connPool) takeSyncConn(descriptor DeviceDescriptor) *wire.SyncConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	d := p.deviceLocked(descriptor)
+
+	for {
+		p.expireLocked(d)
+		n := len(d.idleSync)
+		if n == 0 {
+			return nil
+		}
+		idle := d.idleSync[n-1]
+		d.idleSync = d.idleSync[:n-1]
+
+		if time.Since(idle.since) > p.config.HealthCheckAfter {
+			p.lock.Unlock()
+			_, err := stat(idle.conn, "/")
+			if err != nil {
+				idle.conn.Close()
+			}
+			p.lock.Lock()
+			if err != nil {
+				p.stats.Discarded++
+				continue
+			}
+		}
+
+		p.stats.Hits++
+		return idle.conn
+	}
+}
+
+// putSyncConn makes conn, which must be idle, available for the next sync operation on the
+// device, or closes it if the device already has enough idle sync connections.
+func (p *connPool) putSyncConn(descriptor DeviceDescriptor, conn *wire.SyncConn) error {
+	p.lock.Lock()
+	d := p.deviceLocked(descriptor)
+	if p.closed || len(d.idleSync) >= p.config.MaxIdlePerDevice {
+		p.lock.Unlock()
+		return conn.Close()
+	}
+	d.idleSync = append(d.idleSync, idleSyncConn{conn, time.Now()})
+	p.scheduleSweepLocked()
+	p.notifyLocked()
+	p.lock.Unlock()
+	return nil
+}
+
+// discard records that a connection that was idle turned out to be unusable.
+func (p *connPool) discard() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stats.Discarded++
+}
+
+func (p *connPool) hasRoomLocked(d *devicePool) bool {
+	return p.config.MaxConnsPerDevice == 0 || d.open < p.config.MaxConnsPerDevice
+}
+
+// notifyLocked wakes up operations waiting for a connection to be closed or become idle.
+func (p *connPool) notifyLocked() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// prewarmLocked starts dialing connections in the background until the device has
+// MaxIdlePerDevice idle connections, unless the last connection to it failed to dial.
+func (p *connPool) prewarmLocked(d *devicePool) {
+	for !p.closed && d.dialed && len(d.idle)+d.prewarming < p.config.MaxIdlePerDevice && p.hasRoomLocked(d) {
+		d.open++
+		d.prewarming++
+		go func() {
+			conn, err := p.dialTransport(d)
+
+			p.lock.Lock()
+			d.prewarming--
+			if err != nil || p.closed {
+				p.lock.Unlock()
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+			d.idle = append(d.idle, idleConn{conn, time.Now()})
+			p.scheduleSweepLocked()
+			p.notifyLocked()
+			p.lock.Unlock()
+		}()
+	}
+}
+
+// dialTransport dials a connection switched to the device's transport, for which a slot has
+// already been taken. The slot is released when the connection is closed, or if dialing fails.
+func (p *connPool) dialTransport(d *devicePool) (*wire.Conn, error) {
+	conn, err := dialTransport(p.server, d.descriptor)
+
+	p.lock.Lock()
+	d.dialed = err == nil
+	p.lock.Unlock()
+	if err != nil {
+		p.release(d)
+		return nil, err
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { p.release(d) })
+	}
+	return &wire.Conn{
+		Scanner: &pooledScanner{Scanner: conn.Scanner, release: release},
+		Sender:  conn.Sender,
+	}, nil
+}
+
+func (p *connPool) release(d *devicePool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	d.open--
+	p.notifyLocked()
+}
+
+// expireLocked removes connections that have been idle for longer than IdleTimeout, and closes
+// them in the background.
+func (p *connPool) expireLocked(d *devicePool) {
+	deadline := time.Now().Add(-p.config.IdleTimeout)
+	var expired []idleConn
+	var expiredSync []idleSyncConn
+
+	// Idle connections are appended, so the oldest ones are first.
+	for len(d.idle) > 0 && d.idle[0].since.Before(deadline) {
+		expired = append(expired, d.idle[0])
+		d.idle = d.idle[1:]
+	}
+	for len(d.idleSync) > 0 && d.idleSync[0].since.Before(deadline) {
+		expiredSync = append(expiredSync, d.idleSync[0])
+		d.idleSync = d.idleSync[1:]
+	}
+	if len(expired)+len(expiredSync) == 0 {
+		return
+	}
+
+	p.stats.Discarded += int64(len(expired) + len(expiredSync))
+	go func() {
+		for _, c := range expired {
+			c.conn.Close()
+		}
+		for _, c := range expiredSync {
+			c.conn.Close()
+		}
+	}()
+}
+
+// scheduleSweepLocked makes sure expired connections will be closed even if the pool isn't used
+// again.
+func (p *connPool) scheduleSweepLocked() {
+	if p.sweep != nil || p.closed {
+		return
+	}
+	p.sweep = time.AfterFunc(p.config.IdleTimeout, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.sweep = nil
+		idle := false
+		for _, d := range p.devices {
+			p.expireLocked(d)
+			idle = idle || len(d.idle)+len(d.idleSync) > 0
+		}
+		if idle {
+			p.scheduleSweepLocked()
+		}
+	})
+}
+
+// dialTransport dials the server and switches the connection to the transport defined by
+// descriptor.
+func dialTransport(s server, descriptor DeviceDescriptor) (*wire.Conn, error) {
+	conn, err := s.Dial()
+	if err != nil {
+		return nil, err
+	}
+
+	req := fmt.Sprintf("host:%s", descriptor.getTransportDescriptor())
+	if err = wire.SendMessageString(conn, req); err != nil {
+		conn.Close()
+		return nil, errors.WrapErrf(err, "error connecting to device '%s'", descriptor)
+	}
+
+	if _, err = conn.ReadStatus(req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// pooledScanner releases its connection's slot in the pool when it's closed, including when the
+// connection has been switched to sync mode.
+type pooledScanner struct {
+	wire.Scanner
+	release func()
+}
+
+func (s *pooledScanner) Close() error {
+	s.release()
+	return s.Scanner.Close()
+}
+
+func (s *pooledScanner) Read(buf []byte) (int, error) {
+	return wire.ReadRaw(s.Scanner, buf)
+}
+
+func (s *pooledScanner) NewSyncScanner() wire.SyncScanner {
+	return &pooledSyncScanner{SyncScanner: s.Scanner.NewSyncScanner(), release: s.release}
+}
+
+type pooledSyncScanner struct {
+	wire.SyncScanner
+	release func()
+}
+
+func (s *pooledSyncScanner) Close() error {
+	s.release()
+	return s.SyncScanner.Close()
+}
+
+/*
+pooledListScanner is the SyncScanner for a LIST request on a pooled connection. If the response
+was read to the end, the connection is returned to the pool when the scanner is closed.
+Otherwise, the connection is closed.
+*/
+type pooledListScanner struct {
+	*wire.SyncConn
+	pool       pooledServer
+	descriptor DeviceDescriptor
+
+	done   bool
+	err    error
+	closed bool
+}
+
+func (s *pooledListScanner) ReadStatus(req string) (string, error) {
+	status, err := s.SyncConn.ReadStatus(req)
+	if err != nil {
+		s.err = err
+	} else if status == wire.StatusSyncDone {
+		s.done = true
+	}
+	return status, err
+}
+
+func (s *pooledListScanner) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.err != nil || !s.done {
+		return s.SyncConn.Close()
+	}
+	// The DONE message has the same format as a DENT, with all fields set to 0.
+	for i := 0; i < 4; i++ {
+		if _, err := s.SyncConn.ReadInt32(); err != nil {
+			s.SyncConn.Close()
+			return err
+		}
+	}
+	return s.pool.putSyncConn(s.descriptor, releaseSlot(s.SyncConn))
+}
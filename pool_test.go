@@ -0,0 +1,240 @@
+package adb
+
+import (
+	"context"
+	stderrors "errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/adbtest"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// trackingDialer dials an adbtest.Server, and keeps the connections so tests can break them.
+type trackingDialer struct {
+	server *adbtest.Server
+
+	lock  sync.Mutex
+	conns []io.ReadWriteCloser
+}
+
+func (d *trackingDialer) Dial(address string) (*wire.Conn, error) {
+	rw, err := d.server.DialRaw(address)
+	if err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	d.conns = append(d.conns, rw)
+	d.lock.Unlock()
+
+	safeConn := wire.MultiCloseable(rw)
+	return &wire.Conn{
+		Scanner: wire.NewScanner(safeConn),
+		Sender:  wire.NewSender(safeConn),
+	}, nil
+}
+
+// closeAll closes all connections dialed so far, like a server that was restarted.
+func (d *trackingDialer) closeAll() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, rw := range d.conns {
+		rw.Close()
+	}
+	d.conns = nil
+}
+
+func newPooledClient(t *testing.T, config PoolConfig) (*Adb, *adbtest.Server, *trackingDialer) {
+	server := adbtest.NewServer()
+	device := server.AddDevice("serial")
+	device.HandleShell(func(cmd string) string {
+		return cmd + "\n"
+	})
+	require.NoError(t, device.FS().WriteFile("/sdcard/file", []byte("hello"), 0644, time.Unix(0, 0)))
+
+	dialer := &trackingDialer{server: server}
+	client, err := NewWithConfig(ServerConfig{Dialer: dialer, NoStartServer: true, Pool: &config})
+	require.NoError(t, err)
+	return client, server, dialer
+}
+
+// waitForIdle waits until the pool has at least n idle connections.
+func waitForIdle(t *testing.T, client *Adb, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for client.PoolStats().Idle < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d idle connections: %+v", n, client.PoolStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolReusesSyncConns(t *testing.T) {
+	client, server, _ := newPooledClient(t, PoolConfig{MaxIdlePerDevice: 1})
+	defer server.Close()
+	defer client.Close()
+	device := client.Device(DeviceWithSerial("serial"))
+
+	for i := 0; i < 3; i++ {
+		entry, err := device.Stat("/sdcard/file")
+		require.NoError(t, err)
+		assert.Equal(t, int32(5), entry.Size)
+	}
+	_, err := device.Stat("/sdcard/missing")
+	assert.True(t, HasErrCode(err, FileNoExistError))
+
+	entries, err := device.ListDirEntries("/sdcard")
+	require.NoError(t, err)
+	all, err := entries.ReadAll()
+	assert.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, "file", all[0].Name)
+
+	// Only the first request needed a new connection.
+	stats := client.PoolStats()
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(4), stats.Hits)
+
+	reader, err := device.OpenRead("/sdcard/file")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	reader.Close()
+	assert.Equal(t, int64(5), client.PoolStats().Hits)
+}
+
+func TestPoolPrewarmsTransportConns(t *testing.T) {
+	client, server, _ := newPooledClient(t, PoolConfig{MaxIdlePerDevice: 2})
+	defer server.Close()
+	defer client.Close()
+	device := client.Device(DeviceWithSerial("serial"))
+
+	output, err := device.RunCommand("echo", "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo 1\n", output)
+	waitForIdle(t, client, 2)
+
+	for i := 0; i < 2; i++ {
+		_, err := device.RunCommand("echo")
+		assert.NoError(t, err)
+	}
+	stats := client.PoolStats()
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(2), stats.Hits)
+
+	// Idle connections are closed when the client is closed.
+	waitForIdle(t, client, 2)
+	assert.NoError(t, client.Close())
+	stats = client.PoolStats()
+	assert.Equal(t, 0, stats.Idle)
+	assert.Equal(t, 0, stats.Open)
+}
+
+func TestPoolRetriesStaleConns(t *testing.T) {
+	client, server, dialer := newPooledClient(t, PoolConfig{MaxIdlePerDevice: 1, HealthCheckAfter: time.Nanosecond})
+	defer server.Close()
+	defer client.Close()
+	device := client.Device(DeviceWithSerial("serial"))
+
+	_, err := device.Stat("/sdcard/file")
+	require.NoError(t, err)
+	waitForIdle(t, client, 2)
+
+	// Both the idle sync connection and the idle transport connection are broken.
+	dialer.closeAll()
+	_, err = device.Stat("/sdcard/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), client.PoolStats().Discarded)
+}
+
+func TestPoolRetriesStaleConnsOnce(t *testing.T) {
+	client, server, dialer := newPooledClient(t, PoolConfig{MaxIdlePerDevice: 3})
+	defer server.Close()
+	defer client.Close()
+	device := client.Device(DeviceWithSerial("serial"))
+
+	_, err := device.RunCommand("true")
+	require.NoError(t, err)
+	waitForIdle(t, client, 3)
+
+	// Only one of the broken idle connections is tried before dialing a new one.
+	dialer.closeAll()
+	_, err = device.RunCommand("true")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), client.PoolStats().Discarded)
+}
+
+func TestPoolDoesNotPrewarmUnreachableDevices(t *testing.T) {
+	client, server, dialer := newPooledClient(t, PoolConfig{})
+	defer server.Close()
+	defer client.Close()
+
+	_, err := client.Device(DeviceWithSerial("missing")).RunCommand("true")
+	assert.True(t, HasErrCode(err, DeviceNotFound))
+	assert.Equal(t, 0, client.PoolStats().Open)
+	dialer.lock.Lock()
+	assert.Len(t, dialer.conns, 1)
+	dialer.lock.Unlock()
+}
+
+func TestPoolExpiresIdleConns(t *testing.T) {
+	client, server, _ := newPooledClient(t, PoolConfig{IdleTimeout: 10 * time.Millisecond})
+	defer server.Close()
+	defer client.Close()
+
+	_, err := client.Device(DeviceWithSerial("serial")).Stat("/sdcard/file")
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.PoolStats().Open > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle connections weren't closed: %+v", client.PoolStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(3), client.PoolStats().Discarded)
+}
+
+func TestPoolMaxConnsPerDevice(t *testing.T) {
+	client, server, _ := newPooledClient(t, PoolConfig{MaxConnsPerDevice: 1})
+	defer server.Close()
+	defer client.Close()
+	device := client.Device(DeviceWithSerial("serial"))
+
+	reader, err := device.OpenRead("/sdcard/file")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := device.RunCommand("true")
+		assert.NoError(t, err)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("command ran while the device was at its connection limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 1, client.PoolStats().Open)
+
+	// Waiting for a connection stops when the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = device.WithContext(ctx).RunCommand("true")
+	assert.True(t, HasErrCode(err, Canceled))
+	assert.True(t, stderrors.Is(err, context.DeadlineExceeded))
+
+	reader.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command didn't run after a connection was closed")
+	}
+}
@@ -0,0 +1,218 @@
+package adb
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+// propertyPollInterval is how often WaitForProperty reads the property.
+var propertyPollInterval = 250 * time.Millisecond
+
+/*
+Properties returns all the system properties of the device, e.g. ro.build.version.sdk, keyed by
+name.
+
+Corresponds to the command:
+
+	adb shell getprop
+*/
+func (c *Device) Properties() (map[string]string, error) {
+	props, err := c.properties()
+	return props, wrapClientError(err, c, "Properties")
+}
+
+func (c *Device) properties() (map[string]string, error) {
+	var props map[string]string
+	err := c.retry.do(c.context(), true, func() error {
+		output, err := c.runShell("getprop")
+		if err != nil {
+			return err
+		}
+		props, err = parseProperties(output)
+		return err
+	})
+	return props, err
+}
+
+/*
+GetProp returns the value of the system property name. Android doesn't distinguish between
+properties that aren't set and those set to an empty string, so returns a PropertyNotFound error
+for both.
+
+Corresponds to the command:
+
+	adb shell getprop <name>
+*/
+func (c *Device) GetProp(name string) (string, error) {
+	if err := validatePropertyName(name); err != nil {
+		return "", wrapClientError(err, c, "GetProp")
+	}
+
+	var value string
+	err := c.retry.do(c.context(), true, func() (err error) {
+		value, err = c.getProp(name)
+		return err
+	})
+	return value, wrapClientError(err, c, "GetProp(%s)", name)
+}
+
+func (c *Device) getProp(name string) (string, error) {
+	return c.getPropContext(context.Background(), name)
+}
+
+// getPropContext reads the property like getProp, but stops when ctx is done, even if getprop
+// doesn't finish.
+func (c *Device) getPropContext(ctx context.Context, name string) (string, error) {
+	output, err := c.runShellContext(ctx, "getprop "+shellQuote(name))
+	if err != nil {
+		return "", err
+	}
+
+	value := strings.TrimSuffix(strings.TrimSuffix(output, "\n"), "\r")
+	if value == "" {
+		return "", errors.Errorf(errors.PropertyNotFound, "property %s is not set", name)
+	}
+	return value, nil
+}
+
+/*
+SetProp sets the system property name to value. Returns a PropertyPermissionDenied error if the
+device refuses, e.g. because the property is read-only or the shell isn't allowed to set it.
+Devices older than Android 7.0 don't report failures, so this may succeed without setting the
+property.
+
+Corresponds to the command:
+
+	adb shell setprop <name> <value>
+*/
+func (c *Device) SetProp(name, value string) error {
+	if err := validatePropertyName(name); err != nil {
+		return wrapClientError(err, c, "SetProp")
+	}
+	cmdLine, err := NewCommand("setprop", name, value).commandLine()
+	if err != nil {
+		return wrapClientError(err, c, "SetProp(%s)", name)
+	}
+
+	err = c.retry.do(c.context(), c.idempotent, func() error {
+		output, exitCode, err := c.runShellCheckingExit(cmdLine)
+		if err == nil && exitCode != 0 {
+			err = errors.Errorf(errors.PropertyPermissionDenied, "error setting property %s: %s", name, strings.TrimSpace(output))
+		}
+		return err
+	})
+	return wrapClientError(err, c, "SetProp(%s)", name)
+}
+
+/*
+WaitForProperty waits until the system property name is set to value, e.g.
+
+	err := device.WaitForProperty(ctx, "sys.boot_completed", "1")
+
+Keeps waiting while the device is missing or offline, e.g. while it's rebooting, and returns a
+Canceled error wrapping ctx.Err() when ctx is done, even if the device stops responding while
+the property is being read.
+*/
+func (c *Device) WaitForProperty(ctx context.Context, name, value string) error {
+	if err := validatePropertyName(name); err != nil {
+		return wrapClientError(err, c, "WaitForProperty")
+	}
+
+	device := c.WithContext(ctx)
+	var last string
+	for ctx.Err() == nil {
+		current, err := device.getPropContext(ctx, name)
+		if err == nil && current == value {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// The read was interrupted.
+			break
+		}
+		if err != nil && !isTransientPropertyError(err) {
+			return wrapClientError(err, c, "WaitForProperty(%s)", name)
+		}
+		last = current
+
+		timer := time.NewTimer(propertyPollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	err := errors.WrapErrorf(ctx.Err(), errors.Canceled, "error waiting for property %s=%s, last value %q", name, value, last)
+	return wrapClientError(err, c, "WaitForProperty(%s)", name)
+}
+
+// isTransientPropertyError returns true if err may go away if the property is read again, e.g.
+// once the device finishes booting.
+func isTransientPropertyError(err error) bool {
+	for _, code := range []errors.ErrCode{errors.PropertyNotFound, errors.DeviceNotFound, errors.DeviceOffline, errors.ConnectionResetError} {
+		if errors.HasErrCode(err, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePropertyName(name string) error {
+	if isBlank(name) {
+		return errors.AssertionErrorf("property name cannot be empty")
+	}
+	return validateShellArgs([]string{name})
+}
+
+// propertyLinePattern matches the first line of a property in getprop's output, e.g.
+// `[ro.build.version.sdk]: [30]`.
+var propertyLinePattern = regexp.MustCompile(`^\[([^\]]*)\]: \[(.*)$`)
+
+/*
+parseProperties parses the output of getprop, which has a line for each property like
+
+	[ro.build.version.sdk]: [30]
+
+Values can contain newlines, so lines that don't start a property continue the previous value.
+*/
+func parseProperties(output string) (map[string]string, error) {
+	props := make(map[string]string)
+	var name string
+	var value []string
+
+	addProperty := func() error {
+		if value == nil {
+			return nil
+		}
+		joined := strings.Join(value, "\n")
+		if !strings.HasSuffix(joined, "]") {
+			return errors.Errorf(errors.ParseError, "unterminated value for property %s: %q", name, joined)
+		}
+		props[name] = strings.TrimSuffix(joined, "]")
+		return nil
+	}
+
+	// The shell service may translate newlines to CRLF.
+	output = strings.Replace(output, "\r\n", "\n", -1)
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if match := propertyLinePattern.FindStringSubmatch(line); match != nil {
+			if err := addProperty(); err != nil {
+				return nil, err
+			}
+			name = match[1]
+			value = []string{match[2]}
+		} else if value != nil {
+			value = append(value, line)
+		} else if line != "" {
+			return nil, errors.Errorf(errors.ParseError, "invalid getprop output: %q", line)
+		}
+	}
+	if err := addProperty(); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
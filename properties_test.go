@@ -0,0 +1,199 @@
+package adb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/adbtest"
+)
+
+func TestParseProperties(t *testing.T) {
+	props, err := parseProperties("[ro.build.version.sdk]: [30]\r\n" +
+		"[ro.product.cpu.abi]: [arm64-v8a]\r\n" +
+		"[empty]: []\r\n" +
+		"[multi.line]: [first\r\n" +
+		"[second]\r\n" +
+		"third]\r\n" +
+		"[brackets]: [[a]: [b]]\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"ro.build.version.sdk": "30",
+		"ro.product.cpu.abi":   "arm64-v8a",
+		"empty":                "",
+		"multi.line":           "first\n[second]\nthird",
+		"brackets":             "[a]: [b]",
+	}, props)
+}
+
+func TestParsePropertiesEmpty(t *testing.T) {
+	props, err := parseProperties("")
+	assert.NoError(t, err)
+	assert.Empty(t, props)
+}
+
+func TestParsePropertiesInvalid(t *testing.T) {
+	_, err := parseProperties("/system/bin/sh: getprop: not found\n")
+	assert.True(t, HasErrCode(err, ParseError))
+
+	_, err = parseProperties("[ro.build.version.sdk]: [30\n")
+	assert.True(t, HasErrCode(err, ParseError))
+}
+
+func newPropertiesTestDevice(t *testing.T, handler adbtest.ShellHandler) (*Device, *adbtest.Server) {
+	server := adbtest.NewServer()
+	server.AddDevice("serial").HandleShell(handler)
+
+	client, err := NewWithConfig(ServerConfig{Dialer: server, NoStartServer: true})
+	require.NoError(t, err)
+	return client.Device(DeviceWithSerial("serial")), server
+}
+
+func TestProperties(t *testing.T) {
+	d, server := newPropertiesTestDevice(t, func(cmd string) string {
+		return "[ro.build.version.sdk]: [30]\n[ro.product.cpu.abi]: [x86_64]\n"
+	})
+	defer server.Close()
+
+	props, err := d.Properties()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"ro.build.version.sdk": "30", "ro.product.cpu.abi": "x86_64"}, props)
+}
+
+func TestGetProp(t *testing.T) {
+	var cmds []string
+	d, server := newPropertiesTestDevice(t, func(cmd string) string {
+		cmds = append(cmds, cmd)
+		if cmd == "getprop ro.build.version.sdk" {
+			return "30\n"
+		}
+		return "\n"
+	})
+	defer server.Close()
+
+	value, err := d.GetProp("ro.build.version.sdk")
+	assert.NoError(t, err)
+	assert.Equal(t, "30", value)
+
+	_, err = d.GetProp("not set")
+	assert.True(t, HasErrCode(err, PropertyNotFound))
+	assert.True(t, errors.Is(err, ErrPropertyNotFound))
+
+	_, err = d.GetProp("")
+	assert.True(t, HasErrCode(err, AssertionError))
+
+	assert.Equal(t, []string{"getprop ro.build.version.sdk", "getprop 'not set'"}, cmds)
+}
+
+func TestSetProp(t *testing.T) {
+	var cmds []string
+	d, server := newPropertiesTestDevice(t, func(cmd string) string {
+		cmds = append(cmds, cmd)
+		if strings.Contains(cmd, "ro.") {
+			return "Failed to set property 'ro.debuggable' to '1'.\n:1\n"
+		}
+		return ":0\n"
+	})
+	defer server.Close()
+
+	assert.NoError(t, d.SetProp("debug.value", "a b"))
+
+	err := d.SetProp("ro.debuggable", "1")
+	assert.True(t, HasErrCode(err, PropertyPermissionDenied))
+	assert.Contains(t, ErrorWithCauseChain(err), "Failed to set property")
+
+	assert.Equal(t, []string{
+		`{ setprop debug.value 'a b'; } 2>&1; echo ":$?"`,
+		`{ setprop ro.debuggable 1; } 2>&1; echo ":$?"`,
+	}, cmds)
+}
+
+func TestWaitForProperty(t *testing.T) {
+	defer func(interval time.Duration) { propertyPollInterval = interval }(propertyPollInterval)
+	propertyPollInterval = time.Millisecond
+
+	var lock sync.Mutex
+	reads := 0
+	d, server := newPropertiesTestDevice(t, func(cmd string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		reads++
+		switch {
+		case reads < 3:
+			return "\n"
+		case reads < 5:
+			return "0\n"
+		default:
+			return "1\n"
+		}
+	})
+	defer server.Close()
+
+	assert.NoError(t, d.WaitForProperty(context.Background(), "sys.boot_completed", "1"))
+	assert.Equal(t, 5, reads)
+}
+
+func TestWaitForPropertyTimesOut(t *testing.T) {
+	defer func(interval time.Duration) { propertyPollInterval = interval }(propertyPollInterval)
+	propertyPollInterval = time.Millisecond
+
+	d, server := newPropertiesTestDevice(t, func(cmd string) string {
+		return "0\n"
+	})
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := d.WaitForProperty(ctx, "sys.boot_completed", "1")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, HasErrCode(err, Canceled))
+	assert.Contains(t, ErrorWithCauseChain(err), `last value "0"`)
+}
+
+func TestWaitForPropertyInterruptsHungRead(t *testing.T) {
+	unblock := make(chan struct{})
+	d, server := newPropertiesTestDevice(t, func(cmd string) string {
+		<-unblock
+		return "1\n"
+	})
+	defer server.Close()
+	defer close(unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- d.WaitForProperty(ctx, "sys.boot_completed", "1")
+	}()
+
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.True(t, HasErrCode(err, Canceled))
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForProperty didn't return while getprop was hanging")
+	}
+}
+
+func TestWaitForPropertyWaitsForDevice(t *testing.T) {
+	defer func(interval time.Duration) { propertyPollInterval = interval }(propertyPollInterval)
+	propertyPollInterval = time.Millisecond
+
+	server := adbtest.NewServer()
+	defer server.Close()
+	client, err := NewWithConfig(ServerConfig{Dialer: server, NoStartServer: true})
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		server.AddDevice("serial").HandleShell(func(cmd string) string {
+			return "1\n"
+		})
+	}()
+	assert.NoError(t, client.Device(DeviceWithSerial("serial")).WaitForProperty(context.Background(), "sys.boot_completed", "1"))
+}
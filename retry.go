@@ -0,0 +1,76 @@
+package adb
+
+import (
+	"context"
+	"time"
+)
+
+/*
+RetryPolicy configures how operations are retried when they fail with transient errors. Only
+operations that are safe to repeat are retried, e.g. Stat, ListDevices and getting device
+attributes. RunCommand is only retried on a device returned by Device.Idempotent, since the
+command may have had side effects before it failed. Writes are never retried.
+*/
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is tried, including the first.
+	// If less than 2, operations aren't retried.
+	MaxAttempts int
+
+	// Backoff is how long to wait before the first retry. The wait doubles after each retry, up
+	// to MaxBackoff if it's set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// RetryCodes are the codes of errors that are retried.
+	RetryCodes []ErrCode
+}
+
+// DefaultRetryPolicy retries connections reset by the server and devices that are briefly
+// offline, for up to about a second.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  500 * time.Millisecond,
+	RetryCodes:  []ErrCode{ConnectionResetError, DeviceOffline},
+}
+
+/*
+do runs op until it succeeds, fails with an error that isn't retriable, or has been tried
+MaxAttempts times, and returns its last error. If idempotent is false, or p is nil, op is only
+run once. Stops waiting to retry when ctx is done.
+*/
+func (p *RetryPolicy) do(ctx context.Context, idempotent bool, op func() error) error {
+	if p == nil || !idempotent {
+		return op()
+	}
+
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.MaxAttempts || !p.isRetriable(err) {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+func (p *RetryPolicy) isRetriable(err error) bool {
+	for _, code := range p.RetryCodes {
+		if HasErrCode(err, code) {
+			return true
+		}
+	}
+	return false
+}
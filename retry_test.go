@@ -0,0 +1,132 @@
+package adb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     time.Millisecond,
+	RetryCodes:  []ErrCode{ConnectionResetError, DeviceOffline},
+}
+
+func offlineError() error {
+	return &errors.Err{
+		Code:    errors.DeviceOffline,
+		Message: "server error: device offline",
+		Details: wire.ErrorResponseDetails{Request: "host:transport:serial", ServerMsg: "device offline"},
+	}
+}
+
+func TestRetryPolicyRetriesTransientErrors(t *testing.T) {
+	s := &MockServer{
+		Status:   wire.StatusSuccess,
+		Messages: []string{"serial"},
+		Errs: []error{
+			errors.Errorf(errors.ConnectionResetError, "reset"),
+			offlineError(),
+		},
+	}
+	client := (&Adb{server: s, retry: &testRetryPolicy}).Device(DeviceWithSerial("serial"))
+
+	serial, err := client.Serial()
+	assert.NoError(t, err)
+	assert.Equal(t, "serial", serial)
+	assert.Equal(t, []string{"Dial", "Dial", "Dial", "SendMessage", "ReadStatus", "ReadMessage"}, s.Trace[:6])
+}
+
+func TestRetryPolicyGivesUp(t *testing.T) {
+	s := &MockServer{
+		Errs: []error{
+			errors.Errorf(errors.ConnectionResetError, "reset"),
+			errors.Errorf(errors.ConnectionResetError, "reset"),
+			errors.Errorf(errors.ConnectionResetError, "reset"),
+		},
+	}
+	client := &Adb{server: s, retry: &testRetryPolicy}
+
+	_, err := client.ListDevices()
+	assert.True(t, HasErrCode(err, ConnectionResetError))
+	assert.Equal(t, []string{"Dial", "Dial", "Dial"}, s.Trace)
+}
+
+func TestRetryPolicyOnlyRetriesRetriableErrors(t *testing.T) {
+	s := &MockServer{
+		Errs: []error{errors.Errorf(errors.DeviceNotFound, "not found")},
+	}
+	client := (&Adb{server: s, retry: &testRetryPolicy}).Device(DeviceWithSerial("serial"))
+
+	_, err := client.Serial()
+	assert.True(t, HasErrCode(err, DeviceNotFound))
+	assert.Equal(t, []string{"Dial"}, s.Trace)
+}
+
+func TestRetryPolicyOnlyRetriesIdempotentCommands(t *testing.T) {
+	newClient := func() (*Device, *MockServer) {
+		s := &MockServer{
+			Status:   wire.StatusSuccess,
+			Messages: []string{"output"},
+			Errs:     []error{errors.Errorf(errors.ConnectionResetError, "reset")},
+		}
+		return (&Adb{server: s}).Device(AnyDevice()).WithRetry(testRetryPolicy), s
+	}
+
+	client, _ := newClient()
+	_, err := client.RunCommand("rm", "file")
+	assert.True(t, HasErrCode(err, ConnectionResetError))
+
+	client, s := newClient()
+	output, err := client.Idempotent().RunCommand("cat", "file")
+	assert.NoError(t, err)
+	assert.Equal(t, "output", output)
+	assert.Equal(t, "shell:cat file", s.Requests[len(s.Requests)-1])
+}
+
+func TestRetryPolicyStopsWhenContextDone(t *testing.T) {
+	policy := testRetryPolicy
+	policy.Backoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts := 0
+	err := policy.do(ctx, true, func() error {
+		attempts++
+		return offlineError()
+	})
+	assert.True(t, HasErrCode(err, DeviceOffline))
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 4,
+		Backoff:     10 * time.Millisecond,
+		MaxBackoff:  15 * time.Millisecond,
+		RetryCodes:  []ErrCode{NetworkError},
+	}
+
+	start := time.Now()
+	attempts := 0
+	err := policy.do(context.Background(), true, func() error {
+		attempts++
+		return errors.Errorf(errors.NetworkError, "error")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 4, attempts)
+	// 10ms + 15ms + 15ms
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	var nilPolicy *RetryPolicy
+	attempts = 0
+	nilPolicy.do(context.Background(), true, func() error {
+		attempts++
+		return errors.Errorf(errors.NetworkError, "error")
+	})
+	assert.Equal(t, 1, attempts)
+}
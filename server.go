@@ -30,6 +30,40 @@ type ServerConfig struct {
 	// Dialer used to connect to the adb server.
 	Dialer
 
+	// If true, the server is never started, and the adb executable isn't required. Use this to
+	// connect to a server that's managed by something else, e.g. a fake server in tests.
+	NoStartServer bool
+
+	// If set, StartServer is called with the server's Host:Port to start the server instead of
+	// running `adb start-server`, and the adb executable isn't required. E.g. to run a server
+	// in-process instead of the adb executable:
+	//
+	//	StartServer: func(address string) error {
+	//		return transport.NewServer(transport.ServerConfig{Address: address}).Start()
+	//	},
+	StartServer func(address string) error
+
+	// If set, connections to devices are pooled and reused. See PoolConfig.
+	Pool *PoolConfig
+
+	// If greater than 0, limits the number of operations that can use each device at once, e.g.
+	// running commands or transferring files. An operation uses the device until its connection
+	// is closed. Other operations wait their turn in the order they started. See
+	// Device.WithContext to stop waiting, and Adb.QueueStats.
+	MaxConcurrentPerDevice int
+
+	// If set, operations that are safe to repeat are retried when they fail with transient
+	// errors. See RetryPolicy and DefaultRetryPolicy.
+	Retry *RetryPolicy
+
+	// Labels for devices, keyed by serial, e.g. to describe a device lab in a config file.
+	// Queries can match them with label.<name>=<value>. See ParseDeviceQuery.
+	DeviceLabels map[string]map[string]string
+
+	// If set, all traffic on connections to the server is decoded and reported to Tracer.
+	// See wire.NewWriterTracer and wire.NewSlogTracer.
+	Tracer wire.Tracer
+
 	fs *filesystem
 }
 
@@ -72,15 +106,17 @@ func newServer(config ServerConfig) (server, error) {
 		config.fs = localFilesystem
 	}
 
-	if config.PathToAdb == "" {
-		path, err := config.fs.LookPath(AdbExecutableName)
-		if err != nil {
-			return nil, errors.WrapErrorf(err, errors.ServerNotAvailable, "could not find %s in PATH", AdbExecutableName)
+	if !config.NoStartServer && config.StartServer == nil {
+		if config.PathToAdb == "" {
+			path, err := config.fs.LookPath(AdbExecutableName)
+			if err != nil {
+				return nil, errors.WrapErrorf(err, errors.ServerNotAvailable, "could not find %s in PATH", AdbExecutableName)
+			}
+			config.PathToAdb = path
+		}
+		if err := config.fs.IsExecutableFile(config.PathToAdb); err != nil {
+			return nil, errors.WrapErrorf(err, errors.ServerNotAvailable, "invalid adb executable: %s", config.PathToAdb)
 		}
-		config.PathToAdb = path
-	}
-	if err := config.fs.IsExecutableFile(config.PathToAdb); err != nil {
-		return nil, errors.WrapErrorf(err, errors.ServerNotAvailable, "invalid adb executable: %s", config.PathToAdb)
 	}
 
 	return &realServer{
@@ -104,11 +140,22 @@ func (s *realServer) Dial() (*wire.Conn, error) {
 			return nil, err
 		}
 	}
+
+	if s.config.Tracer != nil {
+		conn = wire.TraceConn(conn, s.config.Tracer)
+	}
 	return conn, nil
 }
 
 // StartServer ensures there is a server running.
 func (s *realServer) Start() error {
+	if s.config.NoStartServer {
+		return errors.Errorf(errors.ServerNotAvailable, "server at %s not running, and NoStartServer is set", s.address)
+	}
+	if s.config.StartServer != nil {
+		err := s.config.StartServer(s.address)
+		return errors.WrapErrorf(err, errors.ServerNotAvailable, "error starting server at %s", s.address)
+	}
 	output, err := s.config.fs.CmdCombinedOutput(s.config.PathToAdb, "-L", fmt.Sprintf("tcp:%s", s.address), "start-server")
 	outputStr := strings.TrimSpace(string(output))
 	return errors.WrapErrorf(err, errors.ServerNotAvailable, "error starting server: %s\noutput:\n%s", err, outputStr)
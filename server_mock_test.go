@@ -77,6 +77,25 @@ func (s *MockServer) ReadUntilEof() ([]byte, error) {
 	return []byte(strings.Join(data, "")), nil
 }
 
+// Read returns the remaining messages concatenated, without length headers.
+func (s *MockServer) Read(buf []byte) (int, error) {
+	s.logMethod("Read")
+	if err := s.getNextErrToReturn(); err != nil {
+		return 0, err
+	}
+	if s.nextMsgIndex >= len(s.Messages) {
+		return 0, io.EOF
+	}
+
+	n := copy(buf, s.Messages[s.nextMsgIndex])
+	if n < len(s.Messages[s.nextMsgIndex]) {
+		s.Messages[s.nextMsgIndex] = s.Messages[s.nextMsgIndex][n:]
+	} else {
+		s.nextMsgIndex++
+	}
+	return n, nil
+}
+
 func (s *MockServer) SendMessage(msg []byte) error {
 	s.logMethod("SendMessage")
 	if err := s.getNextErrToReturn(); err != nil {
@@ -76,3 +76,44 @@ func TestNewServer_AdbNotFound(t *testing.T) {
 	_, err := newServer(config)
 	assert.EqualError(t, err, "ServerNotAvailable: could not find adb in PATH")
 }
+
+func TestNewServer_NoStartServer(t *testing.T) {
+	config := ServerConfig{
+		NoStartServer: true,
+		fs: &filesystem{
+			LookPath: func(name string) (string, error) {
+				return "", fmt.Errorf("executable not found: %s", name)
+			},
+		},
+	}
+
+	serverIf, err := newServer(config)
+	assert.NoError(t, err)
+	assert.True(t, HasErrCode(serverIf.Start(), ServerNotAvailable))
+}
+
+func TestNewServer_StartServer(t *testing.T) {
+	var started string
+	config := ServerConfig{
+		StartServer: func(address string) error {
+			started = address
+			return nil
+		},
+		fs: &filesystem{
+			LookPath: func(name string) (string, error) {
+				return "", fmt.Errorf("executable not found: %s", name)
+			},
+		},
+	}
+
+	serverIf, err := newServer(config)
+	assert.NoError(t, err)
+	assert.NoError(t, serverIf.Start())
+	assert.Equal(t, fmt.Sprintf("localhost:%d", AdbPort), started)
+
+	serverIf.(*realServer).config.StartServer = func(address string) error {
+		return fmt.Errorf("address in use")
+	}
+	err = serverIf.Start()
+	assert.EqualError(t, err, fmt.Sprintf("ServerNotAvailable: error starting server at localhost:%d", AdbPort))
+}
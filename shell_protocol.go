@@ -0,0 +1,62 @@
+package adb
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+/*
+Packet IDs of the shell protocol, which is used by the shell service on devices with the
+shell_v2 feature, and by the abb service. Each packet has a 1-byte ID and a 4-byte little-endian
+length, followed by the data.
+*/
+const (
+	shellPacketStdin      = 0
+	shellPacketStdout     = 1
+	shellPacketStderr     = 2
+	shellPacketExit       = 3
+	shellPacketCloseStdin = 4
+	shellPacketWindowSize = 5
+)
+
+/*
+readShellProtocol reads shell protocol packets from r until the exit packet, writes the data of
+stdout and stderr packets to stdout and stderr, and returns the exit status.
+*/
+func readShellProtocol(r io.Reader, stdout, stderr io.Writer) (int, error) {
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return 0, errors.WrapErrorf(err, errors.ConnectionResetError, "error reading shell packet header")
+		}
+		length := int64(binary.LittleEndian.Uint32(header[1:]))
+
+		var w io.Writer
+		switch header[0] {
+		case shellPacketStdout:
+			w = stdout
+		case shellPacketStderr:
+			w = stderr
+		case shellPacketExit:
+			// The length is checked first, so a bad one can't make us allocate a huge buffer.
+			if length != 1 {
+				return 0, errors.Errorf(errors.ParseError, "exit packet must have 1 byte, got %d", length)
+			}
+			var status [1]byte
+			if _, err := io.ReadFull(r, status[:]); err != nil {
+				return 0, errors.WrapErrorf(err, errors.ConnectionResetError, "error reading exit status")
+			}
+			return int(status[0]), nil
+		default:
+			// Other packets aren't sent to the host, so skip them.
+			w = ioutil.Discard
+		}
+
+		if _, err := io.CopyN(w, r, length); err != nil {
+			return 0, errors.WrapErrorf(err, errors.NetworkError, "error reading shell packet data")
+		}
+	}
+}
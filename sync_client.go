@@ -1,7 +1,6 @@
 package adb
 
 import (
-	"io"
 	"os"
 	"time"
 
@@ -12,60 +11,74 @@ import (
 var zeroTime = time.Unix(0, 0).UTC()
 
 func stat(conn *wire.SyncConn, path string) (*DirEntry, error) {
-	if err := conn.SendOctetString("STAT"); err != nil {
+	if err := sendSyncRequest(conn, "STAT", path); err != nil {
 		return nil, err
 	}
-	if err := conn.SendBytes([]byte(path)); err != nil {
-		return nil, err
-	}
-
-	id, err := conn.ReadStatus("stat")
-	if err != nil {
-		return nil, err
-	}
-	if id != "STAT" {
-		return nil, errors.Errorf(errors.AssertionError, "expected stat ID 'STAT', but got '%s'", id)
-	}
-
-	return readStat(conn)
+	return readStatResponse(conn)
 }
 
 func listDirEntries(conn *wire.SyncConn, path string) (entries *DirEntries, err error) {
-	if err = conn.SendOctetString("LIST"); err != nil {
-		return
-	}
-	if err = conn.SendBytes([]byte(path)); err != nil {
+	if err = sendSyncRequest(conn, "LIST", path); err != nil {
 		return
 	}
 
 	return &DirEntries{scanner: conn}, nil
 }
 
-func receiveFile(conn *wire.SyncConn, path string) (io.ReadCloser, error) {
-	if err := conn.SendOctetString("RECV"); err != nil {
-		return nil, err
-	}
-	if err := conn.SendBytes([]byte(path)); err != nil {
+func receiveFile(conn *wire.SyncConn, path string, opts ...TransferOption) (FileReader, error) {
+	if err := sendSyncRequest(conn, "RECV", path); err != nil {
 		return nil, err
 	}
-	return newSyncFileReader(conn)
+	return newSyncFileReader(conn, opts...)
 }
 
-// sendFile returns a WriteCloser than will write to the file at path on device.
+// sendFile returns a FileWriter than will write to the file at path on device.
 // The file will be created with permissions specified by mode.
 // The file's modified time will be set to mtime, unless mtime is 0, in which case the time the writer is
 // closed will be used.
-func sendFile(conn *wire.SyncConn, path string, mode os.FileMode, mtime time.Time) (io.WriteCloser, error) {
-	if err := conn.SendOctetString("SEND"); err != nil {
+func sendFile(conn *wire.SyncConn, path string, mode os.FileMode, mtime time.Time, opts ...TransferOption) (FileWriter, error) {
+	if err := sendSendRequest(conn, path, mode); err != nil {
 		return nil, err
 	}
 
+	sender := &sendFileSender{
+		SyncSender: conn,
+		scanner:    conn,
+		done: func(err error) error {
+			return errors.CombineErrs("error closing SyncConn", errors.NetworkError, err, conn.Close())
+		},
+	}
+	return newSyncFileWriter(sender, mtime, opts...), nil
+}
+
+// sendSyncRequest sends a request ID followed by its argument, usually a path.
+func sendSyncRequest(s wire.SyncSender, id string, arg string) error {
+	if err := s.SendOctetString(id); err != nil {
+		return err
+	}
+	return s.SendBytes([]byte(arg))
+}
+
+func sendSendRequest(s wire.SyncSender, path string, mode os.FileMode) error {
+	if err := s.SendOctetString("SEND"); err != nil {
+		return err
+	}
+
 	pathAndMode := encodePathAndMode(path, mode)
-	if err := conn.SendBytes(pathAndMode); err != nil {
+	return s.SendBytes(pathAndMode)
+}
+
+// readStatResponse reads the response to a STAT request.
+func readStatResponse(s wire.SyncScanner) (*DirEntry, error) {
+	id, err := s.ReadStatus("stat")
+	if err != nil {
 		return nil, err
 	}
+	if id != "STAT" {
+		return nil, errors.Errorf(errors.AssertionError, "expected stat ID 'STAT', but got '%s'", id)
+	}
 
-	return newSyncFileWriter(conn, mtime), nil
+	return readStat(s)
 }
 
 func readStat(s wire.SyncScanner) (entry *DirEntry, err error) {
@@ -98,3 +111,84 @@ func readStat(s wire.SyncScanner) (entry *DirEntry, err error) {
 	}
 	return
 }
+
+// stat2Size returns the size of the file at path using a STA2 request, which, unlike STAT,
+// reports the full 64-bit size. Only devices with FeatureStat2 support it.
+func stat2Size(conn *wire.SyncConn, path string) (int64, error) {
+	if err := sendSyncRequest(conn, "STA2", path); err != nil {
+		return 0, err
+	}
+	return readStat2SizeResponse(conn)
+}
+
+/*
+readStat2SizeResponse reads the response to a STA2 request, and returns the size of the file.
+After the ID, the response contains these little-endian fields:
+
+	error uint32 (an errno, or 0)
+	dev, ino uint64
+	mode, nlink, uid, gid uint32
+	size uint64
+	atime, mtime, ctime int64
+
+The whole response is always sent, even when error is set.
+*/
+func readStat2SizeResponse(s wire.SyncScanner) (int64, error) {
+	id, err := s.ReadStatus("stat2")
+	if err != nil {
+		return 0, err
+	}
+	if id != "STA2" {
+		return 0, errors.Errorf(errors.AssertionError, "expected stat ID 'STA2', but got '%s'", id)
+	}
+
+	var fields [17]int32
+	for i := range fields {
+		if fields[i], err = s.ReadInt32(); err != nil {
+			return 0, errors.WrapErrf(err, "error reading stat2 response: %v", err)
+		}
+	}
+
+	switch errno := fields[0]; errno {
+	case 0:
+		return int64(uint32(fields[9])) | int64(fields[10])<<32, nil
+	case statErrnoNoEnt:
+		return 0, errors.Errorf(errors.FileNoExistError, "file doesn't exist")
+	case statErrnoAccess:
+		return 0, errors.Errorf(errors.FilePermissionDeniedError, "permission denied")
+	default:
+		return 0, errors.Errorf(errors.AdbError, "stat failed with errno %d", errno)
+	}
+}
+
+// Linux errnos reported in STA2 responses.
+const (
+	statErrnoNoEnt  = 2
+	statErrnoAccess = 13
+)
+
+// sendFileSender is the SyncSender used to send a file. After the file has been sent, Close reads
+// the device's response, so that errors writing the file are reported and the file is complete on
+// the device before Close returns, then calls done.
+type sendFileSender struct {
+	wire.SyncSender
+	scanner wire.SyncScanner
+	done    func(error) error
+
+	closed bool
+}
+
+func (s *sendFileSender) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	// The OKAY response is followed by a length field that is always 0.
+	_, err := s.scanner.ReadStatus("send-done")
+	if err == nil {
+		_, err = s.scanner.ReadInt32()
+	}
+
+	return s.done(err)
+}
@@ -59,3 +59,20 @@ func TestStatNoExist(t *testing.T) {
 	assert.Nil(t, entry)
 	assert.Equal(t, errors.FileNoExistError, err.(*errors.Err).Code)
 }
+
+func TestSendFileCloseReadsResponse(t *testing.T) {
+	var respBuf, reqBuf bytes.Buffer
+	conn := &wire.SyncConn{SyncScanner: wire.NewSyncScanner(&respBuf), SyncSender: wire.NewSyncSender(&reqBuf)}
+
+	responses := wire.NewSyncSender(&respBuf)
+	responses.SendOctetString("FAIL")
+	responses.SendBytes([]byte("No space left on device"))
+
+	writer, err := sendFile(conn, "/file", 0644, time.Unix(1, 0))
+	require.NoError(t, err)
+	writer.Write([]byte("hello"))
+
+	err = writer.Close()
+	assert.True(t, HasErrCode(err, AdbError))
+	assert.Contains(t, ErrorWithCauseChain(err), "No space left on device")
+}
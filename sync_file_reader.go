@@ -7,6 +7,14 @@ import (
 	"github.com/zach-klippenstein/goadb/wire"
 )
 
+// FileReader reads a file from a device.
+type FileReader interface {
+	io.ReadCloser
+
+	// Stats returns statistics about the data read so far.
+	Stats() TransferStats
+}
+
 // syncFileReader wraps a SyncConn that has requested to receive a file.
 type syncFileReader struct {
 	// Reader used to read data from the adb connection.
@@ -17,13 +25,16 @@ type syncFileReader struct {
 
 	// False until the DONE chunk is encountered.
 	eof bool
+
+	meter *transferMeter
 }
 
-var _ io.ReadCloser = &syncFileReader{}
+var _ FileReader = &syncFileReader{}
 
-func newSyncFileReader(s wire.SyncScanner) (r io.ReadCloser, err error) {
+func newSyncFileReader(s wire.SyncScanner, opts ...TransferOption) (r FileReader, err error) {
 	r = &syncFileReader{
 		scanner: s,
+		meter:   newTransferMeter(opts),
 	}
 
 	// Read the header for the first chunk to consume any errors.
@@ -51,10 +62,12 @@ func (r *syncFileReader) Read(buf []byte) (n int, err error) {
 			if err == io.EOF {
 				// We just read the last chunk, set our flag before passing it up.
 				r.eof = true
+				r.meter.finish()
 			}
 			return 0, err
 		}
 		r.chunkReader = chunkReader
+		r.meter.startChunk()
 	}
 
 	if len(buf) == 0 {
@@ -65,6 +78,7 @@ func (r *syncFileReader) Read(buf []byte) (n int, err error) {
 	}
 
 	n, err = r.chunkReader.Read(buf)
+	r.meter.transferred(n)
 	if err == io.EOF {
 		// End of current chunk, don't return an error, the next chunk will be
 		// read on the next call to this method.
@@ -76,9 +90,14 @@ func (r *syncFileReader) Read(buf []byte) (n int, err error) {
 }
 
 func (r *syncFileReader) Close() error {
+	r.meter.finish()
 	return r.scanner.Close()
 }
 
+func (r *syncFileReader) Stats() TransferStats {
+	return r.meter.Stats()
+}
+
 // readNextChunk creates an io.LimitedReader for the next chunk of data,
 // and returns io.EOF if the last chunk has been read.
 func readNextChunk(r wire.SyncScanner) (io.Reader, error) {
@@ -10,6 +10,25 @@ import (
 	"github.com/zach-klippenstein/goadb/wire"
 )
 
+/*
+FileWriter writes a file to a device.
+
+Writes are buffered and sent to the device in chunks of up to wire.SyncMaxChunkSize bytes, so
+small writes don't each cost a round-trip. Close sends any buffered data before closing the
+file. ReadFrom reads directly into the chunk buffer, so io.Copy doesn't need to copy the data
+an extra time.
+*/
+type FileWriter interface {
+	io.WriteCloser
+	io.ReaderFrom
+
+	// Flush sends any buffered data to the device.
+	Flush() error
+
+	// Stats returns statistics about the data sent so far.
+	Stats() TransferStats
+}
+
 // syncFileWriter wraps a SyncConn that has requested to send a file.
 type syncFileWriter struct {
 	// The modification time to write in the footer.
@@ -18,14 +37,21 @@ type syncFileWriter struct {
 
 	// Reader used to read data from the adb connection.
 	sender wire.SyncSender
+
+	// Data that hasn't been sent yet. Allocated on first use, with a capacity of
+	// wire.SyncMaxChunkSize.
+	buf []byte
+
+	meter *transferMeter
 }
 
-var _ io.WriteCloser = &syncFileWriter{}
+var _ FileWriter = &syncFileWriter{}
 
-func newSyncFileWriter(s wire.SyncSender, mtime time.Time) io.WriteCloser {
+func newSyncFileWriter(s wire.SyncSender, mtime time.Time, opts ...TransferOption) *syncFileWriter {
 	return &syncFileWriter{
 		mtime:  mtime,
 		sender: s,
+		meter:  newTransferMeter(opts),
 	}
 }
 
@@ -41,46 +67,111 @@ func encodePathAndMode(path string, mode os.FileMode) []byte {
 	return []byte(fmt.Sprintf("%s,%d", path, uint32(mode.Perm())))
 }
 
-// Write writes the min of (len(buf), 64k).
+// Write buffers buf, sending a chunk to the device each time the buffer fills up.
 func (w *syncFileWriter) Write(buf []byte) (n int, err error) {
-	written := 0
-
-	// If buf > 64k we'll have to send multiple chunks.
-	// TODO Refactor this into something that can coalesce smaller writes into a single chukn.
 	for len(buf) > 0 {
-		// Writes < 64k have a one-to-one mapping to chunks.
-		// If buffer is larger than the max, we'll return the max size and leave it up to the
-		// caller to handle correctly.
-		partialBuf := buf
-		if len(partialBuf) > wire.SyncMaxChunkSize {
-			partialBuf = partialBuf[:wire.SyncMaxChunkSize]
+		if len(w.buf) == 0 && len(buf) >= wire.SyncMaxChunkSize {
+			// Nothing is buffered, so full chunks can be sent without copying them.
+			if err := w.sendChunk(buf[:wire.SyncMaxChunkSize]); err != nil {
+				return n, err
+			}
+			n += wire.SyncMaxChunkSize
+			buf = buf[wire.SyncMaxChunkSize:]
+			continue
 		}
 
-		if err := w.sender.SendOctetString(wire.StatusSyncData); err != nil {
-			return written, err
+		w.allocBuf()
+		copied := copy(w.buf[len(w.buf):cap(w.buf)], buf)
+		w.buf = w.buf[:len(w.buf)+copied]
+		n += copied
+		buf = buf[copied:]
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// ReadFrom reads from r until EOF, reading directly into the chunk buffer.
+func (w *syncFileWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	w.allocBuf()
+	for {
+		read, err := r.Read(w.buf[len(w.buf):cap(w.buf)])
+		w.buf = w.buf[:len(w.buf)+read]
+		n += int64(read)
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.Flush(); err != nil {
+				return n, err
+			}
 		}
-		if err := w.sender.SendBytes(partialBuf); err != nil {
-			return written, err
+
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
 		}
+	}
+}
 
-		written += len(partialBuf)
-		buf = buf[len(partialBuf):]
+// Flush sends any buffered data to the device as a single chunk.
+func (w *syncFileWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
 	}
+	if err := w.sendChunk(w.buf); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
 
-	return written, nil
+func (w *syncFileWriter) sendChunk(chunk []byte) error {
+	w.meter.startChunk()
+	if err := w.sender.SendOctetString(wire.StatusSyncData); err != nil {
+		return err
+	}
+	if err := w.sender.SendBytes(chunk); err != nil {
+		return err
+	}
+	w.meter.transferred(len(chunk))
+	return nil
 }
 
+func (w *syncFileWriter) Stats() TransferStats {
+	return w.meter.Stats()
+}
+
+func (w *syncFileWriter) allocBuf() {
+	if w.buf == nil {
+		w.buf = make([]byte, 0, wire.SyncMaxChunkSize)
+	}
+}
+
+// Close sends any buffered data and closes the file. The sender is always closed, even if sending
+// fails.
 func (w *syncFileWriter) Close() error {
 	if w.mtime.IsZero() {
 		w.mtime = time.Now()
 	}
 
-	if err := w.sender.SendOctetString(wire.StatusSyncDone); err != nil {
-		return errors.WrapErrf(err, "error sending done chunk to close stream")
-	}
-	if err := w.sender.SendTime(w.mtime); err != nil {
-		return errors.WrapErrf(err, "error writing file modification time")
+	err := w.Flush()
+	if err != nil {
+		err = errors.WrapErrf(err, "error sending buffered data")
+	} else if err = w.sender.SendOctetString(wire.StatusSyncDone); err != nil {
+		err = errors.WrapErrf(err, "error sending done chunk to close stream")
+	} else if err = w.sender.SendTime(w.mtime); err != nil {
+		err = errors.WrapErrf(err, "error writing file modification time")
 	}
 
-	return errors.WrapErrf(w.sender.Close(), "error closing FileWriter")
+	closeErr := errors.WrapErrf(w.sender.Close(), "error closing FileWriter")
+	w.meter.finish()
+	if err != nil {
+		return err
+	}
+	return closeErr
 }
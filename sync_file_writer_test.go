@@ -6,7 +6,9 @@ import (
 	"time"
 
 	"encoding/binary"
+	"io"
 	"strings"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/zach-klippenstein/goadb/wire"
@@ -19,7 +21,9 @@ func TestFileWriterWriteSingleChunk(t *testing.T) {
 	n, err := writer.Write([]byte("hello"))
 	assert.NoError(t, err)
 	assert.Equal(t, 5, n)
+	assert.Equal(t, 0, buf.Len(), "small writes should be buffered")
 
+	assert.NoError(t, writer.Flush())
 	assert.Equal(t, "DATA\005\000\000\000hello", buf.String())
 }
 
@@ -35,7 +39,8 @@ func TestFileWriterWriteMultiChunk(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 6, n)
 
-	assert.Equal(t, "DATA\005\000\000\000helloDATA\006\000\000\000 world", buf.String())
+	assert.NoError(t, writer.Flush())
+	assert.Equal(t, "DATA\013\000\000\000hello world", buf.String())
 }
 
 func TestFileWriterWriteLargeChunk(t *testing.T) {
@@ -48,7 +53,10 @@ func TestFileWriterWriteLargeChunk(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Equal(t, wire.SyncMaxChunkSize+1, n)
-	assert.Equal(t, 8 + 8 + wire.SyncMaxChunkSize+1, buf.Len())
+	assert.Equal(t, 8+wire.SyncMaxChunkSize, buf.Len())
+
+	assert.NoError(t, writer.Flush())
+	assert.Equal(t, 8+8+wire.SyncMaxChunkSize+1, buf.Len())
 
 	// First header.
 	chunk := buf.Bytes()[:8+wire.SyncMaxChunkSize]
@@ -58,12 +66,44 @@ func TestFileWriterWriteLargeChunk(t *testing.T) {
 	assert.Equal(t, data[:wire.SyncMaxChunkSize], chunk[8:])
 
 	// Second header.
-	chunk = buf.Bytes()[wire.SyncMaxChunkSize+8:wire.SyncMaxChunkSize+8+1]
+	chunk = buf.Bytes()[wire.SyncMaxChunkSize+8 : wire.SyncMaxChunkSize+8+1]
 	expectedHeader = []byte("DATA\000\000\000\000")
 	binary.LittleEndian.PutUint32(expectedHeader[4:], 1)
 	assert.Equal(t, expectedHeader, chunk[:8])
 }
 
+func TestFileWriterCoalescesSmallWrites(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newSyncFileWriter(wire.NewSyncSender(&buf), MtimeOfClose)
+
+	for i := 0; i < wire.SyncMaxChunkSize+10; i++ {
+		_, err := writer.Write([]byte{'a'})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 8+wire.SyncMaxChunkSize, buf.Len(), "should have sent exactly one full chunk")
+
+	assert.NoError(t, writer.Flush())
+	assert.Equal(t, 8+wire.SyncMaxChunkSize+8+10, buf.Len())
+}
+
+func TestFileWriterReadFrom(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newSyncFileWriter(wire.NewSyncSender(&buf), time.Unix(1, 0))
+
+	// io.Copy should use ReadFrom.
+	data := strings.Repeat("x", wire.SyncMaxChunkSize) + "hello"
+	n, err := io.Copy(writer, iotest.OneByteReader(strings.NewReader(data)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.NoError(t, writer.Close())
+
+	expectedHeader := []byte("DATA----")
+	binary.LittleEndian.PutUint32(expectedHeader[4:], wire.SyncMaxChunkSize)
+	assert.Equal(t, expectedHeader, buf.Bytes()[:8])
+	assert.Equal(t, "DATA\005\000\000\000helloDONE\x01\x00\x00\x00",
+		buf.String()[8+wire.SyncMaxChunkSize:])
+}
+
 func TestFileWriterCloseEmpty(t *testing.T) {
 	var buf bytes.Buffer
 	mtime := time.Unix(1, 0)
@@ -0,0 +1,389 @@
+package adb
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+/*
+SyncSession runs multiple sync requests (STAT, LIST, RECV, SEND) over a single connection to a
+device. The Stat, ListDirEntries, OpenRead, and OpenWrite methods on Device each dial a new
+connection and switch it to sync mode, which is expensive when operating on many files.
+
+Requests are executed one at a time. The DirEntries, readers, and writers returned by a session
+must be closed (or, for DirEntries, iterated to the end) before the next request can be made;
+any request made before then returns an AssertionError. Closing a reader before reading the
+whole file discards the rest of the file.
+
+If a request fails in a way that leaves the connection in an unknown state (e.g. the device
+returns an error, which makes adbd drop the connection), all subsequent requests will return
+that error.
+
+Close must be called when the session is no longer needed to release the connection.
+*/
+type SyncSession struct {
+	conn *wire.SyncConn
+
+	// Used to identify the session in errors.
+	descriptor DeviceDescriptor
+
+	lock sync.Mutex
+	// True while a DirEntries, reader, or writer returned by the session is still open.
+	busy bool
+	// Set when the connection can no longer be used.
+	err    error
+	closed bool
+	// Set once conn has been closed, which may happen before the session is closed if a
+	// request fails in a way that would leave a goroutine blocked on the connection.
+	connClosed bool
+}
+
+// NewSyncSession dials the device and switches the connection to sync mode.
+func (c *Device) NewSyncSession() (*SyncSession, error) {
+	conn, err := c.getSyncConn()
+	if err != nil {
+		return nil, wrapClientError(err, c, "NewSyncSession")
+	}
+	return newSyncSession(conn, c.descriptor), nil
+}
+
+func newSyncSession(conn *wire.SyncConn, descriptor DeviceDescriptor) *SyncSession {
+	return &SyncSession{
+		conn:       conn,
+		descriptor: descriptor,
+	}
+}
+
+func (s *SyncSession) String() string {
+	return fmt.Sprintf("SyncSession[%s]", s.descriptor)
+}
+
+func (s *SyncSession) Stat(path string) (*DirEntry, error) {
+	if err := s.begin(); err != nil {
+		return nil, wrapClientError(err, s, "Stat(%s)", path)
+	}
+
+	entry, err := stat(s.conn, path)
+	if err != nil && !HasErrCode(err, FileNoExistError) {
+		s.end(err)
+	} else {
+		s.end(nil)
+	}
+	return entry, wrapClientError(err, s, "Stat(%s)", path)
+}
+
+/*
+StatAll stats all of paths, pipelining the requests: all the requests are sent before waiting
+for any of the responses, so the cost of a round-trip to the device is only paid once.
+
+The returned slice has one entry for each path, in the same order. Entries for files that
+don't exist are nil.
+*/
+func (s *SyncSession) StatAll(paths []string) ([]*DirEntry, error) {
+	if err := s.begin(); err != nil {
+		return nil, wrapClientError(err, s, "StatAll")
+	}
+
+	// Send the requests concurrently with reading the responses, otherwise both sides could
+	// block writing once the socket buffers are full.
+	sendErrs := make(chan error, 1)
+	go func() {
+		for _, path := range paths {
+			if err := sendSyncRequest(s.conn, "STAT", path); err != nil {
+				sendErrs <- err
+				return
+			}
+		}
+		sendErrs <- nil
+	}()
+
+	entries := make([]*DirEntry, len(paths))
+	var err error
+	for i := range paths {
+		entries[i], err = readStatResponse(s.conn)
+		if HasErrCode(err, FileNoExistError) {
+			err = nil
+		} else if err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		// The sender may be blocked writing requests the device will never read, closing the
+		// connection makes it fail.
+		s.end(err)
+		s.lock.Lock()
+		s.closeConnLocked()
+		s.lock.Unlock()
+		return nil, wrapClientError(err, s, "StatAll")
+	}
+
+	err = <-sendErrs
+	s.end(err)
+	if err != nil {
+		return nil, wrapClientError(err, s, "StatAll")
+	}
+	return entries, nil
+}
+
+// ListDirEntries lists the directory at path. The session can't be used for other requests
+// until the returned DirEntries has been read to the end or closed.
+func (s *SyncSession) ListDirEntries(path string) (*DirEntries, error) {
+	if err := s.begin(); err != nil {
+		return nil, wrapClientError(err, s, "ListDirEntries(%s)", path)
+	}
+
+	scanner := &sessionScanner{
+		SyncScanner: s.conn,
+		session:     s,
+		skipItem: func(scanner wire.SyncScanner) error {
+			_, _, err := readNextDirListEntry(scanner)
+			return err
+		},
+		// The DONE message has the same format as a DENT, with all fields set to 0.
+		trailerInts: 4,
+	}
+
+	if err := sendSyncRequest(s.conn, "LIST", path); err != nil {
+		s.end(err)
+		return nil, wrapClientError(err, s, "ListDirEntries(%s)", path)
+	}
+	return &DirEntries{scanner: scanner}, nil
+}
+
+// OpenRead opens the file at path for reading. The session can't be used for other requests
+// until the returned reader is closed.
+func (s *SyncSession) OpenRead(path string, opts ...TransferOption) (FileReader, error) {
+	if err := s.begin(); err != nil {
+		return nil, wrapClientError(err, s, "OpenRead(%s)", path)
+	}
+
+	scanner := &sessionScanner{
+		SyncScanner: s.conn,
+		session:     s,
+		// The DONE message has a length field that is always 0.
+		trailerInts: 1,
+	}
+
+	if err := sendSyncRequest(s.conn, "RECV", path); err != nil {
+		s.end(err)
+		return nil, wrapClientError(err, s, "OpenRead(%s)", path)
+	}
+
+	// If the device returns an error, the reader will close the scanner, which ends the request.
+	reader, err := newSyncFileReader(scanner, opts...)
+	if err != nil {
+		return nil, wrapClientError(err, s, "OpenRead(%s)", path)
+	}
+	return &sessionFileReader{FileReader: reader, scanner: scanner}, nil
+}
+
+// OpenWrite opens the file at path for writing, see Device.OpenWrite. The session can't be used
+// for other requests until the returned writer is closed.
+func (s *SyncSession) OpenWrite(path string, perms os.FileMode, mtime time.Time, opts ...TransferOption) (FileWriter, error) {
+	if err := s.begin(); err != nil {
+		return nil, wrapClientError(err, s, "OpenWrite(%s)", path)
+	}
+
+	sender := &sendFileSender{
+		SyncSender: s.conn,
+		scanner:    s.conn,
+		done: func(err error) error {
+			s.end(err)
+			return err
+		},
+	}
+
+	if err := sendSendRequest(s.conn, path, perms); err != nil {
+		s.end(err)
+		return nil, wrapClientError(err, s, "OpenWrite(%s)", path)
+	}
+	return newSyncFileWriter(sender, mtime, opts...), nil
+}
+
+// Close ends the session and closes the connection. If the session is still in a valid state,
+// the device is told to quit first.
+func (s *SyncSession) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var quitErr error
+	if s.err == nil && !s.busy {
+		quitErr = sendSyncRequest(s.conn, "QUIT", "")
+	}
+	return wrapClientError(
+		errors.CombineErrs("error closing sync session", errors.NetworkError, quitErr, s.closeConnLocked()),
+		s, "Close")
+}
+
+// closeConnLocked closes the connection if it hasn't been closed yet. s.lock must be held.
+func (s *SyncSession) closeConnLocked() error {
+	if s.connClosed {
+		return nil
+	}
+	s.connClosed = true
+	return s.conn.Close()
+}
+
+// begin marks the session as busy, or returns an error if it can't be used.
+func (s *SyncSession) begin() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case s.closed:
+		return errors.AssertionErrorf("sync session is closed")
+	case s.err != nil:
+		return errors.WrapErrf(s.err, "sync session is no longer usable")
+	case s.busy:
+		return errors.AssertionErrorf("sync session is busy: the result of the previous request must be closed first")
+	}
+	s.busy = true
+	return nil
+}
+
+// end marks the session as no longer busy. If err is not nil, the session is marked unusable.
+func (s *SyncSession) end(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.busy = false
+	if err != nil && s.err == nil {
+		if _, ok := err.(*errors.Err); !ok {
+			err = errors.WrapErrorf(err, errors.NetworkError, "%s", err)
+		}
+		s.err = err
+	}
+}
+
+// sessionScanner is the SyncScanner used for a single LIST or RECV request on a SyncSession.
+// Instead of closing the connection, Close consumes the rest of the response so the next request
+// starts on a message boundary, and releases the session.
+type sessionScanner struct {
+	wire.SyncScanner
+	session *SyncSession
+
+	// Reads and discards the next item of the response. If nil, the response must have been
+	// read to the end before closing.
+	skipItem func(wire.SyncScanner) error
+	// The number of int32s that follow the DONE ID.
+	trailerInts int
+
+	done   bool
+	err    error
+	closed bool
+}
+
+func (s *sessionScanner) ReadStatus(req string) (string, error) {
+	status, err := s.SyncScanner.ReadStatus(req)
+	if err == nil && status == wire.StatusSyncDone {
+		s.done = true
+	}
+	return status, s.record(err)
+}
+
+func (s *sessionScanner) ReadInt32() (int32, error) {
+	value, err := s.SyncScanner.ReadInt32()
+	return value, s.record(err)
+}
+
+func (s *sessionScanner) ReadFileMode() (os.FileMode, error) {
+	mode, err := s.SyncScanner.ReadFileMode()
+	return mode, s.record(err)
+}
+
+func (s *sessionScanner) ReadTime() (time.Time, error) {
+	t, err := s.SyncScanner.ReadTime()
+	return t, s.record(err)
+}
+
+func (s *sessionScanner) ReadString() (string, error) {
+	str, err := s.SyncScanner.ReadString()
+	return str, s.record(err)
+}
+
+func (s *sessionScanner) ReadBytes() (io.Reader, error) {
+	r, err := s.SyncScanner.ReadBytes()
+	if err != nil {
+		return nil, s.record(err)
+	}
+	return &sessionBytesReader{Reader: r, scanner: s}, nil
+}
+
+// record remembers the first error read from the connection. Any read error, even one in the
+// middle of a message, means the connection is no longer on a message boundary.
+func (s *sessionScanner) record(err error) error {
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	return err
+}
+
+func (s *sessionScanner) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.err
+	for err == nil && !s.done {
+		if s.skipItem == nil {
+			err = errors.AssertionErrorf("sync response was not read to the end")
+		} else if err = s.skipItem(s); err == nil {
+			err = s.err
+		}
+	}
+	for i := 0; err == nil && i < s.trailerInts; i++ {
+		_, err = s.SyncScanner.ReadInt32()
+	}
+
+	s.session.end(err)
+	return err
+}
+
+// sessionBytesReader records errors from reading the body of a message on its scanner,
+// including the connection ending before the whole body was read.
+type sessionBytesReader struct {
+	io.Reader
+	scanner *sessionScanner
+}
+
+func (r *sessionBytesReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		if limited, ok := r.Reader.(*io.LimitedReader); ok && limited.N > 0 {
+			err = errors.WrapErrorf(io.ErrUnexpectedEOF, errors.ConnectionResetError,
+				"connection closed with %d bytes of message left to read", limited.N)
+		}
+	}
+	if err != io.EOF {
+		r.scanner.record(err)
+	}
+	return n, err
+}
+
+// sessionFileReader discards the rest of the file when closed, so the next request can be
+// made on the session.
+type sessionFileReader struct {
+	FileReader
+	scanner *sessionScanner
+}
+
+func (r *sessionFileReader) Close() error {
+	if _, err := io.Copy(ioutil.Discard, r.FileReader); err != nil {
+		r.scanner.record(err)
+	}
+	return r.FileReader.Close()
+}
@@ -0,0 +1,245 @@
+package adb
+
+import (
+	"bytes"
+	stderrors "errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// newTestSyncSession returns a session that reads responses from the bytes written to the
+// returned responses buffer, and writes requests to the returned requests buffer.
+func newTestSyncSession() (session *SyncSession, responses wire.SyncSender, requests *bytes.Buffer) {
+	var respBuf bytes.Buffer
+	requests = &bytes.Buffer{}
+	conn := &wire.SyncConn{
+		SyncScanner: wire.NewSyncScanner(&respBuf),
+		SyncSender:  wire.NewSyncSender(requests),
+	}
+	return newSyncSession(conn, AnyDevice()), wire.NewSyncSender(&respBuf), requests
+}
+
+func sendStatResponse(s wire.SyncSender, mode uint32, size int32, mtime time.Time) {
+	s.SendOctetString("STAT")
+	s.SendInt32(int32(mode))
+	s.SendInt32(size)
+	s.SendTime(mtime)
+}
+
+func TestSyncSessionMultipleStats(t *testing.T) {
+	session, responses, requests := newTestSyncSession()
+	sendStatResponse(responses, 0644, 4, someTime)
+	sendStatResponse(responses, 0, 0, zeroTime)
+	sendStatResponse(responses, 0755, 5, someTime)
+
+	entry, err := session.Stat("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), entry.Size)
+
+	_, err = session.Stat("/b")
+	assert.True(t, HasErrCode(err, FileNoExistError))
+
+	entry, err = session.Stat("/c")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(5), entry.Size)
+
+	assert.NoError(t, session.Close())
+	assert.Equal(t, "STAT\002\000\000\000/aSTAT\002\000\000\000/bSTAT\002\000\000\000/cQUIT\000\000\000\000",
+		requests.String())
+}
+
+func TestSyncSessionStatAll(t *testing.T) {
+	session, responses, requests := newTestSyncSession()
+	sendStatResponse(responses, 0644, 4, someTime)
+	sendStatResponse(responses, 0, 0, zeroTime)
+
+	entries, err := session.StatAll([]string{"/a", "/b"})
+	assert.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, int32(4), entries[0].Size)
+	assert.Nil(t, entries[1])
+	assert.Equal(t, "STAT\002\000\000\000/aSTAT\002\000\000\000/b", requests.String())
+}
+
+func TestSyncSessionListThenStat(t *testing.T) {
+	session, responses, _ := newTestSyncSession()
+	responses.SendOctetString("DENT")
+	responses.SendInt32(0644)
+	responses.SendInt32(4)
+	responses.SendTime(someTime)
+	responses.SendBytes([]byte("file"))
+	responses.SendOctetString("DONE")
+	for i := 0; i < 4; i++ {
+		responses.SendInt32(0)
+	}
+	sendStatResponse(responses, 0644, 4, someTime)
+
+	entries, err := session.ListDirEntries("/")
+	require.NoError(t, err)
+
+	_, err = session.Stat("/file")
+	assert.Error(t, err, "session should be busy until entries are read")
+
+	result, err := entries.ReadAll()
+	assert.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, "file", result[0].Name)
+
+	_, err = session.Stat("/file")
+	assert.NoError(t, err)
+}
+
+func TestSyncSessionReadPartialThenStat(t *testing.T) {
+	session, responses, _ := newTestSyncSession()
+	responses.SendOctetString("DATA")
+	responses.SendBytes([]byte("hello "))
+	responses.SendOctetString("DATA")
+	responses.SendBytes([]byte("world"))
+	responses.SendOctetString("DONE")
+	responses.SendInt32(0)
+	sendStatResponse(responses, 0644, 4, someTime)
+
+	reader, err := session.OpenRead("/file")
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = reader.Read(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+
+	entry, err := session.Stat("/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), entry.Size)
+}
+
+func TestSyncSessionReadAll(t *testing.T) {
+	session, responses, _ := newTestSyncSession()
+	responses.SendOctetString("DATA")
+	responses.SendBytes([]byte("hello"))
+	responses.SendOctetString("DONE")
+	responses.SendInt32(0)
+
+	reader, err := session.OpenRead("/file")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.NoError(t, reader.Close())
+	assert.NoError(t, session.Close())
+}
+
+func TestSyncSessionWriteReadsResponse(t *testing.T) {
+	session, responses, requests := newTestSyncSession()
+	responses.SendOctetString("OKAY")
+	responses.SendInt32(0)
+	sendStatResponse(responses, 0644, 5, someTime)
+
+	writer, err := session.OpenWrite("/file", 0644, time.Unix(1, 0))
+	require.NoError(t, err)
+	writer.Write([]byte("hello"))
+	assert.NoError(t, writer.Close())
+
+	entry, err := session.Stat("/file")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(5), entry.Size)
+	assert.Equal(t, "SEND\011\000\000\000/file,420DATA\005\000\000\000helloDONE\001\000\000\000"+
+		"STAT\005\000\000\000/file", requests.String())
+}
+
+func TestSyncSessionUnusableAfterFailure(t *testing.T) {
+	session, responses, _ := newTestSyncSession()
+	responses.SendOctetString("FAIL")
+	responses.SendBytes([]byte("No such file or directory"))
+
+	_, err := session.OpenRead("/file")
+	assert.True(t, HasErrCode(err, FileNoExistError))
+
+	_, err = session.Stat("/file")
+	assert.True(t, HasErrCode(err, AdbError))
+	assert.NoError(t, session.Close())
+}
+
+// scriptedConn returns each of reads in turn from Read, which may be a []byte or an error, and
+// counts how many times it's closed.
+type scriptedConn struct {
+	reads  []interface{}
+	closes int
+}
+
+func (c *scriptedConn) Read(p []byte) (int, error) {
+	if len(c.reads) == 0 {
+		return 0, io.EOF
+	}
+	switch next := c.reads[0].(type) {
+	case error:
+		c.reads = c.reads[1:]
+		return 0, next
+	case []byte:
+		n := copy(p, next)
+		if n == len(next) {
+			c.reads = c.reads[1:]
+		} else {
+			c.reads[0] = next[n:]
+		}
+		return n, nil
+	}
+	panic("invalid read")
+}
+
+func (c *scriptedConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *scriptedConn) Close() error {
+	c.closes++
+	return nil
+}
+
+func newScriptedSyncSession(reads ...interface{}) (*SyncSession, *scriptedConn) {
+	conn := &scriptedConn{reads: reads}
+	return newSyncSession(&wire.SyncConn{
+		SyncScanner: wire.NewSyncScanner(conn),
+		SyncSender:  wire.NewSyncSender(ioutil.Discard),
+	}, AnyDevice()), conn
+}
+
+func TestSyncSessionStatAllFailureClosesConnOnce(t *testing.T) {
+	session, conn := newScriptedSyncSession([]byte("STAT\244\001\000\000"), stderrors.New("connection reset"))
+
+	_, err := session.StatAll([]string{"/a", "/b"})
+	assert.True(t, HasErrCode(err, NetworkError))
+	assert.Equal(t, 1, conn.closes)
+
+	_, err = session.Stat("/a")
+	assert.Error(t, err)
+	assert.NoError(t, session.Close())
+	assert.Equal(t, 1, conn.closes)
+}
+
+func TestSyncSessionUnusableAfterErrorInsideDirEntry(t *testing.T) {
+	var rest bytes.Buffer
+	responses := wire.NewSyncSender(&rest)
+	responses.SendOctetString("DONE")
+	for i := 0; i < 4; i++ {
+		responses.SendInt32(0)
+	}
+	sendStatResponse(responses, 0644, 4, someTime)
+	session, _ := newScriptedSyncSession(
+		[]byte("DENT\244\001\000\000"), stderrors.New("connection reset"), rest.Bytes())
+
+	entries, err := session.ListDirEntries("/")
+	require.NoError(t, err)
+	_, err = entries.ReadAll()
+	assert.Error(t, err)
+
+	// Whatever follows the error must not be read as the end of the listing or as the response
+	// to a new request.
+	_, err = session.Stat("/file")
+	assert.True(t, HasErrCode(err, NetworkError))
+	assert.Contains(t, ErrorWithCauseChain(err), "no longer usable")
+}
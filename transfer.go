@@ -0,0 +1,300 @@
+package adb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+/*
+PushFile copies src to the file at path on the device, then verifies that the file on the device
+has the same size and SHA-256 checksum as the data read from src. Returns the stats of the
+transfer.
+
+If the file on the device doesn't match, returns a FileMismatchError.
+*/
+func (c *Device) PushFile(src io.Reader, path string, perms os.FileMode, mtime time.Time,
+	opts ...TransferOption) (TransferStats, error) {
+	writer, err := c.OpenWrite(path, perms, mtime, opts...)
+	if err != nil {
+		return TransferStats{}, wrapClientError(err, c, "PushFile(%s)", path)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(writer, io.TeeReader(src, hash))
+	if err != nil {
+		err = wrapCopyError(err, path)
+		err = errors.CombineErrs(fmt.Sprintf("error pushing %s", path), err.(*errors.Err).Code, err, writer.Close())
+		return writer.Stats(), wrapClientError(err, c, "PushFile(%s)", path)
+	}
+	if err := writer.Close(); err != nil {
+		return writer.Stats(), wrapClientError(err, c, "PushFile(%s)", path)
+	}
+
+	err = c.VerifyFile(path, n, hash.Sum(nil))
+	return writer.Stats(), wrapClientError(err, c, "PushFile(%s)", path)
+}
+
+/*
+VerifyFile checks that the file at path on the device has the given size and SHA-256 checksum,
+and returns a FileMismatchError if it doesn't.
+*/
+func (c *Device) VerifyFile(path string, size int64, sha256sum []byte) error {
+	remoteSize, err := c.fileSize(path)
+	if err != nil {
+		return wrapClientError(err, c, "VerifyFile(%s)", path)
+	}
+	if remoteSize != size {
+		err = errors.Errorf(errors.FileMismatchError, "size of %s on device is %d, expected %d",
+			path, remoteSize, size)
+		return wrapClientError(err, c, "VerifyFile(%s)", path)
+	}
+
+	remoteSum, err := c.SHA256(path)
+	if err != nil {
+		return wrapClientError(err, c, "VerifyFile(%s)", path)
+	}
+	if !bytes.Equal(remoteSum, sha256sum) {
+		err = errors.Errorf(errors.FileMismatchError, "SHA-256 of %s on device is %x, expected %x",
+			path, remoteSum, sha256sum)
+		return wrapClientError(err, c, "VerifyFile(%s)", path)
+	}
+	return nil
+}
+
+// SHA256 returns the SHA-256 checksum of the file at path, computed on the device by sha256sum.
+func (c *Device) SHA256(path string) ([]byte, error) {
+	cmdLine, err := NewCommand("sha256sum", "--", path).commandLine()
+	if err != nil {
+		return nil, wrapClientError(err, c, "SHA256(%s)", path)
+	}
+	output, exitCode, err := c.runShellCheckingExit(cmdLine)
+	if err == nil && exitCode != 0 {
+		err = fileCommandError(path, exitCode, output)
+	}
+	if err != nil {
+		return nil, wrapClientError(err, c, "SHA256(%s)", path)
+	}
+
+	sum, err := parseSHA256Output(output)
+	return sum, wrapClientError(err, c, "SHA256(%s)", path)
+}
+
+/*
+OpenReadFrom opens the file at path for reading, starting offset bytes into the file.
+
+If offset is not 0, the file is read by running tail with the exec service, so the skipped bytes
+are never sent. If the device doesn't support the exec service, the file is read with the sync
+protocol and the skipped bytes are discarded. Skipped bytes are not included in the transfer
+stats.
+
+Returns a FileMismatchError if offset is past the end of the file. The exec service doesn't
+report whether tail succeeded, so if it sends less than the rest of the file, e.g. because tail
+isn't available on the device, reading returns a FileMismatchError instead of io.EOF.
+*/
+func (c *Device) OpenReadFrom(path string, offset int64, opts ...TransferOption) (FileReader, error) {
+	if offset == 0 {
+		return c.OpenRead(path, opts...)
+	}
+
+	size, err := c.fileSize(path)
+	if err == nil {
+		err = checkOffset(path, offset, size)
+	}
+	if err != nil {
+		return nil, wrapClientError(err, c, "OpenReadFrom(%s, %d)", path, offset)
+	}
+
+	reader, err := c.openReadFrom(path, offset, size, opts)
+	return reader, wrapClientError(err, c, "OpenReadFrom(%s, %d)", path, offset)
+}
+
+// openReadFrom is OpenReadFrom for a file whose size is already known.
+func (c *Device) openReadFrom(path string, offset, size int64, opts []TransferOption) (FileReader, error) {
+	// tail's offsets are 1-based. Its errors can't be told apart from the file's contents, so
+	// they're discarded, and failures are detected by the output being too short.
+	cmdLine, err := NewCommand("tail", "-c", fmt.Sprintf("+%d", offset+1), "--", path).StderrTo("/dev/null").commandLine()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.openExec(cmdLine)
+	if err != nil {
+		return c.openReadSkipping(path, offset, opts...)
+	}
+	return newMeteredReader(&sizeCheckingReader{ReadCloser: conn, path: path, remaining: size - offset}, opts), nil
+}
+
+/*
+ResumePull copies the file at path on the device to dst, resuming a previous pull: dst is
+assumed to already contain the start of the file, so only the data after the current end of
+dst is read from the device and appended. Returns the stats of the transfer, whose Bytes is the
+number of bytes appended.
+
+If dst is already longer than the file on the device, or its total size after copying differs
+from the size of the file on the device, a FileMismatchError is returned.
+*/
+func (c *Device) ResumePull(path string, dst io.WriteSeeker, opts ...TransferOption) (TransferStats, error) {
+	offset, err := dst.Seek(0, io.SeekEnd)
+	if err != nil {
+		err = errors.WrapErrorf(err, errors.AssertionError, "error seeking to end of destination")
+		return TransferStats{}, wrapClientError(err, c, "ResumePull(%s)", path)
+	}
+
+	size, err := c.fileSize(path)
+	if err == nil {
+		err = checkOffset(path, offset, size)
+	}
+	if err != nil {
+		return TransferStats{}, wrapClientError(err, c, "ResumePull(%s)", path)
+	}
+	if offset == size {
+		return TransferStats{}, nil
+	}
+
+	stats, err := c.copyFrom(path, dst, func() (FileReader, error) {
+		return c.openReadFrom(path, offset, size, opts)
+	})
+	if HasErrCode(err, FileMismatchError) && stats.Bytes == 0 {
+		// tail failed without sending anything, most likely because it isn't available on the
+		// device. Fall back to sync.
+		stats, err = c.copyFrom(path, dst, func() (FileReader, error) {
+			return c.openReadSkipping(path, offset, opts...)
+		})
+	}
+	if err != nil {
+		return stats, wrapClientError(err, c, "ResumePull(%s)", path)
+	}
+
+	if total := offset + stats.Bytes; total != size {
+		err = errors.Errorf(errors.FileMismatchError, "pulled %d bytes of %s, but size on device is %d",
+			total, path, size)
+		return stats, wrapClientError(err, c, "ResumePull(%s)", path)
+	}
+	return stats, nil
+}
+
+// checkOffset returns a FileMismatchError if offset is past the end of the file at path.
+func checkOffset(path string, offset, size int64) error {
+	if offset > size {
+		return errors.Errorf(errors.FileMismatchError, "offset %d is past the end of %s, which is %d bytes",
+			offset, path, size)
+	}
+	return nil
+}
+
+// copyFrom copies the file opened by open to dst.
+func (c *Device) copyFrom(path string, dst io.Writer, open func() (FileReader, error)) (TransferStats, error) {
+	reader, err := open()
+	if err != nil {
+		return TransferStats{}, err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(dst, reader)
+	return reader.Stats(), wrapCopyError(err, path)
+}
+
+// openReadSkipping opens the file at path with the sync protocol, and discards the first offset
+// bytes.
+func (c *Device) openReadSkipping(path string, offset int64, opts ...TransferOption) (FileReader, error) {
+	// The skipped bytes are read without opts so they don't count towards the stats or rate limit.
+	reader, err := c.OpenRead(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+		reader.Close()
+		if err == io.EOF {
+			return nil, errors.Errorf(errors.FileMismatchError, "offset %d is past the end of %s", offset, path)
+		}
+		return nil, wrapCopyError(err, path)
+	}
+	return newMeteredReader(reader, opts), nil
+}
+
+// sizeCheckingReader returns a FileMismatchError instead of io.EOF if the stream ends before
+// remaining bytes have been read.
+type sizeCheckingReader struct {
+	io.ReadCloser
+	path      string
+	remaining int64
+}
+
+func (r *sizeCheckingReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = errors.Errorf(errors.FileMismatchError, "read of %s ended %d bytes before the end of the file",
+			r.path, r.remaining)
+	}
+	return n, err
+}
+
+// meteredReader applies TransferOptions to a reader that isn't a sync file reader.
+type meteredReader struct {
+	io.ReadCloser
+	meter *transferMeter
+}
+
+func newMeteredReader(r io.ReadCloser, opts []TransferOption) *meteredReader {
+	return &meteredReader{
+		ReadCloser: r,
+		meter:      newTransferMeter(opts),
+	}
+}
+
+func (r *meteredReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	if n > 0 {
+		r.meter.startChunk()
+		r.meter.transferred(n)
+	}
+	if err == io.EOF {
+		r.meter.finish()
+	}
+	return n, err
+}
+
+func (r *meteredReader) Close() error {
+	r.meter.finish()
+	return r.ReadCloser.Close()
+}
+
+func (r *meteredReader) Stats() TransferStats {
+	return r.meter.Stats()
+}
+
+// parseSHA256Output parses the checksum from the output of sha256sum, which is formatted as
+// "<hex checksum>  <path>".
+func parseSHA256Output(output string) ([]byte, error) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return nil, errors.Errorf(errors.ParseError, "empty sha256sum output")
+	}
+
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.Errorf(errors.ParseError, "invalid sha256sum output: %q", output)
+	}
+	return sum, nil
+}
+
+// wrapCopyError ensures errors returned from io.Copy are *errors.Errs.
+// Errors from the device will already be *errors.Errs, other errors came from the local side.
+func wrapCopyError(err error, path string) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*errors.Err); ok {
+		return err
+	}
+	return errors.WrapErrorf(err, errors.LocalIOError, "error copying %s", path)
+}
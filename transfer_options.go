@@ -0,0 +1,184 @@
+package adb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// TransferStats describes the progress of a file transfer.
+type TransferStats struct {
+	// Bytes is the number of bytes of file data transferred.
+	Bytes int64
+	// Chunks is the number of sync DATA chunks transferred. For transfers that don't use the
+	// sync protocol, it's the number of reads.
+	Chunks int
+	// Duration is the time since the transfer started, or the total time the transfer took
+	// once it's finished.
+	Duration time.Duration
+}
+
+// Throughput returns the average transfer rate, in bytes per second.
+func (s TransferStats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// TransferOption configures file transfers started by OpenRead, OpenWrite, and the transfer
+// helpers.
+type TransferOption func(*transferMeter)
+
+// WithProgress calls f with the current stats each time data is transferred.
+// f is called synchronously, so it should return quickly.
+func WithProgress(f func(TransferStats)) TransferOption {
+	return func(m *transferMeter) {
+		m.progress = f
+	}
+}
+
+// WithRateLimit limits the transfer to bytesPerSec. If bytesPerSec is 0 or negative, the
+// transfer isn't limited.
+func WithRateLimit(bytesPerSec int64) TransferOption {
+	if bytesPerSec <= 0 {
+		return WithRateLimiter(nil)
+	}
+	return WithRateLimiter(NewRateLimiter(bytesPerSec))
+}
+
+// WithRateLimiter limits the transfer with limiter, which may be shared with other transfers
+// to limit their combined rate, e.g. for all the devices connected to the same USB hub. If
+// limiter is nil, the transfer isn't limited.
+func WithRateLimiter(limiter *RateLimiter) TransferOption {
+	return func(m *transferMeter) {
+		m.limiter = limiter
+	}
+}
+
+/*
+RateLimiter is a token bucket that limits the rate of one or more transfers.
+
+The bucket holds up to one sync chunk worth of tokens, so transfers can burst a single chunk
+before being throttled. It is safe to share between goroutines.
+*/
+type RateLimiter struct {
+	lock sync.Mutex
+
+	// Tokens are bytes.
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// Stubbed out in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter returns a RateLimiter that allows bytesPerSec bytes per second. If bytesPerSec
+// is 0 or negative, the limiter is unlimited and never blocks.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  float64(wire.SyncMaxChunkSize),
+		tokens: float64(wire.SyncMaxChunkSize),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// wait takes n tokens from the bucket, blocking until they're available.
+// If there aren't enough tokens, the bucket goes into debt, so waiters are served in the
+// order they arrive.
+func (l *RateLimiter) wait(n int) {
+	if l.rate == 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// transferMeter tracks the stats of a single transfer and applies its TransferOptions.
+type transferMeter struct {
+	progress func(TransferStats)
+	limiter  *RateLimiter
+
+	start  time.Time
+	end    time.Time
+	bytes  int64
+	chunks int
+}
+
+func newTransferMeter(opts []TransferOption) *transferMeter {
+	m := &transferMeter{
+		start: time.Now(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// startChunk records the start of a new chunk.
+func (m *transferMeter) startChunk() {
+	m.chunks++
+}
+
+// transferred records that n bytes were transferred, reports progress, and blocks if the
+// transfer is going faster than its rate limit.
+func (m *transferMeter) transferred(n int) {
+	if n <= 0 {
+		return
+	}
+	m.bytes += int64(n)
+
+	if m.limiter != nil {
+		m.limiter.wait(n)
+	}
+	if m.progress != nil {
+		m.progress(m.Stats())
+	}
+}
+
+// finish records the end of the transfer. Subsequent calls have no effect.
+func (m *transferMeter) finish() {
+	if m.end.IsZero() {
+		m.end = time.Now()
+	}
+}
+
+func (m *transferMeter) Stats() TransferStats {
+	end := m.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return TransferStats{
+		Bytes:    m.bytes,
+		Chunks:   m.chunks,
+		Duration: end.Sub(m.start),
+	}
+}
@@ -0,0 +1,116 @@
+package adb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+func TestTransferStatsThroughput(t *testing.T) {
+	assert.Equal(t, 0.0, TransferStats{Bytes: 100}.Throughput())
+	assert.Equal(t, 50.0, TransferStats{Bytes: 100, Duration: 2 * time.Second}.Throughput())
+}
+
+func newTestRateLimiter(bytesPerSec int64) (*RateLimiter, *time.Time, *[]time.Duration) {
+	now := time.Unix(0, 0)
+	var sleeps []time.Duration
+
+	l := NewRateLimiter(bytesPerSec)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+	return l, &now, &sleeps
+}
+
+func TestRateLimiterBurstsOneChunk(t *testing.T) {
+	l, _, sleeps := newTestRateLimiter(1024)
+
+	l.wait(wire.SyncMaxChunkSize)
+	assert.Empty(t, *sleeps)
+
+	l.wait(1024)
+	assert.Equal(t, []time.Duration{time.Second}, *sleeps)
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l, now, sleeps := newTestRateLimiter(1024)
+
+	l.wait(wire.SyncMaxChunkSize)
+	*now = now.Add(2 * time.Second)
+	l.wait(1024)
+	l.wait(1024)
+	assert.Empty(t, *sleeps)
+
+	l.wait(512)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, *sleeps)
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	l, _, sleeps := newTestRateLimiter(1024)
+	l.wait(wire.SyncMaxChunkSize)
+
+	// Each waiter is queued behind the debt of the previous one.
+	l.wait(1024)
+	l.wait(1024)
+	assert.Equal(t, []time.Duration{time.Second, time.Second}, *sleeps)
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	for _, rate := range []int64{0, -1024} {
+		l, _, sleeps := newTestRateLimiter(rate)
+		for i := 0; i < 10; i++ {
+			l.wait(wire.SyncMaxChunkSize)
+		}
+		assert.Empty(t, *sleeps, "rate %d", rate)
+
+		assert.Nil(t, newTransferMeter([]TransferOption{WithRateLimit(rate)}).limiter, "rate %d", rate)
+	}
+}
+
+func TestFileWriterProgressAndStats(t *testing.T) {
+	var buf bytes.Buffer
+	var progress []int64
+	writer := newSyncFileWriter(wire.NewSyncSender(&buf), MtimeOfClose,
+		WithProgress(func(s TransferStats) {
+			progress = append(progress, s.Bytes)
+		}))
+
+	_, err := writer.Write(make([]byte, wire.SyncMaxChunkSize+10))
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{wire.SyncMaxChunkSize}, progress)
+
+	assert.NoError(t, writer.Close())
+	assert.Equal(t, []int64{wire.SyncMaxChunkSize, wire.SyncMaxChunkSize + 10}, progress)
+
+	stats := writer.Stats()
+	assert.Equal(t, int64(wire.SyncMaxChunkSize+10), stats.Bytes)
+	assert.Equal(t, 2, stats.Chunks)
+	assert.Equal(t, stats, writer.Stats(), "stats should not change after Close")
+}
+
+func TestFileReaderProgressAndStats(t *testing.T) {
+	s := wire.NewSyncScanner(strings.NewReader(
+		"DATA\006\000\000\000hello DATA\005\000\000\000worldDONE"))
+	var progress []int64
+	reader, err := newSyncFileReader(s, WithProgress(func(s TransferStats) {
+		progress = append(progress, s.Bytes)
+	}))
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	assert.Equal(t, []int64{6, 11}, progress)
+
+	stats := reader.Stats()
+	assert.Equal(t, int64(11), stats.Bytes)
+	assert.Equal(t, 2, stats.Chunks)
+}
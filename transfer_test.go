@@ -0,0 +1,283 @@
+package adb
+
+import (
+	"bytes"
+	"encoding/hex"
+	stderrors "errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb/adbtest"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestSHA256(t *testing.T) {
+	s := &MockServer{
+		Status:   wire.StatusSuccess,
+		Messages: []string{helloSHA256 + "  /sdcard/hello.txt\n:0\n"},
+	}
+	d := (&Adb{server: s}).Device(AnyDevice())
+
+	sum, err := d.SHA256("/sdcard/hello.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, helloSHA256, hex.EncodeToString(sum))
+	assert.Equal(t, `shell:{ sha256sum -- /sdcard/hello.txt; } 2>&1; echo ":$?"`, s.Requests[1])
+}
+
+func TestSHA256NoExist(t *testing.T) {
+	s := &MockServer{
+		Status:   wire.StatusSuccess,
+		Messages: []string{"sha256sum: /sdcard/nope: No such file or directory\n:1\n"},
+	}
+	d := (&Adb{server: s}).Device(AnyDevice())
+
+	_, err := d.SHA256("/sdcard/nope")
+	assert.True(t, HasErrCode(err, FileNoExistError))
+}
+
+func TestParseSHA256OutputInvalid(t *testing.T) {
+	_, err := parseSHA256Output("")
+	assert.Equal(t, ParseError, ErrCode(code(err)))
+
+	_, err = parseSHA256Output("abcd  /file")
+	assert.Equal(t, ParseError, ErrCode(code(err)))
+}
+
+const tailHelloCmd = "tail -c +7 -- /sdcard/hello.txt 2> /dev/null"
+
+// newTransferTestDevice returns a device with /sdcard/hello.txt containing "hello world", that
+// runs commands with shell. If stat2 is true, the device supports STA2.
+func newTransferTestDevice(t *testing.T, stat2 bool, shell adbtest.ShellHandler) (*Device, *adbtest.Server) {
+	server := adbtest.NewServer()
+	d := server.AddDevice("serial")
+	d.FS().WriteFile("/sdcard/hello.txt", []byte("hello world"), 0644, someTime)
+	if stat2 {
+		d.SetFeatures(string(FeatureStat2))
+	}
+	d.HandleShell(shell)
+
+	client, err := NewWithConfig(ServerConfig{Dialer: server, NoStartServer: true})
+	require.NoError(t, err)
+	return client.Device(DeviceWithSerial("serial")), server
+}
+
+// failingReader returns some data, then err.
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(buf []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(buf, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestPushFileLocalReadFails(t *testing.T) {
+	d, server := newTransferTestDevice(t, true, func(cmd string) string { return "" })
+	defer server.Close()
+
+	readErr := stderrors.New("disk on fire")
+	_, err := d.PushFile(&failingReader{data: "hel", err: readErr}, "/sdcard/new.txt", 0644, someTime)
+	assert.True(t, HasErrCode(err, LocalIOError))
+	assert.True(t, stderrors.Is(err, readErr))
+}
+
+func TestOpenReadFromUsesExecTail(t *testing.T) {
+	var cmds []string
+	device, server := newTransferTestDevice(t, true, func(cmd string) string {
+		cmds = append(cmds, cmd)
+		return "world"
+	})
+	defer server.Close()
+
+	reader, err := device.OpenReadFrom("/sdcard/hello.txt", 6)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+	assert.Equal(t, []string{tailHelloCmd}, cmds)
+}
+
+func TestOpenReadFromWithoutStat2(t *testing.T) {
+	device, server := newTransferTestDevice(t, false, func(cmd string) string {
+		switch cmd {
+		case `{ stat -c %s -- /sdcard/hello.txt; } 2>&1; echo ":$?"`:
+			return "11\n:0\n"
+		case tailHelloCmd:
+			return "world"
+		}
+		return ""
+	})
+	defer server.Close()
+
+	reader, err := device.OpenReadFrom("/sdcard/hello.txt", 6)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+}
+
+func TestOpenReadFromMissingFile(t *testing.T) {
+	var cmds []string
+	device, server := newTransferTestDevice(t, true, func(cmd string) string {
+		cmds = append(cmds, cmd)
+		return ""
+	})
+	defer server.Close()
+
+	_, err := device.OpenReadFrom("/sdcard/nope", 6)
+	assert.True(t, HasErrCode(err, FileNoExistError))
+	assert.Empty(t, cmds)
+}
+
+func TestOpenReadFromPastEnd(t *testing.T) {
+	device, server := newTransferTestDevice(t, true, nil)
+	defer server.Close()
+
+	_, err := device.OpenReadFrom("/sdcard/hello.txt", 12)
+	assert.True(t, HasErrCode(err, FileMismatchError))
+}
+
+func TestOpenReadFromTailFails(t *testing.T) {
+	// tail's error message is discarded, so the device sends nothing.
+	device, server := newTransferTestDevice(t, true, func(cmd string) string { return "" })
+	defer server.Close()
+
+	reader, err := device.OpenReadFrom("/sdcard/hello.txt", 6)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.True(t, HasErrCode(err, FileMismatchError))
+}
+
+// newResumeFile returns a temporary file containing data.
+func newResumeFile(t *testing.T, data string) *os.File {
+	f, err := ioutil.TempFile("", "resume")
+	require.NoError(t, err)
+	_, err = f.WriteString(data)
+	require.NoError(t, err)
+	return f
+}
+
+func readResumeFile(t *testing.T, f *os.File) string {
+	data, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestResumePull(t *testing.T) {
+	device, server := newTransferTestDevice(t, true, func(cmd string) string {
+		if cmd == tailHelloCmd {
+			return "world"
+		}
+		return ""
+	})
+	defer server.Close()
+	f := newResumeFile(t, "hello ")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stats, err := device.ResumePull("/sdcard/hello.txt", f)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), stats.Bytes)
+	assert.Equal(t, "hello world", readResumeFile(t, f))
+}
+
+func TestResumePullFallsBackToSync(t *testing.T) {
+	device, server := newTransferTestDevice(t, true, func(cmd string) string { return "" })
+	defer server.Close()
+	f := newResumeFile(t, "hello ")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stats, err := device.ResumePull("/sdcard/hello.txt", f)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), stats.Bytes)
+	assert.Equal(t, "hello world", readResumeFile(t, f))
+}
+
+func TestResumePullAlreadyComplete(t *testing.T) {
+	var cmds []string
+	device, server := newTransferTestDevice(t, true, func(cmd string) string {
+		cmds = append(cmds, cmd)
+		return ""
+	})
+	defer server.Close()
+	f := newResumeFile(t, "hello world")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stats, err := device.ResumePull("/sdcard/hello.txt", f)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Bytes)
+	assert.Empty(t, cmds)
+}
+
+func TestResumePullLocalFileLonger(t *testing.T) {
+	device, server := newTransferTestDevice(t, true, nil)
+	defer server.Close()
+	f := newResumeFile(t, "hello world, again")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err := device.ResumePull("/sdcard/hello.txt", f)
+	assert.True(t, HasErrCode(err, FileMismatchError))
+	assert.Equal(t, "hello world, again", readResumeFile(t, f))
+}
+
+func TestResumePullSizeOver4GiB(t *testing.T) {
+	// The local file is the same size as the remote one modulo 4GiB, which must not be mistaken
+	// for a complete pull.
+	device, server := newTransferTestDevice(t, false, func(cmd string) string {
+		if cmd == `{ stat -c %s -- /sdcard/hello.txt; } 2>&1; echo ":$?"` {
+			return "4294967307\n:0\n"
+		}
+		return ""
+	})
+	defer server.Close()
+	f := newResumeFile(t, "hello world")
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err := device.ResumePull("/sdcard/hello.txt", f)
+	assert.True(t, HasErrCode(err, FileMismatchError))
+}
+
+func TestReadStat2SizeResponse(t *testing.T) {
+	var buf bytes.Buffer
+	sender := wire.NewSyncSender(&buf)
+	sendStat2Response := func(errno int32, size int64) {
+		sender.SendOctetString("STA2")
+		fields := make([]int32, 17)
+		fields[0] = errno
+		fields[9] = int32(size)
+		fields[10] = int32(size >> 32)
+		for _, field := range fields {
+			sender.SendInt32(field)
+		}
+	}
+	sendStat2Response(0, 5<<30+3)
+	sendStat2Response(2, 0)
+	sendStat2Response(13, 0)
+	sendStat2Response(5, 0)
+	scanner := wire.NewSyncScanner(&buf)
+
+	size, err := readStat2SizeResponse(scanner)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5<<30+3), size)
+
+	_, err = readStat2SizeResponse(scanner)
+	assert.True(t, HasErrCode(err, FileNoExistError))
+	_, err = readStat2SizeResponse(scanner)
+	assert.True(t, HasErrCode(err, FilePermissionDeniedError))
+	_, err = readStat2SizeResponse(scanner)
+	assert.True(t, HasErrCode(err, AdbError))
+}
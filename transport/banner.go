@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+/*
+Banner is the identity sent by each end of a connection in its CNXN message. It's encoded as
+
+	<system type>:<serial>:<key>=<value>;<key>=<value>;...;features=<feature>,<feature>,...
+
+The host's system type is "host", and the device's is its state, e.g. "device" or "recovery".
+Devices send some of their system properties, like ro.product.model.
+*/
+type Banner struct {
+	SystemType string
+	Serial     string
+	Properties map[string]string
+	Features   []string
+}
+
+// Device properties included in device banners.
+const (
+	PropertyProduct = "ro.product.name"
+	PropertyModel   = "ro.product.model"
+	PropertyDevice  = "ro.product.device"
+)
+
+// ParseBanner parses a banner, ignoring any trailing null bytes.
+func ParseBanner(banner string) Banner {
+	banner = strings.TrimRight(banner, "\x00")
+	fields := strings.SplitN(banner, ":", 3)
+	for len(fields) < 3 {
+		fields = append(fields, "")
+	}
+
+	b := Banner{
+		SystemType: fields[0],
+		Serial:     fields[1],
+		Properties: make(map[string]string),
+	}
+	for _, prop := range strings.Split(fields[2], ";") {
+		if prop == "" {
+			continue
+		}
+		split := strings.SplitN(prop, "=", 2)
+		if len(split) < 2 {
+			continue
+		}
+		if split[0] == "features" {
+			if split[1] != "" {
+				b.Features = strings.Split(split[1], ",")
+			}
+			continue
+		}
+		b.Properties[split[0]] = split[1]
+	}
+	return b
+}
+
+// String encodes the banner, with properties sorted by key.
+func (b Banner) String() string {
+	var buf bytes.Buffer
+	buf.WriteString(b.SystemType)
+	buf.WriteByte(':')
+	buf.WriteString(b.Serial)
+	buf.WriteByte(':')
+
+	keys := make([]string, 0, len(b.Properties))
+	for key := range b.Properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(b.Properties[key])
+		buf.WriteByte(';')
+	}
+	buf.WriteString("features=")
+	buf.WriteString(strings.Join(b.Features, ","))
+	return buf.String()
+}
+
+// HasFeature returns true if feature is in the banner's features.
+func (b Banner) HasFeature(feature string) bool {
+	for _, f := range b.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
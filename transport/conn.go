@@ -0,0 +1,415 @@
+/*
+package transport implements the protocol adb uses to talk to devices, so devices can be used
+without an adb server.
+
+Devices running adbd over TCP (e.g. `adb tcpip 5555`, or emulators) can be dialed directly:
+
+	conn, err := transport.Dial("192.168.1.10:5555", transport.Config{})
+	if err != nil { … }
+	defer conn.Close()
+
+A connection multiplexes streams, each of which is connected to a service on the device, e.g.
+"shell:ls" or "sync:". Streams are opened with Conn.Open.
+
+To use a connection with the rest of goadb, use a Dialer as the client's dialer:
+
+	client, err := adb.NewWithConfig(adb.ServerConfig{
+		Dialer:        transport.NewDialer(conn),
+		NoStartServer: true,
+	})
+	output, err := client.Device(adb.AnyDevice()).RunCommand("ls")
+
+When the device asks the host to authenticate, the host signs a token with its private keys. If
+the device doesn't accept any of them, the host sends it its public key, and the device asks the
+user whether to allow the connection. By default, the adb server's key in ~/.android/adbkey is
+used.
+
+The protocol is defined at https://android.googlesource.com/platform/packages/modules/adb/+/master/protocol.txt.
+*/
+package transport
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/zach-klippenstein/goadb/adbkey"
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/internal/hostserver"
+)
+
+// DefaultPort is the port adbd listens on when it's restarted in TCP mode.
+const DefaultPort = "5555"
+
+// Config configures a connection to a device.
+type Config struct {
+	// Keys used to authenticate with the device, in the order they're tried. If nil, the adb
+	// server's key is used, if it exists.
+	Keys []*adbkey.Key
+
+	// MaxPayload is the largest message payload the host will accept. If 0, MaxPayload is used.
+	MaxPayload int
+
+	// Features advertised to the device. Devices change the behavior of some services depending
+	// on the host's features, e.g. shell_v2, so this is empty by default.
+	Features []string
+
+	// Accept is called when the device opens a stream to the host, e.g. for a reverse forward,
+	// and returns the connection the stream is spliced to. If nil, or if it returns an error,
+	// the stream is refused.
+	Accept AcceptFunc
+}
+
+/*
+AcceptFunc returns the connection to splice a stream opened by the other end of conn to. Data is
+copied between them until either is closed, and then both are closed.
+
+service is the name sent by the other end, e.g. "tcp:8080" for a reverse forward.
+*/
+type AcceptFunc func(conn *Conn, service string) (io.ReadWriteCloser, error)
+
+// Conn is a connection to a device. It's safe for concurrent use.
+type Conn struct {
+	rw         io.ReadWriteCloser
+	serial     string
+	version    uint32
+	maxPayload int
+	banner     Banner
+	accept     AcceptFunc
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	streams map[uint32]*Stream
+	lastID  uint32
+	// Why the connection was closed. Set once done is closed.
+	err  error
+	done chan struct{}
+}
+
+/*
+Dial connects to adbd at address over TCP, and authenticates with it. If address doesn't include
+a port, DefaultPort is used.
+
+If the device asks the user to authorize the host, Dial blocks until they do.
+*/
+func Dial(address string, config Config) (*Conn, error) {
+	address = withDefaultPort(address)
+	netConn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, errors.WrapErrorf(err, errors.ServerNotAvailable, "error dialing %s", address)
+	}
+	conn, err := NewConn(netConn, config)
+	if err != nil {
+		return nil, errors.WrapErrf(err, "error connecting to %s", address)
+	}
+	conn.serial = address
+	return conn, nil
+}
+
+// NewConn performs the connection handshake with a device over rw. If the handshake fails, rw
+// is closed.
+func NewConn(rw io.ReadWriteCloser, config Config) (*Conn, error) {
+	if config.MaxPayload == 0 {
+		config.MaxPayload = MaxPayload
+	}
+	if config.Keys == nil {
+		if key, err := adbkey.LoadDefault(); err == nil {
+			config.Keys = []*adbkey.Key{key}
+		}
+	}
+
+	c := newConn(rw, config.Accept)
+	if err := c.handshake(config); err != nil {
+		rw.Close()
+		return nil, err
+	}
+	c.serial = c.banner.Serial
+
+	go c.readMessages()
+	return c, nil
+}
+
+func newConn(rw io.ReadWriteCloser, accept AcceptFunc) *Conn {
+	return &Conn{
+		rw:      rw,
+		accept:  accept,
+		streams: make(map[uint32]*Stream),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *Conn) handshake(config Config) error {
+	hostBanner := Banner{SystemType: "host", Features: config.Features}
+	if err := WriteMessage(c.rw, &Message{
+		Command: CmdCnxn,
+		Arg0:    Version,
+		Arg1:    uint32(config.MaxPayload),
+		Payload: []byte(hostBanner.String()),
+	}); err != nil {
+		return err
+	}
+
+	keys := config.Keys
+	sentPublicKey := false
+	for {
+		msg, err := ReadMessage(c.rw, config.MaxPayload)
+		if errors.HasErrCode(err, errors.ConnectionResetError) && sentPublicKey {
+			return errors.WrapErrf(err, "device closed the connection, the user may have rejected the key")
+		} else if err != nil {
+			return errors.WrapErrf(err, "error reading handshake")
+		}
+
+		switch msg.Command {
+		case CmdCnxn:
+			c.version = msg.Arg0
+			if c.version > Version {
+				c.version = Version
+			}
+			c.maxPayload = int(msg.Arg1)
+			if c.maxPayload > config.MaxPayload {
+				c.maxPayload = config.MaxPayload
+			}
+			c.banner = ParseBanner(string(msg.Payload))
+			return nil
+
+		case CmdAuth:
+			if msg.Arg0 != AuthToken {
+				return errors.Errorf(errors.ParseError, "device sent AUTH message of unknown type %d", msg.Arg0)
+			}
+			if len(keys) > 0 {
+				sig, err := keys[0].Sign(msg.Payload)
+				if err != nil {
+					return err
+				}
+				keys = keys[1:]
+				if err := WriteMessage(c.rw, &Message{Command: CmdAuth, Arg0: AuthSignature, Payload: sig}); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if sentPublicKey {
+				return errors.Errorf(errors.AssertionError, "device asked for another signature after receiving the public key")
+			}
+			pub := publicKey(config.Keys)
+			if pub == nil {
+				return errors.Errorf(errors.AssertionError,
+					"device requires authentication, but it didn't accept any keys and there's no public key to send it")
+			}
+			if err := WriteMessage(c.rw, &Message{
+				Command: CmdAuth,
+				Arg0:    AuthRSAPublicKey,
+				Payload: append(pub, 0),
+			}); err != nil {
+				return err
+			}
+			sentPublicKey = true
+
+		case CmdStls:
+			return errors.Errorf(errors.AssertionError, "device requires TLS, which isn't supported")
+
+		default:
+			return errors.Errorf(errors.ParseError, "unexpected message during handshake: %s", msg)
+		}
+	}
+}
+
+// publicKey returns the public key of the first key that has one.
+func publicKey(keys []*adbkey.Key) []byte {
+	for _, key := range keys {
+		if pub := key.PublicKey(); pub != nil {
+			return append([]byte(nil), pub...)
+		}
+	}
+	return nil
+}
+
+// Serial returns the address the connection was dialed with, or the serial number sent by the
+// device if it was created with NewConn.
+func (c *Conn) Serial() string {
+	return c.serial
+}
+
+// Banner returns the banner the other end sent when connecting.
+func (c *Conn) Banner() Banner {
+	return c.banner
+}
+
+// Version returns the protocol version negotiated with the device.
+func (c *Conn) Version() uint32 {
+	return c.version
+}
+
+// MaxPayload returns the largest payload that can be sent in a single message.
+func (c *Conn) MaxPayload() int {
+	return c.maxPayload
+}
+
+// Done returns a channel that's closed when the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection was closed, or nil if it's still open.
+func (c *Conn) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Close closes the connection and all its streams.
+func (c *Conn) Close() error {
+	c.closeWithError(errors.Errorf(errors.ConnectionResetError, "connection closed"))
+	return nil
+}
+
+/*
+Open opens a stream to a service on the device, e.g. "shell:ls". Services are the same as the
+ones the adb server forwards to the device after a host:transport request.
+
+Returns an error if the device refuses to open the service.
+*/
+func (c *Conn) Open(service string) (*Stream, error) {
+	s, err := c.newStream(service)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.send(CmdOpen, s.localID, 0, append([]byte(service), 0)); err != nil {
+		c.removeStream(s.localID)
+		return nil, err
+	}
+
+	select {
+	case <-s.opened:
+		return s, nil
+	case <-s.done:
+	}
+	// The device may have accepted the stream and closed it right away.
+	select {
+	case <-s.opened:
+		return s, nil
+	default:
+		return nil, s.doneErr()
+	}
+}
+
+func (c *Conn) newStream(service string) (*Stream, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.lastID++
+	s := newStream(c, c.lastID, service)
+	c.streams[s.localID] = s
+	return s, nil
+}
+
+// acceptStream handles a stream opened by the other end.
+func (c *Conn) acceptStream(remoteID uint32, service string) {
+	var rw io.ReadWriteCloser
+	err := errors.Errorf(errors.AdbError, "streams can't be opened by the device")
+	if c.accept != nil {
+		rw, err = c.accept(c, service)
+	}
+	if err != nil {
+		c.send(CmdClse, 0, remoteID, nil)
+		return
+	}
+
+	s, err := c.newStream(service)
+	if err != nil {
+		rw.Close()
+		return
+	}
+	s.handleOkay(remoteID)
+	if err := c.send(CmdOkay, s.localID, remoteID, nil); err != nil {
+		rw.Close()
+		s.Close()
+		return
+	}
+	hostserver.Splice(rw, s)
+}
+
+func (c *Conn) send(cmd, arg0, arg1 uint32, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return WriteMessage(c.rw, &Message{Command: cmd, Arg0: arg0, Arg1: arg1, Payload: payload})
+}
+
+func (c *Conn) stream(localID uint32) *Stream {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.streams[localID]
+}
+
+func (c *Conn) removeStream(localID uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.streams, localID)
+}
+
+func (c *Conn) readMessages() {
+	for {
+		msg, err := ReadMessage(c.rw, c.maxPayload)
+		if err != nil {
+			c.closeWithError(err)
+			return
+		}
+		c.handleMessage(msg)
+	}
+}
+
+// handleMessage dispatches a message from the device. The device's stream ID is in arg0, and
+// ours in arg1.
+func (c *Conn) handleMessage(msg *Message) {
+	switch msg.Command {
+	case CmdOkay:
+		if s := c.stream(msg.Arg1); s != nil {
+			s.handleOkay(msg.Arg0)
+		}
+
+	case CmdWrte:
+		if s := c.stream(msg.Arg1); s != nil {
+			s.handleWrite(msg.Payload)
+		} else {
+			go c.send(CmdClse, 0, msg.Arg0, nil)
+		}
+
+	case CmdClse:
+		if s := c.stream(msg.Arg1); s != nil {
+			c.removeStream(msg.Arg1)
+			s.handleClose()
+		}
+
+	case CmdOpen:
+		// Accepting may block, and replies must be sent asynchronously so reading is never blocked
+		// by writing.
+		go c.acceptStream(msg.Arg0, strings.TrimRight(string(msg.Payload), "\x00"))
+
+	case CmdCnxn:
+		c.closeWithError(errors.Errorf(errors.ConnectionResetError, "connection reset by new CNXN with banner %q",
+			strings.TrimRight(string(msg.Payload), "\x00")))
+	}
+}
+
+func (c *Conn) closeWithError(err error) {
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return
+	}
+	c.err = err
+	close(c.done)
+	streams := c.streams
+	c.streams = nil
+	c.lock.Unlock()
+
+	c.rw.Close()
+	for _, s := range streams {
+		s.connClosed(err)
+	}
+}
@@ -0,0 +1,289 @@
+package transport
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb"
+	"github.com/zach-klippenstein/goadb/adbkey"
+)
+
+// testDevice is the device end of a connection. It serves "echo:", which writes back everything
+// it receives, and "shell:<cmd>", which writes cmd and closes the stream.
+type testDevice struct {
+	t          *testing.T
+	rw         io.ReadWriteCloser
+	maxPayload int
+	banner     Banner
+	// If set, the device requires a signature that verifies with this key.
+	authKey *rsa.PublicKey
+
+	lock       sync.Mutex
+	hostBanner string
+	publicKey  string
+	lastID     uint32
+	received   [][]byte
+}
+
+func newTestDevice(t *testing.T) (*testDevice, io.ReadWriteCloser) {
+	host, device := net.Pipe()
+	return &testDevice{
+		t:          t,
+		rw:         device,
+		maxPayload: MaxPayload,
+		banner: Banner{
+			SystemType: "device",
+			Properties: map[string]string{PropertyModel: "Pixel", PropertyProduct: "sailfish"},
+			Features:   []string{"shell_v2", "cmd"},
+		},
+	}, host
+}
+
+func (d *testDevice) send(cmd, arg0, arg1 uint32, payload string) {
+	require.NoError(d.t, WriteMessage(d.rw, &Message{Command: cmd, Arg0: arg0, Arg1: arg1, Payload: []byte(payload)}))
+}
+
+func (d *testDevice) serve() {
+	defer d.rw.Close()
+	token := strings.Repeat("t", adbkey.TokenSize)
+	for {
+		msg, err := ReadMessage(d.rw, MaxPayload)
+		if err != nil {
+			return
+		}
+
+		switch msg.Command {
+		case CmdCnxn:
+			d.lock.Lock()
+			d.hostBanner = string(msg.Payload)
+			d.lock.Unlock()
+			if d.authKey != nil {
+				d.send(CmdAuth, AuthToken, 0, token)
+				continue
+			}
+			d.send(CmdCnxn, Version, uint32(d.maxPayload), d.banner.String())
+
+		case CmdAuth:
+			switch msg.Arg0 {
+			case AuthSignature:
+				if rsa.VerifyPKCS1v15(d.authKey, crypto.SHA1, []byte(token), msg.Payload) == nil {
+					d.send(CmdCnxn, Version, uint32(d.maxPayload), d.banner.String())
+				} else {
+					d.send(CmdAuth, AuthToken, 0, token)
+				}
+			case AuthRSAPublicKey:
+				d.lock.Lock()
+				d.publicKey = string(msg.Payload)
+				d.lock.Unlock()
+				// The user rejects the key.
+				return
+			}
+
+		case CmdOpen:
+			service := strings.TrimRight(string(msg.Payload), "\x00")
+			d.lock.Lock()
+			d.lastID++
+			id := d.lastID
+			d.lock.Unlock()
+
+			switch {
+			case service == "echo:":
+				d.send(CmdOkay, id, msg.Arg0, "")
+			case strings.HasPrefix(service, "shell:"):
+				d.send(CmdOkay, id, msg.Arg0, "")
+				d.send(CmdWrte, id, msg.Arg0, strings.TrimPrefix(service, "shell:")+"\n")
+				d.send(CmdClse, id, msg.Arg0, "")
+			default:
+				d.send(CmdClse, 0, msg.Arg0, "")
+			}
+
+		case CmdWrte:
+			d.lock.Lock()
+			d.received = append(d.received, msg.Payload)
+			d.lock.Unlock()
+			d.send(CmdOkay, msg.Arg1, msg.Arg0, "")
+			d.send(CmdWrte, msg.Arg1, msg.Arg0, string(msg.Payload))
+		}
+	}
+}
+
+func newTestConn(t *testing.T, configure func(*testDevice), config Config) (*Conn, *testDevice, error) {
+	device, rw := newTestDevice(t)
+	if configure != nil {
+		configure(device)
+	}
+	go device.serve()
+	if config.Keys == nil {
+		config.Keys = []*adbkey.Key{}
+	}
+	conn, err := NewConn(rw, config)
+	return conn, device, err
+}
+
+func TestHandshake(t *testing.T) {
+	conn, device, err := newTestConn(t, func(d *testDevice) {
+		d.maxPayload = 4096
+	}, Config{Features: []string{"stat_v2"}})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "host::features=stat_v2", device.hostBanner)
+	assert.Equal(t, Version, conn.Version())
+	assert.Equal(t, 4096, conn.MaxPayload())
+	assert.Equal(t, "device", conn.Banner().SystemType)
+	assert.Equal(t, "Pixel", conn.Banner().Properties[PropertyModel])
+	assert.True(t, conn.Banner().HasFeature("shell_v2"))
+}
+
+func TestStreamReadUntilClosed(t *testing.T) {
+	conn, _, err := newTestConn(t, nil, Config{})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := conn.Open("shell:hello")
+	require.NoError(t, err)
+	output, err := ioutil.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(output))
+	assert.NoError(t, stream.Close())
+}
+
+func TestStreamWriteSplitsPayload(t *testing.T) {
+	conn, device, err := newTestConn(t, func(d *testDevice) {
+		d.maxPayload = 4
+	}, Config{})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stream, err := conn.Open("echo:")
+	require.NoError(t, err)
+
+	go func() {
+		n, err := stream.Write([]byte("hello world"))
+		assert.NoError(t, err)
+		assert.Equal(t, 11, n)
+	}()
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(stream, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(buf))
+
+	device.lock.Lock()
+	assert.Equal(t, [][]byte{[]byte("hell"), []byte("o wo"), []byte("rld")}, device.received)
+	device.lock.Unlock()
+}
+
+func TestOpenRefused(t *testing.T) {
+	conn, _, err := newTestConn(t, nil, Config{})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Open("nope:")
+	assert.EqualError(t, err, "AdbError: device refused to open service: nope:")
+}
+
+func TestConnCloseClosesStreams(t *testing.T) {
+	conn, _, err := newTestConn(t, nil, Config{})
+	require.NoError(t, err)
+
+	stream, err := conn.Open("echo:")
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	_, err = stream.Read(make([]byte, 1))
+	assert.EqualError(t, err, "ConnectionResetError: connection closed")
+	_, err = conn.Open("echo:")
+	assert.Error(t, err)
+}
+
+func newTestKey(t *testing.T) *adbkey.Key {
+	priv, err := rsa.GenerateKey(rand.Reader, adbkey.KeyBits)
+	require.NoError(t, err)
+	key, err := adbkey.New(priv, "user@host")
+	require.NoError(t, err)
+	return key
+}
+
+func TestAuthSignature(t *testing.T) {
+	rejected, accepted := newTestKey(t), newTestKey(t)
+
+	conn, _, err := newTestConn(t, func(d *testDevice) {
+		d.authKey = &accepted.PrivateKey().PublicKey
+	}, Config{Keys: []*adbkey.Key{rejected, accepted}})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestAuthSendsPublicKey(t *testing.T) {
+	key, other := newTestKey(t), newTestKey(t)
+
+	_, device, err := newTestConn(t, func(d *testDevice) {
+		d.authKey = &other.PrivateKey().PublicKey
+	}, Config{Keys: []*adbkey.Key{key}})
+	assert.Contains(t, adb.ErrorWithCauseChain(err), "the user may have rejected the key")
+	device.lock.Lock()
+	assert.Equal(t, string(key.PublicKey())+"\x00", device.publicKey)
+	device.lock.Unlock()
+}
+
+func TestDialer(t *testing.T) {
+	conn, _, err := newTestConn(t, func(d *testDevice) {
+		d.banner.Serial = "emulator-5554"
+	}, Config{})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client, err := adb.NewWithConfig(adb.ServerConfig{Dialer: NewDialer(conn), NoStartServer: true})
+	require.NoError(t, err)
+
+	version, err := client.ServerVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, hostVersion, version)
+
+	devices, err := client.ListDevices()
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Equal(t, &adb.DeviceInfo{
+		Serial:      "emulator-5554",
+		State:       adb.StateOnline,
+		Product:     "sailfish",
+		Model:       "Pixel",
+		Connection:  adb.ConnectionEmulator,
+		TransportID: 1,
+	}, devices[0])
+
+	device := client.Device(adb.DeviceWithSerial("emulator-5554"))
+	state, err := device.State()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.StateOnline, state)
+
+	output, err := device.RunCommand("echo", "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo hi\n", output)
+
+	_, err = client.Device(adb.DeviceWithSerial("other")).RunCommand("true")
+	assert.True(t, adb.HasErrCode(err, adb.DeviceNotFound))
+
+	// The device can also be selected by the transport ID it's listed with.
+	device = client.Device(adb.DeviceWithTransportID(devices[0].TransportID))
+	serial, err := device.Serial()
+	assert.NoError(t, err)
+	assert.Equal(t, "emulator-5554", serial)
+	output, err = device.RunCommand("echo", "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo hi\n", output)
+
+	_, err = client.Device(adb.DeviceWithTransportID(2)).RunCommand("true")
+	assert.True(t, adb.HasErrCode(err, adb.DeviceNotFound))
+	_, err = client.Device(adb.DeviceWithTransportID(2)).State()
+	assert.True(t, adb.HasErrCode(err, adb.DeviceNotFound))
+}
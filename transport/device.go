@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"strings"
+
+	"github.com/zach-klippenstein/goadb/adbkey"
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+// DeviceConfig configures the device end of a connection, for implementing adbd.
+type DeviceConfig struct {
+	// Banner sent to the host. SystemType should be a device state, e.g. "device".
+	Banner Banner
+
+	// MaxPayload is the largest message payload the device will accept. If 0, MaxPayload is used.
+	MaxPayload int
+
+	// If true, hosts must authenticate with one of AuthorizedKeys, or a key accepted by ConfirmKey.
+	RequireAuth bool
+
+	// AuthorizedKeys returns the keys hosts can sign tokens with, i.e. the device's adb_keys.
+	AuthorizedKeys func() []*rsa.PublicKey
+
+	// ConfirmKey is called with the public key a host sends when none of its signatures were
+	// accepted, and returns true if the user allows the host to connect. If nil, the key is
+	// rejected.
+	ConfirmKey func(pub *rsa.PublicKey) bool
+
+	// Accept returns the connection a stream opened by the host, i.e. a service, is spliced to.
+	Accept AcceptFunc
+}
+
+/*
+NewDeviceConn performs the device end of the connection handshake with a host over rw. If the
+handshake fails, rw is closed.
+
+If auth is required, hosts whose signatures don't verify with any authorized key are sent new
+tokens until they send their public key.
+*/
+func NewDeviceConn(rw io.ReadWriteCloser, config DeviceConfig) (*Conn, error) {
+	if config.MaxPayload == 0 {
+		config.MaxPayload = MaxPayload
+	}
+
+	c := newConn(rw, config.Accept)
+	if err := c.deviceHandshake(config); err != nil {
+		rw.Close()
+		return nil, err
+	}
+	c.serial = c.banner.Serial
+
+	go c.readMessages()
+	return c, nil
+}
+
+func (c *Conn) deviceHandshake(config DeviceConfig) error {
+	msg, err := ReadMessage(c.rw, config.MaxPayload)
+	if err != nil {
+		return errors.WrapErrf(err, "error reading handshake")
+	}
+	if msg.Command != CmdCnxn {
+		return errors.Errorf(errors.ParseError, "expected CNXN, got %s", msg)
+	}
+	if msg.Arg0 < VersionMin {
+		return errors.Errorf(errors.ParseError, "unsupported protocol version %#x", msg.Arg0)
+	}
+	c.version = msg.Arg0
+	if c.version > Version {
+		c.version = Version
+	}
+	c.maxPayload = int(msg.Arg1)
+	if c.maxPayload > config.MaxPayload {
+		c.maxPayload = config.MaxPayload
+	}
+	c.banner = ParseBanner(string(msg.Payload))
+
+	if config.RequireAuth {
+		if err := c.authenticateHost(config); err != nil {
+			return err
+		}
+	}
+
+	return WriteMessage(c.rw, &Message{
+		Command: CmdCnxn,
+		Arg0:    c.version,
+		Arg1:    uint32(config.MaxPayload),
+		Payload: []byte(config.Banner.String()),
+	})
+}
+
+// authenticateHost sends tokens to the host until it signs one with an authorized key, or sends
+// a public key the user accepts.
+func (c *Conn) authenticateHost(config DeviceConfig) error {
+	for {
+		token := make([]byte, adbkey.TokenSize)
+		if _, err := rand.Read(token); err != nil {
+			return errors.WrapErrorf(err, errors.AssertionError, "error generating token")
+		}
+		if err := WriteMessage(c.rw, &Message{Command: CmdAuth, Arg0: AuthToken, Payload: token}); err != nil {
+			return err
+		}
+
+		msg, err := ReadMessage(c.rw, config.MaxPayload)
+		if err != nil {
+			return errors.WrapErrf(err, "error reading AUTH response")
+		}
+		if msg.Command != CmdAuth {
+			return errors.Errorf(errors.ParseError, "expected AUTH, got %s", msg)
+		}
+
+		switch msg.Arg0 {
+		case AuthSignature:
+			// The signature doesn't say which key made it, so every authorized key has to be tried.
+			if config.AuthorizedKeys == nil {
+				continue
+			}
+			for _, pub := range config.AuthorizedKeys() {
+				if rsa.VerifyPKCS1v15(pub, crypto.SHA1, token, msg.Payload) == nil {
+					return nil
+				}
+			}
+
+		case AuthRSAPublicKey:
+			pub, _, err := adbkey.ParsePublicKey([]byte(strings.TrimRight(string(msg.Payload), "\x00")))
+			if err != nil {
+				return errors.WrapErrf(err, "host sent invalid public key")
+			}
+			if config.ConfirmKey != nil && config.ConfirmKey(pub) {
+				return nil
+			}
+			return errors.Errorf(errors.AssertionError, "host's public key was rejected")
+
+		default:
+			return errors.Errorf(errors.ParseError, "host sent AUTH message of unknown type %d", msg.Arg0)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/internal/hostserver"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// Version reported by the host:version request of a Dialer.
+const hostVersion = 41
+
+// Transport ID of a Dialer's device. It's the only device, so it gets the ID an adb server gives
+// the first device attached to it.
+const dialerTransportID = 1
+
+/*
+Dialer is an adb.Dialer that serves the requests goadb sends to the adb server using a single
+device connection. Requests to select the device, to list devices, and to get the device's
+attributes are answered by the Dialer, and services are opened on the device, so a Device from a
+client using the Dialer works the same as one from a client using a real server.
+
+The device is reported as a local (i.e. TCP) device, with the serial returned by Conn.Serial and
+transport ID 1. The address passed to Dial is ignored.
+*/
+type Dialer struct {
+	conn *Conn
+}
+
+// NewDialer returns a Dialer for the device connected to conn.
+func NewDialer(conn *Conn) *Dialer {
+	return &Dialer{conn}
+}
+
+func (d *Dialer) Dial(address string) (*wire.Conn, error) {
+	select {
+	case <-d.conn.Done():
+		return nil, errors.WrapErrf(d.conn.Err(), "device connection closed")
+	default:
+	}
+
+	client, server := net.Pipe()
+	go d.serve(server)
+
+	safeConn := wire.MultiCloseable(client)
+	return &wire.Conn{
+		Scanner: wire.NewScanner(safeConn),
+		Sender:  wire.NewSender(safeConn),
+	}, nil
+}
+
+// serve handles the requests sent on one client connection.
+func (d *Dialer) serve(rw io.ReadWriteCloser) {
+	defer rw.Close()
+	c := hostserver.NewConn(rw)
+
+	req, err := c.Scanner.ReadMessage()
+	if err != nil {
+		return
+	}
+	request := string(req)
+
+	switch {
+	case request == "host:version":
+		c.OkayMessage(fmt.Sprintf("%04x", hostVersion))
+	case request == "host:devices":
+		c.OkayMessage(fmt.Sprintf("%s\t%s\n", d.conn.Serial(), connState(d.conn)))
+	case request == "host:devices-l":
+		c.OkayMessage(formatDeviceLong(d.conn))
+	case strings.HasPrefix(request, "host:transport"):
+		d.handleTransport(c, strings.TrimPrefix(request, "host:"))
+	default:
+		d.handleDeviceHostRequest(c, request)
+	}
+}
+
+func (d *Dialer) handleTransport(c *hostserver.Conn, transport string) {
+	if msg := d.checkSelected(transport); msg != "" {
+		c.Fail(msg)
+		return
+	}
+	serveTransport(c, d.conn, nil)
+}
+
+// serveTransport switches c to conn after a successful host:transport request: it reads a service
+// from c, opens it on conn, and splices them together. If opened isn't nil, it's called with the
+// service once it's open.
+func serveTransport(c *hostserver.Conn, conn *Conn, opened func(service string)) {
+	if err := c.Okay(); err != nil {
+		return
+	}
+
+	service, err := c.Scanner.ReadMessage()
+	if err != nil {
+		return
+	}
+	stream, err := conn.Open(string(service))
+	if err != nil {
+		c.Fail(err.Error())
+		return
+	}
+	if opened != nil {
+		opened(string(service))
+	}
+	if err := c.Okay(); err != nil {
+		stream.Close()
+		return
+	}
+
+	hostserver.Splice(c, stream)
+}
+
+// checkSelected returns a failure message if the device isn't selected by a transport request,
+// e.g. "transport:<serial>", "transport-id:<id>" or "transport-usb".
+func (d *Dialer) checkSelected(transport string) string {
+	switch {
+	case transport == "transport-any" || transport == "transport-local":
+		return ""
+	case transport == "transport-usb":
+		return "no devices found"
+	case strings.HasPrefix(transport, "transport:"):
+		serial := strings.TrimPrefix(transport, "transport:")
+		if serial != d.conn.Serial() {
+			return fmt.Sprintf("device '%s' not found", serial)
+		}
+		return ""
+	case strings.HasPrefix(transport, "transport-id:"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(transport, "transport-id:"), 10, 64)
+		if err != nil {
+			return fmt.Sprintf("invalid transport id: %s", transport)
+		}
+		if id != dialerTransportID {
+			return fmt.Sprintf("no device with transport id '%d'", id)
+		}
+		return ""
+	default:
+		return fmt.Sprintf("unknown transport request: %s", transport)
+	}
+}
+
+// handleDeviceHostRequest handles requests like host-serial:<serial>:get-state and
+// host-transport-id:<id>:get-state.
+func (d *Dialer) handleDeviceHostRequest(c *hostserver.Conn, request string) {
+	var transport, attr string
+	switch {
+	case strings.HasPrefix(request, "host-serial:"):
+		rest := strings.TrimPrefix(request, "host-serial:")
+		i := strings.LastIndex(rest, ":")
+		if i < 0 {
+			c.Fail(fmt.Sprintf("unsupported request: %s", request))
+			return
+		}
+		transport, attr = "transport:"+rest[:i], rest[i+1:]
+	case strings.HasPrefix(request, "host-transport-id:"):
+		rest := strings.TrimPrefix(request, "host-transport-id:")
+		i := strings.Index(rest, ":")
+		if i < 0 {
+			c.Fail(fmt.Sprintf("unsupported request: %s", request))
+			return
+		}
+		transport, attr = "transport-id:"+rest[:i], rest[i+1:]
+	case strings.HasPrefix(request, "host-usb:"):
+		transport, attr = "transport-usb", strings.TrimPrefix(request, "host-usb:")
+	case strings.HasPrefix(request, "host-local:"):
+		transport, attr = "transport-local", strings.TrimPrefix(request, "host-local:")
+	case strings.HasPrefix(request, "host:"):
+		transport, attr = "transport-any", strings.TrimPrefix(request, "host:")
+	default:
+		c.Fail(fmt.Sprintf("unsupported request: %s", request))
+		return
+	}
+
+	if msg := d.checkSelected(transport); msg != "" {
+		c.Fail(msg)
+		return
+	}
+	switch attr {
+	case "get-state":
+		c.OkayMessage(connState(d.conn))
+	case "get-serialno":
+		c.OkayMessage(d.conn.Serial())
+	case "get-devpath":
+		c.OkayMessage("unknown")
+	default:
+		c.Fail(fmt.Sprintf("unsupported request: %s", request))
+	}
+}
+
+// connState returns the state of the device connected to conn, which adbd sends as the system
+// type in its banner.
+func connState(conn *Conn) string {
+	select {
+	case <-conn.Done():
+		return "offline"
+	default:
+		return conn.Banner().SystemType
+	}
+}
+
+// formatDeviceLong formats the device connected to conn as a line of host:devices-l.
+func formatDeviceLong(conn *Conn) string {
+	props := conn.Banner().Properties
+	line := fmt.Sprintf("%-22s %s", conn.Serial(), connState(conn))
+	for _, attr := range []struct{ key, prop string }{
+		{"product", PropertyProduct},
+		{"model", PropertyModel},
+		{"device", PropertyDevice},
+	} {
+		if val := props[attr.prop]; val != "" {
+			line += fmt.Sprintf(" %s:%s", attr.key, val)
+		}
+	}
+	return line + fmt.Sprintf(" transport_id:%d\n", dialerTransportID)
+}
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+// Commands, which are their names encoded as little-endian integers.
+const (
+	CmdSync uint32 = 0x434e5953
+	CmdCnxn uint32 = 0x4e584e43
+	CmdAuth uint32 = 0x48545541
+	CmdOpen uint32 = 0x4e45504f
+	CmdOkay uint32 = 0x59414b4f
+	CmdClse uint32 = 0x45534c43
+	CmdWrte uint32 = 0x45545257
+	CmdStls uint32 = 0x534c5453
+)
+
+// Types of AUTH messages, sent in arg0.
+const (
+	// Sent by the device, with a random token to sign.
+	AuthToken uint32 = 1
+	// Sent by the host, with the signed token.
+	AuthSignature uint32 = 2
+	// Sent by the host, with a public key for the user to accept.
+	AuthRSAPublicKey uint32 = 3
+)
+
+const (
+	// Protocol version sent in CNXN messages. Since this version, checksums aren't checked.
+	Version uint32 = 0x01000001
+	// Oldest protocol version, which requires checksums.
+	VersionMin uint32 = 0x01000000
+
+	// MaxPayload is the largest payload sent or accepted by default. The maximum payload for a
+	// connection is the smaller of the host's and the device's.
+	MaxPayload = 1024 * 1024
+	// Largest payload accepted by devices before the maximum was negotiated.
+	MaxPayloadV1 = 4 * 1024
+)
+
+// Size of a message header on the wire.
+const headerSize = 24
+
+/*
+Message is a single packet of the transport protocol. On the wire, each message is a 24-byte
+header followed by the payload:
+
+	command, arg0, arg1, payload length, payload checksum, command ^ 0xffffffff
+
+All header fields are little-endian uint32s.
+*/
+type Message struct {
+	Command uint32
+	Arg0    uint32
+	Arg1    uint32
+	Payload []byte
+}
+
+func (m *Message) String() string {
+	return fmt.Sprintf("%s(%#x, %#x, %d bytes)", CommandName(m.Command), m.Arg0, m.Arg1, len(m.Payload))
+}
+
+// CommandName returns the 4-letter name of a command, e.g. "CNXN".
+func CommandName(cmd uint32) string {
+	var name [4]byte
+	binary.LittleEndian.PutUint32(name[:], cmd)
+	return string(name[:])
+}
+
+// ReadMessage reads a message from r. Returns an error if the payload is longer than maxPayload.
+func ReadMessage(r io.Reader, maxPayload int) (*Message, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+		return nil, errors.WrapErrorf(err, errors.ConnectionResetError, "connection closed")
+	} else if err != nil {
+		return nil, errors.WrapErrorf(err, errors.NetworkError, "error reading message header")
+	}
+
+	msg := &Message{
+		Command: binary.LittleEndian.Uint32(header[0:]),
+		Arg0:    binary.LittleEndian.Uint32(header[4:]),
+		Arg1:    binary.LittleEndian.Uint32(header[8:]),
+	}
+	length := binary.LittleEndian.Uint32(header[12:])
+	if magic := binary.LittleEndian.Uint32(header[20:]); magic != msg.Command^0xffffffff {
+		return nil, errors.Errorf(errors.ParseError, "invalid magic %#x for command %#x", magic, msg.Command)
+	}
+	if length > uint32(maxPayload) {
+		return nil, errors.Errorf(errors.ParseError, "%s payload of %d bytes is larger than the maximum of %d",
+			CommandName(msg.Command), length, maxPayload)
+	}
+
+	if length > 0 {
+		msg.Payload = make([]byte, length)
+		if _, err := io.ReadFull(r, msg.Payload); err != nil {
+			return nil, errors.WrapErrorf(err, errors.NetworkError, "error reading %s payload", CommandName(msg.Command))
+		}
+	}
+	return msg, nil
+}
+
+// WriteMessage writes msg to w in a single write.
+func WriteMessage(w io.Writer, msg *Message) error {
+	buf := make([]byte, headerSize+len(msg.Payload))
+	binary.LittleEndian.PutUint32(buf[0:], msg.Command)
+	binary.LittleEndian.PutUint32(buf[4:], msg.Arg0)
+	binary.LittleEndian.PutUint32(buf[8:], msg.Arg1)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(msg.Payload)))
+	// Devices using VersionMin still check the checksum, so always send it.
+	binary.LittleEndian.PutUint32(buf[16:], checksum(msg.Payload))
+	binary.LittleEndian.PutUint32(buf[20:], msg.Command^0xffffffff)
+	copy(buf[headerSize:], msg.Payload)
+
+	if _, err := w.Write(buf); err != nil {
+		return errors.WrapErrorf(err, errors.NetworkError, "error writing %s", CommandName(msg.Command))
+	}
+	return nil
+}
+
+func checksum(data []byte) uint32 {
+	var sum uint32
+	for _, b := range data {
+		sum += uint32(b)
+	}
+	return sum
+}
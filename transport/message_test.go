@@ -0,0 +1,61 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteMessage(&buf, &Message{Command: CmdWrte, Arg0: 1, Arg1: 2, Payload: []byte("ab")}))
+	assert.Equal(t, []byte{
+		'W', 'R', 'T', 'E',
+		1, 0, 0, 0,
+		2, 0, 0, 0,
+		2, 0, 0, 0,
+		'a' + 'b', 0, 0, 0,
+		'W' ^ 0xff, 'R' ^ 0xff, 'T' ^ 0xff, 'E' ^ 0xff,
+		'a', 'b',
+	}, buf.Bytes())
+
+	msg, err := ReadMessage(&buf, MaxPayload)
+	assert.NoError(t, err)
+	assert.Equal(t, &Message{Command: CmdWrte, Arg0: 1, Arg1: 2, Payload: []byte("ab")}, msg)
+	assert.Equal(t, "WRTE(0x1, 0x2, 2 bytes)", msg.String())
+}
+
+func TestReadMessageTooLong(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteMessage(&buf, &Message{Command: CmdWrte, Payload: []byte("hello")}))
+	_, err := ReadMessage(&buf, 4)
+	assert.EqualError(t, err, "ParseError: WRTE payload of 5 bytes is larger than the maximum of 4")
+}
+
+func TestReadMessageBadMagic(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteMessage(&buf, &Message{Command: CmdOkay}))
+	data := buf.Bytes()
+	data[20] = 0
+	_, err := ReadMessage(bytes.NewReader(data), MaxPayload)
+	assert.EqualError(t, err, "ParseError: invalid magic 0xa6beb400 for command 0x59414b4f")
+}
+
+func TestReadMessageEOF(t *testing.T) {
+	_, err := ReadMessage(bytes.NewReader(nil), MaxPayload)
+	assert.EqualError(t, err, "ConnectionResetError: connection closed")
+}
+
+func TestParseBanner(t *testing.T) {
+	banner := ParseBanner("device::ro.product.name=sailfish;ro.product.model=Pixel;features=cmd,shell_v2\x00")
+	assert.Equal(t, Banner{
+		SystemType: "device",
+		Properties: map[string]string{PropertyProduct: "sailfish", PropertyModel: "Pixel"},
+		Features:   []string{"cmd", "shell_v2"},
+	}, banner)
+	assert.Equal(t, "device::ro.product.model=Pixel;ro.product.name=sailfish;features=cmd,shell_v2", banner.String())
+
+	assert.Equal(t, Banner{SystemType: "host", Properties: map[string]string{}}, ParseBanner("host::"))
+}
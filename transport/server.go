@@ -0,0 +1,486 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/internal/hostserver"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// DefaultServerAddress is the address adb servers listen on by default.
+const DefaultServerAddress = "localhost:5037"
+
+// ServerConfig configures a Server.
+type ServerConfig struct {
+	// Address the server listens on when started. If empty, DefaultServerAddress is used.
+	Address string
+
+	// Device configures connections to devices made by Connect. If its Accept is nil, a device can
+	// only open streams for reverse forwards that a client created on it (e.g. with `adb reverse`),
+	// and only to "tcp:<port>", which is connected to the port on localhost. Other streams are
+	// refused.
+	Device Config
+}
+
+// Forward is a port forward created with the forward service.
+type Forward = hostserver.Forward
+
+/*
+Server is an adb server implemented in Go, so goadb can be used without the adb executable. It
+serves the smart socket protocol that adb clients speak, and talks to devices over TCP with the
+transport protocol:
+
+	server := transport.NewServer(transport.ServerConfig{})
+	if err := server.Start(); err != nil { … }
+	defer server.Close()
+	if _, err := server.Connect("192.168.1.10:5555"); err != nil { … }
+
+Devices are attached with Connect (or the host:connect request, as sent by `adb connect`), or
+AddDevice. Only TCP devices are supported, so there are never any USB devices. Since the server
+can't reconnect to devices, they're removed when their connection is closed.
+
+Supported requests are host:version, host:kill, host:host-features, host:devices,
+host:devices-l, host:track-devices, host:connect, host:disconnect, the host:transport requests
+(services are opened on the device), and get-state, get-serialno, get-devpath, features, forward,
+killforward, killforward-all, and list-forward for a device. The reverse:forward and reverse:killforward
+services opened on a device are recorded, so the device can only connect back to the host
+services it was given. The host's features are the ones in
+ServerConfig.Device, and a device's are the ones in its banner. Only tcp:<port> can be forwarded from the host.
+
+A Server is also an adb.Dialer, so a client can use it in-process without listening on a port:
+
+	client, err := adb.NewWithConfig(adb.ServerConfig{
+		Dialer:        server,
+		NoStartServer: true,
+	})
+
+Server is safe for concurrent use.
+*/
+type Server struct {
+	config ServerConfig
+	host   *hostserver.Server
+
+	lock    sync.Mutex
+	devices []*Conn
+	// Reverse forwards created by clients, by device, from the service the device listens on to
+	// the service on the host.
+	reverses map[*Conn]map[string]string
+	done     chan struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewServer returns a server with no devices. It doesn't listen until Start is called.
+func NewServer(config ServerConfig) *Server {
+	if config.Address == "" {
+		config.Address = DefaultServerAddress
+	}
+	s := &Server{
+		config:   config,
+		reverses: make(map[*Conn]map[string]string),
+		done:     make(chan struct{}),
+	}
+	if s.config.Device.Accept == nil {
+		s.config.Device.Accept = s.acceptReverse
+	}
+	s.host = hostserver.NewServer(serverBackend{s})
+	return s
+}
+
+// Start listens on the configured address and serves clients until the server is closed.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.config.Address)
+	if err != nil {
+		return errors.WrapErrorf(err, errors.ServerNotAvailable, "error listening on %s", s.config.Address)
+	}
+	return s.host.Serve(listener)
+}
+
+// Addr returns the address the server is listening on, or "" if it hasn't been started.
+func (s *Server) Addr() string {
+	addr := s.host.Addr()
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// Dial implements adb.Dialer by serving a client connection in memory. The address is ignored.
+func (s *Server) Dial(address string) (*wire.Conn, error) {
+	client, err := s.host.Dial()
+	if err != nil {
+		return nil, err
+	}
+
+	safeConn := wire.MultiCloseable(client)
+	return &wire.Conn{
+		Scanner: wire.NewScanner(safeConn),
+		Sender:  wire.NewSender(safeConn),
+	}, nil
+}
+
+/*
+Connect connects to adbd at address over TCP, and attaches the device. The device's serial is
+its address, including the port. If address doesn't include a port, DefaultPort is used.
+
+If a device is already connected at address, it's returned.
+*/
+func (s *Server) Connect(address string) (*Conn, error) {
+	conn, _, err := s.connect(address)
+	return conn, err
+}
+
+// connect is Connect, and also returns true if the device was already connected.
+func (s *Server) connect(address string) (*Conn, bool, error) {
+	address = withDefaultPort(address)
+	if conn := s.device(address); conn != nil {
+		return conn, true, nil
+	}
+
+	conn, err := Dial(address, s.config.Device)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.AddDevice(conn); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+/*
+AddDevice attaches the device connected to conn, e.g. one returned by NewConn. Its serial is
+conn.Serial(). If a device with the same serial is already attached, it's disconnected first.
+
+The server owns conn: the device is removed when conn is closed, and conn is closed when the
+device is disconnected or the server is closed.
+*/
+func (s *Server) AddDevice(conn *Conn) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return errors.Errorf(errors.ServerNotAvailable, "server closed")
+	}
+	old := s.deviceLocked(conn.Serial())
+	if old != nil {
+		s.removeDeviceLocked(old)
+	}
+	s.devices = append(s.devices, conn)
+	s.host.Notify()
+
+	s.wg.Add(1)
+	go s.watchDevice(conn)
+	s.lock.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Disconnect detaches the device with serial and closes its connection.
+func (s *Server) Disconnect(serial string) error {
+	s.lock.Lock()
+	conn := s.deviceLocked(serial)
+	if conn == nil {
+		s.lock.Unlock()
+		return errors.Errorf(errors.DeviceNotFound, "no such device '%s'", serial)
+	}
+	s.removeDeviceLocked(conn)
+	s.lock.Unlock()
+
+	return conn.Close()
+}
+
+// Devices returns the connections to the attached devices, in the order they were attached.
+func (s *Server) Devices() []*Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Conn(nil), s.devices...)
+}
+
+// Forwards returns the port forwards that have been created by clients.
+func (s *Server) Forwards() []Forward {
+	return s.host.Forwards()
+}
+
+// Close stops listening, removes all forwards, disconnects all devices, and closes all client
+// connections.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	devices := s.devices
+	s.devices = nil
+	s.lock.Unlock()
+
+	for _, conn := range devices {
+		conn.Close()
+	}
+	err := s.host.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) device(serial string) *Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.deviceLocked(serial)
+}
+
+func (s *Server) deviceLocked(serial string) *Conn {
+	for _, conn := range s.devices {
+		if conn.Serial() == serial {
+			return conn
+		}
+	}
+	return nil
+}
+
+// watchDevice removes the device connected to conn when the connection is closed.
+func (s *Server) watchDevice(conn *Conn) {
+	defer s.wg.Done()
+	select {
+	case <-conn.Done():
+	case <-s.done:
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removeDeviceLocked(conn)
+}
+
+// removeDeviceLocked detaches the device connected to conn, if it's attached, and removes its
+// forwards.
+func (s *Server) removeDeviceLocked(conn *Conn) {
+	for i, c := range s.devices {
+		if c == conn {
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			s.host.Notify()
+			s.host.RemoveForwards(conn.Serial())
+			break
+		}
+	}
+	delete(s.reverses, conn)
+}
+
+// serverBackend provides the devices of a Server to its hostserver.Server.
+type serverBackend struct {
+	s *Server
+}
+
+func (b serverBackend) Version() int {
+	return hostVersion
+}
+
+func (b serverBackend) HostFeatures() []string {
+	return b.s.config.Device.Features
+}
+
+func (b serverBackend) Devices() []hostserver.Device {
+	conns := b.s.Devices()
+	devices := make([]hostserver.Device, len(conns))
+	for i, conn := range conns {
+		devices[i] = serverDevice{conn}
+	}
+	return devices
+}
+
+// HandleHostRequest handles host:kill, host:connect, and host:disconnect.
+func (b serverBackend) HandleHostRequest(c *hostserver.Conn, req string) bool {
+	switch {
+	case req == "host:kill":
+		c.Okay()
+		// Close waits for this connection to be served.
+		go b.s.Close()
+	case strings.HasPrefix(req, "host:connect:"):
+		b.s.handleConnect(c, strings.TrimPrefix(req, "host:connect:"))
+	case strings.HasPrefix(req, "host:disconnect:"):
+		b.s.handleDisconnect(c, strings.TrimPrefix(req, "host:disconnect:"))
+	default:
+		return false
+	}
+	return true
+}
+
+// ServeTransport opens the service requested next on the device.
+func (b serverBackend) ServeTransport(c *hostserver.Conn, d hostserver.Device) {
+	conn := d.(serverDevice).Conn
+	serveTransport(c, conn, func(service string) { b.s.trackReverse(conn, service) })
+}
+
+// Forward listens on local, which must be "tcp:<port>", and opens remote on the device for every
+// connection to it.
+func (b serverBackend) Forward(d hostserver.Device, local, remote string) (string, io.Closer, error) {
+	if !strings.HasPrefix(local, "tcp:") {
+		return "", nil, errors.Errorf(errors.AdbError, "unsupported forward spec '%s'", local)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", strings.TrimPrefix(local, "tcp:")))
+	if err != nil {
+		return "", nil, errors.Errorf(errors.NetworkError, "cannot bind listener: %s", err)
+	}
+	go acceptForwarded(listener, d.(serverDevice).Conn, remote)
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return "tcp:" + port, listener, nil
+}
+
+// acceptForwarded opens remote on the device connected to conn for every connection accepted by
+// listener, until it's closed.
+func acceptForwarded(listener net.Listener, conn *Conn, remote string) {
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			stream, err := conn.Open(remote)
+			if err != nil {
+				netConn.Close()
+				return
+			}
+			hostserver.Splice(netConn, stream)
+		}()
+	}
+}
+
+// serverDevice is a device attached to a Server, as seen by its hostserver.Server. The
+// attributes are taken from the device's banner.
+type serverDevice struct {
+	*Conn
+}
+
+func (d serverDevice) State() string {
+	return connState(d.Conn)
+}
+
+// TransportID returns 0, since transport IDs aren't supported.
+func (d serverDevice) TransportID() int64 {
+	return 0
+}
+
+func (d serverDevice) Features() []string {
+	return d.Banner().Features
+}
+
+func (d serverDevice) Info() hostserver.DeviceInfo {
+	props := d.Banner().Properties
+	return hostserver.DeviceInfo{
+		Product: props[PropertyProduct],
+		Model:   props[PropertyModel],
+		Device:  props[PropertyDevice],
+	}
+}
+
+// handleConnect handles host:connect:<address>. Like real servers, the result is sent as a
+// message after an OKAY, even if connecting failed.
+func (s *Server) handleConnect(c *hostserver.Conn, address string) {
+	if address == "" {
+		c.Fail("empty address")
+		return
+	}
+
+	conn, connected, err := s.connect(address)
+	switch {
+	case err != nil:
+		c.OkayMessage(fmt.Sprintf("failed to connect to %s: %s", withDefaultPort(address), err))
+	case connected:
+		c.OkayMessage(fmt.Sprintf("already connected to %s", conn.Serial()))
+	default:
+		c.OkayMessage(fmt.Sprintf("connected to %s", conn.Serial()))
+	}
+}
+
+// handleDisconnect handles host:disconnect:<address>. If address is empty, all devices are
+// disconnected.
+func (s *Server) handleDisconnect(c *hostserver.Conn, address string) {
+	if address == "" {
+		for _, conn := range s.Devices() {
+			s.Disconnect(conn.Serial())
+		}
+		c.OkayMessage("disconnected everything")
+		return
+	}
+
+	address = withDefaultPort(address)
+	if err := s.Disconnect(address); err != nil {
+		c.Fail(fmt.Sprintf("no such device '%s'", address))
+		return
+	}
+	c.OkayMessage(fmt.Sprintf("disconnected %s", address))
+}
+
+// trackReverse records the reverse forward created or removed by service, which was opened on
+// the device connected to conn.
+func (s *Server) trackReverse(conn *Conn, service string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case strings.HasPrefix(service, "reverse:forward:"):
+		spec := strings.TrimPrefix(service, "reverse:forward:")
+		noRebind := strings.HasPrefix(spec, "norebind:")
+		parts := strings.SplitN(strings.TrimPrefix(spec, "norebind:"), ";", 2)
+		if len(parts) != 2 {
+			return
+		}
+		reverses := s.reverses[conn]
+		if reverses == nil {
+			reverses = make(map[string]string)
+			s.reverses[conn] = reverses
+		}
+		if _, ok := reverses[parts[0]]; ok && noRebind {
+			return
+		}
+		reverses[parts[0]] = parts[1]
+	case strings.HasPrefix(service, "reverse:killforward:"):
+		delete(s.reverses[conn], strings.TrimPrefix(service, "reverse:killforward:"))
+	case service == "reverse:killforward-all":
+		delete(s.reverses, conn)
+	}
+}
+
+// acceptReverse is the default AcceptFunc for devices attached by a Server. It only accepts
+// streams to "tcp:<port>" that match a reverse forward created on the device, and connects them
+// to the port on localhost.
+func (s *Server) acceptReverse(conn *Conn, service string) (io.ReadWriteCloser, error) {
+	s.lock.Lock()
+	found := false
+	for _, local := range s.reverses[conn] {
+		if local == service {
+			found = true
+			break
+		}
+	}
+	s.lock.Unlock()
+	if !found {
+		return nil, errors.Errorf(errors.AdbError, "no reverse forward to %s", service)
+	}
+	if !strings.HasPrefix(service, "tcp:") {
+		return nil, errors.Errorf(errors.AdbError, "unsupported service: %s", service)
+	}
+
+	address := net.JoinHostPort("localhost", strings.TrimPrefix(service, "tcp:"))
+	netConn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, errors.WrapErrorf(err, errors.NetworkError, "error dialing %s", address)
+	}
+	return netConn, nil
+}
+
+// withDefaultPort returns address with DefaultPort added if it doesn't have a port.
+func withDefaultPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, DefaultPort)
+	}
+	return address
+}
@@ -0,0 +1,394 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zach-klippenstein/goadb"
+	"github.com/zach-klippenstein/goadb/adbkey"
+	"github.com/zach-klippenstein/goadb/internal/errors"
+	"github.com/zach-klippenstein/goadb/wire"
+)
+
+// acceptTestService serves "shell:<cmd>", which writes cmd and closes the stream, "echo:", which
+// writes back everything it receives, and "reverse:<request>", which accepts any request.
+func acceptTestService(conn *Conn, service string) (io.ReadWriteCloser, error) {
+	host, device := net.Pipe()
+	switch {
+	case service == "echo:":
+		go func() {
+			io.Copy(device, device)
+			device.Close()
+		}()
+	case strings.HasPrefix(service, "shell:"):
+		go func() {
+			io.WriteString(device, strings.TrimPrefix(service, "shell:")+"\n")
+			device.Close()
+		}()
+	case strings.HasPrefix(service, "reverse:"):
+		go func() {
+			io.WriteString(device, "OKAYOKAY")
+			device.Close()
+		}()
+	default:
+		host.Close()
+		device.Close()
+		return nil, errors.Errorf(errors.AdbError, "unknown service: %s", service)
+	}
+	return host, nil
+}
+
+func testDeviceConfig(serial string) DeviceConfig {
+	return DeviceConfig{
+		Banner: Banner{
+			SystemType: "device",
+			Serial:     serial,
+			Properties: map[string]string{PropertyModel: "Pixel"},
+			Features:   []string{"shell_v2", "cmd"},
+		},
+		Accept: acceptTestService,
+	}
+}
+
+// newTestConnPair returns both ends of an in-memory connection to a device with serial.
+func newTestConnPair(t *testing.T, serial string) (host, device *Conn) {
+	hostRW, deviceRW := net.Pipe()
+	devices := make(chan *Conn, 1)
+	go func() {
+		conn, err := NewDeviceConn(deviceRW, testDeviceConfig(serial))
+		assert.NoError(t, err)
+		devices <- conn
+	}()
+	host, err := NewConn(hostRW, Config{Keys: []*adbkey.Key{}})
+	require.NoError(t, err)
+	return host, <-devices
+}
+
+// startTestAdbd listens for hosts on a local port, and serves the same services as
+// acceptTestService. The device end of each connection is sent on the returned channel.
+func startTestAdbd(t *testing.T) (net.Listener, <-chan *Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	devices := make(chan *Conn, 10)
+	go func() {
+		for {
+			rw, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if conn, err := NewDeviceConn(rw, testDeviceConfig("")); err == nil {
+					devices <- conn
+				}
+			}()
+		}
+	}()
+	return listener, devices
+}
+
+func startTestServer(t *testing.T) (*Server, *adb.Adb) {
+	server := NewServer(ServerConfig{
+		Address: "127.0.0.1:0",
+		Device:  Config{Keys: []*adbkey.Key{}, Features: []string{"shell_v2"}},
+	})
+	require.NoError(t, server.Start())
+	_, port, err := net.SplitHostPort(server.Addr())
+	require.NoError(t, err)
+	portNum, _ := strconv.Atoi(port)
+	client, err := adb.NewWithConfig(adb.ServerConfig{Host: "127.0.0.1", Port: portNum, NoStartServer: true})
+	require.NoError(t, err)
+	return server, client
+}
+
+func roundTrip(t *testing.T, server *Server, req string) (string, error) {
+	conn, err := server.Dial("")
+	require.NoError(t, err)
+	defer conn.Close()
+	resp, err := conn.RoundTripSingleResponse([]byte(req))
+	return string(resp), err
+}
+
+// roundTripStatus sends req, and returns the error if the server fails it. Unlike roundTrip, it
+// doesn't expect a response message.
+func roundTripStatus(t *testing.T, server *Server, req string) error {
+	conn, err := server.Dial("")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SendMessage([]byte(req)))
+	_, err = conn.ReadStatus(req)
+	return err
+}
+
+func assertServerMsg(t *testing.T, err error, msg string) {
+	if assert.Error(t, err) && assert.IsType(t, &errors.Err{}, err) {
+		assert.Equal(t, msg, err.(*errors.Err).Details.(wire.ErrorResponseDetails).ServerMsg)
+	}
+}
+
+func TestServerConnect(t *testing.T) {
+	adbd, _ := startTestAdbd(t)
+	defer adbd.Close()
+	server, client := startTestServer(t)
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(adbd.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	version, err := client.ServerVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, hostVersion, version)
+	hostFeatures, err := client.HostFeatures()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.FeatureSet{adb.FeatureShell2: true}, hostFeatures)
+
+	require.NoError(t, client.Connect(host, portNum))
+	resp, err := roundTrip(t, server, "host:connect:"+adbd.Addr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, "already connected to "+adbd.Addr().String(), resp)
+
+	devices, err := client.ListDevices()
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Equal(t, &adb.DeviceInfo{
+		Serial:     adbd.Addr().String(),
+		State:      adb.StateOnline,
+		Model:      "Pixel",
+		Connection: adb.ConnectionTcp,
+	}, devices[0])
+
+	device := client.Device(adb.DeviceWithSerial(adbd.Addr().String()))
+	state, err := device.State()
+	assert.NoError(t, err)
+	assert.Equal(t, adb.StateOnline, state)
+	features, err := device.Features()
+	assert.NoError(t, err)
+	assert.Equal(t, []adb.Feature{adb.FeatureCmd, adb.FeatureShell2}, features.List())
+	output, err := device.RunCommand("echo", "hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo hi\n", output)
+
+	resp, err = roundTrip(t, server, "host:disconnect:"+adbd.Addr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, "disconnected "+adbd.Addr().String(), resp)
+	serials, err := client.ListDeviceSerials()
+	assert.NoError(t, err)
+	assert.Empty(t, serials)
+
+	resp, err = roundTrip(t, server, "host:connect:127.0.0.1:1")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp, "failed to connect to 127.0.0.1:1: "), resp)
+}
+
+func TestServerSelectDevice(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	defer server.Close()
+
+	_, err := roundTrip(t, server, "host:get-state")
+	assertServerMsg(t, err, "no devices/emulators found")
+
+	for _, serial := range []string{"emulator-5554", "emulator-5556"} {
+		conn, _ := newTestConnPair(t, serial)
+		require.NoError(t, server.AddDevice(conn))
+	}
+	_, err = roundTrip(t, server, "host:transport-any")
+	assertServerMsg(t, err, "more than one device/emulator")
+	_, err = roundTrip(t, server, "host-usb:get-state")
+	assertServerMsg(t, err, "no devices found")
+
+	resp, err := roundTrip(t, server, "host-serial:emulator-5556:get-serialno")
+	assert.NoError(t, err)
+	assert.Equal(t, "emulator-5556", resp)
+	resp, err = roundTrip(t, server, "host:devices")
+	assert.NoError(t, err)
+	assert.Equal(t, "emulator-5554\tdevice\nemulator-5556\tdevice\n", resp)
+}
+
+func TestServerTrackDevices(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	defer server.Close()
+	conn, err := server.Dial("")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SendMessage([]byte("host:track-devices")))
+	_, err = conn.ReadStatus("host:track-devices")
+	require.NoError(t, err)
+	assertNextMessage := func(expected string) {
+		msg, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(msg))
+	}
+	assertNextMessage("")
+
+	host, device := newTestConnPair(t, "emulator-5554")
+	require.NoError(t, server.AddDevice(host))
+	assertNextMessage("emulator-5554\tdevice\n")
+
+	// The device is removed when its connection is closed.
+	device.Close()
+	assertNextMessage("")
+}
+
+func TestServerForward(t *testing.T) {
+	server := NewServer(ServerConfig{})
+	defer server.Close()
+	host, _ := newTestConnPair(t, "emulator-5554")
+	require.NoError(t, server.AddDevice(host))
+
+	conn, err := server.Dial("")
+	require.NoError(t, err)
+	require.NoError(t, conn.SendMessage([]byte("host-serial:emulator-5554:forward:tcp:0;echo:")))
+	_, err = conn.ReadStatus("forward")
+	require.NoError(t, err)
+	_, err = conn.ReadStatus("forward")
+	require.NoError(t, err)
+	port, err := wire.ReadMessageString(conn)
+	require.NoError(t, err)
+	conn.Close()
+
+	forwards := server.Forwards()
+	assert.Equal(t, []Forward{{Serial: "emulator-5554", Local: "tcp:" + port, Remote: "echo:"}}, forwards)
+	resp, err := roundTrip(t, server, "host:list-forward")
+	assert.NoError(t, err)
+	assert.Equal(t, "emulator-5554 tcp:"+port+" echo:\n", resp)
+
+	netConn, err := net.Dial("tcp", "localhost:"+port)
+	require.NoError(t, err)
+	_, err = netConn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(netConn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	netConn.Close()
+
+	assert.NoError(t, roundTripStatus(t, server, "host:killforward:tcp:"+port))
+	assert.Empty(t, server.Forwards())
+	err = roundTripStatus(t, server, "host:killforward:tcp:"+port)
+	assertServerMsg(t, err, "listener 'tcp:"+port+"' not found")
+	_, err = net.Dial("tcp", "localhost:"+port)
+	assert.Error(t, err)
+}
+
+// openReverse opens service, a reverse request, on the device with serial through server.
+func openReverse(t *testing.T, server *Server, serial, service string) {
+	conn, err := server.Dial("")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SendMessage([]byte("host:transport:"+serial)))
+	_, err = conn.ReadStatus("host:transport")
+	require.NoError(t, err)
+	require.NoError(t, conn.SendMessage([]byte(service)))
+	_, err = conn.ReadStatus(service)
+	require.NoError(t, err)
+	_, err = conn.ReadStatus(service)
+	require.NoError(t, err)
+}
+
+func TestServerReverse(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	server := NewServer(ServerConfig{Device: Config{Keys: []*adbkey.Key{}}})
+	defer server.Close()
+	adbd, devices := startTestAdbd(t)
+	defer adbd.Close()
+	_, err = server.Connect(adbd.Addr().String())
+	require.NoError(t, err)
+	device := <-devices
+
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	openReverse(t, server, adbd.Addr().String(), "reverse:forward:tcp:7100;tcp:"+port)
+	stream, err := device.Open("tcp:" + port)
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(stream, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	stream.Close()
+
+	openReverse(t, server, adbd.Addr().String(), "reverse:killforward:tcp:7100")
+	_, err = device.Open("tcp:" + port)
+	assert.Error(t, err)
+}
+
+func TestServerRefusesUnregisteredReverse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	server := NewServer(ServerConfig{Device: Config{Keys: []*adbkey.Key{}}})
+	defer server.Close()
+	adbd, devices := startTestAdbd(t)
+	defer adbd.Close()
+	_, err = server.Connect(adbd.Addr().String())
+	require.NoError(t, err)
+	device := <-devices
+
+	// Services on the host can't be reached without a reverse forward to them.
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	_, err = device.Open("tcp:" + port)
+	assert.Error(t, err)
+	openReverse(t, server, adbd.Addr().String(), "reverse:forward:tcp:7100;tcp:1")
+	_, err = device.Open("tcp:" + port)
+	assert.Error(t, err)
+	_, err = device.Open("localabstract:foo")
+	assert.Error(t, err)
+	select {
+	case <-accepted:
+		t.Error("device connected to an unregistered port")
+	default:
+	}
+}
+
+func TestServerStartedByClient(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	var server *Server
+	client, err := adb.NewWithConfig(adb.ServerConfig{
+		Host: "127.0.0.1",
+		Port: port,
+		StartServer: func(address string) error {
+			server = NewServer(ServerConfig{Address: address})
+			return server.Start()
+		},
+	})
+	require.NoError(t, err)
+
+	version, err := client.ServerVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, hostVersion, version)
+	require.NotNil(t, server)
+
+	require.NoError(t, client.KillServer())
+	select {
+	case <-server.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server wasn't killed")
+	}
+}
@@ -0,0 +1,204 @@
+package transport
+
+import (
+	"io"
+	"sync"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+/*
+Stream is a connection to a single service on a device. It's an io.ReadWriteCloser.
+
+Each write is split into messages of at most the connection's max payload, and the device must
+acknowledge each one before the next is sent. Data received from the device is acknowledged once
+it's been read, so a device can't send more until the previous data has been read.
+*/
+type Stream struct {
+	conn     *Conn
+	service  string
+	localID  uint32
+	remoteID uint32
+
+	// Closed when the device accepts the stream.
+	opened chan struct{}
+	// Receives a value for each OKAY sent by the device after it's opened.
+	acks chan struct{}
+	// Closed when the stream is closed by either end, or the connection is closed.
+	done chan struct{}
+
+	writeLock sync.Mutex
+
+	lock sync.Mutex
+	// Signaled when data is received or the stream is closed.
+	cond *sync.Cond
+	// Chunks received but not read yet.
+	chunks [][]byte
+	// Set when done is closed. io.EOF if the device closed the stream.
+	err    error
+	isOpen bool
+}
+
+func newStream(conn *Conn, localID uint32, service string) *Stream {
+	s := &Stream{
+		conn:    conn,
+		service: service,
+		localID: localID,
+		opened:  make(chan struct{}),
+		acks:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// Service returns the name of the service the stream is connected to.
+func (s *Stream) Service() string {
+	return s.service
+}
+
+func (s *Stream) Read(buf []byte) (int, error) {
+	s.lock.Lock()
+	for len(s.chunks) == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.chunks) == 0 {
+		err := s.err
+		s.lock.Unlock()
+		return 0, err
+	}
+
+	n := copy(buf, s.chunks[0])
+	s.chunks[0] = s.chunks[0][n:]
+	consumed := len(s.chunks[0]) == 0
+	if consumed {
+		s.chunks = s.chunks[1:]
+	}
+	needsAck := consumed && s.err == nil
+	s.lock.Unlock()
+
+	if needsAck {
+		// Let the device send the next chunk.
+		if err := s.conn.send(CmdOkay, s.localID, s.remoteID, nil); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *Stream) Write(data []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	written := 0
+	for written < len(data) {
+		select {
+		case <-s.done:
+			return written, s.writeErr()
+		default:
+		}
+
+		n := len(data) - written
+		if n > s.conn.maxPayload {
+			n = s.conn.maxPayload
+		}
+		if err := s.conn.send(CmdWrte, s.localID, s.remoteID, data[written:written+n]); err != nil {
+			return written, err
+		}
+
+		select {
+		case <-s.acks:
+		case <-s.done:
+			select {
+			case <-s.acks:
+				// The device acknowledged the write before closing the stream.
+				written += n
+			default:
+			}
+			return written, s.writeErr()
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the stream. Any data that hasn't been read is discarded.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	alreadyClosed := s.err != nil
+	s.chunks = nil
+	s.closeLocked(errors.Errorf(errors.ConnectionResetError, "stream closed"))
+	s.lock.Unlock()
+
+	if alreadyClosed {
+		return nil
+	}
+	s.conn.removeStream(s.localID)
+	return s.conn.send(CmdClse, s.localID, s.remoteID, nil)
+}
+
+func (s *Stream) handleOkay(remoteID uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.isOpen {
+		s.isOpen = true
+		s.remoteID = remoteID
+		close(s.opened)
+		return
+	}
+	select {
+	case s.acks <- struct{}{}:
+	default:
+		// Unexpected OKAY, the device must have acknowledged a write twice.
+	}
+}
+
+func (s *Stream) handleWrite(data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.chunks = append(s.chunks, data)
+	s.cond.Broadcast()
+}
+
+func (s *Stream) handleClose() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.isOpen {
+		s.closeLocked(errors.Errorf(errors.AdbError, "device refused to open service: %s", s.service))
+		return
+	}
+	s.closeLocked(io.EOF)
+}
+
+func (s *Stream) connClosed(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closeLocked(err)
+}
+
+func (s *Stream) closeLocked(err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+	s.cond.Broadcast()
+}
+
+func (s *Stream) doneErr() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+func (s *Stream) writeErr() error {
+	err := s.doneErr()
+	if err == io.EOF {
+		return errors.Errorf(errors.ConnectionResetError, "device closed stream to %s", s.service)
+	}
+	return err
+}
@@ -48,6 +48,12 @@ func (c *Conn) NewSyncConn() *SyncConn {
 	}
 }
 
+// Read reads raw bytes from the connection, without any framing. Returns an error if the
+// Scanner isn't a RawScanner.
+func (c *Conn) Read(buf []byte) (int, error) {
+	return ReadRaw(c.Scanner, buf)
+}
+
 // RoundTripSingleResponse sends a message to the server, and reads a single
 // message response. If the reponse has a failure status code, returns it as an error.
 func (conn *Conn) RoundTripSingleResponse(req []byte) (resp []byte, err error) {
@@ -45,6 +45,24 @@ type Scanner interface {
 	NewSyncScanner() SyncScanner
 }
 
+/*
+RawScanner is implemented by Scanners that can also read raw bytes, without any framing. Used to
+stream the output of services that don't send length headers. Scanners that wrap another Scanner
+should implement it by calling ReadRaw.
+*/
+type RawScanner interface {
+	Scanner
+	io.Reader
+}
+
+// ReadRaw reads raw bytes from s if it's a RawScanner, and returns an error otherwise.
+func ReadRaw(s Scanner, buf []byte) (int, error) {
+	if r, ok := s.(RawScanner); ok {
+		return r.Read(buf)
+	}
+	return 0, errors.AssertionErrorf("scanner %T can't read raw bytes", s)
+}
+
 type realScanner struct {
 	reader io.ReadCloser
 }
@@ -77,6 +95,14 @@ func (s *realScanner) ReadUntilEof() ([]byte, error) {
 	return data, nil
 }
 
+func (s *realScanner) Read(buf []byte) (int, error) {
+	n, err := s.reader.Read(buf)
+	if err != nil && err != io.EOF {
+		return n, errors.WrapErrorf(err, errors.NetworkError, "error reading from scanner")
+	}
+	return n, err
+}
+
 func (s *realScanner) NewSyncScanner() SyncScanner {
 	return NewSyncScanner(s.reader)
 }
@@ -85,7 +111,7 @@ func (s *realScanner) Close() error {
 	return errors.WrapErrorf(s.reader.Close(), errors.NetworkError, "error closing scanner")
 }
 
-var _ Scanner = &realScanner{}
+var _ RawScanner = &realScanner{}
 
 // lengthReader is a func that readMessage uses to read message length.
 // See readHexLength and readInt32.
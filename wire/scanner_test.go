@@ -110,6 +110,26 @@ func TestReadLengthIncompleteLength(t *testing.T) {
 	assertEof(t, s)
 }
 
+func TestConnReadRaw(t *testing.T) {
+	conn := NewConn(NewScanner(newEofReader("OKAYraw output")), nil)
+	_, err := conn.ReadStatus("")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "raw output", string(data))
+}
+
+// framedOnlyScanner is a Scanner that can't read raw bytes.
+type framedOnlyScanner struct {
+	Scanner
+}
+
+func TestConnReadRawNotSupported(t *testing.T) {
+	conn := NewConn(framedOnlyScanner{NewScanner(newEofReader("raw output"))}, nil)
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, errors.AssertionError, err.(*errors.Err).Code)
+}
+
 func assertEof(t *testing.T, r io.Reader) {
 	msg, err := readMessage(r, readHexLength)
 	assert.True(t, errors.HasErrCode(err, errors.ConnectionResetError))
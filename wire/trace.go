@@ -0,0 +1,313 @@
+package wire
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zach-klippenstein/goadb/internal/errors"
+)
+
+// TraceDirection is the direction of a traced token, relative to the client.
+type TraceDirection string
+
+const (
+	TraceSend TraceDirection = ">"
+	TraceRecv TraceDirection = "<"
+)
+
+// TraceKind identifies the type of token in a TraceEvent, and so the type of its Value.
+type TraceKind string
+
+const (
+	// A hex-length-prefixed message. Value is a string.
+	TraceMessage TraceKind = "message"
+	// An OKAY or FAIL status, or a sync ID like STAT or DATA. Value is a string.
+	// For FAIL, the error containing the server's message is in Err.
+	TraceStatus TraceKind = "status"
+	// Raw bytes read without framing, e.g. shell output. Value is a []byte.
+	TraceRaw TraceKind = "raw"
+	// A sync protocol integer. Value is an int32.
+	TraceInt32 TraceKind = "int32"
+	// A sync protocol file mode. Value is an os.FileMode.
+	TraceFileMode TraceKind = "mode"
+	// A sync protocol timestamp. Value is a time.Time.
+	TraceTime TraceKind = "time"
+	// A sync protocol length-prefixed string. Value is a string.
+	TraceString TraceKind = "string"
+	// A sync protocol length-prefixed chunk of data. For sent chunks, Value is a []byte. For
+	// received chunks, which are streamed, Value is the int32 length.
+	TraceBytes TraceKind = "bytes"
+	// The connection was closed. Value is nil.
+	TraceClose TraceKind = "close"
+)
+
+// Bytes values longer than this are truncated when formatted.
+const maxTracedBytes = 32
+
+// TraceEvent describes a single token sent or received on a connection.
+type TraceEvent struct {
+	Time time.Time
+	// ConnID identifies the connection, and is unique for the life of the process.
+	ConnID    int
+	Direction TraceDirection
+	Kind      TraceKind
+	Value     interface{}
+	// Err is set if sending or receiving the token failed.
+	Err error
+}
+
+func (e TraceEvent) String() string {
+	str := fmt.Sprintf("conn %d %s %s", e.ConnID, e.Direction, e.Kind)
+	if e.Value != nil {
+		str += " " + e.FormatValue()
+	}
+	if e.Err != nil {
+		str += fmt.Sprintf(" (%s)", e.Err)
+	}
+	return str
+}
+
+// FormatValue formats Value for humans. Strings and data are quoted, and long data is truncated.
+func (e TraceEvent) FormatValue() string {
+	switch v := e.Value.(type) {
+	case nil:
+		return ""
+	case string:
+		if e.Kind == TraceStatus {
+			return v
+		}
+		return fmt.Sprintf("%q", v)
+	case []byte:
+		if len(v) > maxTracedBytes {
+			return fmt.Sprintf("%q… (%d bytes)", v[:maxTracedBytes], len(v))
+		}
+		return fmt.Sprintf("%q", v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// Tracer receives events from connections wrapped with TraceConn.
+// Trace may be called concurrently from different connections.
+type Tracer interface {
+	Trace(TraceEvent)
+}
+
+// TracerFunc is a Tracer that calls itself.
+type TracerFunc func(TraceEvent)
+
+func (f TracerFunc) Trace(e TraceEvent) {
+	f(e)
+}
+
+// NewWriterTracer returns a Tracer that writes each event to w on its own line, prefixed by
+// its time.
+func NewWriterTracer(w io.Writer) Tracer {
+	var lock sync.Mutex
+	return TracerFunc(func(e TraceEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprintf(w, "%s %s\n", e.Time.Format("15:04:05.000000"), e)
+	})
+}
+
+var lastTraceConnID int32
+
+// TraceConn returns a Conn that reports everything sent and received on conn, including
+// on any SyncConn created from it, to tracer.
+func TraceConn(conn *Conn, tracer Tracer) *Conn {
+	t := &connTracer{
+		id:     int(atomic.AddInt32(&lastTraceConnID, 1)),
+		tracer: tracer,
+	}
+	return &Conn{
+		Scanner: &tracingScanner{conn.Scanner, t},
+		Sender:  &tracingSender{conn.Sender, t},
+	}
+}
+
+type connTracer struct {
+	id     int
+	tracer Tracer
+}
+
+func (t *connTracer) trace(dir TraceDirection, kind TraceKind, value interface{}, err error) {
+	t.tracer.Trace(TraceEvent{
+		Time:      time.Now(),
+		ConnID:    t.id,
+		Direction: dir,
+		Kind:      kind,
+		Value:     value,
+		Err:       err,
+	})
+}
+
+// traceStatus traces a status read by a StatusReader. FAIL statuses are returned as errors.
+func (t *connTracer) traceStatus(status string, err error) {
+	if err, ok := err.(*errors.Err); ok {
+		if _, ok := err.Details.(ErrorResponseDetails); ok {
+			status = StatusFailure
+		}
+	}
+	t.trace(TraceRecv, TraceStatus, status, err)
+}
+
+type tracingScanner struct {
+	Scanner
+	t *connTracer
+}
+
+func (s *tracingScanner) ReadStatus(req string) (string, error) {
+	status, err := s.Scanner.ReadStatus(req)
+	s.t.traceStatus(status, err)
+	return status, err
+}
+
+func (s *tracingScanner) ReadMessage() ([]byte, error) {
+	msg, err := s.Scanner.ReadMessage()
+	s.t.trace(TraceRecv, TraceMessage, string(msg), err)
+	return msg, err
+}
+
+func (s *tracingScanner) ReadUntilEof() ([]byte, error) {
+	data, err := s.Scanner.ReadUntilEof()
+	s.t.trace(TraceRecv, TraceRaw, data, err)
+	return data, err
+}
+
+func (s *tracingScanner) Read(buf []byte) (int, error) {
+	n, err := ReadRaw(s.Scanner, buf)
+	if n > 0 || (err != nil && err != io.EOF) {
+		s.t.trace(TraceRecv, TraceRaw, append([]byte(nil), buf[:n]...), ignoreEOF(err))
+	}
+	if err == io.EOF {
+		// The server closed the connection.
+		s.t.trace(TraceRecv, TraceClose, nil, nil)
+	}
+	return n, err
+}
+
+func (s *tracingScanner) NewSyncScanner() SyncScanner {
+	return &tracingSyncScanner{s.Scanner.NewSyncScanner(), s.t}
+}
+
+// Close traces the close of the whole connection, since Conn.Close always closes the scanner.
+func (s *tracingScanner) Close() error {
+	err := s.Scanner.Close()
+	s.t.trace(TraceSend, TraceClose, nil, err)
+	return err
+}
+
+type tracingSender struct {
+	Sender
+	t *connTracer
+}
+
+func (s *tracingSender) SendMessage(msg []byte) error {
+	err := s.Sender.SendMessage(msg)
+	s.t.trace(TraceSend, TraceMessage, string(msg), err)
+	return err
+}
+
+func (s *tracingSender) NewSyncSender() SyncSender {
+	return &tracingSyncSender{s.Sender.NewSyncSender(), s.t}
+}
+
+type tracingSyncScanner struct {
+	SyncScanner
+	t *connTracer
+}
+
+func (s *tracingSyncScanner) ReadStatus(req string) (string, error) {
+	status, err := s.SyncScanner.ReadStatus(req)
+	s.t.traceStatus(status, err)
+	return status, err
+}
+
+func (s *tracingSyncScanner) ReadInt32() (int32, error) {
+	val, err := s.SyncScanner.ReadInt32()
+	s.t.trace(TraceRecv, TraceInt32, val, err)
+	return val, err
+}
+
+func (s *tracingSyncScanner) ReadFileMode() (os.FileMode, error) {
+	mode, err := s.SyncScanner.ReadFileMode()
+	s.t.trace(TraceRecv, TraceFileMode, mode, err)
+	return mode, err
+}
+
+func (s *tracingSyncScanner) ReadTime() (time.Time, error) {
+	t, err := s.SyncScanner.ReadTime()
+	s.t.trace(TraceRecv, TraceTime, t, err)
+	return t, err
+}
+
+func (s *tracingSyncScanner) ReadString() (string, error) {
+	str, err := s.SyncScanner.ReadString()
+	s.t.trace(TraceRecv, TraceString, str, err)
+	return str, err
+}
+
+func (s *tracingSyncScanner) ReadBytes() (io.Reader, error) {
+	r, err := s.SyncScanner.ReadBytes()
+	var length int32
+	if lr, ok := r.(*io.LimitedReader); ok {
+		length = int32(lr.N)
+	}
+	s.t.trace(TraceRecv, TraceBytes, length, err)
+	return r, err
+}
+
+func (s *tracingSyncScanner) Close() error {
+	err := s.SyncScanner.Close()
+	s.t.trace(TraceSend, TraceClose, nil, err)
+	return err
+}
+
+type tracingSyncSender struct {
+	SyncSender
+	t *connTracer
+}
+
+func (s *tracingSyncSender) SendOctetString(str string) error {
+	err := s.SyncSender.SendOctetString(str)
+	s.t.trace(TraceSend, TraceStatus, str, err)
+	return err
+}
+
+func (s *tracingSyncSender) SendInt32(val int32) error {
+	err := s.SyncSender.SendInt32(val)
+	s.t.trace(TraceSend, TraceInt32, val, err)
+	return err
+}
+
+func (s *tracingSyncSender) SendFileMode(mode os.FileMode) error {
+	err := s.SyncSender.SendFileMode(mode)
+	s.t.trace(TraceSend, TraceFileMode, mode, err)
+	return err
+}
+
+func (s *tracingSyncSender) SendTime(t time.Time) error {
+	err := s.SyncSender.SendTime(t)
+	s.t.trace(TraceSend, TraceTime, t, err)
+	return err
+}
+
+func (s *tracingSyncSender) SendBytes(data []byte) error {
+	err := s.SyncSender.SendBytes(data)
+	s.t.trace(TraceSend, TraceBytes, append([]byte(nil), data...), err)
+	return err
+}
+
+func ignoreEOF(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,27 @@
+//go:build go1.21
+// +build go1.21
+
+package wire
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NewSlogTracer returns a Tracer that logs each event to logger at debug level.
+func NewSlogTracer(logger *slog.Logger) Tracer {
+	return TracerFunc(func(e TraceEvent) {
+		attrs := []slog.Attr{
+			slog.Int("conn", e.ConnID),
+			slog.String("dir", string(e.Direction)),
+			slog.String("kind", string(e.Kind)),
+		}
+		if e.Value != nil {
+			attrs = append(attrs, slog.String("value", e.FormatValue()))
+		}
+		if e.Err != nil {
+			attrs = append(attrs, slog.String("err", e.Err.Error()))
+		}
+		logger.LogAttrs(context.Background(), slog.LevelDebug, "adb trace", attrs...)
+	})
+}
@@ -0,0 +1,116 @@
+package wire
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTracedTestConn returns a traced Conn that reads input, and the events traced on it
+// formatted without their connection IDs.
+func newTracedTestConn(input string) (*Conn, *TestWriter, *[]string) {
+	var events []string
+	sender, w := NewTestSender()
+	conn := TraceConn(NewConn(NewScanner(newEofReader(input)), sender), TracerFunc(func(e TraceEvent) {
+		e.ConnID = 0
+		events = append(events, e.String())
+	}))
+	return conn, w, &events
+}
+
+func TestTraceHostRequest(t *testing.T) {
+	conn, w, events := newTracedTestConn("OKAY0004\x01\x02\x03\x04")
+
+	resp, err := conn.RoundTripSingleResponse([]byte("host:version"))
+	assert.NoError(t, err)
+	assert.Equal(t, "\x01\x02\x03\x04", string(resp))
+	assert.Equal(t, "000chost:version", w.String())
+	assert.NoError(t, conn.Close())
+
+	assert.Equal(t, []string{
+		`conn 0 > message "host:version"`,
+		`conn 0 < status OKAY`,
+		`conn 0 < message "\x01\x02\x03\x04"`,
+		`conn 0 > close`,
+	}, *events)
+}
+
+func TestTraceFailure(t *testing.T) {
+	conn, _, events := newTracedTestConn("FAIL0004fail")
+
+	_, err := conn.ReadStatus("req")
+	assert.Error(t, err)
+	require.Len(t, *events, 1)
+	assert.Equal(t, `conn 0 < status FAIL (AdbError: server error for req request: fail ({Request:req ServerMsg:fail}))`,
+		(*events)[0])
+}
+
+func TestTraceRawRead(t *testing.T) {
+	conn, _, events := newTracedTestConn("hello")
+
+	data, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, []string{
+		`conn 0 < raw "hello"`,
+		`conn 0 < close`,
+	}, *events)
+}
+
+func TestTraceSync(t *testing.T) {
+	input := "STAT" + string([]byte{0xa4, 0x81, 0, 0}) + "\x05\x00\x00\x00" + string(someTimeEncoded) +
+		"DATA\x03\x00\x00\x00abc"
+	conn, w, events := newTracedTestConn(input)
+	sync := conn.NewSyncConn()
+
+	assert.NoError(t, sync.SendOctetString("STAT"))
+	assert.NoError(t, sync.SendBytes([]byte("/file")))
+	_, err := sync.ReadStatus("stat")
+	assert.NoError(t, err)
+	mode, err := sync.ReadFileMode()
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), mode)
+	_, err = sync.ReadInt32()
+	assert.NoError(t, err)
+	_, err = sync.ReadTime()
+	assert.NoError(t, err)
+	_, err = sync.ReadStatus("recv")
+	assert.NoError(t, err)
+	_, err = sync.ReadBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, "STAT\x05\x00\x00\x00/file", w.String())
+
+	assert.Equal(t, []string{
+		`conn 0 > status STAT`,
+		`conn 0 > bytes "/file"`,
+		`conn 0 < status STAT`,
+		`conn 0 < mode -rw-r--r--`,
+		`conn 0 < int32 5`,
+		`conn 0 < time ` + someTime.Local().Format(time.RFC3339),
+		`conn 0 < status DATA`,
+		`conn 0 < bytes 3`,
+	}, *events)
+}
+
+func TestTraceEventTruncatesBytes(t *testing.T) {
+	e := TraceEvent{ConnID: 1, Direction: TraceSend, Kind: TraceBytes, Value: bytes.Repeat([]byte("a"), 40)}
+	assert.Equal(t, `conn 1 > bytes "`+strings.Repeat("a", maxTracedBytes)+`"… (40 bytes)`, e.String())
+}
+
+func TestWriterTracer(t *testing.T) {
+	var buf bytes.Buffer
+	NewWriterTracer(&buf).Trace(TraceEvent{
+		Time:      time.Date(2015, 1, 1, 12, 30, 0, 0, time.UTC),
+		ConnID:    2,
+		Direction: TraceRecv,
+		Kind:      TraceStatus,
+		Value:     StatusSuccess,
+	})
+	assert.Equal(t, "12:30:00.000000 conn 2 < status OKAY\n", buf.String())
+}
@@ -10,17 +10,37 @@ import (
 )
 
 // ErrorResponseDetails is an error message returned by the server for a particular request.
-type ErrorResponseDetails struct {
-	Request   string
-	ServerMsg string
+type ErrorResponseDetails = errors.ErrorResponseDetails
+
+// serverErrorPatterns match the error messages returned by adb servers and devices, and are used
+// to set the error code on error values. Messages that don't match any pattern are AdbErrors.
+var serverErrorPatterns = []struct {
+	Pattern *regexp.Regexp
+	Code    errors.ErrCode
+}{
+	// Old servers send "device not found", and newer ones "device 'serial' not found".
+	{regexp.MustCompile(`device( '.*')? not found`), errors.DeviceNotFound},
+	{regexp.MustCompile(`^no device with transport id`), errors.DeviceNotFound},
+	{regexp.MustCompile(`^device (unauthorized|still authorizing)`), errors.DeviceUnauthorized},
+	{regexp.MustCompile(`^device (offline|still connecting)`), errors.DeviceOffline},
+	{regexp.MustCompile(`^more than one (device/emulator|device|emulator)`), errors.MoreThanOneDevice},
+	{regexp.MustCompile(`^no (devices/emulators|devices|emulators) found`), errors.NoDevices},
+	{regexp.MustCompile(`^insufficient permissions for device`), errors.DevicePermissionDenied},
+	{regexp.MustCompile(`(?i)permission denied`), errors.FilePermissionDeniedError},
+	{regexp.MustCompile(`(?i)read-only file system`), errors.ReadOnlyFileSystem},
+	{regexp.MustCompile(`^(closed|protocol fault)`), errors.ProtocolFault},
+	{regexp.MustCompile(`^unknown host service`), errors.UnknownService},
 }
 
-// deviceNotFoundMessagePattern matches all possible error messages returned by adb servers to
-// report that a matching device was not found. Used to set the DeviceNotFound error code on
-// error values.
-//
-// Old servers send "device not found", and newer ones "device 'serial' not found".
-var deviceNotFoundMessagePattern = regexp.MustCompile(`device( '.*')? not found`)
+// serverErrorCode returns the ErrCode for an error message returned by the server.
+func serverErrorCode(serverMsg string) errors.ErrCode {
+	for _, p := range serverErrorPatterns {
+		if p.Pattern.MatchString(serverMsg) {
+			return p.Code
+		}
+	}
+	return errors.AdbError
+}
 
 func adbServerError(request string, serverMsg string) error {
 	var msg string
@@ -30,13 +50,8 @@ func adbServerError(request string, serverMsg string) error {
 		msg = fmt.Sprintf("server error for %s request: %s", request, serverMsg)
 	}
 
-	errCode := errors.AdbError
-	if deviceNotFoundMessagePattern.MatchString(serverMsg) {
-		errCode = errors.DeviceNotFound
-	}
-
 	return &errors.Err{
-		Code:    errCode,
+		Code:    serverErrorCode(serverMsg),
 		Message: msg,
 		Details: ErrorResponseDetails{
 			Request:   request,
@@ -54,3 +54,29 @@ func TestAdbServerError_DeviceSerialNotFound(t *testing.T) {
 		},
 	}, *(err.(*errors.Err)))
 }
+
+func TestAdbServerError_Codes(t *testing.T) {
+	for msg, code := range map[string]errors.ErrCode{
+		"device unauthorized.\nThis adb server's $ADB_VENDOR_KEYS is not set": errors.DeviceUnauthorized,
+		"device still authorizing":      errors.DeviceUnauthorized,
+		"device offline":                errors.DeviceOffline,
+		"device still connecting":       errors.DeviceOffline,
+		"more than one device/emulator": errors.MoreThanOneDevice,
+		"more than one device":          errors.MoreThanOneDevice,
+		"no devices/emulators found":    errors.NoDevices,
+		"no emulators found":            errors.NoDevices,
+		"insufficient permissions for device: user in plugdev group": errors.DevicePermissionDenied,
+		"couldn't create file: Permission denied":                    errors.FilePermissionDeniedError,
+		"couldn't create file: Read-only file system":                errors.ReadOnlyFileSystem,
+		"closed": errors.ProtocolFault,
+		"protocol fault (couldn't read status length)": errors.ProtocolFault,
+		"unknown host service":                         errors.UnknownService,
+		"unknown host service: host:nope":              errors.UnknownService,
+		"no device with transport id '3'":              errors.DeviceNotFound,
+		"No such file or directory":                    errors.AdbError,
+	} {
+		err := adbServerError("req", msg)
+		assert.Equal(t, code, err.(*errors.Err).Code, msg)
+		assert.Equal(t, ErrorResponseDetails{Request: "req", ServerMsg: msg}, err.(*errors.Err).Details)
+	}
+}